@@ -5,12 +5,20 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 	"zecx-deploy/internal/cli"
+	"zecx-deploy/internal/config"
 	"zecx-deploy/internal/covert"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/hostkeys"
 	"zecx-deploy/internal/pairing"
+	"zecx-deploy/internal/recording"
 	"zecx-deploy/internal/stealth"
 	"zecx-deploy/internal/transform"
+	"zecx-deploy/internal/transform/firewall"
 	"zecx-deploy/internal/uninstall"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func main() {
@@ -36,12 +44,39 @@ func main() {
 func runForegroundTasks() {
 	// Support both a flag and a subcommand for uninstalling.
 	uninstallFlag := flag.Bool("uninstall", false, "Uninstall the ZecX-Honeypot and restore the system.")
+	purgeFlag := flag.Bool("purge", false, "With --uninstall, also delete the collected evidence: quarantined samples, session recordings, host keys and certificates.")
+	configFlag := flag.String("config", "", "Path to the configuration file (default "+config.DefaultPath+").")
+	dashboardFlag := flag.String("dashboard", "", "wss:// URL of the monitoring dashboard, overriding the configuration file.")
 	flag.Parse()
 
+	// The background process re-reads these from its environment.
+	if *configFlag != "" {
+		config.SetPath(*configFlag)
+	}
+	if *dashboardFlag != "" {
+		config.SetDashboardURL(*dashboardFlag)
+	}
+
 	// ...existing flag handling (use --uninstall to run cleanup)
 
+	switch flag.Arg(0) {
+	case "":
+	case "keys":
+		runKeysCommand(flag.Args()[1:])
+		return
+	case "replay":
+		runReplayCommand(flag.Args()[1:])
+		return
+	case "firewall":
+		runFirewallCommand(flag.Args()[1:])
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
 	if *uninstallFlag {
-		if err := uninstall.CleanUp(); err != nil {
+		if err := uninstall.CleanUp(*purgeFlag); err != nil {
 			log.Printf("Error during uninstallation: %v\n", err)
 			fmt.Fprintf(os.Stderr, "Error during uninstallation: %v\n", err)
 			os.Exit(1)
@@ -71,6 +106,99 @@ func runForegroundTasks() {
 	stealth.Daemonize(code)
 }
 
+// runKeysCommand handles "zecx-deploy keys rotate", which replaces the SSH
+// host keys. The running honeypot picks up the new keys when it restarts.
+func runKeysCommand(args []string) {
+	if len(args) != 1 || args[0] != "rotate" {
+		fmt.Fprintln(os.Stderr, "Usage: zecx-deploy keys rotate")
+		os.Exit(2)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	keys, err := hostkeys.Rotate(hostkeys.Dir(cfg.StateDir))
+	if err != nil {
+		log.Printf("Error rotating host keys: %v", err)
+		fmt.Fprintf(os.Stderr, "Error rotating host keys: %v\n", err)
+		os.Exit(1)
+	}
+	log.Println("SSH host keys rotated.")
+	fmt.Println("SSH host keys rotated. New fingerprints:")
+	for _, key := range keys {
+		fmt.Printf("  %s %s\n", key.PublicKey().Type(), ssh.FingerprintSHA256(key.PublicKey()))
+	}
+	fmt.Println("Restart the honeypot to serve the new keys.")
+}
+
+// runReplayCommand handles "zecx-deploy replay <session-id>", which plays a
+// recorded SSH session back in the terminal.
+func runReplayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Playback speed multiplier.")
+	maxIdle := fs.Duration("max-idle", 2*time.Second, "Longest pause to keep; 0 keeps every pause.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: zecx-deploy replay [-speed N] [-max-idle D] <session-id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	path, err := recording.Path(recording.Dir(cfg.StateDir), fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening recording: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := recording.Play(f, os.Stdout, *speed, *maxIdle); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError replaying session: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runFirewallCommand handles "zecx-deploy firewall verify", which compares
+// the installed redirect rules with the ones the honeypot wants and exits
+// with status 1 if they differ.
+func runFirewallCommand(args []string) {
+	if len(args) != 1 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: zecx-deploy firewall verify")
+		os.Exit(2)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	report, err := firewall.Verify(cfg.StateDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying firewall: %v\n", err)
+		os.Exit(1)
+	}
+	if len(report.Discrepancies) == 0 {
+		fmt.Printf("Firewall rules (%s) match the desired mapping.\n", report.Backend)
+		return
+	}
+	fmt.Printf("Firewall rules (%s) differ from the desired mapping:\n", report.Backend)
+	for _, d := range report.Discrepancies {
+		fmt.Printf("  %s\n", d)
+	}
+	os.Exit(1)
+}
+
 func runBackgroundTasks() {
 	log.Println("--- Background process started ---")
 
@@ -81,12 +209,30 @@ func runBackgroundTasks() {
 	}
 	log.Printf("Background process operating with pairing code: %s", pairingCode)
 
-	if err := transform.Apply(); err != nil {
+	eventLog, err := os.OpenFile("zecx-events.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("FATAL: Failed to open event log: %v", err)
+		os.Exit(1)
+	}
+	defer eventLog.Close()
+	go events.WriteJSONLines(events.Subscribe("eventlog", 1024, 0), eventLog)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Printf("FATAL: Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
+
+	if err := transform.Apply(cfg); err != nil {
 		log.Printf("FATAL: Error during system transformation: %v", err)
-		uninstall.CleanUp()
+		uninstall.CleanUp(false)
 		os.Exit(1)
 	}
 
 	log.Println("Handing off to covert communication module.")
-	covert.StartTunnel(pairingCode)
+	if err := covert.StartTunnel(pairingCode, cfg); err != nil {
+		// Keep the emulators running; the local event log still records everything.
+		log.Printf("Covert tunnel stopped: %v", err)
+		select {}
+	}
 }
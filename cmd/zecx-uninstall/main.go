@@ -1,6 +1,7 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "log"
     "os"
@@ -8,6 +9,9 @@ import (
 )
 
 func main() {
+    purge := flag.Bool("purge", false, "Also delete the collected evidence: quarantined samples, session recordings, host keys and certificates.")
+    flag.Parse()
+
     logFile, err := os.OpenFile("zecx-uninstall.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
     if err != nil {
         fmt.Fprintf(os.Stderr, "FATAL: Failed to open log file: %v\n", err)
@@ -17,7 +21,7 @@ func main() {
     log.SetOutput(logFile)
     log.Println("ZecX-Uninstall helper starting...")
 
-    if err := uninstall.CleanUp(); err != nil {
+    if err := uninstall.CleanUp(*purge); err != nil {
         log.Printf("Uninstall failed: %v", err)
         fmt.Fprintf(os.Stderr, "Uninstall failed: %v\n", err)
         os.Exit(1)
@@ -3,6 +3,10 @@ module zecx-deploy
 go 1.23.0
 
 require (
-	golang.org/x/crypto v0.41.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.41.0
+	golang.org/x/term v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,368 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	pathEnvVar      = "ZECX_CONFIG"
+	dashboardEnvVar = "ZECX_DASHBOARD_URL"
+	stateDirEnvVar  = "ZECX_STATE_DIR"
+
+	// DefaultPath is where the configuration file is looked up when ZECX_CONFIG is unset.
+	DefaultPath = "/etc/zecx/config.json"
+
+	// DefaultStateDir holds everything the honeypot persists between restarts.
+	DefaultStateDir = "/var/lib/zecx"
+)
+
+// Config is the operator-supplied configuration of a honeypot instance.
+// Every field has a usable default, so the file itself is optional.
+type Config struct {
+	// StateDir holds the outbound spool and other persistent state.
+	StateDir string  `json:"state_dir"`
+	Persona  Persona `json:"persona"`
+	SSH      SSH     `json:"ssh"`
+	FTP      FTP     `json:"ftp"`
+	HTTP     HTTP    `json:"http"`
+	SMB      SMB     `json:"smb"`
+	Tunnel   Tunnel  `json:"tunnel"`
+	Spool    Spool   `json:"spool"`
+	// Quarantine bounds the store of files uploaded by attackers.
+	Quarantine Quarantine `json:"quarantine"`
+	Downloads  Downloads  `json:"downloads"`
+	Signatures Signatures `json:"signatures"`
+	Egress     Egress     `json:"egress"`
+}
+
+// Egress confines outbound traffic from the honeypot's own processes, so
+// that an attacker who breaks out of an emulator cannot use the host to
+// attack others. Replies to inbound connections, loopback, DNS and the
+// dashboard endpoint are always allowed; everything else is dropped.
+type Egress struct {
+	// Enabled applies the policy together with the port redirects. The
+	// honeypot's own outbound flows are confined too: FTP active-mode
+	// transfers (PORT/EPRT) connect to the client and downloads.fetch to
+	// the attacker's server, so both need the destination in Allow.
+	Enabled bool `json:"enabled"`
+	// User (a name or UID) or Cgroup (a cgroup v2 path such as
+	// "system.slice/zecx.service") selects the processes the policy applies
+	// to. With neither, it applies to the systemd service the honeypot runs
+	// in, or else to its UID unless that is root.
+	User   string `json:"user"`
+	Cgroup string `json:"cgroup"`
+	// Allow lists further destinations: an address, CIDR or host name,
+	// optionally with ":port" ("[addr]:port" for IPv6). Servers that
+	// downloads.fetch retrieves from are only reachable if listed here.
+	Allow []string `json:"allow"`
+	// RateLimit, such as "10/minute", lets other new outbound TCP
+	// connections through at that rate instead of dropping them all.
+	RateLimit string `json:"rate_limit"`
+	// Log writes other new outbound TCP connections to the kernel log,
+	// prefixed "zecx-egress: " and limited to 10 a minute.
+	Log bool `json:"log"`
+}
+
+// Signatures configures how captured requests are classified.
+type Signatures struct {
+	// RulesFile is a YAML or JSON file of rules laid over the built-in
+	// set: a rule replaces the built-in one with the same id, and one
+	// marked disabled removes it.
+	RulesFile string `json:"rules_file"`
+}
+
+// Downloads controls what wget, curl and tftp in the fake shell do with the
+// URLs attackers give them. Every URL is recorded; payloads are only
+// retrieved when Fetch is set.
+type Downloads struct {
+	// Fetch retrieves payloads into the quarantine. Private and loopback
+	// addresses are never contacted. With egress.enabled, only servers in
+	// egress.allow are reachable, so fetches elsewhere fail.
+	Fetch bool `json:"fetch"`
+	// MaxSizeMB caps one payload; the rest is discarded.
+	MaxSizeMB int64 `json:"max_size_mb"`
+	// Timeout bounds a whole retrieval, including redirects.
+	Timeout Duration `json:"timeout"`
+}
+
+// Persona describes the machine the emulators pretend to be.
+type Persona struct {
+	// Hostname shown in shell prompts and command output; defaults to the host's name.
+	Hostname string `json:"hostname"`
+	// CPUs and MemoryMB size the fake machine reported by nproc, free, /proc and friends.
+	CPUs     int `json:"cpus"`
+	MemoryMB int `json:"memory_mb"`
+}
+
+// SSH configures the SSH emulator.
+type SSH struct {
+	Auth SSHAuth `json:"auth"`
+	// ForwardCaptureBytes is how much of a port-forwarded stream is kept.
+	ForwardCaptureBytes int `json:"forward_capture_bytes"`
+}
+
+// HTTP configures the HTTP and HTTPS emulators.
+type HTTP struct {
+	// Persona picks the site served: "nginx" (the default page of the web
+	// server the fake shell reports), "apache", "wordpress", "jenkins",
+	// "phpmyadmin" or "router".
+	Persona string `json:"persona"`
+	// BodyCaptureBytes is how much of a request body is kept in its event;
+	// longer bodies are kept whole in the quarantine.
+	BodyCaptureBytes int `json:"body_capture_bytes"`
+	// Certificate is what HTTPS presents, kept in StateDir/tls/issued.
+	Certificate Certificate `json:"certificate"`
+}
+
+// Certificate describes a server certificate issued through an
+// intermediate, so the chain looks like one from a public CA.
+type Certificate struct {
+	// CommonName defaults to the persona's hostname.
+	CommonName string `json:"common_name"`
+	// SANs are further DNS names or IP addresses the certificate covers.
+	SANs   []string `json:"sans"`
+	Issuer CertName `json:"issuer"`
+	Root   CertName `json:"root"`
+}
+
+// CertName is the subject of a CA certificate in the chain.
+type CertName struct {
+	CommonName   string `json:"common_name"`
+	Organization string `json:"organization"`
+	Country      string `json:"country"`
+}
+
+// FTP configures the FTP emulator. Active-mode transfers (PORT/EPRT)
+// connect out to the client, which egress.enabled blocks unless the client
+// is in egress.allow; passive mode is unaffected.
+type FTP struct {
+	// Banner is the text of the 220 greeting sent on connect.
+	Banner string `json:"banner"`
+	// Anonymous accepts the "anonymous" and "ftp" users with any password.
+	Anonymous bool `json:"anonymous"`
+	// TLS offers explicit FTPS (AUTH TLS) with a self-signed certificate
+	// for the persona's hostname, kept in StateDir/tls.
+	TLS bool `json:"tls"`
+	// Auth decides which other logins succeed, with the same rules as SSH.
+	Auth SSHAuth `json:"auth"`
+	// PassiveAddress is the IPv4 address advertised in PASV replies, for
+	// hosts behind NAT; it defaults to the address the client connected to.
+	PassiveAddress string `json:"passive_address"`
+}
+
+// SMB configures the SMB emulator.
+type SMB struct {
+	// Workgroup is the NetBIOS domain the server reports.
+	Workgroup string `json:"workgroup"`
+	// Guest lets every login in as a guest once its NTLM response has been
+	// captured; otherwise every login fails.
+	Guest bool `json:"guest"`
+	// Shares are the read-only shares offered, each a directory of the
+	// decoy tree. IPC$ is always present.
+	Shares []SMBShare `json:"shares"`
+}
+
+// SMBShare is one share of the SMB emulator.
+type SMBShare struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Comment string `json:"comment"`
+}
+
+// SSHAuth decides which login attempts succeed. A login is accepted when any
+// rule matches; a source address that has logged in once keeps getting in
+// with the same credentials.
+type SSHAuth struct {
+	// AcceptAfter accepts the next attempt from a source address once this
+	// many of its attempts have failed, so 3 lets the fourth in (0 disables).
+	AcceptAfter int `json:"accept_after"`
+	// Credentials are exact username/password pairs that are always accepted.
+	Credentials []Credential `json:"credentials"`
+	// Usernames are accepted with any password; Passwords with any username.
+	Usernames []string `json:"usernames"`
+	Passwords []string `json:"passwords"`
+	// Pattern is a regular expression matched against "username:password".
+	Pattern string `json:"pattern"`
+	// Probability accepts any attempt with this chance, between 0 and 1.
+	Probability float64 `json:"probability"`
+	// PublicKeys are accepted for any username. Each entry is an
+	// authorized_keys line or a "SHA256:..." fingerprint. Other key offers
+	// are recorded and refused.
+	PublicKeys []string `json:"public_keys"`
+}
+
+// Credential is a username/password pair.
+type Credential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Tunnel configures the outbound connection to the monitoring dashboard.
+type Tunnel struct {
+	// DashboardURL is the wss:// endpoint of the dashboard. Empty disables the tunnel.
+	DashboardURL string `json:"dashboard_url"`
+	// CAFile optionally names a PEM bundle trusted instead of the system roots.
+	CAFile string `json:"ca_file"`
+	// MinBackoff and MaxBackoff bound the reconnect delay.
+	MinBackoff Duration `json:"min_backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+}
+
+// Spool configures the on-disk queue of events awaiting delivery to the dashboard.
+type Spool struct {
+	// SegmentSizeMB is the size at which a new segment file is started.
+	SegmentSizeMB int64 `json:"segment_size_mb"`
+	// MaxSizeMB and MaxAge bound the spool; the oldest segments are evicted first.
+	MaxSizeMB int64    `json:"max_size_mb"`
+	MaxAge    Duration `json:"max_age"`
+	// Sync is "always", "interval" or "never".
+	Sync         string   `json:"sync"`
+	SyncInterval Duration `json:"sync_interval"`
+}
+
+// Quarantine configures where uploaded files are kept. Samples are stored
+// under StateDir/quarantine, named by their SHA-256.
+type Quarantine struct {
+	// MaxFileSizeMB caps a single upload; anything beyond it is discarded.
+	MaxFileSizeMB int64 `json:"max_file_size_mb"`
+	// MaxTotalSizeMB caps the whole store; new samples are dropped once it is full.
+	MaxTotalSizeMB int64 `json:"max_total_size_mb"`
+	// MaxSessionSizeMB caps what one session may add to its copy of the
+	// decoy filesystem over SFTP, SCP, FTP and the shell together; writes
+	// beyond it fail with "No space left on device". Zero applies 256.
+	MaxSessionSizeMB int64 `json:"max_session_size_mb"`
+}
+
+// Duration is a time.Duration that reads and writes as a string such as "30s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	return &Config{
+		StateDir: DefaultStateDir,
+		Persona: Persona{
+			CPUs:     2,
+			MemoryMB: 1967,
+		},
+		SSH: SSH{
+			Auth:                SSHAuth{AcceptAfter: 3},
+			ForwardCaptureBytes: 4096,
+		},
+		HTTP: HTTP{
+			Persona:          "nginx",
+			BodyCaptureBytes: 16 << 10,
+			Certificate: Certificate{
+				Issuer: CertName{CommonName: "R3", Organization: "Let's Encrypt", Country: "US"},
+				Root:   CertName{CommonName: "ISRG Root X1", Organization: "Internet Security Research Group", Country: "US"},
+			},
+		},
+		FTP: FTP{
+			Banner:    "ProFTPD 1.3.5a Server (Debian) [::ffff:127.0.0.1]",
+			Anonymous: true,
+			TLS:       true,
+			Auth:      SSHAuth{AcceptAfter: 3},
+		},
+		SMB: SMB{
+			Workgroup: "WORKGROUP",
+			Guest:     true,
+			Shares: []SMBShare{
+				{Name: "backup", Path: "/var/backups", Comment: "Backups"},
+				{Name: "www", Path: "/var/www", Comment: "Web root"},
+			},
+		},
+		Tunnel: Tunnel{
+			MinBackoff: Duration(time.Second),
+			MaxBackoff: Duration(5 * time.Minute),
+		},
+		Spool: Spool{
+			SegmentSizeMB: 4,
+			MaxSizeMB:     256,
+			MaxAge:        Duration(7 * 24 * time.Hour),
+			Sync:          "interval",
+			SyncInterval:  Duration(time.Second),
+		},
+		Quarantine: Quarantine{
+			MaxFileSizeMB:    32,
+			MaxTotalSizeMB:   1024,
+			MaxSessionSizeMB: 256,
+		},
+		Downloads: Downloads{
+			MaxSizeMB: 16,
+			Timeout:   Duration(30 * time.Second),
+		},
+		Egress: Egress{
+			Enabled: true,
+		},
+	}
+}
+
+// Path returns the location of the configuration file.
+func Path() string {
+	if p := os.Getenv(pathEnvVar); p != "" {
+		return p
+	}
+	return DefaultPath
+}
+
+// SetPath points this process, and the background process it forks, at a configuration file.
+func SetPath(path string) error {
+	return os.Setenv(pathEnvVar, path)
+}
+
+// SetDashboardURL overrides the dashboard URL for this process and the background process.
+func SetDashboardURL(url string) error {
+	return os.Setenv(dashboardEnvVar, url)
+}
+
+// Load reads the configuration file on top of the defaults. A missing file is
+// not an error; environment overrides are applied last.
+func Load() (*Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(Path())
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", Path(), err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return nil, fmt.Errorf("failed to read %s: %w", Path(), err)
+	}
+
+	if u := os.Getenv(dashboardEnvVar); u != "" {
+		cfg.Tunnel.DashboardURL = u
+	}
+	if d := os.Getenv(stateDirEnvVar); d != "" {
+		cfg.StateDir = d
+	}
+	if cfg.Persona.Hostname == "" {
+		cfg.Persona.Hostname = "ubuntu"
+		if h, err := os.Hostname(); err == nil {
+			cfg.Persona.Hostname = h
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,34 @@
+package covert
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff produces exponentially growing, fully jittered reconnect delays so
+// that a fleet of honeypots does not reconnect to the dashboard in lockstep.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt int
+}
+
+// Next returns the delay before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	ceil := b.Min << b.attempt
+	if ceil <= 0 || ceil > b.Max {
+		ceil = b.Max
+	} else {
+		b.attempt++
+	}
+	if ceil <= b.Min {
+		return b.Min
+	}
+	return b.Min + rand.N(ceil-b.Min)
+}
+
+// Reset starts the sequence over after a successful connection.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
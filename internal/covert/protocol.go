@@ -0,0 +1,28 @@
+package covert
+
+import "encoding/json"
+
+// protocolVersion is sent in the hello message so the dashboard can reject
+// clients it does not understand.
+const protocolVersion = 1
+
+// Message types exchanged over the tunnel. Every WebSocket text frame carries
+// exactly one JSON-encoded message.
+const (
+	msgHello   = "hello"   // client -> server: authenticate with the pairing code
+	msgWelcome = "welcome" // server -> client: pairing code accepted
+	msgReject  = "reject"  // server -> client: pairing code refused, Reason set
+	msgEvent   = "event"   // client -> server: one emulator event
+	msgAck     = "ack"     // server -> client: every event up to Seq is stored
+)
+
+// message is the single frame format used in both directions.
+type message struct {
+	Type        string          `json:"type"`
+	Version     int             `json:"version,omitempty"`
+	PairingCode string          `json:"pairing_code,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	ID          string          `json:"id,omitempty"` // stable across resends, for deduplication
+	Event       json.RawMessage `json:"event,omitempty"`
+}
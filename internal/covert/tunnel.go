@@ -1,16 +1,283 @@
 package covert
 
-import "fmt"
-
-// StartTunnel establishes the covert communication channel.
-func StartTunnel(pairingCode string) {
-	fmt.Printf("Establishing covert tunnel with pairing code: %s\n", pairingCode)
-	// This is a placeholder. A real implementation would:
-	// 1. Initiate a WebSocket over TLS connection to the remote monitoring server.
-	// 2. Send the pairing code as the initial authentication token.
-	// 3. Create a secure channel to exfiltrate data captured by the emulators.
-	// This function would block indefinitely, running for the life of the honeypot.
-	fmt.Println("Covert tunnel logic not yet implemented.")
-	// Block forever
-	select {}
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/spool"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	handshakeTimeout = 15 * time.Second
+	writeTimeout     = 10 * time.Second
+	pingInterval     = 30 * time.Second
+	pongTimeout      = 2 * pingInterval
+
+	// maxInFlight bounds how many events may be sent before the dashboard acknowledges them.
+	maxInFlight = 256
+)
+
+// errRejected is returned when the dashboard refuses the pairing code.
+var errRejected = errors.New("pairing code rejected by dashboard")
+
+// Tunnel drains the outbound spool to the dashboard over an outbound
+// WebSocket-over-TLS connection, reconnecting with jittered exponential backoff.
+// Events stay in the spool until the dashboard acknowledges them, so every
+// reconnect (or daemon restart) resumes from the last acknowledged record.
+type Tunnel struct {
+	URL         string
+	PairingCode string
+	TLSConfig   *tls.Config
+	Backoff     Backoff
+	Spool       *spool.Spool
+
+	seq uint64
+}
+
+// inflight is an event that has been sent but not yet acknowledged.
+type inflight struct {
+	seq  uint64
+	next spool.Position
+}
+
+// StartTunnel establishes the covert communication channel. Events from the bus
+// are written to the spool first, so they survive outages of the dashboard. It
+// blocks for the life of the honeypot.
+func StartTunnel(pairingCode string, cfg *config.Config) error {
+	sp, err := spool.Open(spool.Options{
+		Dir:          spool.Dir(cfg.StateDir),
+		SegmentSize:  cfg.Spool.SegmentSizeMB << 20,
+		MaxSize:      cfg.Spool.MaxSizeMB << 20,
+		MaxAge:       time.Duration(cfg.Spool.MaxAge),
+		Sync:         spool.SyncPolicy(cfg.Spool.Sync),
+		SyncInterval: time.Duration(cfg.Spool.SyncInterval),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %w", err)
+	}
+	go spoolEvents(events.Subscribe("spool", 4096, time.Second), sp)
+
+	if cfg.Tunnel.DashboardURL == "" {
+		log.Println("[tunnel] No dashboard URL configured; events are only kept locally.")
+		select {}
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.Tunnel.CAFile)
+	if err != nil {
+		log.Printf("[tunnel] %v; falling back to system roots", err)
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	t := &Tunnel{
+		URL:         cfg.Tunnel.DashboardURL,
+		PairingCode: pairingCode,
+		TLSConfig:   tlsConfig,
+		Backoff:     Backoff{Min: time.Duration(cfg.Tunnel.MinBackoff), Max: time.Duration(cfg.Tunnel.MaxBackoff)},
+		Spool:       sp,
+	}
+	return t.Run(context.Background())
+}
+
+// spoolEvents persists every event from sub until the subscription closes.
+func spoolEvents(sub *events.Subscription, sp *spool.Spool) {
+	for e := range sub.Events() {
+		b, err := events.Encode(e)
+		if err != nil {
+			log.Printf("[tunnel] Failed to encode %s event: %v", e.Kind(), err)
+			continue
+		}
+		if err := sp.Append(b); err != nil {
+			log.Printf("[tunnel] Failed to spool %s event: %v", e.Kind(), err)
+		}
+	}
+}
+
+// newTLSConfig trusts the bundle in caFile, or the system roots when it is empty.
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// Run keeps a connection to the dashboard open until ctx is cancelled.
+func (t *Tunnel) Run(ctx context.Context) error {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return fmt.Errorf("invalid dashboard URL: %w", err)
+	}
+	if u.Scheme != "wss" {
+		return fmt.Errorf("dashboard URL must use wss://, got %q", u.Scheme)
+	}
+
+	for {
+		connected, err := t.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			t.Backoff.Reset()
+		}
+		delay := t.Backoff.Next()
+		log.Printf("[tunnel] Connection to %s lost: %v; retrying in %s", u.Host, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// session runs one connection and reports whether the handshake succeeded.
+func (t *Tunnel) session(ctx context.Context) (bool, error) {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  t.TLSConfig,
+		HandshakeTimeout: handshakeTimeout,
+	}
+	conn, _, err := dialer.DialContext(ctx, t.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := t.authenticate(conn); err != nil {
+		return false, err
+	}
+	cursor := t.Spool.Acked()
+	log.Printf("[tunnel] Connected to dashboard at %s; resuming from %s", t.URL, cursor)
+
+	// done stops the reader once session returns, so that it never blocks
+	// on delivering an acknowledgement nobody will receive.
+	done := make(chan struct{})
+	defer close(done)
+	readErr := make(chan error, 1)
+	acks := make(chan uint64, maxInFlight)
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	go func() {
+		for {
+			var m message
+			if err := conn.ReadJSON(&m); err != nil {
+				readErr <- err
+				return
+			}
+			switch m.Type {
+			case msgAck:
+				select {
+				case acks <- m.Seq:
+				case <-done:
+					return
+				}
+			case msgReject:
+				readErr <- fmt.Errorf("%w: %s", errRejected, m.Reason)
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	var pending []inflight
+	for {
+		// Fetch the notification channel before reading so an append that
+		// lands in between still wakes us up.
+		appended := t.Spool.Notify()
+		if len(pending) < maxInFlight {
+			recs, err := t.Spool.Read(cursor, maxInFlight-len(pending))
+			if err != nil {
+				return true, err
+			}
+			for _, rec := range recs {
+				t.seq++
+				if err := t.send(conn, &message{Type: msgEvent, Seq: t.seq, ID: rec.Pos.String(), Event: rec.Data}); err != nil {
+					return true, err
+				}
+				pending = append(pending, inflight{seq: t.seq, next: rec.Next})
+				cursor = rec.Next
+			}
+			if len(recs) > 0 {
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+			return true, ctx.Err()
+		case err := <-readErr:
+			return true, err
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return true, err
+			}
+		case seq := <-acks:
+			// Acknowledgements are cumulative.
+			n := 0
+			for n < len(pending) && pending[n].seq <= seq {
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			if err := t.Spool.Ack(pending[n-1].next); err != nil {
+				log.Printf("[tunnel] Failed to record acknowledgement: %v", err)
+			}
+			pending = pending[n:]
+		case <-appended:
+		}
+	}
+}
+
+// authenticate sends the pairing code and waits for the dashboard's verdict.
+func (t *Tunnel) authenticate(conn *websocket.Conn) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteJSON(message{Type: msgHello, Version: protocolVersion, PairingCode: t.PairingCode}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	var reply message
+	if err := conn.ReadJSON(&reply); err != nil {
+		return fmt.Errorf("failed to read handshake reply: %w", err)
+	}
+	switch reply.Type {
+	case msgWelcome:
+		return nil
+	case msgReject:
+		return fmt.Errorf("%w: %s", errRejected, reply.Reason)
+	default:
+		return fmt.Errorf("unexpected handshake reply %q", reply.Type)
+	}
+}
+
+// send writes one frame with a write deadline.
+func (t *Tunnel) send(conn *websocket.Conn, m *message) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteJSON(m)
 }
@@ -0,0 +1,266 @@
+package covert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"zecx-deploy/internal/spool"
+
+	"github.com/gorilla/websocket"
+)
+
+const testPairingCode = "123456"
+
+// newDashboard starts a TLS WebSocket server that hands every upgraded
+// connection to the test.
+func newDashboard(t *testing.T) (*httptest.Server, <-chan *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 4)
+	var upgrader websocket.Upgrader
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	return srv, conns
+}
+
+func newSpool(t *testing.T) *spool.Spool {
+	sp, err := spool.Open(spool.Options{Dir: t.TempDir(), Sync: spool.SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp
+}
+
+func newTestTunnel(srv *httptest.Server, sp *spool.Spool) *Tunnel {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return &Tunnel{
+		URL:         "wss://" + strings.TrimPrefix(srv.URL, "https://"),
+		PairingCode: testPairingCode,
+		TLSConfig:   &tls.Config{RootCAs: pool},
+		Backoff:     Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond},
+		Spool:       sp,
+	}
+}
+
+func accept(t *testing.T, conns <-chan *websocket.Conn) *websocket.Conn {
+	t.Helper()
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not connect")
+		return nil
+	}
+}
+
+func receive(t *testing.T, conn *websocket.Conn) message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m message
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return m
+}
+
+func reply(t *testing.T, conn *websocket.Conn, m message) {
+	t.Helper()
+	if err := conn.WriteJSON(m); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// handshake checks the hello and welcomes the tunnel.
+func handshake(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	hello := receive(t, conn)
+	if hello.Type != msgHello || hello.Version != protocolVersion || hello.PairingCode != testPairingCode {
+		t.Fatalf("hello = %+v", hello)
+	}
+	reply(t, conn, message{Type: msgWelcome})
+}
+
+func appendEvents(t *testing.T, sp *spool.Spool, n int) []spool.Record {
+	t.Helper()
+	for i := range n {
+		if err := sp.Append([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := sp.Read(sp.Acked(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func waitAcked(t *testing.T, sp *spool.Spool, want spool.Position) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for sp.Acked() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("acked = %s, want %s", sp.Acked(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		reply     message
+		connected bool
+		err       error
+	}{
+		{reply: message{Type: msgWelcome}, connected: true},
+		{reply: message{Type: msgReject, Reason: "unknown code"}, err: errRejected},
+		{reply: message{Type: msgAck}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply.Type, func(t *testing.T) {
+			srv, conns := newDashboard(t)
+			tun := newTestTunnel(srv, newSpool(t))
+			go func() {
+				conn := <-conns
+				defer conn.Close()
+				var hello message
+				if err := conn.ReadJSON(&hello); err != nil {
+					t.Errorf("read hello: %v", err)
+					return
+				}
+				if hello.Type != msgHello || hello.Version != protocolVersion || hello.PairingCode != testPairingCode {
+					t.Errorf("hello = %+v", hello)
+				}
+				conn.WriteJSON(tt.reply)
+			}()
+
+			connected, err := tun.session(context.Background())
+			if connected != tt.connected {
+				t.Errorf("connected = %v, want %v", connected, tt.connected)
+			}
+			if err == nil {
+				t.Fatal("session ended without an error")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if tt.reply.Reason != "" && !strings.Contains(err.Error(), tt.reply.Reason) {
+				t.Errorf("err = %v, want the reason", err)
+			}
+		})
+	}
+}
+
+func TestEventsAndAcks(t *testing.T) {
+	srv, conns := newDashboard(t)
+	sp := newSpool(t)
+	recs := appendEvents(t, sp, 3)
+	tun := newTestTunnel(srv, sp)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() { ran <- tun.Run(ctx) }()
+
+	conn := accept(t, conns)
+	handshake(t, conn)
+	for i, rec := range recs {
+		m := receive(t, conn)
+		if m.Type != msgEvent || m.Seq != uint64(i+1) || m.ID != rec.Pos.String() || string(m.Event) != string(rec.Data) {
+			t.Fatalf("frame %d = %+v, want record %s", i, m, rec.Pos)
+		}
+	}
+
+	// Acknowledgements are cumulative.
+	reply(t, conn, message{Type: msgAck, Seq: 2})
+	waitAcked(t, sp, recs[1].Next)
+	reply(t, conn, message{Type: msgAck, Seq: 3})
+	waitAcked(t, sp, recs[2].Next)
+
+	// Events spooled while connected are sent without waiting for a poll.
+	more := appendEvents(t, sp, 1)
+	if m := receive(t, conn); m.Seq != 4 || m.ID != more[0].Pos.String() {
+		t.Fatalf("frame = %+v, want record %s", m, more[0].Pos)
+	}
+
+	cancel()
+	select {
+	case err := <-ran:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestReconnectResumesFromAck(t *testing.T) {
+	srv, conns := newDashboard(t)
+	sp := newSpool(t)
+	recs := appendEvents(t, sp, 2)
+	tun := newTestTunnel(srv, sp)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() { ran <- tun.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-ran
+	}()
+
+	conn := accept(t, conns)
+	handshake(t, conn)
+	receive(t, conn)
+	receive(t, conn)
+	reply(t, conn, message{Type: msgAck, Seq: 1})
+	waitAcked(t, sp, recs[0].Next)
+	conn.Close()
+
+	// The unacknowledged event is sent again under the same ID.
+	conn = accept(t, conns)
+	handshake(t, conn)
+	m := receive(t, conn)
+	if m.ID != recs[1].Pos.String() || string(m.Event) != string(recs[1].Data) {
+		t.Fatalf("resent frame = %+v, want record %s", m, recs[1].Pos)
+	}
+	if m.Seq != 3 {
+		t.Errorf("seq = %d, want 3", m.Seq)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	if d := b.Next(); d != b.Min {
+		t.Errorf("first delay = %s, want %s", d, b.Min)
+	}
+	ceil := b.Min
+	seen := map[time.Duration]bool{}
+	for range 50 {
+		ceil = min(2*ceil, b.Max)
+		d := b.Next()
+		if d < b.Min || d >= ceil {
+			t.Fatalf("delay %s outside [%s, %s)", d, b.Min, ceil)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("delays are not jittered")
+	}
+
+	b.Reset()
+	if d := b.Next(); d != b.Min {
+		t.Errorf("delay after Reset = %s, want %s", d, b.Min)
+	}
+}
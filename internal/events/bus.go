@@ -0,0 +1,167 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bus fans published events out to every subscriber. Each subscriber has its
+// own bounded queue; when a queue is full the publisher waits up to the
+// subscriber's configured grace period and then drops the event for that
+// subscriber only, so a slow sink never stalls the emulators.
+type Bus struct {
+	mu        sync.RWMutex
+	subs      []*Subscription
+	closed    bool
+	published atomic.Uint64
+}
+
+// Subscription is a single consumer of a Bus.
+type Subscription struct {
+	name      string
+	ch        chan Event
+	wait      time.Duration
+	bus       *Bus
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// Stats is a snapshot of a subscription's counters.
+type Stats struct {
+	Name      string
+	Queued    int
+	Delivered uint64
+	Dropped   uint64
+}
+
+// Default is the process-wide bus the emulators publish to.
+var Default = NewBus()
+
+// NewBus returns an empty bus.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers a consumer with a queue of the given size. wait is how
+// long Publish may block on a full queue before counting the event as dropped;
+// zero means drop immediately.
+func (b *Bus) Subscribe(name string, buffer int, wait time.Duration) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := &Subscription{name: name, ch: make(chan Event, buffer), wait: wait, bus: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.ch)
+		return s
+	}
+	b.subs = append(b.subs, s)
+	return s
+}
+
+// Publish delivers e to every subscriber.
+func (b *Bus) Publish(e Event) {
+	if h := e.Header(); h.Time.IsZero() {
+		h.Time = time.Now().UTC()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	b.published.Add(1)
+	for _, s := range b.subs {
+		s.offer(e)
+	}
+}
+
+// Published returns the number of events accepted by the bus.
+func (b *Bus) Published() uint64 {
+	return b.published.Load()
+}
+
+// Stats returns the counters of every current subscriber.
+func (b *Bus) Stats() []Stats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]Stats, 0, len(b.subs))
+	for _, s := range b.subs {
+		out = append(out, s.Stats())
+	}
+	return out
+}
+
+// Close unsubscribes everybody and closes their channels. Later publishes are ignored.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, s := range b.subs {
+		close(s.ch)
+	}
+	b.subs = nil
+}
+
+func (s *Subscription) offer(e Event) {
+	select {
+	case s.ch <- e:
+		s.delivered.Add(1)
+		return
+	default:
+	}
+	if s.wait > 0 {
+		t := time.NewTimer(s.wait)
+		defer t.Stop()
+		select {
+		case s.ch <- e:
+			s.delivered.Add(1)
+			return
+		case <-t.C:
+		}
+	}
+	s.dropped.Add(1)
+}
+
+// Events returns the channel the subscriber reads from. It is closed on Unsubscribe.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns how many events were discarded because the queue was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Stats returns a snapshot of the subscription's counters.
+func (s *Subscription) Stats() Stats {
+	return Stats{Name: s.name, Queued: len(s.ch), Delivered: s.delivered.Load(), Dropped: s.dropped.Load()}
+}
+
+// Unsubscribe removes the subscription from its bus and closes its channel.
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(s.ch)
+			return
+		}
+	}
+}
+
+// Publish sends e on the Default bus.
+func Publish(e Event) {
+	Default.Publish(e)
+}
+
+// Subscribe registers a consumer on the Default bus.
+func Subscribe(name string, buffer int, wait time.Duration) *Subscription {
+	return Default.Subscribe(name, buffer, wait)
+}
@@ -0,0 +1,303 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Kind identifies the type of an event on the wire.
+type Kind string
+
+const (
+	KindConnectionOpened Kind = "connection.opened"
+	KindConnectionClosed Kind = "connection.closed"
+	KindAuthAttempt      Kind = "auth.attempt"
+	KindCommand          Kind = "command"
+	KindFileTransfer     Kind = "file.transfer"
+	KindHTTPRequest      Kind = "http.request"
+	KindSessionMetadata  Kind = "session.metadata"
+	KindPortForward      Kind = "port.forward"
+	KindDownload         Kind = "download"
+	KindFTPCommand       Kind = "ftp.command"
+	KindTLSHandshake     Kind = "tls.handshake"
+	KindExploitAttempt   Kind = "exploit.attempt"
+)
+
+// Event is implemented by every typed event published by the emulators.
+type Event interface {
+	Kind() Kind
+	Header() *Meta
+}
+
+// Meta carries the fields shared by all events.
+type Meta struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	Protocol  string    `json:"protocol"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+}
+
+// Header returns the shared event fields.
+func (m *Meta) Header() *Meta { return m }
+
+// ConnectionOpened is emitted when an attacker connects to an emulator.
+type ConnectionOpened struct {
+	Meta
+	// SSH fingerprints the client software; set by the SSH emulator only.
+	SSH *SSHClient `json:"ssh,omitempty"`
+	// TLS fingerprints the ClientHello; set by the HTTPS emulator only.
+	TLS *TLSClient `json:"tls,omitempty"`
+}
+
+// SSHClient identifies an SSH client by its version banner and the algorithm
+// preferences in its KEXINIT. HASSH is the MD5 of HASSHAlgorithms, which is
+// "kex;ciphers;macs;compression" (see https://github.com/salesforce/hassh).
+type SSHClient struct {
+	Version           string   `json:"version"`
+	HASSH             string   `json:"hassh,omitempty"`
+	HASSHAlgorithms   string   `json:"hassh_algorithms,omitempty"`
+	KexAlgorithms     []string `json:"kex_algorithms,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+	// Ciphers, MACs and Compression are the client-to-server lists.
+	Ciphers     []string `json:"ciphers,omitempty"`
+	MACs        []string `json:"macs,omitempty"`
+	Compression []string `json:"compression,omitempty"`
+}
+
+// TLSClient identifies a TLS client by its ClientHello. JA3 is the MD5 of
+// JA3String (https://github.com/salesforce/ja3); JA4 follows
+// https://github.com/FoxIO-LLC/ja4. Lists are in the client's order and
+// include GREASE values.
+type TLSClient struct {
+	JA3          string   `json:"ja3"`
+	JA3String    string   `json:"ja3_string"`
+	JA4          string   `json:"ja4"`
+	Version      uint16   `json:"version"`
+	ServerName   string   `json:"server_name,omitempty"`
+	ALPN         []string `json:"alpn,omitempty"`
+	CipherSuites []uint16 `json:"cipher_suites,omitempty"`
+	Extensions   []uint16 `json:"extensions,omitempty"`
+}
+
+// ConnectionClosed is emitted when an emulator connection ends.
+type ConnectionClosed struct {
+	Meta
+	Duration time.Duration `json:"duration"`
+}
+
+// AuthAttempt records a credential submitted to an emulator.
+type AuthAttempt struct {
+	Meta
+	Method   string `json:"method"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Success  bool   `json:"success"`
+	// KeyType, Fingerprint (SHA256) and PublicKey (authorized_keys format)
+	// describe a key offered for "publickey" authentication.
+	KeyType     string `json:"key_type,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PublicKey   string `json:"public_key,omitempty"`
+	// Answers holds the responses to "keyboard-interactive" prompts.
+	Answers []string `json:"answers,omitempty"`
+	// Domain and Workstation are what an "ntlm" client claimed to be. Hash
+	// is its challenge-response in the format hashcat cracks with
+	// HashcatMode: 5600 for NetNTLMv2, 5500 for NetNTLMv1.
+	Domain      string `json:"domain,omitempty"`
+	Workstation string `json:"workstation,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	HashcatMode int    `json:"hashcat_mode,omitempty"`
+}
+
+// Command records a single command or protocol verb issued by an attacker.
+type Command struct {
+	Meta
+	Input string `json:"input"`
+}
+
+// FileTransfer records a file uploaded to or downloaded from an emulator.
+type FileTransfer struct {
+	Meta
+	Direction string `json:"direction"` // "upload" or "download"
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256,omitempty"`
+	// Via names the transfer mechanism, e.g. "sftp" or "scp".
+	Via string `json:"via,omitempty"`
+	// Truncated is set when an upload exceeded the size cap and only its head was kept.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// HTTPRequest records a request received by the HTTP emulator.
+type HTTPRequest struct {
+	Meta
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	Proto     string `json:"proto,omitempty"`
+	Host      string `json:"host"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Headers are in the order sent, with names spelled as the client did.
+	Headers []HTTPHeader `json:"headers,omitempty"`
+	// Body holds the first bytes of the decoded body. A body longer than
+	// that is kept whole in the quarantine under BodySHA256.
+	Body       []byte `json:"body,omitempty"`
+	BodySize   int64  `json:"body_size,omitempty"`
+	BodySHA256 string `json:"body_sha256,omitempty"`
+	// BodyTruncated is set when the body exceeded the quarantine's size cap.
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+	// Raw is the request as it arrived: head and the start of the body.
+	Raw []byte     `json:"raw,omitempty"`
+	TLS *TLSClient `json:"tls,omitempty"`
+	// Malformed marks bytes that were not a request net/http would serve;
+	// only Raw, and whatever could be read of the request line, is set.
+	Malformed bool `json:"malformed,omitempty"`
+	// Signatures are the exploit signatures the request matched.
+	Signatures []Signature `json:"signatures,omitempty"`
+}
+
+// Signature tags an event with an exploit signature it matched. Field
+// names the part of the input that matched, e.g. "query" or "body".
+type Signature struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	CVE      string `json:"cve,omitempty"`
+	Severity string `json:"severity"`
+	Field    string `json:"field,omitempty"`
+}
+
+// ExploitAttempt records traffic recognised as an exploit or a check for
+// one, outside of what a request's own event carries, such as an SMBv1
+// transaction shaped like EternalBlue.
+type ExploitAttempt struct {
+	Meta
+	Signature Signature `json:"signature"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// HTTPHeader is one header line of a request.
+type HTTPHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// SessionMetadata records what an SSH client asked for when it started a
+// shell, command or subsystem: its terminal and environment.
+type SessionMetadata struct {
+	Meta
+	Request string            `json:"request"`           // "shell", "exec" or "subsystem"
+	Command string            `json:"command,omitempty"` // exec command or subsystem name
+	Term    string            `json:"term,omitempty"`
+	Width   uint32            `json:"width,omitempty"`
+	Height  uint32            `json:"height,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// PortForward records an SSH client trying to use the honeypot as a proxy.
+// No connection is ever made; Payload holds the first bytes the client sent.
+type PortForward struct {
+	Meta
+	Request        string `json:"request"` // "direct-tcpip" or "tcpip-forward"
+	Host           string `json:"host"`
+	Port           uint32 `json:"port"`
+	OriginatorIP   string `json:"originator_ip,omitempty"`
+	OriginatorPort uint32 `json:"originator_port,omitempty"`
+	Payload        []byte `json:"payload,omitempty"`
+	// BytesIn counts everything the client sent, including what was not kept.
+	BytesIn int64 `json:"bytes_in,omitempty"`
+}
+
+// Download records a URL an attacker handed to wget, curl or tftp in the
+// fake shell. The payload is only retrieved when fetching is enabled, and is
+// then identified by SHA256; it is never executed.
+type Download struct {
+	Meta
+	Tool string `json:"tool"` // "wget", "curl", "tftp" or "busybox wget"
+	URL  string `json:"url"`
+	// Path is where the tool claimed to save the file; empty for stdout.
+	Path      string `json:"path,omitempty"`
+	Fetched   bool   `json:"fetched"`
+	Status    int    `json:"status,omitempty"` // HTTP status of the fetch
+	Size      int64  `json:"size,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TLSHandshake is emitted when a client starts TLS on a connection that
+// began in cleartext, such as FTP after AUTH TLS. Error is set when the
+// handshake failed; the ClientHello is still reported if one was sent.
+type TLSHandshake struct {
+	Meta
+	TLS   *TLSClient `json:"tls,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// FTPCommand records one command received on an FTP control connection,
+// split into its verb and argument. PASS arguments are kept as sent.
+type FTPCommand struct {
+	Meta
+	Command  string `json:"command"` // upper-cased verb, e.g. "RETR"
+	Argument string `json:"argument,omitempty"`
+}
+
+func (*ConnectionOpened) Kind() Kind { return KindConnectionOpened }
+func (*ConnectionClosed) Kind() Kind { return KindConnectionClosed }
+func (*AuthAttempt) Kind() Kind      { return KindAuthAttempt }
+func (*Command) Kind() Kind          { return KindCommand }
+func (*FileTransfer) Kind() Kind     { return KindFileTransfer }
+func (*HTTPRequest) Kind() Kind      { return KindHTTPRequest }
+func (*SessionMetadata) Kind() Kind  { return KindSessionMetadata }
+func (*PortForward) Kind() Kind      { return KindPortForward }
+func (*Download) Kind() Kind         { return KindDownload }
+func (*FTPCommand) Kind() Kind       { return KindFTPCommand }
+func (*TLSHandshake) Kind() Kind     { return KindTLSHandshake }
+func (*ExploitAttempt) Kind() Kind   { return KindExploitAttempt }
+
+// Session holds the identity of one attacker connection so that every event
+// it produces shares the same session ID and addresses.
+type Session struct {
+	ID       string
+	Protocol string
+	Src      string
+	Dst      string
+	Started  time.Time
+}
+
+// NewSession allocates a session ID for a connection between remote and local.
+func NewSession(protocol string, local, remote net.Addr) *Session {
+	s := &Session{ID: NewSessionID(), Protocol: protocol, Started: time.Now()}
+	if remote != nil {
+		s.Src = remote.String()
+	}
+	if local != nil {
+		s.Dst = local.String()
+	}
+	return s
+}
+
+// Meta returns a header for a new event in this session, stamped with the current time.
+func (s *Session) Meta() Meta {
+	return Meta{Time: time.Now().UTC(), SessionID: s.ID, Protocol: s.Protocol, Src: s.Src, Dst: s.Dst}
+}
+
+// NewSessionID returns a random 16-character hex identifier.
+func NewSessionID() string {
+	b := make([]byte, 8)
+	// crypto/rand does not fail on the platforms we support.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// envelope is the JSON form of an event: its kind alongside its fields.
+type envelope struct {
+	Type  Kind  `json:"type"`
+	Event Event `json:"event"`
+}
+
+// Encode serialises an event into a self-describing JSON object.
+func Encode(e Event) ([]byte, error) {
+	return json.Marshal(envelope{Type: e.Kind(), Event: e})
+}
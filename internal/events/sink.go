@@ -0,0 +1,39 @@
+package events
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// dropReportInterval controls how often sinks log their drop counters.
+const dropReportInterval = time.Minute
+
+// WriteJSONLines consumes sub and writes one JSON object per event to w until
+// the subscription is closed. It is the sink behind the local event log.
+func WriteJSONLines(sub *Subscription, w io.Writer) {
+	ticker := time.NewTicker(dropReportInterval)
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			b, err := Encode(e)
+			if err != nil {
+				log.Printf("[events] Failed to encode %s event: %v", e.Kind(), err)
+				continue
+			}
+			if _, err := w.Write(append(b, '\n')); err != nil {
+				log.Printf("[events] Failed to write event: %v", err)
+			}
+		case <-ticker.C:
+			if d := sub.Dropped(); d != reported {
+				log.Printf("[events] Sink %q has dropped %d events", sub.name, d)
+				reported = d
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrUnsupportedScheme is returned for URLs the fetcher cannot retrieve.
+var ErrUnsupportedScheme = errors.New("unsupported URL scheme")
+
+// ErrForbiddenAddress is returned when a URL resolves to an address the
+// honeypot must not contact, such as its own network or loopback.
+var ErrForbiddenAddress = errors.New("destination address not allowed")
+
+// Request describes a payload an attacker asked for.
+type Request struct {
+	URL string
+	// UserAgent is sent with HTTP requests, so the serving side sees the tool
+	// the attacker used.
+	UserAgent string
+}
+
+// Result is what a fetch returned.
+type Result struct {
+	// Status is the HTTP status code; it is 0 for other protocols.
+	Status      int
+	ContentType string
+	Data        []byte
+	// Truncated is set when the payload exceeded the size limit and only its
+	// head was kept.
+	Truncated bool
+}
+
+// Fetcher retrieves payloads on behalf of the fake shell. Implementations
+// must never execute what they retrieve.
+type Fetcher interface {
+	Fetch(ctx context.Context, req Request) (*Result, error)
+}
+
+// Client fetches http, https and tftp URLs within size and time limits.
+type Client struct {
+	// MaxSize caps a payload in bytes; zero means unlimited.
+	MaxSize int64
+	// Timeout bounds a whole fetch; zero means no limit beyond ctx.
+	Timeout time.Duration
+	// AllowPrivate permits loopback, private and link-local destinations.
+	AllowPrivate bool
+}
+
+// Fetch implements Fetcher.
+func (c *Client) Fetch(ctx context.Context, req Request) (*Result, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return c.fetchHTTP(ctx, u, req.UserAgent)
+	case "tftp":
+		return c.fetchTFTP(ctx, u)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+}
+
+func (c *Client) fetchHTTP(ctx context.Context, u *url.URL, userAgent string) (*Result, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: c.control}
+	client := &http.Client{
+		Transport: &http.Transport{
+			// Never go through a proxy from the environment: the request
+			// must leave from this host or not at all.
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true}, // droppers are rarely served with valid certificates
+			TLSHandshakeTimeout: 10 * time.Second,
+			DisableKeepAlives:   true,
+		},
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		hreq.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &Result{Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")}
+	res.Data, res.Truncated, err = c.readLimited(resp.Body)
+	return res, err
+}
+
+// readLimited reads r up to MaxSize bytes, reporting whether more followed.
+func (c *Client) readLimited(r io.Reader) ([]byte, bool, error) {
+	if c.MaxSize <= 0 {
+		data, err := io.ReadAll(r)
+		return data, false, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, c.MaxSize+1))
+	if int64(len(data)) > c.MaxSize {
+		return data[:c.MaxSize], true, nil
+	}
+	return data, false, err
+}
+
+// control vets every address dialled, including those reached by redirects
+// and DNS answers, so a URL cannot point the honeypot at its own network.
+func (c *Client) control(network, address string, _ syscall.RawConn) error {
+	if c.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !allowed(net.ParseIP(host)) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func allowed(ip net.IP) bool {
+	return ip != nil &&
+		!ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
@@ -0,0 +1,220 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "Wget/1.21.2" {
+			t.Errorf("User-Agent = %q", ua)
+		}
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-sh")
+		w.Write([]byte("#!/bin/sh\necho hi\n"))
+	}))
+	defer srv.Close()
+
+	c := &Client{AllowPrivate: true}
+	res, err := c.Fetch(context.Background(), Request{URL: srv.URL + "/x.sh", UserAgent: "Wget/1.21.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != http.StatusOK || res.ContentType != "application/x-sh" || string(res.Data) != "#!/bin/sh\necho hi\n" || res.Truncated {
+		t.Errorf("result = %+v", res)
+	}
+
+	res, err = c.Fetch(context.Background(), Request{URL: srv.URL + "/missing", UserAgent: "Wget/1.21.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", res.Status)
+	}
+}
+
+func TestFetchMaxSize(t *testing.T) {
+	body := strings.Repeat("A", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		max       int64
+		size      int
+		truncated bool
+	}{
+		{max: 0, size: 100},
+		{max: 100, size: 100},
+		{max: 99, size: 99, truncated: true},
+		{max: 10, size: 10, truncated: true},
+	}
+	for _, tt := range tests {
+		c := &Client{MaxSize: tt.max, AllowPrivate: true}
+		res, err := c.Fetch(context.Background(), Request{URL: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Data) != tt.size || res.Truncated != tt.truncated {
+			t.Errorf("MaxSize %d: got %d bytes, truncated %v; want %d, %v", tt.max, len(res.Data), res.Truncated, tt.size, tt.truncated)
+		}
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := &Client{Timeout: 50 * time.Millisecond, AllowPrivate: true}
+	start := time.Now()
+	_, err := c.Fetch(context.Background(), Request{URL: srv.URL})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want a deadline error", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("fetch took %s", took)
+	}
+}
+
+func TestFetchRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the server")
+	}))
+	defer srv.Close()
+
+	c := &Client{}
+	for _, u := range []string{srv.URL, "tftp://127.0.0.1/x"} {
+		if _, err := c.Fetch(context.Background(), Request{URL: u}); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("%s: err = %v, want ErrForbiddenAddress", u, err)
+		}
+	}
+	if _, err := c.Fetch(context.Background(), Request{URL: "ftp://example.com/x"}); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Errorf("ftp: err = %v, want ErrUnsupportedScheme", err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+	}
+	for addr, want := range tests {
+		if got := allowed(net.ParseIP(addr)); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// serveTFTP answers read requests for files the way a TFTP server does,
+// sending each transfer from a port of its own.
+func serveTFTP(t *testing.T, files map[string][]byte) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 516)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			fields := bytes.Split(buf[2:n], []byte{0})
+			if binary.BigEndian.Uint16(buf) != tftpRRQ || len(fields) < 2 || string(fields[1]) != "octet" {
+				t.Errorf("bad request %q", buf[:n])
+				continue
+			}
+			go sendTFTP(client, files[string(fields[0])], files[string(fields[0])] != nil)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func sendTFTP(client *net.UDPAddr, data []byte, found bool) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if !found {
+		conn.WriteToUDP(append([]byte{0, tftpError, 0, 1}, "File not found\x00"...), client)
+		return
+	}
+	ack := make([]byte, 4)
+	for block := uint16(1); ; block++ {
+		chunk := data[min(len(data), int(block-1)*tftpBlockSize):min(len(data), int(block)*tftpBlockSize)]
+		pkt := binary.BigEndian.AppendUint16([]byte{0, tftpData}, block)
+		conn.WriteToUDP(append(pkt, chunk...), client)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := conn.ReadFromUDP(ack); err != nil || binary.BigEndian.Uint16(ack[2:]) != block {
+			return
+		}
+		if len(chunk) < tftpBlockSize {
+			return
+		}
+	}
+}
+
+func TestFetchTFTP(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 110)
+	addr := serveTFTP(t, map[string][]byte{"bins/x86": payload, "empty": {}})
+
+	c := &Client{AllowPrivate: true, Timeout: 10 * time.Second}
+	res, err := c.Fetch(context.Background(), Request{URL: "tftp://" + addr + "/bins/x86"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Data, payload) || res.Truncated || res.Status != 0 {
+		t.Errorf("got %d bytes, truncated %v, status %d", len(res.Data), res.Truncated, res.Status)
+	}
+
+	res, err = c.Fetch(context.Background(), Request{URL: "tftp://" + addr + "/empty"})
+	if err != nil || len(res.Data) != 0 {
+		t.Errorf("empty file: %v, %d bytes", err, len(res.Data))
+	}
+
+	c.MaxSize = 600
+	res, err = c.Fetch(context.Background(), Request{URL: "tftp://" + addr + "/bins/x86"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Data, payload[:600]) || !res.Truncated {
+		t.Errorf("limited: got %d bytes, truncated %v", len(res.Data), res.Truncated)
+	}
+
+	if _, err := c.Fetch(context.Background(), Request{URL: "tftp://" + addr + "/nope"}); err == nil || !strings.Contains(err.Error(), "File not found") {
+		t.Errorf("missing file: err = %v", err)
+	}
+}
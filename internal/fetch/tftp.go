@@ -0,0 +1,120 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TFTP opcodes and parameters from RFC 1350.
+const (
+	tftpRRQ   = 1
+	tftpData  = 3
+	tftpAck   = 4
+	tftpError = 5
+
+	tftpBlockSize = 512
+	tftpRetries   = 3
+	tftpWait      = 3 * time.Second
+)
+
+// fetchTFTP performs an octet-mode read request for the URL's path.
+func (c *Client) fetchTFTP(ctx context.Context, u *url.URL) (*Result, error) {
+	file := strings.TrimPrefix(u.Path, "/")
+	if file == "" {
+		return nil, errors.New("tftp: no file name")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "69"
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	var server *net.UDPAddr
+	for _, ip := range ips {
+		if c.AllowPrivate || allowed(ip.IP) {
+			server, err = net.ResolveUDPAddr("udp", net.JoinHostPort(ip.IP.String(), port))
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, fmt.Errorf("%w: %s", ErrForbiddenAddress, u.Hostname())
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	rrq := []byte{0, tftpRRQ}
+	rrq = append(append(append(rrq, file...), 0), "octet\x00"...)
+	last, peer := rrq, server
+	var data bytes.Buffer
+	buf := make([]byte, 4+tftpBlockSize)
+	block := uint16(1)
+	for tries := 0; ; {
+		if _, err := conn.WriteToUDP(last, peer); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(tftpWait))
+		n, from, err := conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() && tries < tftpRetries {
+				tries++
+				continue
+			}
+			return nil, err
+		}
+		// The server answers from a new port, which identifies the transfer.
+		if peer == server {
+			if !from.IP.Equal(server.IP) {
+				continue
+			}
+			peer = from
+		} else if from.Port != peer.Port || !from.IP.Equal(peer.IP) {
+			continue
+		}
+		if n < 4 {
+			return nil, errors.New("tftp: short packet")
+		}
+		switch binary.BigEndian.Uint16(buf) {
+		case tftpError:
+			return nil, fmt.Errorf("tftp: server error %d: %s", binary.BigEndian.Uint16(buf[2:]), bytes.TrimRight(buf[4:n], "\x00"))
+		case tftpData:
+		default:
+			return nil, errors.New("tftp: unexpected packet")
+		}
+		if binary.BigEndian.Uint16(buf[2:]) != block {
+			continue // a duplicate; the last ACK is resent on timeout
+		}
+		tries = 0
+		data.Write(buf[4:n])
+		last = binary.BigEndian.AppendUint16([]byte{0, tftpAck}, block)
+		if c.MaxSize > 0 && int64(data.Len()) > c.MaxSize {
+			return &Result{Data: data.Bytes()[:c.MaxSize], Truncated: true}, nil
+		}
+		if n-4 < tftpBlockSize {
+			conn.WriteToUDP(last, peer)
+			return &Result{Data: data.Bytes()}, nil
+		}
+		block++
+	}
+}
@@ -0,0 +1,125 @@
+package hostkeys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// algorithm is one kind of host key, stored under OpenSSH's file name for it.
+type algorithm struct {
+	file     string
+	generate func() (crypto.Signer, error)
+}
+
+var algorithms = []algorithm{
+	{"ssh_host_ed25519_key", func() (crypto.Signer, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}},
+	{"ssh_host_ecdsa_key", func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}},
+	{"ssh_host_rsa_key", func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}},
+}
+
+// Dir returns the directory host keys are kept in under the state directory.
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, "hostkeys")
+}
+
+// Load returns the host keys kept in dir, generating any that are missing.
+// Keys are generated once and reused, so the server's fingerprints stay the
+// same across restarts the way a real sshd's do.
+func Load(dir string) ([]ssh.Signer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory: %w", err)
+	}
+	var signers []ssh.Signer
+	for _, alg := range algorithms {
+		path := filepath.Join(dir, alg.file)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			data, err = generate(dir, alg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// Rotate replaces every host key in dir with a freshly generated one and
+// returns the new keys. A running emulator keeps its old keys until restarted.
+func Rotate(dir string) ([]ssh.Signer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory: %w", err)
+	}
+	for _, alg := range algorithms {
+		if _, err := generate(dir, alg); err != nil {
+			return nil, err
+		}
+	}
+	return Load(dir)
+}
+
+// generate creates a key and atomically writes it and its public half to dir.
+func generate(dir string, alg algorithm) ([]byte, error) {
+	key, err := alg.generate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s: %w", alg.file, err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", alg.file, err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(block)
+	if err := writeFile(filepath.Join(dir, alg.file), data, 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(dir, alg.file+".pub"), ssh.MarshalAuthorizedKey(pub), 0644); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
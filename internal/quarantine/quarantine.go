@@ -0,0 +1,105 @@
+package quarantine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrFull is returned when storing a sample would exceed the total size budget.
+var ErrFull = errors.New("quarantine is full")
+
+// Result describes a stored sample.
+type Result struct {
+	SHA256 string
+	Size   int64
+	Path   string
+	// Duplicate is set when a sample with the same hash was already stored.
+	Duplicate bool
+}
+
+// Dir returns the directory samples are kept in under the state directory.
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, "quarantine")
+}
+
+// Store keeps attacker-supplied files on disk, named by their SHA-256 so that
+// the same payload dropped by a thousand bots is stored once. Files are
+// written without execute permission and are never run.
+type Store struct {
+	dir      string
+	maxFile  int64
+	maxTotal int64
+
+	mu    sync.Mutex
+	total int64
+}
+
+// Open creates the quarantine directory if needed and accounts for its contents.
+// maxFile caps each sample and maxTotal the whole store; zero means unlimited.
+func Open(dir string, maxFile, maxTotal int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	s := &Store{dir: dir, maxFile: maxFile, maxTotal: maxTotal}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			s.total += info.Size()
+		}
+	}
+	return s, nil
+}
+
+// MaxFileSize returns the per-sample cap, or 0 when unlimited.
+func (s *Store) MaxFileSize() int64 {
+	return s.maxFile
+}
+
+// Save stores data under its hash.
+func (s *Store) Save(data []byte) (Result, error) {
+	sum := sha256.Sum256(data)
+	res := Result{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	res.Path = filepath.Join(s.dir, res.SHA256)
+
+	if s.maxFile > 0 && res.Size > s.maxFile {
+		return res, fmt.Errorf("sample of %d bytes exceeds the %d byte limit", res.Size, s.maxFile)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(res.Path); err == nil {
+		res.Duplicate = true
+		return res, nil
+	}
+	if s.maxTotal > 0 && s.total+res.Size > s.maxTotal {
+		return res, ErrFull
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".incoming-*")
+	if err != nil {
+		return res, fmt.Errorf("failed to create quarantine file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return res, fmt.Errorf("failed to write quarantine file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return res, err
+	}
+	if err := os.Rename(tmp.Name(), res.Path); err != nil {
+		os.Remove(tmp.Name())
+		return res, err
+	}
+	s.total += res.Size
+	return res, nil
+}
@@ -0,0 +1,272 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxFileSize stops a recording from growing without bound when an attacker
+// streams output forever; events past it are dropped.
+const maxFileSize = 64 << 20
+
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// Dir returns the directory recordings are kept in under the state directory.
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, "recordings")
+}
+
+// Path returns the file a session's recording is stored in.
+func Path(dir, sessionID string) (string, error) {
+	if !sessionIDPattern.MatchString(sessionID) {
+		return "", fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	return filepath.Join(dir, sessionID+".cast"), nil
+}
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes a terminal session as an asciicast v2 stream
+// (https://docs.asciinema.org/manual/asciicast/v2/). It is safe for
+// concurrent use; all channels of one SSH connection share a recorder.
+type Recorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	written int64
+	err     error
+	// outTail and inTail hold the start of a UTF-8 sequence cut off at the
+	// end of the last Output or Input, completed by the next one.
+	outTail []byte
+	inTail  []byte
+}
+
+// Create starts a recording for sessionID in dir.
+func Create(dir, sessionID string, h Header) (*Recorder, error) {
+	path, err := Path(dir, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	h.Version = 2
+	if h.Timestamp == 0 {
+		h.Timestamp = r.start.Unix()
+	}
+	line, err := json.Marshal(h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.writeLine(line)
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	if r.err != nil {
+		f.Close()
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// Output records data sent to the attacker's terminal.
+func (r *Recorder) Output(p []byte) { r.text("o", &r.outTail, p) }
+
+// Input records data typed by the attacker.
+func (r *Recorder) Input(p []byte) { r.text("i", &r.inTail, p) }
+
+// Resize records a terminal size change.
+func (r *Recorder) Resize(width, height int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("r", strconv.Itoa(width)+"x"+strconv.Itoa(height))
+}
+
+// text records p as an event of the given code. A multi-byte character split
+// across writes is held back in tail until the rest of it arrives, so that it
+// is not recorded as two invalid halves.
+func (r *Recorder) text(code string, tail *[]byte, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buf := append(*tail, p...)
+	n := completeLen(buf)
+	data := decode(buf[:n])
+	*tail = append((*tail)[:0], buf[n:]...)
+	r.event(code, data)
+}
+
+// completeLen returns the length of b without an incomplete UTF-8 sequence
+// at its end.
+func completeLen(b []byte) int {
+	for i := len(b) - 1; i >= 0 && len(b)-i < utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// decode turns b into the string an event carries. Event data must be valid
+// UTF-8, so each byte that is not part of a valid sequence becomes U+FFFD,
+// the way asciinema's own recorder and terminals show it.
+func decode(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	data := make([]byte, 0, len(b)+8)
+	for len(b) > 0 {
+		c, size := utf8.DecodeRune(b)
+		if c == utf8.RuneError && size == 1 {
+			data = utf8.AppendRune(data, utf8.RuneError)
+		} else {
+			data = append(data, b[:size]...)
+		}
+		b = b[size:]
+	}
+	return string(data)
+}
+
+// event appends one event line. Callers hold mu.
+func (r *Recorder) event(code, data string) {
+	if len(data) == 0 {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{json.Number(strconv.FormatFloat(elapsed, 'f', 6, 64)), code, data})
+	if err != nil {
+		return
+	}
+	r.writeLine(line)
+	// Flush per event so an abrupt stop loses little; the writer only
+	// batches the pieces of one line.
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+}
+
+// writeLine appends one line unless the size cap is reached. Callers hold mu
+// or own r exclusively.
+func (r *Recorder) writeLine(line []byte) {
+	if r.err != nil || r.written+int64(len(line))+1 > maxFileSize {
+		return
+	}
+	r.w.Write(line)
+	r.err = r.w.WriteByte('\n')
+	r.written += int64(len(line)) + 1
+}
+
+// Close flushes and closes the recording. A character still cut off at
+// that point is recorded as invalid.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("o", decode(r.outTail))
+	r.event("i", decode(r.inTail))
+	r.outTail, r.inTail = nil, nil
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Tee wraps the stream rw so that everything read from it is recorded as
+// input and everything written to it as output.
+func (r *Recorder) Tee(rw io.ReadWriter) io.ReadWriter {
+	return &tee{rw: rw, rec: r}
+}
+
+type tee struct {
+	rw  io.ReadWriter
+	rec *Recorder
+}
+
+func (t *tee) Read(p []byte) (int, error) {
+	n, err := t.rw.Read(p)
+	t.rec.Input(p[:n])
+	return n, err
+}
+
+func (t *tee) Write(p []byte) (int, error) {
+	n, err := t.rw.Write(p)
+	t.rec.Output(p[:n])
+	return n, err
+}
+
+// Play writes the output events of an asciicast v2 stream to w, keeping the
+// recorded timing divided by speed. Pauses longer than maxIdle are shortened
+// to maxIdle unless it is zero.
+func Play(r io.Reader, w io.Writer, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFileSize)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("empty recording")
+	}
+	var h Header
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		return fmt.Errorf("invalid asciicast header: %w", err)
+	}
+	if h.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version %d", h.Version)
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var ev [3]any
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("invalid asciicast event: %w", err)
+		}
+		at, _ := ev[0].(float64)
+		code, _ := ev[1].(string)
+		data, _ := ev[2].(string)
+		if code != "o" {
+			continue
+		}
+		delay := time.Duration((at - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		last = at
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
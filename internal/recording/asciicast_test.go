@@ -0,0 +1,111 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// record writes each chunk as an Output and an Input event and returns the
+// recording's path once it is closed.
+func record(t *testing.T, chunks ...[]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	r, err := Create(dir, "abc", Header{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		r.Output(c)
+		r.Input(c)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := Path(dir, "abc")
+	return path
+}
+
+func play(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	if err := Play(f, &out, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// input returns the data of the input events in the recording at path.
+func input(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Scan() // header
+	for scanner.Scan() {
+		var ev [3]any
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev[1] == "i" {
+			in.WriteString(ev[2].(string))
+		}
+	}
+	return in.String()
+}
+
+func TestSplitCharacters(t *testing.T) {
+	text := []byte("héllo wörld ✓ 🙂 done\r\n")
+	// Cut the text at every byte so that each multi-byte character is split
+	// at every point inside it.
+	var chunks [][]byte
+	for i := range text {
+		chunks = append(chunks, text[i:i+1])
+	}
+	path := record(t, chunks...)
+	if got := play(t, path); got != string(text) {
+		t.Errorf("played %q, want %q", got, text)
+	}
+	if got := input(t, path); got != string(text) {
+		t.Errorf("input %q, want %q", got, text)
+	}
+}
+
+func TestInvalidBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"invalid byte", []string{"a\xffb"}, "a�b"},
+		{"stray continuation", []string{"a\x80", "\x80b"}, "a��b"},
+		{"broken sequence", []string{"a\xe2\x9c", "b"}, "a��b"},
+		{"cut off at close", []string{"ok\xf0\x9f"}, "ok��"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chunks [][]byte
+			for _, c := range tt.chunks {
+				chunks = append(chunks, []byte(c))
+			}
+			path := record(t, chunks...)
+			if got := play(t, path); got != tt.want {
+				t.Errorf("played %q, want %q", got, tt.want)
+			}
+			if got := input(t, path); got != tt.want {
+				t.Errorf("input %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
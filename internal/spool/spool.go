@@ -0,0 +1,524 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when appended records are flushed to stable storage.
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"   // fsync after every append
+	SyncInterval SyncPolicy = "interval" // fsync once per Options.SyncInterval while appends are unsynced
+	SyncNever    SyncPolicy = "never"    // leave flushing to the kernel
+)
+
+const (
+	segmentExt   = ".seg"
+	ackExt       = ".ack"
+	headerSize   = 8 // uint32 length + uint32 CRC-32C
+	maxRecordLen = 16 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrClosed is returned by operations on a closed spool.
+var ErrClosed = errors.New("spool is closed")
+
+// Options configures a spool. Zero values select the defaults noted on each field.
+type Options struct {
+	Dir          string
+	SegmentSize  int64         // roll to a new segment after this many bytes (default 4 MiB)
+	MaxSize      int64         // evict oldest segments beyond this total (default 256 MiB, <0 unlimited)
+	MaxAge       time.Duration // evict segments older than this (0 keeps them forever)
+	Sync         SyncPolicy    // default SyncInterval
+	SyncInterval time.Duration // default 1s
+}
+
+// Dir returns the directory the spool is kept in under the state directory.
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, "spool")
+}
+
+// Position addresses a record: the segment it lives in and its byte offset.
+type Position struct {
+	Segment uint64
+	Offset  int64
+}
+
+// String formats the position as "segment:offset"; it doubles as a stable record ID.
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Segment, p.Offset)
+}
+
+// Less reports whether p comes before q.
+func (p Position) Less(q Position) bool {
+	return p.Segment < q.Segment || (p.Segment == q.Segment && p.Offset < q.Offset)
+}
+
+// Record is one appended payload and the position of the record after it.
+type Record struct {
+	Pos  Position
+	Next Position
+	Data []byte
+}
+
+// Spool is a persistent append-only queue of opaque records split into
+// segment files. Each segment has a sidecar file holding the offset up to
+// which its records have been acknowledged; fully acknowledged segments are
+// deleted. Records survive restarts until they are acknowledged or evicted.
+type Spool struct {
+	opts Options
+
+	mu       sync.Mutex
+	segments []segment // oldest first; the last one is the active segment
+	active   *os.File
+	acked    Position
+	lastSync time.Time
+	dirty    bool
+	evicted  uint64
+	closed   bool
+	notify   chan struct{}
+	stop     chan struct{} // stops the flush goroutine of SyncInterval
+}
+
+type segment struct {
+	id       uint64
+	size     int64
+	modified time.Time // time of the last append, so MaxAge bounds the newest record
+}
+
+// Open opens or creates the spool in opts.Dir, repairing a torn final record.
+func Open(opts Options) (*Spool, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 4 << 20
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = 256 << 20
+	}
+	if opts.Sync == "" {
+		opts.Sync = SyncInterval
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{opts: opts, notify: make(chan struct{})}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		s.stop = make(chan struct{})
+		go s.flush()
+	}
+	return s, nil
+}
+
+// flush syncs the active segment every SyncInterval, so that the last
+// appends before a quiet spell do not wait for the next Append to reach
+// the disk.
+func (s *Spool) flush() {
+	t := time.NewTicker(s.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			if !s.closed {
+				s.sync()
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// load scans the directory for segments and restores the acknowledged position.
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, segment{id: id, size: info.Size(), modified: info.ModTime()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if len(s.segments) == 0 {
+		return s.roll(1)
+	}
+
+	first := s.segments[0]
+	s.acked = Position{Segment: first.id, Offset: s.readAck(first.id)}
+
+	last := &s.segments[len(s.segments)-1]
+	valid, err := s.validLength(last.id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.segmentPath(last.id), os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open active segment: %w", err)
+	}
+	if valid < last.size {
+		log.Printf("[spool] Truncating torn record in segment %d at offset %d", last.id, valid)
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to repair segment: %w", err)
+		}
+		last.size = valid
+	}
+	if _, err := f.Seek(last.size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.active = f
+	s.evict()
+	return nil
+}
+
+// validLength returns the length of the longest prefix of whole, intact records.
+func (s *Spool) validLength(id uint64) (int64, error) {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var off int64
+	for {
+		data, err := readRecord(f)
+		if err != nil {
+			return off, nil
+		}
+		off += headerSize + int64(len(data))
+	}
+}
+
+// Append adds data to the end of the spool.
+func (s *Spool) Append(data []byte) error {
+	if len(data) > maxRecordLen {
+		return fmt.Errorf("record of %d bytes exceeds limit", len(data))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	cur := &s.segments[len(s.segments)-1]
+	if cur.size > 0 && cur.size+headerSize+int64(len(data)) > s.opts.SegmentSize {
+		if err := s.roll(cur.id + 1); err != nil {
+			return err
+		}
+		cur = &s.segments[len(s.segments)-1]
+	}
+
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[headerSize:], data)
+	if _, err := s.active.Write(buf); err != nil {
+		return fmt.Errorf("failed to append to segment %d: %w", cur.id, err)
+	}
+	cur.size += int64(len(buf))
+	cur.modified = time.Now()
+	s.dirty = true
+
+	switch s.opts.Sync {
+	case SyncAlways:
+		s.sync()
+	case SyncInterval:
+		if time.Since(s.lastSync) >= s.opts.SyncInterval {
+			s.sync()
+		}
+	}
+
+	s.evict()
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return nil
+}
+
+// Notify returns a channel that is closed on the next Append.
+func (s *Spool) Notify() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notify
+}
+
+// Read returns up to max records starting at from. A position in a segment
+// that has since been evicted resumes at the oldest remaining record.
+func (s *Spool) Read(from Position, max int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if from.Less(Position{Segment: s.segments[0].id}) {
+		from = Position{Segment: s.segments[0].id}
+	}
+
+	var out []Record
+	for _, seg := range s.segments {
+		if seg.id < from.Segment {
+			continue
+		}
+		off := int64(0)
+		if seg.id == from.Segment {
+			off = from.Offset
+		}
+		if off >= seg.size {
+			continue
+		}
+		recs, err := s.readSegment(seg, off, max-len(out))
+		out = append(out, recs...)
+		if err != nil {
+			// Skip the damaged remainder of the segment rather than stalling delivery.
+			log.Printf("[spool] %v; skipping rest of segment", err)
+			if next, ok := s.nextSegment(seg.id); ok && len(out) > 0 {
+				out[len(out)-1].Next = Position{Segment: next}
+			}
+		}
+		if len(out) >= max {
+			break
+		}
+	}
+	if n := len(out); n > 0 && out[n-1].Next.Offset >= s.segmentSize(out[n-1].Pos.Segment) {
+		// Point past a finished segment at the start of the next one.
+		if next, ok := s.nextSegment(out[n-1].Pos.Segment); ok {
+			out[n-1].Next = Position{Segment: next}
+		}
+	}
+	return out, nil
+}
+
+func (s *Spool) readSegment(seg segment, off int64, max int) ([]Record, error) {
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var out []Record
+	for len(out) < max && off < seg.size {
+		data, err := readRecord(f)
+		if err != nil {
+			return out, fmt.Errorf("corrupt record in segment %d at offset %d: %w", seg.id, off, err)
+		}
+		next := off + headerSize + int64(len(data))
+		out = append(out, Record{
+			Pos:  Position{Segment: seg.id, Offset: off},
+			Next: Position{Segment: seg.id, Offset: next},
+			Data: data,
+		})
+		off = next
+	}
+	return out, nil
+}
+
+// Ack marks every record before pos as delivered. Segments that are entirely
+// acknowledged are removed; the offset within pos.Segment is persisted.
+func (s *Spool) Ack(pos Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if !s.acked.Less(pos) {
+		return nil
+	}
+	for len(s.segments) > 1 && s.segments[0].id < pos.Segment {
+		s.removeOldest()
+	}
+	first := s.segments[0]
+	if pos.Segment < first.id {
+		pos = Position{Segment: first.id}
+	}
+	s.acked = pos
+	if pos.Segment != first.id {
+		return nil
+	}
+	return s.writeAck(first.id, pos.Offset)
+}
+
+// Acked returns the position up to which records have been acknowledged.
+func (s *Spool) Acked() Position {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// Evicted returns how many unacknowledged segments were dropped by the size or age limits.
+func (s *Spool) Evicted() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evicted
+}
+
+// Close flushes and closes the active segment.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.sync()
+	return s.active.Close()
+}
+
+// roll closes the active segment and starts segment id.
+func (s *Spool) roll(id uint64) error {
+	if s.active != nil {
+		s.sync()
+		s.active.Close()
+	}
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %d: %w", id, err)
+	}
+	s.active = f
+	s.segments = append(s.segments, segment{id: id, modified: time.Now()})
+	if len(s.segments) == 1 {
+		s.acked = Position{Segment: id}
+	}
+	return nil
+}
+
+// evict drops the oldest closed segments while the spool is over its size or age budget.
+func (s *Spool) evict() {
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		var total int64
+		for _, seg := range s.segments {
+			total += seg.size
+		}
+		overSize := s.opts.MaxSize > 0 && total > s.opts.MaxSize
+		overAge := s.opts.MaxAge > 0 && time.Since(oldest.modified) > s.opts.MaxAge
+		if !overSize && !overAge {
+			return
+		}
+		if s.acked.Segment <= oldest.id && s.acked.Offset < oldest.size {
+			s.evicted++
+			log.Printf("[spool] Evicting undelivered segment %d (%d bytes)", oldest.id, oldest.size)
+		}
+		s.removeOldest()
+		s.acked = Position{Segment: s.segments[0].id, Offset: s.readAck(s.segments[0].id)}
+	}
+}
+
+func (s *Spool) removeOldest() {
+	id := s.segments[0].id
+	s.segments = s.segments[1:]
+	os.Remove(s.segmentPath(id))
+	os.Remove(s.ackPath(id))
+}
+
+func (s *Spool) sync() {
+	if !s.dirty {
+		return
+	}
+	if err := s.active.Sync(); err != nil {
+		log.Printf("[spool] fsync failed: %v", err)
+	}
+	s.dirty = false
+	s.lastSync = time.Now()
+}
+
+func (s *Spool) segmentSize(id uint64) int64 {
+	for _, seg := range s.segments {
+		if seg.id == id {
+			return seg.size
+		}
+	}
+	return 0
+}
+
+func (s *Spool) nextSegment(id uint64) (uint64, bool) {
+	for _, seg := range s.segments {
+		if seg.id > id {
+			return seg.id, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Spool) readAck(id uint64) int64 {
+	b, err := os.ReadFile(s.ackPath(id))
+	if err != nil || len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// writeAck persists the acknowledged offset for a segment via write-and-rename.
+func (s *Spool) writeAck(id uint64, off int64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(off))
+	tmp := s.ackPath(id) + ".tmp"
+	if err := os.WriteFile(tmp, b[:], 0600); err != nil {
+		return fmt.Errorf("failed to write ack offset: %w", err)
+	}
+	return os.Rename(tmp, s.ackPath(id))
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func (s *Spool) ackPath(id uint64) string {
+	return filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", id, ackExt))
+}
+
+// readRecord reads one length-prefixed, checksummed record.
+func readRecord(r io.Reader) ([]byte, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n > maxRecordLen {
+		return nil, fmt.Errorf("record length %d exceeds limit", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data, nil
+}
@@ -0,0 +1,211 @@
+package spool
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// record is the payload of the i-th test record; each one takes 16 bytes
+// on disk, so a SegmentSize of 32 holds two.
+func record(i int) string {
+	return fmt.Sprintf("record %d", i)
+}
+
+func open(t *testing.T, opts Options) *Spool {
+	t.Helper()
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendRecords(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append([]byte(record(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readAll returns the records from pos on and checks they are the ones
+// numbered from first onwards.
+func readAll(t *testing.T, s *Spool, pos Position, first int) []Record {
+	t.Helper()
+	recs, err := s.Read(pos, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range recs {
+		if string(r.Data) != record(first+i) {
+			t.Fatalf("record %d = %q, want %q", i, r.Data, record(first+i))
+		}
+	}
+	return recs
+}
+
+func TestTornRecordRepair(t *testing.T) {
+	tests := []struct {
+		name string
+		tear func(path string) error
+		kept int // records left after the repair
+	}{
+		{
+			name: "partial",
+			kept: 3,
+			tear: func(path string) error {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = f.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 'x'})
+				return err
+			},
+		},
+		{
+			name: "checksum",
+			kept: 2, // the damaged record is the torn one
+			tear: func(path string) error {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				data[len(data)-1] ^= 0xff
+				return os.WriteFile(path, data, 0600)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := open(t, Options{Dir: dir, Sync: SyncAlways})
+			appendRecords(t, s, 0, 3)
+			path := s.segmentPath(1)
+			s.Close()
+			if err := tt.tear(path); err != nil {
+				t.Fatal(err)
+			}
+
+			s = open(t, Options{Dir: dir, Sync: SyncAlways})
+			if recs := readAll(t, s, Position{}, 0); len(recs) != tt.kept {
+				t.Fatalf("%d records after repair, want %d", len(recs), tt.kept)
+			}
+			if err := s.Append([]byte(record(tt.kept))); err != nil {
+				t.Fatal(err)
+			}
+			if recs := readAll(t, s, Position{}, 0); len(recs) != tt.kept+1 {
+				t.Errorf("%d records after append, want %d", len(recs), tt.kept+1)
+			}
+		})
+	}
+}
+
+func TestAckPersists(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Dir: dir, SegmentSize: 32, Sync: SyncNever}
+	s := open(t, opts)
+	appendRecords(t, s, 0, 7)
+	recs := readAll(t, s, Position{}, 0)
+	if len(recs) != 7 {
+		t.Fatalf("%d records", len(recs))
+	}
+	if err := s.Ack(recs[2].Next); err != nil {
+		t.Fatal(err)
+	}
+	acked := s.Acked()
+	if acked != recs[2].Next {
+		t.Fatalf("Acked = %v, want %v", acked, recs[2].Next)
+	}
+	s.Close()
+	// The first segment held records 0 and 1 only and is gone.
+	if _, err := os.Stat(s.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("acknowledged segment kept: %v", err)
+	}
+
+	s = open(t, opts)
+	if s.Acked() != acked {
+		t.Errorf("Acked after reopen = %v, want %v", s.Acked(), acked)
+	}
+	if recs := readAll(t, s, s.Acked(), 3); len(recs) != 4 {
+		t.Errorf("%d records after the ack, want 4", len(recs))
+	}
+	// An older position does not move the ack back.
+	if err := s.Ack(Position{Segment: 1}); err != nil || s.Acked() != acked {
+		t.Errorf("Ack backwards: %v, Acked = %v", err, s.Acked())
+	}
+}
+
+func TestEvictBySize(t *testing.T) {
+	s := open(t, Options{Dir: t.TempDir(), SegmentSize: 32, MaxSize: 64, Sync: SyncNever})
+	appendRecords(t, s, 0, 10)
+	// Five segments of two records each, of which the last two fit.
+	if s.Evicted() != 3 {
+		t.Errorf("Evicted = %d, want 3", s.Evicted())
+	}
+	// Reading from the start resumes at the oldest record left.
+	if recs := readAll(t, s, Position{}, 6); len(recs) != 4 {
+		t.Errorf("%d records kept, want 4", len(recs))
+	}
+	if want := (Position{Segment: 4}); s.Acked() != want {
+		t.Errorf("Acked = %v, want %v", s.Acked(), want)
+	}
+}
+
+func TestEvictByAge(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Dir: dir, SegmentSize: 32, Sync: SyncNever}
+	s := open(t, opts)
+	appendRecords(t, s, 0, 5)
+	old := s.segmentPath(1)
+	s.Close()
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.MaxAge = time.Hour
+	s = open(t, opts)
+	if s.Evicted() != 1 {
+		t.Errorf("Evicted = %d, want 1", s.Evicted())
+	}
+	if recs := readAll(t, s, Position{}, 2); len(recs) != 3 {
+		t.Errorf("%d records kept, want 3", len(recs))
+	}
+}
+
+func TestIntervalFlush(t *testing.T) {
+	s := open(t, Options{Dir: t.TempDir(), Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+	// The first append syncs; the second comes within the interval.
+	appendRecords(t, s, 0, 2)
+	dirty := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.dirty
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dirty() {
+		if time.Now().After(deadline) {
+			t.Fatal("append not synced without a later Append")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if err := s.Append([]byte("late")); err != ErrClosed {
+		t.Errorf("Append after Close = %v, want ErrClosed", err)
+	}
+}
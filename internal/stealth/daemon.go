@@ -54,13 +54,3 @@ func Daemonize(pairingCode string) bool {
 	fmt.Printf("Background process launched with PID: %d\n", cmd.Process.Pid)
 	return false
 }
-
-// SelfDestruct removes the original executable file.
-func SelfDestruct() error {
-	exePath, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("failed to get executable path: %w", err)
-	}
-	log.Printf("Attempting to self-destruct: %s", exePath)
-	return os.Remove(exePath)
-}
@@ -2,7 +2,6 @@ package stealth
 
 import (
     "log"
-    "os"
 )
 
 // SelfDestruct removes the launcher binary from disk after confirming a running background
@@ -0,0 +1,244 @@
+package tlscert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Name is the subject of a CA certificate.
+type Name struct {
+	CommonName   string
+	Organization string
+	Country      string
+}
+
+func (n Name) pkix() pkix.Name {
+	name := pkix.Name{CommonName: n.CommonName}
+	if n.Organization != "" {
+		name.Organization = []string{n.Organization}
+	}
+	if n.Country != "" {
+		name.Country = []string{n.Country}
+	}
+	return name
+}
+
+// Chain describes a server certificate issued by an intermediate under a
+// root, the way a public CA's certificates are.
+type Chain struct {
+	CommonName string
+	// SANs are DNS names or IP addresses; CommonName is always included.
+	SANs   []string
+	Issuer Name
+	Root   Name
+}
+
+const (
+	leafLifetime = 90 * 24 * time.Hour
+	// renewBefore replaces the leaf certificate this long before it
+	// expires, as certbot would.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// ChainDir returns the directory the issued certificate is kept in.
+func ChainDir(stateDir string) string {
+	return filepath.Join(Dir(stateDir), "issued")
+}
+
+// LoadChain returns the certificate described by c, with the intermediate
+// appended, from dir. The CA pair is created once and reused; the server
+// certificate is reissued when its names change or it nears expiry.
+func LoadChain(dir string, c Chain) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	issuer, issuerKey, err := loadCA(dir, c)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPath, keyPath := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	switch {
+	case err == nil && current(cert, c, issuer):
+		return cert, nil
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return tls.Certificate{}, fmt.Errorf("failed to load %s: %w", certPath, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	notBefore := time.Now().Add(-time.Duration(randInt(14*24)) * time.Hour).Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: c.CommonName},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(leafLifetime - time.Second),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, san := range append([]string{c.CommonName}, c.SANs...) {
+		if ip := net.ParseIP(san); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if !slices.Contains(tmpl.DNSNames, san) {
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+	der, err := sign(tmpl, issuer, key.Public(), issuerKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chainPEM := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw})...)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := writeFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeFile(certPath, chainPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(chainPEM, keyPEM)
+}
+
+// current reports whether a stored certificate still matches c and its
+// issuer and is not due for renewal.
+func current(cert tls.Certificate, c Chain, issuer *x509.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil || leaf.Subject.CommonName != c.CommonName || time.Until(leaf.NotAfter) < renewBefore {
+		return false
+	}
+	if leaf.CheckSignatureFrom(issuer) != nil {
+		return false
+	}
+	for _, san := range c.SANs {
+		if leaf.VerifyHostname(san) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCA returns the intermediate and its key, creating the root and
+// intermediate when missing or when their names no longer match c.
+func loadCA(dir string, c Chain) (*x509.Certificate, crypto.Signer, error) {
+	caPath, caKeyPath := filepath.Join(dir, "chain.pem"), filepath.Join(dir, "chain.key")
+	if pair, err := tls.LoadX509KeyPair(caPath, caKeyPath); err == nil && pair.Leaf != nil {
+		ca := pair.Leaf
+		if ca.Subject.String() == c.Issuer.pkix().String() && ca.Issuer.String() == c.Root.pkix().String() {
+			return ca, pair.PrivateKey.(crypto.Signer), nil
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to load %s: %w", caPath, err)
+	}
+
+	// The root's key signs once and is thrown away; only its subject and
+	// signature on the intermediate are ever seen by clients.
+	rootKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate root key: %w", err)
+	}
+	rootStart := time.Now().AddDate(-9, -2, 0).Truncate(24 * time.Hour)
+	root := &x509.Certificate{
+		Subject:               c.Root.pkix(),
+		NotBefore:             rootStart,
+		NotAfter:              rootStart.AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := sign(root, root, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if root, err = x509.ParseCertificate(rootDER); err != nil {
+		return nil, nil, err
+	}
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate intermediate key: %w", err)
+	}
+	caStart := time.Now().AddDate(-3, -1, 0).Truncate(24 * time.Hour)
+	tmpl := &x509.Certificate{
+		Subject:               c.Issuer.pkix(),
+		NotBefore:             caStart,
+		NotAfter:              caStart.AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	caDER, err := sign(tmpl, root, caKey.Public(), rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeFile(caKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writeFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		return nil, nil, err
+	}
+	// A new intermediate invalidates the server certificate it signed.
+	os.Remove(filepath.Join(dir, "fullchain.pem"))
+	return ca, caKey, nil
+}
+
+// sign issues tmpl from parent with a random serial and a subject key ID
+// derived from pub.
+func sign(tmpl, parent *x509.Certificate, pub crypto.PublicKey, parentKey crypto.Signer) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki)
+	tmpl.SubjectKeyId = sum[:]
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate for %s: %w", tmpl.Subject.CommonName, err)
+	}
+	return der, nil
+}
+
+func randInt(n int64) int64 {
+	v, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0
+	}
+	return v.Int64()
+}
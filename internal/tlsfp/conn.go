@@ -0,0 +1,58 @@
+package tlsfp
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxSniffBytes bounds what is buffered while waiting for a ClientHello.
+const maxSniffBytes = maxHandshakeBytes + 1024
+
+// Conn passes a connection through to a TLS server while parsing the
+// client's ClientHello from the start of the stream, which crypto/tls does
+// not expose in full.
+type Conn struct {
+	net.Conn
+
+	mu    sync.Mutex
+	buf   []byte
+	done  bool
+	hello *ClientHello
+}
+
+// NewConn wraps c, which must be positioned at the start of the TLS stream.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.observe(p[:n])
+	}
+	return n, err
+}
+
+// ClientHello returns the parsed hello, or nil if none has been seen.
+func (c *Conn) ClientHello() *ClientHello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello
+}
+
+func (c *Conn) observe(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	c.buf = append(c.buf, b...)
+	hello, err := Parse(c.buf)
+	if errors.Is(err, ErrIncomplete) && len(c.buf) < maxSniffBytes {
+		return
+	}
+	c.hello = hello
+	c.done = true
+	c.buf = nil
+}
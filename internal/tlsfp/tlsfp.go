@@ -0,0 +1,304 @@
+package tlsfp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	recordHandshake   = 22
+	typeClientHello   = 1
+	maxHandshakeBytes = 64 * 1024
+
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// ErrIncomplete is returned by Parse when the bytes end before the ClientHello does.
+var ErrIncomplete = errors.New("incomplete ClientHello")
+
+// ClientHello holds the fields of a TLS ClientHello that fingerprints are
+// built from. Lists keep the client's order and include GREASE values.
+type ClientHello struct {
+	Version             uint16 // legacy_version from the hello, not the record
+	CipherSuites        []uint16
+	Extensions          []uint16
+	Curves              []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ServerName          string
+	ALPN                []string
+}
+
+// Parse decodes the ClientHello at the start of a TLS stream, which may be
+// spread over several handshake records.
+func Parse(stream []byte) (*ClientHello, error) {
+	var msg []byte
+	for {
+		if len(msg) >= 4 {
+			n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if n > maxHandshakeBytes {
+				return nil, fmt.Errorf("ClientHello of %d bytes is too large", n)
+			}
+			if len(msg) >= 4+n {
+				msg = msg[:4+n]
+				break
+			}
+		}
+		if len(stream) < 5 {
+			return nil, ErrIncomplete
+		}
+		if stream[0] != recordHandshake {
+			return nil, fmt.Errorf("not a TLS handshake record (type %d)", stream[0])
+		}
+		n := int(binary.BigEndian.Uint16(stream[3:]))
+		if len(stream) < 5+n {
+			return nil, ErrIncomplete
+		}
+		msg = append(msg, stream[5:5+n]...)
+		stream = stream[5+n:]
+	}
+	if msg[0] != typeClientHello {
+		return nil, fmt.Errorf("handshake message type %d is not a ClientHello", msg[0])
+	}
+	return parseHello(msg[4:])
+}
+
+var errMalformed = errors.New("malformed ClientHello")
+
+// reader consumes big-endian fields, recording the first short read.
+type reader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.bad || len(r.b) < n {
+		r.bad = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *reader) u16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// vector returns the body of a field prefixed by an lenBytes-long length.
+func (r *reader) vector(lenBytes int) *reader {
+	n := r.u8()
+	if lenBytes == 2 {
+		n = n<<8 | r.u8()
+	}
+	return &reader{b: r.bytes(n), bad: r.bad}
+}
+
+func (r *reader) u16s() []uint16 {
+	var v []uint16
+	for len(r.b) >= 2 {
+		v = append(v, uint16(r.u16()))
+	}
+	return v
+}
+
+func parseHello(b []byte) (*ClientHello, error) {
+	r := &reader{b: b}
+	ch := &ClientHello{Version: uint16(r.u16())}
+	r.bytes(32) // random
+	r.vector(1) // session id
+	ch.CipherSuites = r.vector(2).u16s()
+	r.vector(1) // compression methods
+	if r.bad {
+		return nil, errMalformed
+	}
+	if len(r.b) == 0 {
+		return ch, nil // SSL 3.0-style hello without extensions
+	}
+	exts := r.vector(2)
+	for len(exts.b) >= 4 && !exts.bad {
+		typ := uint16(exts.u16())
+		body := exts.vector(2)
+		ch.Extensions = append(ch.Extensions, typ)
+		switch typ {
+		case extServerName:
+			names := body.vector(2)
+			for len(names.b) > 0 && !names.bad {
+				kind := names.u8()
+				name := names.vector(2)
+				if kind == 0 && ch.ServerName == "" {
+					ch.ServerName = string(name.b)
+				}
+			}
+		case extSupportedGroups:
+			ch.Curves = body.vector(2).u16s()
+		case extECPointFormats:
+			ch.PointFormats = append([]uint8(nil), body.vector(1).b...)
+		case extSignatureAlgorithms:
+			ch.SignatureAlgorithms = body.vector(2).u16s()
+		case extALPN:
+			protos := body.vector(2)
+			for len(protos.b) > 0 && !protos.bad {
+				if p := protos.vector(1); !p.bad {
+					ch.ALPN = append(ch.ALPN, string(p.b))
+				}
+			}
+		case extSupportedVersions:
+			ch.SupportedVersions = body.vector(1).u16s()
+		}
+	}
+	if exts.bad || r.bad {
+		return nil, errMalformed
+	}
+	return ch, nil
+}
+
+// isGREASE reports whether v is one of RFC 8701's reserved values, which
+// clients insert at random and fingerprints must ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vs []uint16) []uint16 {
+	out := make([]uint16, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal[T uint8 | uint16](vs []T) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+// JA3 returns the JA3 string "version,ciphers,extensions,curves,formats"
+// and its MD5 (see https://github.com/salesforce/ja3).
+func (ch *ClientHello) JA3() (string, string) {
+	s := strings.Join([]string{
+		strconv.Itoa(int(ch.Version)),
+		joinDecimal(withoutGREASE(ch.CipherSuites)),
+		joinDecimal(withoutGREASE(ch.Extensions)),
+		joinDecimal(withoutGREASE(ch.Curves)),
+		joinDecimal(ch.PointFormats),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a hello received over TCP (see
+// https://github.com/FoxIO-LLC/ja4).
+func (ch *ClientHello) JA4() string {
+	version := ch.Version
+	for _, v := range withoutGREASE(ch.SupportedVersions) {
+		version = max(version, v)
+	}
+	sni := "i"
+	if ch.ServerName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(ch.CipherSuites)
+	exts := withoutGREASE(ch.Extensions)
+
+	var hashed []uint16
+	for _, e := range exts {
+		if e != extServerName && e != extALPN {
+			hashed = append(hashed, e)
+		}
+	}
+	extPart := joinHex(sorted(hashed))
+	if sigs := withoutGREASE(ch.SignatureAlgorithms); len(sigs) > 0 && len(hashed) > 0 {
+		extPart += "_" + joinHex(sigs)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), sni, min(len(ciphers), 99), min(len(exts), 99), ja4ALPN(ch.ALPN),
+		truncatedHash(joinHex(sorted(ciphers))), truncatedHash(extPart))
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN is the first and last character of the first ALPN value, or of
+// its hex form when either is not alphanumeric.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(p))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func sorted(vs []uint16) []uint16 {
+	out := append([]uint16(nil), vs...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func joinHex(vs []uint16) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
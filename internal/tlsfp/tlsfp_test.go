@@ -0,0 +1,197 @@
+package tlsfp
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+type ext struct {
+	typ  uint16
+	body []byte
+}
+
+func u16s(vs ...uint16) []byte {
+	b := make([]byte, 0, 2*len(vs))
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+func vec8(b []byte) []byte  { return append([]byte{byte(len(b))}, b...) }
+func vec16(b []byte) []byte { return append(u16s(uint16(len(b))), b...) }
+
+func sni(name string) ext {
+	return ext{extServerName, vec16(append([]byte{0}, vec16([]byte(name))...))}
+}
+
+func alpn(protos ...string) ext {
+	var b []byte
+	for _, p := range protos {
+		b = append(b, vec8([]byte(p))...)
+	}
+	return ext{extALPN, vec16(b)}
+}
+
+// handshake encodes a ClientHello handshake message.
+func handshake(version uint16, ciphers []uint16, exts []ext) []byte {
+	body := u16s(version)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, vec8(make([]byte, 32))...)
+	body = append(body, vec16(u16s(ciphers...))...)
+	body = append(body, vec8([]byte{0})...)
+	var eb []byte
+	for _, e := range exts {
+		eb = append(eb, u16s(e.typ)...)
+		eb = append(eb, vec16(e.body)...)
+	}
+	body = append(body, vec16(eb)...)
+	n := len(body)
+	return append([]byte{typeClientHello, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+// record wraps part of a handshake message in a TLS record.
+func record(msg []byte) []byte {
+	return append([]byte{recordHandshake, 3, 1}, vec16(msg)...)
+}
+
+// chrome is a ClientHello laid out like Chrome's, with GREASE values in the
+// cipher suites, extensions, groups and supported versions. Its fields are
+// those of the example in the JA4 specification.
+func chrome() []byte {
+	return handshake(0x0303,
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]ext{
+			{0x0a0a, nil},
+			sni("example.com"),
+			{0x0017, nil},
+			{0xff01, []byte{0}},
+			{extSupportedGroups, vec16(u16s(0x2a2a, 0x001d, 0x0017, 0x0018))},
+			{extECPointFormats, vec8([]byte{0})},
+			{0x0023, nil},
+			alpn("h2", "http/1.1"),
+			{0x0005, []byte{1, 0, 0, 0, 0}},
+			{extSignatureAlgorithms, vec16(u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))},
+			{0x0012, nil},
+			{0x0033, vec16(nil)},
+			{0x002d, vec8([]byte{1})},
+			{extSupportedVersions, vec8(u16s(0x3a3a, 0x0304, 0x0303))},
+			{0x001b, []byte{2, 0, 2}},
+			{0x4469, []byte{0, 3, 2, 'h', '2'}},
+			{0x0015, make([]byte, 16)},
+			{0x1a1a, []byte{0}},
+		})
+}
+
+func TestParse(t *testing.T) {
+	ch, err := Parse(record(chrome()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.ServerName != "example.com" {
+		t.Errorf("ServerName = %q", ch.ServerName)
+	}
+	if !slices.Equal(ch.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("ALPN = %q", ch.ALPN)
+	}
+	// The hello itself keeps the GREASE values; only fingerprints drop them.
+	if len(ch.CipherSuites) != 16 || ch.CipherSuites[0] != 0x0a0a {
+		t.Errorf("CipherSuites = %04x", ch.CipherSuites)
+	}
+	if len(ch.Extensions) != 18 || ch.Extensions[17] != 0x1a1a {
+		t.Errorf("Extensions = %04x", ch.Extensions)
+	}
+	if !slices.Equal(ch.SupportedVersions, []uint16{0x3a3a, 0x0304, 0x0303}) {
+		t.Errorf("SupportedVersions = %04x", ch.SupportedVersions)
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	msg := chrome()
+	// A hello split over two records, arriving a byte at a time.
+	stream := append(record(msg[:100]), record(msg[100:])...)
+	for n := range len(stream) {
+		if _, err := Parse(stream[:n]); !errors.Is(err, ErrIncomplete) {
+			t.Fatalf("Parse of %d bytes = %v, want ErrIncomplete", n, err)
+		}
+	}
+	ch, err := Parse(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.ServerName != "example.com" {
+		t.Errorf("ServerName = %q", ch.ServerName)
+	}
+
+	if _, err := Parse([]byte{23, 3, 3, 0, 1, 0}); err == nil {
+		t.Error("application data parsed as a hello")
+	}
+}
+
+func TestJA3(t *testing.T) {
+	// The example in the JA3 README.
+	msg := handshake(0x0301,
+		[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		[]ext{
+			sni("example.com"),
+			{extSupportedGroups, vec16(u16s(23, 24, 25))},
+			{extECPointFormats, vec8([]byte{0})},
+		})
+	ch, err := Parse(record(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, hash := ch.JA3()
+	if want := "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"; s != want {
+		t.Errorf("JA3 = %s, want %s", s, want)
+	}
+	if want := "ada70206e40642a3e4461f35503241d5"; hash != want {
+		t.Errorf("JA3 hash = %s, want %s", hash, want)
+	}
+
+	ch, err = Parse(record(chrome()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ = ch.JA3()
+	if want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"; s != want {
+		t.Errorf("JA3 with GREASE = %s, want %s", s, want)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	ch, err := Parse(record(chrome()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The example in the JA4 specification.
+	if got, want := ch.JA4(), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("JA4 = %s, want %s", got, want)
+	}
+
+	// Without SNI and ALPN, on TLS 1.2.
+	ch.ServerName, ch.ALPN, ch.SupportedVersions = "", nil, nil
+	if got, want := ch.JA4()[:10], "t12i151600"; got != want {
+		t.Errorf("JA4 prefix = %s, want %s", got, want)
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := []struct {
+		alpn []string
+		want string
+	}{
+		{nil, "00"},
+		{[]string{"h2"}, "h2"},
+		{[]string{"http/1.1", "h2"}, "h1"},
+		{[]string{"h3"}, "h3"},
+		{[]string{"\xabx\xcd"}, "ad"},
+	}
+	for _, tt := range tests {
+		if got := ja4ALPN(tt.alpn); got != tt.want {
+			t.Errorf("ja4ALPN(%q) = %s, want %s", tt.alpn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"sync"
+
+	"zecx-deploy/internal/config"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxTracked bounds the per-address state so a scan from many addresses cannot exhaust memory.
+const maxTracked = 65536
+
+// Decision is the outcome of a login attempt and the rule that produced it.
+type Decision struct {
+	Accept bool
+	Reason string
+}
+
+// Policy decides which attacker logins succeed. It is safe for concurrent use.
+type Policy struct {
+	cfg     config.SSHAuth
+	pattern *regexp.Regexp
+	pairs   map[config.Credential]bool
+	users   map[string]bool
+	pwds    map[string]bool
+	keys    map[string]bool // SHA256 fingerprints
+	random  func() float64
+
+	mu       sync.Mutex
+	failures map[string]int
+	accepted map[string]map[string]string // source address -> username -> password
+}
+
+// NewPolicy compiles cfg into a policy.
+func NewPolicy(cfg config.SSHAuth) (*Policy, error) {
+	p := &Policy{
+		cfg:      cfg,
+		pairs:    make(map[config.Credential]bool),
+		users:    make(map[string]bool),
+		pwds:     make(map[string]bool),
+		keys:     make(map[string]bool),
+		random:   rand.Float64,
+		failures: make(map[string]int),
+		accepted: make(map[string]map[string]string),
+	}
+	if cfg.Pattern != "" {
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth pattern: %w", err)
+		}
+		p.pattern = re
+	}
+	for _, c := range cfg.Credentials {
+		p.pairs[c] = true
+	}
+	for _, u := range cfg.Usernames {
+		p.users[u] = true
+	}
+	for _, pw := range cfg.Passwords {
+		p.pwds[pw] = true
+	}
+	for _, k := range cfg.PublicKeys {
+		if strings.HasPrefix(k, "SHA256:") {
+			p.keys[k] = true
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %q: %w", k, err)
+		}
+		p.keys[ssh.FingerprintSHA256(key)] = true
+	}
+	return p, nil
+}
+
+// CheckKey evaluates an offered public key by its SHA256 fingerprint. Only configured keys are
+// accepted; refused offers do not count towards accept_after, since clients
+// try their keys before falling back to passwords.
+func (p *Policy) CheckKey(fingerprint string) Decision {
+	if p.keys[fingerprint] {
+		return Decision{Accept: true, Reason: "public_key"}
+	}
+	return Decision{}
+}
+
+// Check evaluates a password attempt from the source address addr (an IP, without port).
+func (p *Policy) Check(addr, user, password string) Decision {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if known, ok := p.accepted[addr][user]; ok {
+		// A real server has one password per account: stay consistent with
+		// what this address already logged in with.
+		if known == password {
+			return Decision{Accept: true, Reason: "returning"}
+		}
+		return p.fail(addr, "password changed")
+	}
+
+	var reason string
+	switch {
+	case p.pairs[config.Credential{Username: user, Password: password}]:
+		reason = "credential"
+	case p.users[user]:
+		reason = "username"
+	case p.pwds[password]:
+		reason = "password"
+	case p.pattern != nil && p.pattern.MatchString(user+":"+password):
+		reason = "pattern"
+	case p.cfg.AcceptAfter > 0 && p.failures[addr] >= p.cfg.AcceptAfter:
+		reason = "accept_after"
+	case p.cfg.Probability > 0 && p.random() < p.cfg.Probability:
+		reason = "probability"
+	default:
+		return p.fail(addr, "")
+	}
+
+	if len(p.accepted) >= maxTracked {
+		p.accepted = make(map[string]map[string]string)
+	}
+	if p.accepted[addr] == nil {
+		p.accepted[addr] = make(map[string]string)
+	}
+	p.accepted[addr][user] = password
+	delete(p.failures, addr)
+	return Decision{Accept: true, Reason: reason}
+}
+
+func (p *Policy) fail(addr, reason string) Decision {
+	if len(p.failures) >= maxTracked {
+		p.failures = make(map[string]int)
+	}
+	p.failures[addr]++
+	return Decision{Reason: reason}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"zecx-deploy/internal/config"
+)
+
+func newTestPolicy(t *testing.T, cfg config.SSHAuth) *Policy {
+	t.Helper()
+	p, err := NewPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.random = func() float64 { return 1 }
+	return p
+}
+
+func TestAcceptAfter(t *testing.T) {
+	p := newTestPolicy(t, config.SSHAuth{AcceptAfter: 3})
+	for i := 1; i <= 3; i++ {
+		if d := p.Check("192.0.2.1", "root", "guess"); d.Accept {
+			t.Fatalf("attempt %d accepted", i)
+		}
+	}
+	// Another address has its own count.
+	if d := p.Check("192.0.2.2", "root", "guess"); d.Accept {
+		t.Error("first attempt from another address accepted")
+	}
+	if d := p.Check("192.0.2.1", "root", "guess"); !d.Accept || d.Reason != "accept_after" {
+		t.Errorf("attempt after 3 failures = %+v", d)
+	}
+}
+
+func TestAcceptAfterDisabled(t *testing.T) {
+	p := newTestPolicy(t, config.SSHAuth{})
+	for i := 1; i <= 10; i++ {
+		if d := p.Check("192.0.2.1", "root", "guess"); d.Accept {
+			t.Fatalf("attempt %d accepted with no rules", i)
+		}
+	}
+}
+
+func TestStickyCredentials(t *testing.T) {
+	p := newTestPolicy(t, config.SSHAuth{AcceptAfter: 1, Passwords: []string{"123456"}})
+	if d := p.Check("192.0.2.1", "root", "admin"); d.Accept {
+		t.Fatal("first attempt accepted")
+	}
+	if d := p.Check("192.0.2.1", "root", "toor"); !d.Accept {
+		t.Fatalf("second attempt = %+v", d)
+	}
+
+	// The account now has the password it was let in with, whatever the
+	// rules would otherwise say: a configured password and further failures
+	// do not open it again.
+	for _, pw := range []string{"123456", "admin", "admin"} {
+		if d := p.Check("192.0.2.1", "root", pw); d.Accept || d.Reason != "password changed" {
+			t.Errorf("root/%s = %+v", pw, d)
+		}
+	}
+	if d := p.Check("192.0.2.1", "root", "toor"); !d.Accept || d.Reason != "returning" {
+		t.Errorf("returning login = %+v", d)
+	}
+
+	// Other accounts and other addresses are decided afresh.
+	if d := p.Check("192.0.2.1", "admin", "123456"); !d.Accept || d.Reason != "password" {
+		t.Errorf("admin from the same address = %+v", d)
+	}
+	if d := p.Check("192.0.2.2", "root", "123456"); !d.Accept || d.Reason != "password" {
+		t.Errorf("root from another address = %+v", d)
+	}
+}
+
+func TestRules(t *testing.T) {
+	p := newTestPolicy(t, config.SSHAuth{
+		Credentials: []config.Credential{{Username: "pi", Password: "raspberry"}},
+		Usernames:   []string{"oracle"},
+		Pattern:     `^admin:admin\d+$`,
+	})
+	tests := []struct {
+		user, password string
+		reason         string // empty when refused
+	}{
+		{"pi", "raspberry", "credential"},
+		{"pi", "wrong", ""},
+		{"oracle", "anything", "username"},
+		{"admin", "admin123", "pattern"},
+		{"admin", "admin", ""},
+	}
+	for i, tt := range tests {
+		// A fresh address per attempt keeps earlier logins from sticking.
+		addr := fmt.Sprintf("198.51.100.%d", i+1)
+		d := p.Check(addr, tt.user, tt.password)
+		if d.Accept != (tt.reason != "") || (d.Accept && d.Reason != tt.reason) {
+			t.Errorf("%s/%s = %+v, want %q", tt.user, tt.password, d, tt.reason)
+		}
+	}
+}
+
+func TestProbability(t *testing.T) {
+	p := newTestPolicy(t, config.SSHAuth{Probability: 0.5})
+	p.random = func() float64 { return 0.7 }
+	if d := p.Check("192.0.2.1", "root", "a"); d.Accept {
+		t.Errorf("accepted above the probability: %+v", d)
+	}
+	p.random = func() float64 { return 0.2 }
+	if d := p.Check("192.0.2.1", "root", "b"); !d.Accept || d.Reason != "probability" {
+		t.Errorf("attempt below the probability = %+v", d)
+	}
+}
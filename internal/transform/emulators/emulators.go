@@ -1,34 +1,48 @@
 package emulators
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
-	"os"
+	"time"
 
-	"golang.org/x/crypto/ssh"
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/signatures"
+	"zecx-deploy/internal/transform/emulators/persona"
 )
 
 var serverStopCh = make(chan struct{})
 
-// Start launches the high-interaction service emulators as concurrent goroutines.
-func Start() error {
+// Start launches the high-interaction service emulators as concurrent goroutines
+// and returns once they have been launched.
+func Start(cfg *config.Config) error {
 	log.Println("Starting service emulators...")
 
-	go startSSHEmulator("0.0.0.0:2222")
-	go startHTTPEmulator("0.0.0.0:8080")
-	go startFTPEmulator("0.0.0.0:2121")
+	host := persona.New(cfg.Persona)
+	fsys := newDecoyFS(host)
 
-	fmt.Println("Service emulators started.")
+	// Uploads over every protocol share one store and its size budget.
+	samples, err := quarantine.Open(quarantine.Dir(cfg.StateDir), cfg.Quarantine.MaxFileSizeMB<<20, cfg.Quarantine.MaxTotalSizeMB<<20)
+	if err != nil {
+		log.Printf("Uploads will not be kept: %v", err)
+		samples = nil
+	}
+	rules, err := signatures.Load(cfg.Signatures.RulesFile)
+	if err != nil {
+		return fmt.Errorf("failed to load signatures: %w", err)
+	}
+	log.Printf("Loaded %d exploit signatures", rules.Len())
+
+	go startSSHEmulator("0.0.0.0:2222", cfg, host, fsys, samples)
+	go startHTTPEmulator("0.0.0.0:8080", cfg, host, samples, rules)
+	go startHTTPSEmulator("0.0.0.0:8443", cfg, host, samples, rules)
+	go startFTPEmulator("0.0.0.0:2121", cfg, host, fsys, samples)
+	go startSMBEmulator("0.0.0.0:4445", cfg, host, fsys)
 
-	// Wait for a stop signal
-	<-serverStopCh
+	fmt.Println("Service emulators started.")
 	return nil
 }
 
@@ -39,144 +53,44 @@ func Stop() error {
 	return nil
 }
 
-// --- SSH Emulator ---
-func startSSHEmulator(addr string) {
-	config := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			log.Printf("[SSH] Login attempt: user=%s, pass=%s from %s", c.User(), string(pass), c.RemoteAddr())
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
-	}
-
-	privateBytes, err := os.ReadFile("id_rsa_honeypot")
-	if err != nil {
-		// For simplicity, we generate a new key if one doesn't exist.
-		// In a real scenario, you'd have a persistent, pre-generated key.
-		private, err := ssh.ParsePrivateKey(generatePrivateKey())
-		if err != nil {
-			log.Fatalf("[SSH] Failed to parse private key: %v", err)
-		}
-		config.AddHostKey(private)
-	} else {
-		private, err := ssh.ParsePrivateKey(privateBytes)
-		if err != nil {
-			log.Fatalf("[SSH] Failed to parse private key file: %v", err)
-		}
-		config.AddHostKey(private)
-	}
-
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("[SSH] Failed to listen on %s: %v", addr, err)
-	}
-	log.Printf("[SSH] Listening on %s", addr)
+// defaultSessionBudget applies when quarantine.max_session_size_mb is 0.
+const defaultSessionBudget = 256 << 20
 
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("[SSH] Failed to accept incoming connection: %v", err)
-			continue
-		}
-		go handleSSHConnection(nConn, config)
+// sessionBudget returns how many bytes one session may add to its copy of
+// the decoy filesystem.
+func sessionBudget(cfg *config.Config) int64 {
+	if mb := cfg.Quarantine.MaxSessionSizeMB; mb > 0 {
+		return mb << 20
 	}
+	return defaultSessionBudget
 }
 
-func handleSSHConnection(nConn net.Conn, config *ssh.ServerConfig) {
-	_, chans, reqs, err := ssh.NewServerConn(nConn, config)
-	if err != nil {
-		log.Printf("[SSH] Failed to handshake (%s)", err)
-		return
-	}
-	log.Printf("[SSH] New SSH connection from %s (%s)", nConn.RemoteAddr(), "version_here")
-
-	go ssh.DiscardRequests(reqs)
-
-	for newChannel := range chans {
-		if newChannel.ChannelType() != "session" {
-			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			continue
-		}
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			log.Printf("[SSH] Could not accept channel: %v", err)
-			continue
-		}
-
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				// We are not implementing a full shell, just logging requests.
-				log.Printf("[SSH] Request type: %s, Payload: %s", req.Type, string(req.Payload))
-				if req.WantReply {
-					req.Reply(false, nil)
-				}
-			}
-		}(requests)
-
-		// A very basic "shell"
-		channel.Write([]byte("Welcome to the honeypot.\r\n$ "))
-		io.Copy(io.Discard, channel) // Read and discard all input
-	}
-}
-
-func generatePrivateKey() []byte {
-	// Generate a 2048-bit RSA key at runtime and return it in PEM format.
-	// This avoids embedding a static private key in the repo while still
-	// providing a valid key for the SSH emulator during testing.
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatalf("[SSH] Failed to generate private key: %v", err)
-	}
-	privDER := x509.MarshalPKCS1PrivateKey(priv)
-	pemBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privDER,
-	}
-	return pem.EncodeToMemory(pemBlock)
+// publishClosed emits the ConnectionClosed event for sess.
+func publishClosed(sess *events.Session) {
+	events.Publish(&events.ConnectionClosed{Meta: sess.Meta(), Duration: time.Since(sess.Started)})
 }
 
-// --- HTTP Emulator ---
-func startHTTPEmulator(addr string) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HTTP] Request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.String())
-		// Serve a fake "404 Not Found" page to most requests
-		http.NotFound(w, r)
-	})
-	log.Printf("[HTTP] Listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Printf("[HTTP] Server error: %v", err)
+// recordUpload quarantines a file uploaded in a session and publishes the
+// transfer. label is the protocol's log prefix and via how the file came in.
+func recordUpload(samples *quarantine.Store, meta events.Meta, label, via, p string, data []byte, truncated bool) {
+	ev := &events.FileTransfer{
+		Meta:      meta,
+		Direction: "upload",
+		Path:      p,
+		Size:      int64(len(data)),
+		Via:       via,
+		Truncated: truncated,
 	}
-}
-
-// --- FTP Emulator (Basic Listener) ---
-func startFTPEmulator(addr string) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("[FTP] Failed to listen on %s: %v", addr, err)
-	}
-	log.Printf("[FTP] Listening on %s", addr)
-	for {
-		conn, err := listener.Accept()
+	if samples != nil {
+		res, err := samples.Save(data)
 		if err != nil {
-			continue
-		}
-		go handleFTPConnection(conn)
-	}
-}
-
-func handleFTPConnection(conn net.Conn) {
-	defer conn.Close()
-	log.Printf("[FTP] Connection from %s", conn.RemoteAddr())
-	conn.Write([]byte("220 ProFTPD 1.3.5a Server (Debian) [::ffff:127.0.0.1]\r\n"))
-	buf := make([]byte, 1024)
-	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			return
-		}
-		log.Printf("[FTP] Received from %s: %s", conn.RemoteAddr(), string(buf[:n]))
-		// Simple canned responses
-		if n > 0 {
-			conn.Write([]byte("530 Please login with USER and PASS.\r\n"))
+			log.Printf("[%s] Could not quarantine %s from %s: %v", label, p, meta.Src, err)
 		}
+		ev.SHA256 = res.SHA256
+	} else {
+		sum := sha256.Sum256(data)
+		ev.SHA256 = hex.EncodeToString(sum[:])
 	}
+	log.Printf("[%s] %s upload from %s: %s (%d bytes, sha256 %s)", label, via, meta.Src, p, ev.Size, ev.SHA256)
+	events.Publish(ev)
 }
@@ -0,0 +1,170 @@
+package emulators
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/transform/decoys"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// skeletonDirs are present on every Ubuntu server and make the tree look lived-in.
+var skeletonDirs = []string{
+	"/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64", "/media", "/mnt",
+	"/opt", "/proc", "/root", "/run", "/sbin", "/srv", "/sys", "/tmp", "/usr/bin",
+	"/usr/lib", "/usr/local/bin", "/usr/sbin", "/usr/share", "/var/backups",
+	"/var/cache", "/var/lib", "/var/log", "/var/mail", "/var/spool/cron", "/var/tmp",
+}
+
+const passwdFile = `root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+bin:x:2:2:bin:/bin:/usr/sbin/nologin
+sys:x:3:3:sys:/dev:/usr/sbin/nologin
+sync:x:4:65534:sync:/bin:/bin/sync
+www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+systemd-network:x:100:102:systemd Network Management,,,:/run/systemd:/usr/sbin/nologin
+systemd-resolve:x:101:103:systemd Resolver,,,:/run/systemd:/usr/sbin/nologin
+messagebus:x:102:105::/nonexistent:/usr/sbin/nologin
+syslog:x:104:111::/home/syslog:/usr/sbin/nologin
+sshd:x:106:65534::/run/sshd:/usr/sbin/nologin
+mysql:x:112:118:MySQL Server,,,:/nonexistent:/bin/false
+alice:x:1000:1000:Alice,,,:/home/alice:/bin/bash
+bob:x:1001:1001:Bob,,,:/home/bob:/bin/bash
+charlie:x:1002:1002:Charlie,,,:/home/charlie:/bin/zsh
+`
+
+// newDecoyFS builds the virtual filesystem shared as a template by all
+// sessions: a standard Linux skeleton plus the decoy tree that decoys.Seed
+// writes to the real disk.
+func newDecoyFS(p *persona.Persona) *vfs.FS {
+	hostname := p.Hostname
+	fsys := vfs.New()
+	for _, d := range skeletonDirs {
+		fsys.MkdirAll(d, 0755, "root")
+	}
+	fsys.Chmod("/root", 0700)
+	fsys.Chmod("/tmp", 0777)
+	fsys.Chmod("/var/tmp", 0777)
+
+	files := map[string]string{
+		"/etc/passwd":     passwdFile,
+		"/etc/hostname":   hostname + "\n",
+		"/etc/hosts":      fmt.Sprintf("127.0.0.1 localhost\n127.0.1.1 %s\n\n::1     ip6-localhost ip6-loopback\n", hostname),
+		"/etc/issue":      persona.Distro + " \\n \\l\n\n",
+		"/etc/os-release": osRelease,
+		"/etc/shells":     "# /etc/shells: valid login shells\n/bin/sh\n/bin/bash\n/usr/bin/bash\n/bin/zsh\n",
+		"/root/.bashrc":   bashrc,
+		"/root/.profile":  "if [ -f ~/.bashrc ]; then\n  . ~/.bashrc\nfi\n",
+		// What the daily cron job leaves behind, plus a dump someone forgot.
+		"/var/backups/passwd.bak":    passwdFile,
+		"/var/backups/group.bak":     "root:x:0:\nadm:x:4:syslog,alice\nsudo:x:27:alice,bob\nwww-data:x:33:\n",
+		"/var/backups/wordpress.sql": wordpressDump,
+	}
+	for name, content := range files {
+		fsys.WriteFile(name, []byte(content), 0644, "root")
+	}
+	writeProcFiles(fsys, p)
+
+	for _, e := range decoys.Entries() {
+		owner := ownerOf(e.Path)
+		if e.IsDir {
+			fsys.MkdirAll(e.Path, 0755, owner)
+			continue
+		}
+		mode := fs.FileMode(0644)
+		if strings.Contains(e.Path, "/.ssh/") || strings.Contains(e.Path, "/.aws/") || strings.HasSuffix(e.Path, "history") {
+			mode = 0600
+		}
+		fsys.WriteFile(e.Path, []byte(e.Content), mode, owner)
+	}
+	fsys.Chmod("/var/backups/passwd.bak", 0600)
+	fsys.Chmod("/var/backups/group.bak", 0600)
+	fsys.Chmod("/root/.ssh", 0700)
+	fsys.Chmod("/root/.aws", 0700)
+
+	t := time.Now().AddDate(0, -3, -11)
+	if root, err := fsys.Stat("/"); err == nil {
+		root.ModTime = t
+	}
+	backdate(fsys, "/", t)
+	return fsys
+}
+
+// writeProcFiles refreshes the /proc files that describe the persona, so that
+// values such as the uptime are current when a session starts.
+func writeProcFiles(fsys *vfs.FS, p *persona.Persona) {
+	for name, content := range p.ProcFiles(time.Now()) {
+		fsys.WriteFile(name, []byte(content), 0444, "root")
+	}
+}
+
+// ownerOf guesses the owner of a decoy path from the home directory it lives in.
+func ownerOf(p string) string {
+	if rest, ok := strings.CutPrefix(p, "/home/"); ok {
+		return strings.SplitN(rest, "/", 2)[0]
+	}
+	return "root"
+}
+
+// backdate gives every node a modification time well in the past so that
+// freshly created decoys do not stand out in ls -l.
+func backdate(fsys *vfs.FS, dir string, t time.Time) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for i, e := range entries {
+		e.ModTime = t.Add(time.Duration(i*37) * time.Minute)
+		if e.IsDir() {
+			backdate(fsys, vfs.Clean(dir, e.Name), t)
+		}
+	}
+}
+
+const osRelease = `PRETTY_NAME="Ubuntu 22.04.3 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+VERSION="22.04.3 LTS (Jammy Jellyfish)"
+VERSION_CODENAME=jammy
+ID=ubuntu
+ID_LIKE=debian
+HOME_URL="https://www.ubuntu.com/"
+SUPPORT_URL="https://help.ubuntu.com/"
+BUG_REPORT_URL="https://bugs.launchpad.net/ubuntu/"
+PRIVACY_POLICY_URL="https://www.ubuntu.com/legal/terms-and-policies/privacy-policy"
+UBUNTU_CODENAME=jammy
+`
+
+const bashrc = `# ~/.bashrc: executed by bash(1) for non-login shells.
+[ -z "$PS1" ] && return
+HISTCONTROL=ignoredups:ignorespace
+HISTSIZE=1000
+HISTFILESIZE=2000
+alias ll='ls -alF'
+alias la='ls -A'
+`
+
+const wordpressDump = `-- MySQL dump 10.13  Distrib 8.0.35, for Linux (x86_64)
+--
+-- Host: localhost    Database: wordpress
+-- ------------------------------------------------------
+-- Server version	8.0.35-0ubuntu0.22.04.1
+
+DROP TABLE IF EXISTS wp_users;
+CREATE TABLE wp_users (
+  ID bigint unsigned NOT NULL AUTO_INCREMENT,
+  user_login varchar(60) NOT NULL DEFAULT '',
+  user_pass varchar(255) NOT NULL DEFAULT '',
+  user_email varchar(100) NOT NULL DEFAULT '',
+  PRIMARY KEY (ID)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+LOCK TABLES wp_users WRITE;
+INSERT INTO wp_users VALUES (1,'admin','$P$BZlPX7NIx8MYpXokBW2AGsN7i.aUOt0','alice@example.com'),(2,'bob','$P$B4ZnTdFzLcZMCDx0qHxLjEvwYbPRbH/','bob@example.com');
+UNLOCK TABLES;
+-- Dump completed on 2023-09-02  3:14:07
+`
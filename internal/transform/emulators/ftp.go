@@ -0,0 +1,877 @@
+package emulators
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/tlscert"
+	"zecx-deploy/internal/tlsfp"
+	"zecx-deploy/internal/transform/emulators/auth"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/sftp"
+	"zecx-deploy/internal/transform/emulators/shell"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// --- FTP Emulator ---
+
+const (
+	ftpIdleTimeout      = 5 * time.Minute
+	ftpDataTimeout      = 30 * time.Second
+	ftpMaxLine          = 4096
+	ftpMaxLoginAttempts = 3 // ProFTPD's MaxLoginAttempts default
+)
+
+// ftpServer holds the state shared by all FTP connections.
+type ftpServer struct {
+	banner    string
+	anonymous bool
+	auth      *auth.Policy
+	fs        *vfs.FS // template; every session works on its own clone
+
+	samples   *quarantine.Store // nil when the quarantine could not be opened
+	maxUpload int64             // bytes of one upload kept, 0 for no limit
+	budget    int64             // bytes a session may add to its filesystem
+	passiveIP net.IP            // advertised by PASV; nil uses the control connection's address
+	tls       *tls.Config       // nil when AUTH TLS is not offered
+}
+
+func startFTPEmulator(addr string, cfg *config.Config, host *persona.Persona, fsys *vfs.FS, samples *quarantine.Store) {
+	policy, err := auth.NewPolicy(cfg.FTP.Auth)
+	if err != nil {
+		log.Fatalf("[FTP] Invalid authentication policy: %v", err)
+	}
+	srv := &ftpServer{
+		banner:    cfg.FTP.Banner,
+		anonymous: cfg.FTP.Anonymous,
+		auth:      policy,
+		fs:        fsys,
+		samples:   samples,
+		maxUpload: cfg.Quarantine.MaxFileSizeMB << 20,
+		budget:    sessionBudget(cfg),
+	}
+	if a := cfg.FTP.PassiveAddress; a != "" {
+		if srv.passiveIP = net.ParseIP(a).To4(); srv.passiveIP == nil {
+			log.Fatalf("[FTP] Invalid passive address %q", a)
+		}
+	}
+	if cfg.FTP.TLS {
+		cert, err := tlscert.Load(tlscert.Dir(cfg.StateDir), host.Hostname)
+		if err != nil {
+			log.Printf("[FTP] AUTH TLS will not be offered: %v", err)
+		} else {
+			// ProFTPD of this vintage still negotiates TLS 1.0, and so do many scanners.
+			srv.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS10}
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[FTP] Failed to listen on %s: %v", addr, err)
+	}
+	log.Printf("[FTP] Listening on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// ftpSession is one control connection and the state its commands build up.
+type ftpSession struct {
+	srv  *ftpServer
+	conn net.Conn
+	r    *bufio.Reader
+	sess *events.Session
+	fs   *vfs.FS
+
+	user     string // from USER; logged in once loggedIn is set
+	loggedIn bool
+	anon     bool
+	failures int
+	cwd      string
+	secure   bool // control connection upgraded by AUTH TLS
+	protect  bool // PROT P: data connections use TLS too
+
+	restart    int64        // REST offset for the next RETR
+	renameFrom string       // RNFR path awaiting RNTO
+	copyFrom   string       // SITE CPFR path awaiting SITE CPTO
+	passive    net.Listener // set by PASV/EPSV until the next transfer
+	active     string       // address set by PORT/EPRT until the next transfer
+}
+
+func (srv *ftpServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	s := &ftpSession{
+		srv:  srv,
+		conn: conn,
+		r:    bufio.NewReaderSize(conn, ftpMaxLine),
+		sess: events.NewSession("ftp", conn.LocalAddr(), conn.RemoteAddr()),
+		fs:   srv.fs.Clone(),
+		cwd:  "/",
+	}
+	s.fs.SetBudget(srv.budget)
+	events.Publish(&events.ConnectionOpened{Meta: s.sess.Meta()})
+	defer publishClosed(s.sess)
+	defer s.resetData()
+
+	s.reply(220, srv.banner)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := s.readLine()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.reply(421, fmt.Sprintf("Idle timeout (%d seconds): closing control connection", int(ftpIdleTimeout.Seconds())))
+			}
+			return
+		}
+		if line == "" {
+			continue
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		events.Publish(&events.FTPCommand{Meta: s.sess.Meta(), Command: verb, Argument: arg})
+		if !s.handle(verb, arg) {
+			return
+		}
+	}
+}
+
+// readLine reads one command line. Overlong lines, a common overflow probe,
+// are cut to the buffer size and the rest is discarded.
+func (s *ftpSession) readLine() (string, error) {
+	b, err := s.r.ReadSlice('\n')
+	line := string(b)
+	for errors.Is(err, bufio.ErrBufferFull) {
+		_, err = s.r.ReadSlice('\n')
+	}
+	if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+		return "", err
+	}
+	// ABOR is preceded by Telnet IP and Synch sequences.
+	line = strings.TrimLeft(line, "\xff\xf4\xf2")
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (s *ftpSession) reply(code int, text string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, text)
+}
+
+// replyLines sends a multi-line reply; the last line carries the final code.
+func (s *ftpSession) replyLines(code int, lines ...string) {
+	var b strings.Builder
+	for i, l := range lines {
+		switch {
+		case i == len(lines)-1:
+			fmt.Fprintf(&b, "%d %s\r\n", code, l)
+		case i == 0:
+			fmt.Fprintf(&b, "%d-%s\r\n", code, l)
+		default:
+			fmt.Fprintf(&b, " %s\r\n", l)
+		}
+	}
+	io.WriteString(s.conn, b.String())
+}
+
+// ftpPreLogin are the commands answered before a successful login.
+var ftpPreLogin = map[string]bool{
+	"USER": true, "PASS": true, "QUIT": true, "FEAT": true, "NOOP": true,
+	"HELP": true, "AUTH": true, "OPTS": true, "SYST": true, "SITE": true,
+	"PBSZ": true, "PROT": true,
+}
+
+// features is the FEAT reply, which lists the TLS commands only when they work.
+func (s *ftpSession) features() []string {
+	feat := []string{"Features:"}
+	if s.srv.tls != nil {
+		feat = append(feat, "AUTH TLS")
+	}
+	feat = append(feat, "EPRT", "EPSV", "MDTM", "PASV")
+	if s.srv.tls != nil {
+		feat = append(feat, "PBSZ", "PROT")
+	}
+	return append(feat, "REST STREAM", "SIZE", "TVFS", "UTF8", "End")
+}
+
+// handle runs one command and reports whether the connection stays open.
+func (s *ftpSession) handle(verb, arg string) bool {
+	if !s.loggedIn && !ftpPreLogin[verb] {
+		s.reply(530, "Please login with USER and PASS")
+		return true
+	}
+	switch verb {
+	case "USER":
+		return s.cmdUser(arg)
+	case "PASS":
+		return s.cmdPass(arg)
+	case "QUIT":
+		s.reply(221, "Goodbye.")
+		return false
+	case "FEAT":
+		s.replyLines(211, s.features()...)
+	case "NOOP":
+		s.reply(200, "NOOP command successful")
+	case "HELP":
+		s.replyLines(214, "The following commands are recognized (* =>'s unimplemented):",
+			"CWD     XCWD    CDUP    XCUP    SMNT*   QUIT    PORT    PASV",
+			"EPRT    EPSV    ALLO    RNFR    RNTO    DELE    MDTM    RMD",
+			"XRMD    MKD     XMKD    PWD     XPWD    SIZE    SYST    HELP",
+			"NOOP    FEAT    OPTS    AUTH*   CCC*    CONF*   ENC*    MIC*",
+			"PBSZ*   PROT*   TYPE    STRU    MODE    RETR    STOR    STOU*",
+			"APPE    REST    ABOR    USER    PASS    ACCT*   REIN*   LIST",
+			"NLST    STAT    SITE    MLSD*   MLST*",
+			"Direct comments to root@localhost")
+	case "AUTH":
+		return s.cmdAuth(arg)
+	case "PBSZ":
+		if !s.secure {
+			s.reply(503, "PBSZ not allowed on insecure control connection")
+			break
+		}
+		s.reply(200, "PBSZ 0 successful")
+	case "PROT":
+		switch {
+		case !s.secure:
+			s.reply(503, "PROT not allowed on insecure control connection")
+		case strings.EqualFold(arg, "P"):
+			s.protect = true
+			s.reply(200, "Protection set to Private")
+		case strings.EqualFold(arg, "C"):
+			s.protect = false
+			s.reply(200, "Protection set to Clear")
+		case strings.EqualFold(arg, "S"), strings.EqualFold(arg, "E"):
+			s.reply(536, "PROT "+arg+" unsupported")
+		default:
+			s.reply(504, "PROT "+arg+" unsupported")
+		}
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			s.reply(200, "UTF8 set to on")
+		} else {
+			s.reply(501, "OPTS: unsupported option '"+arg+"'")
+		}
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+	case "SITE":
+		s.cmdSite(arg)
+	case "PWD", "XPWD":
+		s.reply(257, fmt.Sprintf("%q is the current directory", s.cwd))
+	case "CWD", "XCWD":
+		s.cmdCwd(arg)
+	case "CDUP", "XCUP":
+		s.cmdCwd("..")
+	case "TYPE":
+		switch t := strings.ToUpper(strings.TrimSpace(arg)); t {
+		case "A", "A N", "I", "L 8":
+			s.reply(200, "Type set to "+t[:1])
+		default:
+			s.reply(504, "TYPE not implemented for '"+arg+"' parameter")
+		}
+	case "MODE":
+		if !strings.EqualFold(arg, "S") {
+			s.reply(504, "Unsupported transfer mode")
+			break
+		}
+		s.reply(200, "Mode set to S")
+	case "STRU":
+		if !strings.EqualFold(arg, "F") {
+			s.reply(504, "Unsupported structure type")
+			break
+		}
+		s.reply(200, "Structure set to F")
+	case "ALLO":
+		s.reply(202, "No storage allocation necessary")
+	case "PASV":
+		s.cmdPasv(false)
+	case "EPSV":
+		if strings.EqualFold(arg, "ALL") {
+			s.reply(200, "EPSV ALL command successful")
+			break
+		}
+		s.cmdPasv(true)
+	case "PORT":
+		s.cmdPort(verb, parsePORT(arg))
+	case "EPRT":
+		s.cmdPort(verb, parseEPRT(arg))
+	case "LIST", "NLST":
+		s.cmdList(verb == "NLST", arg)
+	case "RETR":
+		s.cmdRetr(arg)
+	case "STOR", "APPE":
+		s.cmdStor(arg, verb == "APPE")
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			s.reply(501, "REST requires a value greater than or equal to 0")
+			break
+		}
+		s.restart = n
+		s.reply(350, fmt.Sprintf("Restarting at %d. Send STORE or RETRIEVE to initiate transfer", n))
+	case "ABOR":
+		s.resetData()
+		s.reply(226, "Abort successful")
+	case "SIZE", "MDTM":
+		n, err := s.fs.Stat(s.abs(arg))
+		switch {
+		case err != nil:
+			s.reply(550, arg+": "+shell.ErrText(err))
+		case n.IsDir():
+			s.reply(550, arg+": not a regular file")
+		case verb == "SIZE":
+			s.reply(213, strconv.FormatInt(n.Size(), 10))
+		default:
+			s.reply(213, n.ModTime.UTC().Format("20060102150405"))
+		}
+	case "DELE":
+		p := s.abs(arg)
+		if n, err := s.fs.Stat(p); err == nil && n.IsDir() {
+			s.reply(550, arg+": Is a directory")
+		} else if err := s.fs.Remove(p); err != nil {
+			s.reply(550, arg+": "+shell.ErrText(err))
+		} else {
+			s.reply(250, "DELE command successful")
+		}
+	case "MKD", "XMKD":
+		p := s.abs(arg)
+		if _, err := s.fs.Stat(p); err == nil {
+			s.reply(550, arg+": File exists")
+		} else if parent, err := s.fs.Stat(path.Dir(p)); err != nil || !parent.IsDir() {
+			s.reply(550, arg+": No such file or directory")
+		} else {
+			s.fs.MkdirAll(p, 0755, s.owner())
+			s.reply(257, fmt.Sprintf("%q - Directory successfully created", p))
+		}
+	case "RMD", "XRMD":
+		p := s.abs(arg)
+		if n, err := s.fs.Stat(p); err == nil && !n.IsDir() {
+			s.reply(550, arg+": Not a directory")
+		} else if err := s.fs.Remove(p); err != nil {
+			s.reply(550, arg+": "+shell.ErrText(err))
+		} else {
+			s.reply(250, "RMD command successful")
+		}
+	case "RNFR":
+		if _, err := s.fs.Stat(s.abs(arg)); err != nil {
+			s.reply(550, arg+": "+shell.ErrText(err))
+			break
+		}
+		s.renameFrom = s.abs(arg)
+		s.reply(350, "File or directory exists, ready for destination name")
+	case "RNTO":
+		from := s.renameFrom
+		s.renameFrom = ""
+		if from == "" {
+			s.reply(503, "Bad sequence of commands")
+		} else if err := s.fs.Rename(from, s.abs(arg)); err != nil {
+			s.reply(550, "Rename "+arg+": "+shell.ErrText(err))
+		} else {
+			s.reply(250, "Rename successful")
+		}
+	case "STAT":
+		s.replyLines(211, "Status of '"+s.srv.banner+"'",
+			"Connected from "+remoteIP(s.conn.RemoteAddr()),
+			"Logged in as "+s.user,
+			"TYPE: BINARY, STRUcture: File, Mode: Stream",
+			"No data connection",
+			"End of status")
+	default:
+		s.reply(500, verb+" not understood")
+	}
+	return true
+}
+
+// cmdAuth upgrades the control connection to TLS and reports the client's
+// ClientHello. A failed handshake ends the session.
+func (s *ftpSession) cmdAuth(mech string) bool {
+	switch m := strings.ToUpper(mech); {
+	case s.srv.tls == nil:
+		s.reply(500, "AUTH not understood")
+		return true
+	case s.secure:
+		s.reply(503, "TLS session already negotiated")
+		return true
+	case m == "TLS" || m == "TLS-C" || m == "SSL" || m == "TLS-P":
+		s.reply(234, "AUTH "+m+" successful")
+	default:
+		s.reply(504, "AUTH "+mech+" unsupported")
+		return true
+	}
+
+	sniff := tlsfp.NewConn(&bufferedConn{Conn: s.conn, r: s.r})
+	conn := tls.Server(sniff, s.srv.tls)
+	conn.SetDeadline(time.Now().Add(ftpDataTimeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+
+	ev := &events.TLSHandshake{Meta: s.sess.Meta(), TLS: tlsClient(sniff.ClientHello())}
+	if ev.TLS != nil {
+		log.Printf("[FTP] TLS client from %s (ja3 %s, ja4 %s)", s.sess.Src, ev.TLS.JA3, ev.TLS.JA4)
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	events.Publish(ev)
+	if err != nil {
+		return false
+	}
+	s.conn, s.r, s.secure = conn, bufio.NewReaderSize(conn, ftpMaxLine), true
+	return true
+}
+
+func (s *ftpSession) cmdUser(name string) bool {
+	if name == "" {
+		s.reply(500, "USER: command requires a parameter")
+		return true
+	}
+	s.user, s.loggedIn, s.anon = name, false, false
+	if s.srv.anonymous && (name == "anonymous" || name == "ftp") {
+		s.anon = true
+		s.reply(331, "Anonymous login ok, send your complete email address as your password")
+		return true
+	}
+	s.reply(331, "Password required for "+name)
+	return true
+}
+
+// cmdPass completes a login. Anonymous users land in the root of the decoy
+// tree; others in their home directory, as on the SSH side.
+func (s *ftpSession) cmdPass(pass string) bool {
+	if s.user == "" || s.loggedIn {
+		s.reply(503, "Login with USER first")
+		return true
+	}
+	accept := s.anon
+	reason := "anonymous"
+	if !accept {
+		decision := s.srv.auth.Check(remoteIP(s.conn.RemoteAddr()), s.user, pass)
+		accept, reason = decision.Accept, decision.Reason
+	}
+	events.Publish(&events.AuthAttempt{
+		Meta:     s.sess.Meta(),
+		Method:   "password",
+		Username: s.user,
+		Password: pass,
+		Success:  accept,
+	})
+	if !accept {
+		s.user = ""
+		s.failures++
+		s.reply(530, "Login incorrect.")
+		return s.failures < ftpMaxLoginAttempts
+	}
+	log.Printf("[FTP] Accepted login for %s from %s (%s)", s.user, s.sess.Src, reason)
+	s.loggedIn = true
+	if s.anon {
+		s.reply(230, "Anonymous access granted, restrictions apply")
+		return true
+	}
+	s.cwd = shell.HomeDir(s.user)
+	if _, err := s.fs.Stat(s.cwd); err != nil {
+		s.fs.MkdirAll(s.cwd, 0755, s.user)
+	}
+	s.reply(230, "User "+s.user+" logged in")
+	return true
+}
+
+// owner is the user new files and directories belong to.
+func (s *ftpSession) owner() string {
+	if s.anon {
+		return "ftp"
+	}
+	return s.user
+}
+
+func (s *ftpSession) abs(p string) string {
+	return vfs.Clean(s.cwd, p)
+}
+
+func (s *ftpSession) cmdCwd(arg string) {
+	p := s.abs(arg)
+	n, err := s.fs.Stat(p)
+	switch {
+	case err != nil:
+		s.reply(550, arg+": "+shell.ErrText(err))
+	case !n.IsDir():
+		s.reply(550, arg+": Not a directory")
+	default:
+		s.cwd = p
+		s.reply(250, "CWD command successful")
+	}
+}
+
+// cmdSite answers SITE CHMOD and the mod_copy pair CPFR/CPTO, which exploits
+// for ProFTPD 1.3.5 use without logging in to plant web shells.
+func (s *ftpSession) cmdSite(arg string) {
+	sub, rest, _ := strings.Cut(arg, " ")
+	switch strings.ToUpper(sub) {
+	case "CPFR":
+		if _, err := s.fs.Stat(s.abs(rest)); err != nil {
+			s.reply(550, rest+": "+shell.ErrText(err))
+			return
+		}
+		s.copyFrom = s.abs(rest)
+		s.reply(350, "File or directory exists, ready for destination name")
+	case "CPTO":
+		from := s.copyFrom
+		s.copyFrom = ""
+		if from == "" {
+			s.reply(503, "Bad sequence of commands")
+			return
+		}
+		data, err := s.fs.ReadFile(from)
+		if err == nil {
+			err = s.fs.WriteFile(s.abs(rest), data, 0644, s.owner())
+		}
+		if err != nil {
+			s.reply(550, "cpto: "+shell.ErrText(err))
+			return
+		}
+		s.reply(250, "Copy successful")
+	case "CHMOD":
+		if !s.loggedIn {
+			s.reply(530, "Please login with USER and PASS")
+			return
+		}
+		mode, name, _ := strings.Cut(rest, " ")
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || name == "" {
+			s.reply(501, "Invalid number of parameters")
+			return
+		}
+		if err := s.fs.Chmod(s.abs(name), os.FileMode(m)); err != nil {
+			s.reply(550, name+": "+shell.ErrText(err))
+			return
+		}
+		s.reply(200, "SITE CHMOD command successful")
+	case "HELP":
+		s.replyLines(214, "The following SITE commands are recognized (* =>'s unimplemented)", "CPFR", "CPTO", "HELP", "CHGRP*", "CHMOD", "Direct comments to root@localhost")
+	default:
+		s.reply(500, "'SITE "+sub+"' not understood")
+	}
+}
+
+// cmdPasv opens a listener for the next transfer on the address the client
+// reached us on. EPSV replies with just the port.
+func (s *ftpSession) cmdPasv(extended bool) {
+	s.resetData()
+	local := remoteIP(s.conn.LocalAddr())
+	ip := s.srv.passiveIP
+	if ip == nil {
+		ip = net.ParseIP(local).To4()
+	}
+	if !extended && ip == nil {
+		s.reply(501, "PASV: unable to handle IPv6 address, use EPSV")
+		return
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(local, "0"))
+	if err != nil {
+		log.Printf("[FTP] Could not open passive listener: %v", err)
+		s.reply(425, "Unable to build data connection: "+err.Error())
+		return
+	}
+	s.passive = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if extended {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// cmdPort records the client's address for an active transfer. Addresses
+// other than the client's own are refused, as ProFTPD does by default, so
+// the honeypot cannot be used for FTP bounce scans; the attempt itself is
+// already in the FTPCommand event. The egress policy, when enabled, drops
+// the connection unless the client is in egress.allow.
+func (s *ftpSession) cmdPort(verb string, addr *net.TCPAddr) {
+	s.resetData()
+	if addr == nil || addr.Port < 1024 || !addr.IP.Equal(net.ParseIP(remoteIP(s.conn.RemoteAddr()))) {
+		s.reply(500, "Illegal "+verb+" command")
+		return
+	}
+	s.active = addr.String()
+	s.reply(200, verb+" command successful")
+}
+
+// parsePORT parses "h1,h2,h3,h4,p1,p2".
+func parsePORT(arg string) *net.TCPAddr {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 6 {
+		return nil
+	}
+	var b [6]byte
+	for i, p := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+		if err != nil {
+			return nil
+		}
+		b[i] = byte(n)
+	}
+	return &net.TCPAddr{IP: net.IPv4(b[0], b[1], b[2], b[3]), Port: int(b[4])<<8 | int(b[5])}
+}
+
+// parseEPRT parses RFC 2428's "|proto|address|port|".
+func parseEPRT(arg string) *net.TCPAddr {
+	if len(arg) < 2 {
+		return nil
+	}
+	parts := strings.Split(arg, arg[:1])
+	if len(parts) != 5 {
+		return nil
+	}
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.ParseUint(parts[3], 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// resetData drops a data connection prepared but not used.
+func (s *ftpSession) resetData() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+	s.active = ""
+}
+
+var errNoDataConn = errors.New("no data connection")
+
+// openData connects the data channel set up by PASV/EPSV or PORT/EPRT and,
+// after PROT P, runs the server side of a TLS handshake on it.
+func (s *ftpSession) openData() (net.Conn, error) {
+	c, err := s.dialData()
+	if err != nil || !s.protect {
+		return c, err
+	}
+	conn := tls.Server(c, s.srv.tls)
+	if err := conn.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialData accepts or makes the data connection. A passive port only
+// accepts the client that asked for it.
+func (s *ftpSession) dialData() (net.Conn, error) {
+	defer s.resetData()
+	deadline := time.Now().Add(ftpDataTimeout)
+	if s.passive != nil {
+		ln := s.passive.(*net.TCPListener)
+		ln.SetDeadline(deadline)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return nil, err
+			}
+			if remoteIP(c.RemoteAddr()) == remoteIP(s.conn.RemoteAddr()) {
+				c.SetDeadline(time.Now().Add(ftpIdleTimeout))
+				return c, nil
+			}
+			c.Close()
+		}
+	}
+	if s.active != "" {
+		c, err := net.DialTimeout("tcp", s.active, ftpDataTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(ftpIdleTimeout))
+		return c, nil
+	}
+	return nil, errNoDataConn
+}
+
+// transfer sends 150, opens the data connection and runs fn on it,
+// answering 226 or 425/426 according to the outcome.
+func (s *ftpSession) transfer(opening string, fn func(net.Conn) error) bool {
+	s.reply(150, opening)
+	c, err := s.openData()
+	if err != nil {
+		text := "Connection refused"
+		var nerr net.Error
+		switch {
+		case errors.As(err, &nerr) && nerr.Timeout():
+			text = "Connection timed out"
+		}
+		s.reply(425, "Unable to build data connection: "+text)
+		return false
+	}
+	err = fn(c)
+	c.Close()
+	switch {
+	case errors.Is(err, vfs.ErrNoSpace):
+		s.reply(552, "Transfer aborted. "+shell.ErrText(err))
+		return false
+	case err != nil:
+		s.reply(426, "Transfer aborted. Data connection closed")
+		return false
+	}
+	s.reply(226, "Transfer complete")
+	return true
+}
+
+// cmdList serves LIST and NLST from the decoy tree. Options such as -la
+// are accepted; only -a changes the output.
+func (s *ftpSession) cmdList(namesOnly bool, arg string) {
+	all := false
+	var target string
+	for _, f := range strings.Fields(arg) {
+		if strings.HasPrefix(f, "-") {
+			all = all || strings.Contains(f, "a")
+			continue
+		}
+		target = f
+	}
+	p := s.abs(target)
+	n, err := s.fs.Stat(p)
+	if err != nil {
+		s.reply(450, target+": "+shell.ErrText(err))
+		return
+	}
+	nodes := []*vfs.Node{n}
+	if n.IsDir() {
+		children, _ := s.fs.ReadDir(p)
+		nodes = nodes[:0]
+		for _, c := range children {
+			if all || !strings.HasPrefix(c.Name, ".") {
+				nodes = append(nodes, c)
+			}
+		}
+	}
+	var b bytes.Buffer
+	for _, n := range nodes {
+		if namesOnly {
+			fmt.Fprintf(&b, "%s\r\n", n.Name)
+		} else {
+			fmt.Fprintf(&b, "%s\r\n", ftpListLine(n))
+		}
+	}
+	s.transfer("Opening ASCII mode data connection for file list", func(c net.Conn) error {
+		_, err := c.Write(b.Bytes())
+		return err
+	})
+}
+
+// ftpListLine formats an entry the way ProFTPD's LIST does.
+func ftpListLine(n *vfs.Node) string {
+	links := 1
+	if n.IsDir() {
+		links = 2
+	}
+	owner, group := n.Owner, n.Group
+	if owner == "" {
+		owner = "root"
+	}
+	if group == "" {
+		group = owner
+	}
+	stamp := n.ModTime.Format("Jan _2 15:04")
+	if n.ModTime.Before(time.Now().AddDate(0, -6, 0)) {
+		stamp = n.ModTime.Format("Jan _2  2006")
+	}
+	mode := []byte("-rwxrwxrwx")
+	if n.IsDir() {
+		mode[0] = 'd'
+	}
+	for i := 0; i < 9; i++ {
+		if n.Mode&(1<<uint(8-i)) == 0 {
+			mode[i+1] = '-'
+		}
+	}
+	return fmt.Sprintf("%s %3d %-8s %-8s %8d %s %s", mode, links, owner, group, n.Size(), stamp, n.Name)
+}
+
+func (s *ftpSession) cmdRetr(arg string) {
+	offset := s.restart
+	s.restart = 0
+	p := s.abs(arg)
+	n, err := s.fs.Stat(p)
+	switch {
+	case err != nil:
+		s.reply(550, arg+": "+shell.ErrText(err))
+		return
+	case n.IsDir():
+		s.reply(550, arg+": Not a regular file")
+		return
+	}
+	data := n.Data[min(offset, int64(len(n.Data))):]
+	opening := fmt.Sprintf("Opening BINARY mode data connection for %s (%d bytes)", arg, len(n.Data))
+	if s.transfer(opening, func(c net.Conn) error {
+		_, err := c.Write(data)
+		return err
+	}) {
+		events.Publish(&events.FileTransfer{
+			Meta:      s.sess.Meta(),
+			Direction: "download",
+			Path:      p,
+			Size:      int64(len(data)),
+			Via:       "ftp",
+		})
+	}
+}
+
+// cmdStor receives an upload into the session's filesystem and the
+// quarantine. Beyond the size cap, or sftp.DefaultMaxFileSize when there
+// is none, the stream is read and discarded, so the client sees a normal
+// completion. An upload the session's filesystem has no room for is still
+// quarantined.
+func (s *ftpSession) cmdStor(arg string, appendTo bool) {
+	s.restart = 0
+	p := s.abs(arg)
+	if parent, err := s.fs.Stat(path.Dir(p)); err != nil || !parent.IsDir() {
+		s.reply(553, arg+": No such file or directory")
+		return
+	}
+	if n, err := s.fs.Stat(p); err == nil && n.IsDir() {
+		s.reply(553, arg+": Is a directory")
+		return
+	}
+	limit := s.srv.maxUpload
+	if limit <= 0 {
+		limit = sftp.DefaultMaxFileSize
+	}
+	var data []byte
+	truncated, received := false, false
+	s.transfer("Opening BINARY mode data connection for "+arg, func(c net.Conn) error {
+		var err error
+		if data, err = io.ReadAll(io.LimitReader(c, limit+1)); err != nil {
+			return err
+		}
+		if int64(len(data)) > limit {
+			data, truncated = data[:limit], true
+			if _, err := io.Copy(io.Discard, c); err != nil {
+				return err
+			}
+		}
+		received = true
+		stored := data
+		if appendTo {
+			if old, err := s.fs.ReadFile(p); err == nil {
+				stored = append(old, data...)
+			}
+		}
+		return s.fs.WriteFile(p, stored, 0644, s.owner())
+	})
+	if received {
+		recordUpload(s.srv.samples, s.sess.Meta(), "FTP", "ftp", p, data, truncated)
+	}
+}
@@ -0,0 +1,402 @@
+package emulators
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/signatures"
+	"zecx-deploy/internal/tlscert"
+	"zecx-deploy/internal/tlsfp"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/web"
+)
+
+// --- HTTP Emulator ---
+
+const (
+	// httpHeaderTimeout bounds how long a request head takes to arrive, so
+	// that slow clients cannot hold connections open.
+	httpHeaderTimeout = 30 * time.Second
+	// httpReadTimeout bounds reading a whole request, body included.
+	httpReadTimeout = 5 * time.Minute
+	// httpIdleTimeout closes keep-alive connections left idle, like the
+	// FTP and SMB idle timeouts.
+	httpIdleTimeout = 5 * time.Minute
+)
+
+type connContextKey struct{}
+
+// requestConn returns the connection r arrived on.
+func requestConn(r *http.Request) *httpConn {
+	hc, _ := r.Context().Value(connContextKey{}).(*httpConn)
+	if hc == nil {
+		hc = &httpConn{sess: events.NewSession("http", nil, nil)}
+	}
+	return hc
+}
+
+// requestSession returns the session of the connection r arrived on.
+func requestSession(r *http.Request) *events.Session {
+	return requestConn(r).sess
+}
+
+func startHTTPEmulator(addr string, cfg *config.Config, host *persona.Persona, samples *quarantine.Store, rules *signatures.Set) {
+	h, err := newHTTPEmulator("http", cfg, host, samples, rules)
+	if err != nil {
+		log.Fatalf("[HTTP] %v", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("[HTTP] Server error: %v", err)
+		return
+	}
+	log.Printf("[HTTP] Serving the %s persona on %s", h.site.Site.Name, addr)
+	if err := h.server().Serve(rawListener{ln}); err != nil {
+		log.Printf("[HTTP] Server error: %v", err)
+	}
+}
+
+// startHTTPSEmulator serves the same persona as startHTTPEmulator over TLS,
+// with a certificate chain that looks issued by a public CA.
+func startHTTPSEmulator(addr string, cfg *config.Config, host *persona.Persona, samples *quarantine.Store, rules *signatures.Set) {
+	h, err := newHTTPEmulator("https", cfg, host, samples, rules)
+	if err != nil {
+		log.Fatalf("[HTTPS] %v", err)
+	}
+	c := cfg.HTTP.Certificate
+	if c.CommonName == "" {
+		c.CommonName = host.Hostname
+	}
+	cert, err := tlscert.LoadChain(tlscert.ChainDir(cfg.StateDir), tlscert.Chain{
+		CommonName: c.CommonName,
+		SANs:       c.SANs,
+		Issuer:     tlscert.Name(c.Issuer),
+		Root:       tlscert.Name(c.Root),
+	})
+	if err != nil {
+		log.Printf("[HTTPS] HTTPS will not be served: %v", err)
+		return
+	}
+
+	h.tls = true
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// HTTP/2 is not offered, so every request is read as HTTP/1.x.
+		NextProtos: []string{"http/1.1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			fc, ok := hello.Conn.(*tlsfp.Conn)
+			if !ok {
+				return nil, nil
+			}
+			client := tlsClient(fc.ClientHello())
+			if client != nil {
+				log.Printf("[HTTPS] TLS client from %s (sni %q, ja3 %s, ja4 %s)", fc.RemoteAddr(), client.ServerName, client.JA3, client.JA4)
+			}
+			h.open(fc, client)
+			return nil, nil
+		},
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("[HTTPS] Server error: %v", err)
+		return
+	}
+	server := h.server()
+	// Failed handshakes are routine from scanners and would flood the log.
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	log.Printf("[HTTPS] Serving the %s persona on %s as %s", h.site.Site.Name, addr, c.CommonName)
+	// rawConn goes outside TLS so it sees plaintext; net/http then no longer
+	// knows the connection is TLS, which only matters for r.TLS.
+	if err := server.Serve(rawListener{tls.NewListener(sniffListener{ln}, tlsConfig)}); err != nil {
+		log.Printf("[HTTPS] Server error: %v", err)
+	}
+}
+
+// httpEmulator records every request to the configured persona, gives each
+// connection its own session and publishes its opened and closed events.
+type httpEmulator struct {
+	protocol string
+	// tls defers the opened event until the ClientHello has been read.
+	tls   bool
+	site  *web.Server
+	rules *signatures.Set
+
+	samples   *quarantine.Store // nil when the quarantine could not be opened
+	bodyBytes int               // bytes of a body kept in its event
+	maxBody   int64             // bytes of a body read at all, 0 for no limit
+
+	conns sync.Map // net.Conn -> *httpConn
+}
+
+type httpConn struct {
+	sess   *events.Session
+	raw    *rawConn
+	opened sync.Once
+	tls    *events.TLSClient
+}
+
+func newHTTPEmulator(protocol string, cfg *config.Config, host *persona.Persona, samples *quarantine.Store, rules *signatures.Set) (*httpEmulator, error) {
+	site, err := web.Load(cfg.HTTP.Persona)
+	if err != nil {
+		return nil, err
+	}
+	h := &httpEmulator{
+		protocol:  protocol,
+		rules:     rules,
+		samples:   samples,
+		bodyBytes: cfg.HTTP.BodyCaptureBytes,
+		maxBody:   cfg.Quarantine.MaxFileSizeMB << 20,
+	}
+	h.site = &web.Server{
+		Site:     site,
+		Hostname: host.Hostname,
+		OnLogin: func(r *http.Request, method, username, password string) {
+			sess := requestSession(r)
+			log.Printf("[HTTP] %s login attempt for %q from %s on %s", method, username, sess.Src, r.URL.Path)
+			events.Publish(&events.AuthAttempt{
+				Meta:     sess.Meta(),
+				Method:   method,
+				Username: username,
+				Password: password,
+			})
+		},
+	}
+	return h, nil
+}
+
+func (h *httpEmulator) server() *http.Server {
+	return &http.Server{
+		Handler:           h,
+		MaxHeaderBytes:    httpMaxHeaderBytes,
+		ReadHeaderTimeout: httpHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		IdleTimeout:       httpIdleTimeout,
+		ConnContext:       h.context,
+		ConnState:         h.state,
+	}
+}
+
+func (h *httpEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ev := h.record(requestConn(r), r)
+	h.classify(ev, httpFields(r, ev))
+	events.Publish(ev)
+	h.site.ServeHTTP(w, r)
+}
+
+// classify tags ev with the signatures it matches.
+func (h *httpEmulator) classify(ev *events.HTTPRequest, fields signatures.Fields) {
+	for _, m := range h.rules.Match(h.protocol, fields) {
+		ev.Signatures = append(ev.Signatures, events.Signature{ID: m.ID, Name: m.Name, CVE: m.CVE, Severity: m.Severity, Field: m.Field})
+		log.Printf("[HTTP] Request from %s matched %s (%s, %s) in %s", ev.Src, m.ID, m.Severity, cmp.Or(m.CVE, "no CVE"), m.Field)
+	}
+}
+
+// httpFields gives the signature engine the parts of a request it matches
+// on. The URI and headers are as sent, before net/http normalised them.
+func httpFields(r *http.Request, ev *events.HTTPRequest) signatures.Fields {
+	f := signatures.Fields{
+		"method":     {ev.Method},
+		"uri":        {r.RequestURI},
+		"path":       {r.URL.Path},
+		"query":      {r.URL.RawQuery},
+		"user_agent": {ev.UserAgent},
+		"body":       {string(ev.Body)},
+	}
+	for _, hd := range ev.Headers {
+		f["headers"] = append(f["headers"], hd.Name+": "+hd.Value)
+		name := "header." + strings.ToLower(hd.Name)
+		f[name] = append(f[name], hd.Value)
+	}
+	return f
+}
+
+// record builds the event for r, reading its body and putting it back for
+// the site to use.
+func (h *httpEmulator) record(hc *httpConn, r *http.Request) *events.HTTPRequest {
+	ev := &events.HTTPRequest{
+		Meta:      hc.sess.Meta(),
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Proto:     r.Proto,
+		Host:      r.Host,
+		UserAgent: r.UserAgent(),
+		TLS:       hc.tls,
+	}
+	var head []byte
+	if hc.raw != nil {
+		head = hc.raw.nextHead()
+	}
+	if head != nil {
+		_, ev.Headers = parseHead(head)
+	} else {
+		for _, name := range slices.Sorted(maps.Keys(r.Header)) {
+			for _, v := range r.Header[name] {
+				ev.Headers = append(ev.Headers, events.HTTPHeader{Name: name, Value: v})
+			}
+		}
+	}
+
+	chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+	if hc.raw != nil && !chunked && r.ContentLength > 0 {
+		hc.raw.takeBody(r.ContentLength, h.bodyBytes)
+	}
+	body, truncated := h.readBody(r)
+	var rawBody []byte
+	if hc.raw != nil {
+		if chunked && !truncated {
+			rawBody = hc.raw.takeChunked(h.bodyBytes)
+		} else {
+			rawBody = hc.raw.takeRest()
+		}
+	}
+	if head != nil {
+		ev.Raw = append(head, rawBody...)
+	}
+
+	if len(body) > 0 {
+		ev.Body = body[:min(len(body), h.bodyBytes)]
+		ev.BodySize = int64(len(body))
+		ev.BodyTruncated = truncated
+	}
+	if len(body) > h.bodyBytes {
+		if h.samples != nil {
+			res, err := h.samples.Save(body)
+			if err != nil {
+				log.Printf("[HTTP] Could not quarantine request body from %s: %v", hc.sess.Src, err)
+			}
+			ev.BodySHA256 = res.SHA256
+		} else {
+			sum := sha256.Sum256(body)
+			ev.BodySHA256 = hex.EncodeToString(sum[:])
+		}
+		log.Printf("[HTTP] Request body from %s on %s (%d bytes, sha256 %s)", hc.sess.Src, r.URL.Path, ev.BodySize, ev.BodySHA256)
+	}
+	return ev
+}
+
+// readBody reads r's body up to maxBody and replaces it with what was read.
+func (h *httpEmulator) readBody(r *http.Request) ([]byte, bool) {
+	var src io.Reader = r.Body
+	if h.maxBody > 0 {
+		src = io.LimitReader(r.Body, h.maxBody+1)
+	}
+	body, _ := io.ReadAll(src)
+	truncated := h.maxBody > 0 && int64(len(body)) > h.maxBody
+	if truncated {
+		body = body[:h.maxBody]
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, truncated
+}
+
+// connKey is the connection a session is filed under: the one beneath any
+// wrapping, which is what GetConfigForClient sees.
+func connKey(c net.Conn) net.Conn {
+	if rc, ok := c.(*rawConn); ok {
+		c = rc.Conn
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		return tc.NetConn()
+	}
+	return c
+}
+
+func (h *httpEmulator) context(ctx context.Context, c net.Conn) context.Context {
+	hc := &httpConn{sess: events.NewSession(h.protocol, c.LocalAddr(), c.RemoteAddr())}
+	hc.raw, _ = c.(*rawConn)
+	h.conns.Store(connKey(c), hc)
+	return context.WithValue(ctx, connContextKey{}, hc)
+}
+
+// open publishes the opened event of c once, with client set when the
+// connection is TLS and its ClientHello was parsed.
+func (h *httpEmulator) open(c net.Conn, client *events.TLSClient) {
+	v, ok := h.conns.Load(connKey(c))
+	if !ok {
+		return
+	}
+	hc := v.(*httpConn)
+	hc.opened.Do(func() {
+		hc.tls = client
+		events.Publish(&events.ConnectionOpened{Meta: hc.sess.Meta(), TLS: client})
+	})
+}
+
+func (h *httpEmulator) state(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		if !h.tls {
+			h.open(c, nil)
+		}
+	case http.StateClosed, http.StateHijacked:
+		v, ok := h.conns.LoadAndDelete(connKey(c))
+		if !ok {
+			return
+		}
+		hc := v.(*httpConn)
+		// A client that closed before sending a ClientHello still connected.
+		hc.opened.Do(func() {
+			events.Publish(&events.ConnectionOpened{Meta: hc.sess.Meta()})
+		})
+		if hc.raw != nil {
+			h.recordLeftover(hc)
+		}
+		publishClosed(hc.sess)
+	}
+}
+
+// recordLeftover publishes what a client sent that net/http did not serve,
+// such as a request it rejected with 400 or one the client never finished.
+func (h *httpEmulator) recordLeftover(hc *httpConn) {
+	raw := hc.raw.leftover()
+	if raw == nil {
+		return
+	}
+	raw = raw[:min(len(raw), httpMaxHeaderBytes+h.bodyBytes)]
+	ev := &events.HTTPRequest{Meta: hc.sess.Meta(), Raw: bytes.Clone(raw), TLS: hc.tls, Malformed: true}
+	// Scanners often send unencoded spaces in the URI, which net/http rejects.
+	line, _, _ := strings.Cut(string(raw), "\n")
+	if f := strings.Fields(line); len(f) >= 3 && strings.HasPrefix(f[len(f)-1], "HTTP/") {
+		ev.Method, ev.URL, ev.Proto = f[0], strings.Join(f[1:len(f)-1], " "), f[len(f)-1]
+	}
+	log.Printf("[HTTP] Malformed request from %s (%d bytes)", hc.sess.Src, len(raw))
+	fields := signatures.Fields{"raw": {string(raw)}}
+	if ev.URL != "" {
+		path, query, _ := strings.Cut(ev.URL, "?")
+		fields["method"], fields["uri"] = []string{ev.Method}, []string{ev.URL}
+		fields["path"], fields["query"] = []string{path}, []string{query}
+	}
+	h.classify(ev, fields)
+	events.Publish(ev)
+}
+
+// sniffListener wraps accepted connections so their ClientHello can be
+// fingerprinted.
+type sniffListener struct {
+	net.Listener
+}
+
+func (l sniffListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tlsfp.NewConn(c), nil
+}
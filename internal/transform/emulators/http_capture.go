@@ -0,0 +1,225 @@
+package emulators
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"zecx-deploy/internal/events"
+)
+
+const (
+	// httpMaxHeaderBytes is the request head net/http accepts.
+	httpMaxHeaderBytes = 64 << 10
+	// rawBufferBytes bounds what a connection buffers between requests; a
+	// client that sends more than this ahead loses raw capture.
+	rawBufferBytes = 1 << 20
+)
+
+// rawListener wraps accepted connections in a rawConn.
+type rawListener struct {
+	net.Listener
+}
+
+func (l rawListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{Conn: c}, nil
+}
+
+// rawConn keeps what net/http reads from a connection so each request can
+// be recorded as sent, and what it rejected can be recorded at all.
+// Requests on a connection are read in turn: the handler takes each head
+// with nextHead and accounts for the body's bytes before the next request.
+type rawConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	buf []byte // read but not yet taken by a request
+	// drop counts body bytes still to come that are not buffered; the
+	// first keep of them are appended to body instead.
+	drop int64
+	keep int
+	body []byte
+	// lost is set once the buffer overflowed and no longer lines up with
+	// requests.
+	lost bool
+}
+
+func (c *rawConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.observe(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *rawConn) observe(b []byte) {
+	if c.drop > 0 {
+		n := int(min(c.drop, int64(len(b))))
+		if room := c.keep - len(c.body); room > 0 {
+			c.body = append(c.body, b[:min(n, room)]...)
+		}
+		c.drop -= int64(n)
+		b = b[n:]
+	}
+	if c.lost || len(b) == 0 {
+		return
+	}
+	if len(c.buf)+len(b) > rawBufferBytes {
+		c.lost, c.buf = true, nil
+		return
+	}
+	c.buf = append(c.buf, b...)
+}
+
+// nextHead takes the head of the request net/http has just parsed, or
+// returns nil if it is no longer known.
+func (c *rawConn) nextHead() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lost {
+		return nil
+	}
+	end := -1
+	if i := bytes.Index(c.buf, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 4
+	}
+	if i := bytes.Index(c.buf, []byte("\n\n")); i >= 0 && (end < 0 || i+2 < end) {
+		end = i + 2
+	}
+	if end < 0 {
+		c.lost, c.buf = true, nil
+		return nil
+	}
+	head := bytes.Clone(c.buf[:end])
+	c.buf = c.buf[end:]
+	return head
+}
+
+// takeBody accounts for a body of n bytes following the last head and
+// starts capturing the first keep of them, which takeRest returns. It must
+// be called before the body is read.
+func (c *rawConn) takeBody(n int64, keep int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.body, c.keep = nil, keep
+	if c.lost {
+		return
+	}
+	have := int(min(n, int64(len(c.buf))))
+	c.body = bytes.Clone(c.buf[:min(have, keep)])
+	c.buf = c.buf[have:]
+	c.drop = n - int64(have)
+}
+
+// takeChunked accounts for a chunked body that has been read to its end
+// and returns up to keep of its bytes as sent.
+func (c *rawConn) takeChunked(keep int) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lost {
+		return nil
+	}
+	n := chunkedLength(c.buf)
+	if n < 0 {
+		c.lost, c.buf = true, nil
+		return nil
+	}
+	body := bytes.Clone(c.buf[:min(n, keep)])
+	c.buf = c.buf[n:]
+	return body
+}
+
+// takeRest returns the body bytes captured since takeBody.
+func (c *rawConn) takeRest() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	body := c.body
+	c.body = nil
+	return body
+}
+
+// leftover returns what was read but never became a request: a request
+// net/http rejected, or one cut short.
+func (c *rawConn) leftover() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lost || c.drop > 0 || len(bytes.TrimSpace(c.buf)) == 0 {
+		return nil
+	}
+	return c.buf
+}
+
+// chunkedLength returns how many bytes of b the chunked body at its start
+// takes up, trailers included, or -1 if b ends before it does.
+func chunkedLength(b []byte) int {
+	pos := 0
+	line := func() (string, bool) {
+		i := bytes.IndexByte(b[pos:], '\n')
+		if i < 0 {
+			return "", false
+		}
+		l := strings.TrimRight(string(b[pos:pos+i]), "\r")
+		pos += i + 1
+		return l, true
+	}
+	for {
+		l, ok := line()
+		if !ok {
+			return -1
+		}
+		size, _, _ := strings.Cut(l, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return -1
+		}
+		if n == 0 {
+			break
+		}
+		if int64(len(b)-pos) < n {
+			return -1
+		}
+		pos += int(n)
+		if _, ok := line(); !ok {
+			return -1
+		}
+	}
+	for {
+		l, ok := line()
+		if !ok {
+			return -1
+		}
+		if l == "" {
+			return pos
+		}
+	}
+}
+
+// parseHead splits a request head into its request line and its headers in
+// order. Folded continuation lines are joined to the header they continue.
+func parseHead(head []byte) (string, []events.HTTPHeader) {
+	lines := strings.Split(string(head), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	var headers []events.HTTPHeader
+	for _, l := range lines[1:] {
+		switch {
+		case l == "":
+			return lines[0], headers
+		case (l[0] == ' ' || l[0] == '\t') && len(headers) > 0:
+			headers[len(headers)-1].Value += " " + strings.TrimSpace(l)
+		default:
+			name, value, _ := strings.Cut(l, ":")
+			headers = append(headers, events.HTTPHeader{Name: name, Value: strings.Trim(value, " \t")})
+		}
+	}
+	return lines[0], headers
+}
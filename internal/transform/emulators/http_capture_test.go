@@ -0,0 +1,140 @@
+package emulators
+
+import (
+	"strings"
+	"testing"
+)
+
+// received returns a rawConn that has read the given chunks.
+func received(chunks ...string) *rawConn {
+	c := &rawConn{}
+	for _, ch := range chunks {
+		c.observe([]byte(ch))
+	}
+	return c
+}
+
+func TestNextHeadPipelined(t *testing.T) {
+	first := "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+	second := "GET /x HTTP/1.1\r\nHost: a\r\n\r\n"
+	bare := "HEAD / HTTP/1.0\n\n"
+	c := received(first+second[:10], second[10:]+bare)
+	for _, want := range []string{first, second, bare} {
+		if got := string(c.nextHead()); got != want {
+			t.Errorf("nextHead = %q, want %q", got, want)
+		}
+	}
+	if left := c.leftover(); left != nil {
+		t.Errorf("leftover = %q", left)
+	}
+	// With nothing buffered, the heads no longer line up.
+	if head := c.nextHead(); head != nil || !c.lost {
+		t.Errorf("nextHead on an empty buffer = %q, lost %v", head, c.lost)
+	}
+}
+
+func TestTakeBody(t *testing.T) {
+	post := "POST /upload HTTP/1.1\r\nContent-Length: 10\r\n\r\n"
+	next := "GET / HTTP/1.1\r\n\r\n"
+
+	// The body arrived with the head, and the next request behind it.
+	c := received(post + "0123456789" + next)
+	c.nextHead()
+	c.takeBody(10, 4)
+	if body := string(c.takeRest()); body != "0123" {
+		t.Errorf("buffered body = %q", body)
+	}
+	if head := string(c.nextHead()); head != next {
+		t.Errorf("next head = %q", head)
+	}
+
+	// Only part of it was buffered; the rest is captured as it is read,
+	// without being buffered for the next head.
+	c = received(post + "012")
+	c.nextHead()
+	c.takeBody(10, 6)
+	c.observe([]byte("3456"))
+	c.observe([]byte("789" + next))
+	if body := string(c.takeRest()); body != "012345" {
+		t.Errorf("streamed body = %q", body)
+	}
+	if head := string(c.nextHead()); head != next {
+		t.Errorf("next head = %q", head)
+	}
+	if c.drop != 0 {
+		t.Errorf("drop = %d after the body", c.drop)
+	}
+}
+
+func TestTakeBodyCutShort(t *testing.T) {
+	c := received("POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\nabc")
+	c.nextHead()
+	c.takeBody(100, 10)
+	// A connection that closes mid-body has no request left over.
+	if left := c.leftover(); left != nil {
+		t.Errorf("leftover = %q", left)
+	}
+}
+
+func TestTakeChunked(t *testing.T) {
+	head := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+	body := "5;name=x\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\n"
+	next := "GET / HTTP/1.1\r\n\r\n"
+	c := received(head+body[:7], body[7:]+next)
+	c.nextHead()
+	if got := string(c.takeChunked(1 << 10)); got != body {
+		t.Errorf("takeChunked = %q, want %q", got, body)
+	}
+	if got := string(c.nextHead()); got != next {
+		t.Errorf("next head = %q", got)
+	}
+
+	c = received(head + body + next)
+	c.nextHead()
+	if got := string(c.takeChunked(8)); got != body[:8] {
+		t.Errorf("takeChunked capped = %q", got)
+	}
+	if got := string(c.nextHead()); got != next {
+		t.Errorf("next head after a capped body = %q", got)
+	}
+}
+
+func TestChunkedLength(t *testing.T) {
+	tests := map[string]int{
+		"0\r\n\r\n":                    5,
+		"0\n\n":                        3,
+		"3\r\nabc\r\n0\r\n\r\nGET":     13,
+		"a\r\n0123456789\r\n0\r\n\r\n": 20,
+		"3\r\nabc\r\n":                 -1, // no last chunk yet
+		"3\r\nab":                      -1,
+		"zz\r\nabc\r\n0\r\n\r\n":       -1,
+		"-1\r\n\r\n":                   -1,
+		"0\r\nX-Trailer: 1\r\n":        -1, // trailers not ended
+	}
+	for in, want := range tests {
+		if got := chunkedLength([]byte(in)); got != want {
+			t.Errorf("chunkedLength(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestRawBufferOverflow(t *testing.T) {
+	c := received(strings.Repeat("A", rawBufferBytes), "B")
+	if !c.lost || c.nextHead() != nil || c.takeChunked(10) != nil {
+		t.Errorf("overflowed connection still captures: lost %v", c.lost)
+	}
+	// Bodies already accounted for are still captured.
+	c.drop, c.keep = 3, 3
+	c.observe([]byte("xyz"))
+	if body := string(c.takeRest()); body != "xyz" {
+		t.Errorf("body after overflow = %q", body)
+	}
+}
+
+func TestLeftover(t *testing.T) {
+	c := received("GET / HTTP/1.1\r\n\r\n", "\x16\x03\x01 not http\r\n\r\n")
+	c.nextHead()
+	if left := string(c.leftover()); left != "\x16\x03\x01 not http\r\n\r\n" {
+		t.Errorf("leftover = %q", left)
+	}
+}
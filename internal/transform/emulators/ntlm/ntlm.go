@@ -0,0 +1,257 @@
+package ntlm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Signature starts every NTLMSSP message.
+var Signature = []byte("NTLMSSP\x00")
+
+const (
+	typeNegotiate    = 1
+	typeChallenge    = 2
+	typeAuthenticate = 3
+)
+
+// Negotiate flags (MS-NLMP 2.2.2.5).
+const (
+	flagUnicode                 = 0x00000001
+	flagOEM                     = 0x00000002
+	flagRequestTarget           = 0x00000004
+	flagSign                    = 0x00000010
+	flagSeal                    = 0x00000020
+	flagNTLM                    = 0x00000200
+	flagAlwaysSign              = 0x00008000
+	flagTargetTypeDomain        = 0x00010000
+	flagTargetTypeServer        = 0x00020000
+	flagExtendedSessionSecurity = 0x00080000
+	flagTargetInfo              = 0x00800000
+	flagVersion                 = 0x02000000
+	flag128                     = 0x20000000
+	flagKeyExchange             = 0x40000000
+	flag56                      = 0x80000000
+)
+
+// Attribute-value pair IDs in a CHALLENGE's target info.
+const (
+	avEOL             = 0
+	avNbComputerName  = 1
+	avNbDomainName    = 2
+	avDNSComputerName = 3
+	avDNSDomainName   = 4
+	avTimestamp       = 7
+)
+
+var errMalformed = errors.New("malformed NTLMSSP message")
+
+// Server runs the server side of one NTLM exchange. Its names are what a
+// client sees in the CHALLENGE: a Samba server outside a domain uses its
+// NetBIOS name for both the computer and the domain.
+type Server struct {
+	NetBIOSComputer string
+	NetBIOSDomain   string
+	DNSComputer     string
+	DNSDomain       string
+
+	challenge [8]byte
+	flags     uint32
+}
+
+// serverFlags are what the server is willing to negotiate.
+const serverFlags = flagUnicode | flagOEM | flagRequestTarget | flagSign | flagSeal | flagNTLM |
+	flagAlwaysSign | flagExtendedSessionSecurity | flagTargetInfo | flagVersion |
+	flag128 | flagKeyExchange | flag56
+
+// version is the OS version a CHALLENGE reports: 6.1 with NTLMSSP
+// revision 15, as Samba sends.
+var version = []byte{6, 1, 0, 0, 0, 0, 0, 15}
+
+// Challenge answers a NEGOTIATE message with a CHALLENGE carrying a fresh
+// server challenge.
+func (s *Server) Challenge(negotiate []byte) ([]byte, error) {
+	if len(negotiate) < 16 || !bytes.HasPrefix(negotiate, Signature) || binary.LittleEndian.Uint32(negotiate[8:]) != typeNegotiate {
+		return nil, errMalformed
+	}
+	clientFlags := binary.LittleEndian.Uint32(negotiate[12:])
+	if _, err := rand.Read(s.challenge[:]); err != nil {
+		return nil, err
+	}
+	s.flags = clientFlags&serverFlags | flagTargetTypeServer | flagTargetInfo | flagVersion
+	if clientFlags&flagUnicode != 0 {
+		s.flags &^= flagOEM
+	}
+
+	target := s.encode(s.NetBIOSComputer)
+	var info []byte
+	info = appendAV(info, avNbDomainName, utf16le(s.NetBIOSDomain))
+	info = appendAV(info, avNbComputerName, utf16le(s.NetBIOSComputer))
+	info = appendAV(info, avDNSDomainName, utf16le(s.DNSDomain))
+	info = appendAV(info, avDNSComputerName, utf16le(s.DNSComputer))
+	info = appendAV(info, avTimestamp, binary.LittleEndian.AppendUint64(nil, filetime(time.Now())))
+	info = appendAV(info, avEOL, nil)
+
+	const payload = 56
+	msg := make([]byte, payload, payload+len(target)+len(info))
+	copy(msg, Signature)
+	binary.LittleEndian.PutUint32(msg[8:], typeChallenge)
+	putField(msg[12:], len(target), payload)
+	binary.LittleEndian.PutUint32(msg[20:], s.flags)
+	copy(msg[24:], s.challenge[:])
+	putField(msg[40:], len(info), payload+len(target))
+	copy(msg[48:], version)
+	msg = append(msg, target...)
+	msg = append(msg, info...)
+	return msg, nil
+}
+
+func (s *Server) encode(str string) []byte {
+	if s.flags&flagUnicode != 0 {
+		return utf16le(str)
+	}
+	return []byte(str)
+}
+
+// Response is what a client proved in an AUTHENTICATE message.
+type Response struct {
+	User        string
+	Domain      string
+	Workstation string
+	LM          []byte
+	NT          []byte
+	Challenge   [8]byte
+}
+
+// Authenticate parses the client's AUTHENTICATE message. It never verifies
+// the response: there is no password to verify it against.
+func (s *Server) Authenticate(msg []byte) (*Response, error) {
+	r, err := parseAuthenticate(msg)
+	if err != nil {
+		return nil, err
+	}
+	r.Challenge = s.challenge
+	return r, nil
+}
+
+// parseAuthenticate decodes an AUTHENTICATE message. The challenge it
+// answers is not part of the message and is left zero.
+func parseAuthenticate(msg []byte) (*Response, error) {
+	if len(msg) < 64 || !bytes.HasPrefix(msg, Signature) || binary.LittleEndian.Uint32(msg[8:]) != typeAuthenticate {
+		return nil, errMalformed
+	}
+	flags := binary.LittleEndian.Uint32(msg[60:])
+	field := func(at int) ([]byte, error) {
+		n := int(binary.LittleEndian.Uint16(msg[at:]))
+		off := int(binary.LittleEndian.Uint32(msg[at+4:]))
+		if n == 0 {
+			return nil, nil
+		}
+		if off < 0 || off+n > len(msg) {
+			return nil, errMalformed
+		}
+		return msg[off : off+n], nil
+	}
+	str := func(at int) (string, error) {
+		b, err := field(at)
+		if flags&flagUnicode != 0 {
+			return fromUTF16le(b), err
+		}
+		return string(b), err
+	}
+	r := &Response{}
+	var errs [5]error
+	r.LM, errs[0] = field(12)
+	r.NT, errs[1] = field(20)
+	r.Domain, errs[2] = str(28)
+	r.User, errs[3] = str(36)
+	r.Workstation, errs[4] = str(44)
+	if err := errors.Join(errs[:]...); err != nil {
+		return nil, err
+	}
+	r.LM, r.NT = bytes.Clone(r.LM), bytes.Clone(r.NT)
+	return r, nil
+}
+
+// Anonymous reports whether the client authenticated as the null user.
+func (r *Response) Anonymous() bool {
+	return r.User == "" && len(r.NT) == 0 && (len(r.LM) == 0 || bytes.Equal(r.LM, []byte{0}))
+}
+
+// IsV2 reports whether the response is NTLMv2, which is longer than the
+// fixed 24 bytes of NTLMv1.
+func (r *Response) IsV2() bool {
+	return len(r.NT) > 24
+}
+
+// Hashcat returns the response in the format hashcat cracks: mode 5600
+// (NetNTLMv2) or 5500 (NetNTLMv1), as reported by HashcatMode.
+func (r *Response) Hashcat() string {
+	if r.IsV2() {
+		return fmt.Sprintf("%s::%s:%x:%x:%x", r.User, r.Domain, r.Challenge, r.NT[:16], r.NT[16:])
+	}
+	return fmt.Sprintf("%s::%s:%x:%x:%x", r.User, r.Domain, r.LM, r.NT, r.Challenge)
+}
+
+// HashcatMode returns the hashcat mode for Hashcat's output.
+func (r *Response) HashcatMode() int {
+	if r.IsV2() {
+		return 5600
+	}
+	return 5500
+}
+
+// String describes the response for logs.
+func (r *Response) String() string {
+	name := r.User
+	if r.Domain != "" {
+		name = r.Domain + `\` + r.User
+	}
+	kind := "NetNTLMv1"
+	if r.IsV2() {
+		kind = "NetNTLMv2"
+	}
+	return fmt.Sprintf("%s %s from workstation %q", kind, name, r.Workstation)
+}
+
+// filetime converts t to a Windows FILETIME: 100ns intervals since 1601.
+func filetime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano()/100 + 116444736000000000)
+}
+
+func putField(b []byte, n, off int) {
+	binary.LittleEndian.PutUint16(b, uint16(n))
+	binary.LittleEndian.PutUint16(b[2:], uint16(n))
+	binary.LittleEndian.PutUint32(b[4:], uint32(off))
+}
+
+func appendAV(b []byte, id uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, id)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func fromUTF16le(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
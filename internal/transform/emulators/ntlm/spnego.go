@@ -0,0 +1,89 @@
+package ntlm
+
+import "bytes"
+
+// SPNEGO (RFC 4178) wraps NTLMSSP in SMB. Only the NTLM mechanism is ever
+// offered, so the tokens here are fixed apart from the NTLM message inside.
+
+var (
+	oidSPNEGO  = []byte{0x06, 0x06, 0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	oidNTLMSSP = []byte{0x06, 0x0a, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}
+)
+
+// negState values of a NegTokenResp.
+const (
+	acceptCompleted  = 0
+	acceptIncomplete = 1
+	reject           = 2
+)
+
+// InitToken is the security blob of an SMB2 NEGOTIATE response: a
+// NegTokenInit offering NTLMSSP.
+func InitToken() []byte {
+	mechTypes := der(0xa0, der(0x30, oidNTLMSSP))
+	return der(0x60, oidSPNEGO, der(0xa0, der(0x30, mechTypes)))
+}
+
+// Unwrap returns the NTLMSSP message inside a security blob, which may be
+// SPNEGO-wrapped or bare, and whether it was wrapped.
+func Unwrap(blob []byte) ([]byte, bool) {
+	if bytes.HasPrefix(blob, Signature) {
+		return blob, false
+	}
+	// NTLM offsets are relative to the start of the message, so anything
+	// after it, such as a mechListMIC, does no harm.
+	i := bytes.Index(blob, Signature)
+	if i < 0 {
+		return nil, true
+	}
+	return blob[i:], true
+}
+
+// Continue wraps a CHALLENGE in the NegTokenResp that asks for more.
+func Continue(challenge []byte) []byte {
+	return negTokenResp(acceptIncomplete, challenge)
+}
+
+// Accept is the final NegTokenResp of a successful exchange.
+func Accept() []byte {
+	return negTokenResp(acceptCompleted, nil)
+}
+
+// Reject is the final NegTokenResp of a failed exchange.
+func Reject() []byte {
+	return negTokenResp(reject, nil)
+}
+
+func negTokenResp(state byte, token []byte) []byte {
+	fields := [][]byte{der(0xa0, []byte{0x0a, 0x01, state})}
+	if state == acceptIncomplete {
+		fields = append(fields, der(0xa1, oidNTLMSSP))
+	}
+	if token != nil {
+		fields = append(fields, der(0xa2, der(0x04, token)))
+	}
+	return der(0xa1, der(0x30, fields...))
+}
+
+// der encodes a DER element with the given tag around the concatenated contents.
+func der(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	out := []byte{tag}
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range contents {
+		out = append(out, c...)
+	}
+	return out
+}
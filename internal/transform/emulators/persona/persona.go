@@ -0,0 +1,161 @@
+package persona
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/config"
+)
+
+// Identity of the emulated kernel and distribution.
+const (
+	KernelName    = "Linux"
+	KernelRelease = "5.15.0-91-generic"
+	KernelVersion = "#101-Ubuntu SMP Tue Nov 14 13:30:08 UTC 2023"
+	Machine       = "x86_64"
+	OSName        = "GNU/Linux"
+	Distro        = "Ubuntu 22.04.3 LTS"
+	Codename      = "jammy"
+	CPUModel      = "Intel(R) Xeon(R) CPU E5-2676 v3 @ 2.40GHz"
+)
+
+// Root filesystem size reported by df, in 1K blocks.
+const (
+	DiskKB     = 30428560
+	DiskUsedKB = 10261788
+)
+
+// Persona is the machine the emulators pretend to be. Banners, command output
+// and /proc all derive from one Persona so that attackers cross-checking
+// uname, nproc, free and /proc/cpuinfo see a single consistent host.
+type Persona struct {
+	Hostname string
+	CPUs     int
+	MemoryKB int64
+	// BootTime is derived from the hostname, so it is stable for a host.
+	BootTime time.Time
+}
+
+// New builds the persona described by cfg, filling in defaults.
+func New(cfg config.Persona) *Persona {
+	p := &Persona{Hostname: cfg.Hostname, CPUs: cfg.CPUs, MemoryKB: int64(cfg.MemoryMB) * 1024}
+	if p.Hostname == "" {
+		p.Hostname = "ubuntu"
+	}
+	if p.CPUs <= 0 {
+		p.CPUs = 2
+	}
+	if p.MemoryKB <= 0 {
+		p.MemoryKB = 2014088
+	}
+	h := fnv.New32a()
+	h.Write([]byte(p.Hostname))
+	seed := h.Sum32()
+	up := time.Duration(17+seed%90)*24*time.Hour + time.Duration(seed%1440)*time.Minute
+	p.BootTime = time.Now().Add(-up).Truncate(time.Second)
+	return p
+}
+
+// Uptime returns how long the machine has been up at now.
+func (p *Persona) Uptime(now time.Time) time.Duration {
+	return now.Sub(p.BootTime)
+}
+
+// UptimeString formats an uptime the way uptime(1) and w(1) do: "42 days,  3:07".
+func UptimeString(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	mins := int(d.Minutes()) % 60
+	var s string
+	switch days {
+	case 0:
+	case 1:
+		s = "1 day, "
+	default:
+		s = fmt.Sprintf("%d days, ", days)
+	}
+	if hours == 0 {
+		return s + fmt.Sprintf("%d min", mins)
+	}
+	return s + fmt.Sprintf("%2d:%02d", hours, mins)
+}
+
+// LoadAvg is the load average reported everywhere; the box is idle.
+var LoadAvg = [3]float64{0.08, 0.03, 0.01}
+
+// Memory is a breakdown of RAM in kilobytes, as free(1) prints it.
+type Memory struct {
+	Total, Used, Free, Shared, Buffers, Cached, Available int64
+}
+
+// Memory returns the memory usage of a lightly loaded server.
+func (p *Persona) Memory() Memory {
+	t := p.MemoryKB
+	m := Memory{
+		Total:   t,
+		Used:    t * 38 / 100,
+		Free:    t * 11 / 100,
+		Shared:  t * 1 / 100,
+		Buffers: t * 4 / 100,
+	}
+	m.Cached = t - m.Used - m.Free - m.Buffers
+	m.Available = m.Free + (m.Buffers+m.Cached)*85/100
+	return m
+}
+
+// ProcFiles returns the contents of the /proc files that describe the machine at now.
+func (p *Persona) ProcFiles(now time.Time) map[string]string {
+	up := p.Uptime(now).Seconds()
+	m := p.Memory()
+	return map[string]string{
+		"/proc/cpuinfo": p.cpuinfo(),
+		"/proc/meminfo": fmt.Sprintf("MemTotal:       %8d kB\nMemFree:        %8d kB\nMemAvailable:   %8d kB\nBuffers:        %8d kB\nCached:         %8d kB\nSwapCached:            0 kB\nShmem:          %8d kB\nSwapTotal:             0 kB\nSwapFree:              0 kB\n",
+			m.Total, m.Free, m.Available, m.Buffers, m.Cached, m.Shared),
+		"/proc/version": fmt.Sprintf("%s version %s (buildd@lcy02-amd64-045) (gcc (Ubuntu 11.4.0-1ubuntu1~22.04) 11.4.0, GNU ld (GNU Binutils for Ubuntu) 2.38) %s\n",
+			KernelName, KernelRelease, KernelVersion),
+		"/proc/uptime":               fmt.Sprintf("%.2f %.2f\n", up, up*float64(p.CPUs)*0.97),
+		"/proc/loadavg":              fmt.Sprintf("%.2f %.2f %.2f 1/%d 2287\n", LoadAvg[0], LoadAvg[1], LoadAvg[2], 140+p.CPUs*2),
+		"/proc/cmdline":              "BOOT_IMAGE=/boot/vmlinuz-" + KernelRelease + " root=LABEL=cloudimg-rootfs ro console=tty1 console=ttyS0\n",
+		"/proc/sys/kernel/hostname":  p.Hostname + "\n",
+		"/proc/sys/kernel/osrelease": KernelRelease + "\n",
+	}
+}
+
+const cpuFlags = "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ht syscall nx rdtscp lm constant_tsc rep_good nopl xtopology cpuid tsc_known_freq pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic movbe popcnt tsc_deadline_timer aes xsave avx f16c rdrand hypervisor lahf_lm abm cpuid_fault invpcid_single pti fsgsbase bmi1 avx2 smep bmi2 erms invpcid xsaveopt"
+
+func (p *Persona) cpuinfo() string {
+	var b strings.Builder
+	for i := 0; i < p.CPUs; i++ {
+		fmt.Fprintf(&b, `processor	: %d
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 63
+model name	: %s
+stepping	: 2
+microcode	: 0x49
+cpu MHz		: 2399.998
+cache size	: 30720 KB
+physical id	: 0
+siblings	: %d
+core id		: %d
+cpu cores	: %d
+apicid		: %d
+initial apicid	: %d
+fpu		: yes
+fpu_exception	: yes
+cpuid level	: 13
+wp		: yes
+flags		: %s
+bugs		: cpu_meltdown spectre_v1 spectre_v2 spec_store_bypass l1tf mds swapgs itlb_multihit mmio_unknown
+bogomips	: 4799.99
+clflush size	: 64
+cache_alignment	: 64
+address sizes	: 46 bits physical, 48 bits virtual
+power management:
+
+`, i, CPUModel, p.CPUs, i, p.CPUs, i*2, i*2, cpuFlags)
+	}
+	return b.String()
+}
@@ -0,0 +1,628 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// Packet types from draft-ietf-secsh-filexfer-02 (SFTP version 3), the
+// version OpenSSH speaks.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Open flags.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Attribute flags.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+const (
+	maxPacket   = 256 * 1024
+	maxReadSize = 32 * 1024
+	maxHandles  = 64
+	// maxBuffered caps the upload data held across all open handles.
+	maxBuffered = 256 << 20
+)
+
+// DefaultMaxFileSize caps one upload when Server.MaxFileSize is 0.
+const DefaultMaxFileSize = 64 << 20
+
+var errBadMessage = errors.New("malformed sftp packet")
+
+// Server serves the SFTP subsystem from a virtual filesystem. Writes are
+// buffered in memory per handle and handed to OnUpload when the file is
+// closed, so nothing is written to the host except through that callback.
+type Server struct {
+	FS   *vfs.FS
+	User string
+	Home string
+	// MaxFileSize caps how much of one upload is kept; later writes fail.
+	// Zero applies DefaultMaxFileSize.
+	MaxFileSize int64
+	// OnUpload is called when a file opened for writing is closed.
+	OnUpload func(path string, data []byte, truncated bool)
+	// OnDownload is called when a file that was read from is closed.
+	OnDownload func(path string, size int64)
+
+	handles  map[string]*handle
+	nextID   int
+	buffered int64 // bytes held by write handles
+}
+
+type handle struct {
+	path      string
+	dir       bool
+	entries   []*vfs.Node
+	listed    bool
+	write     bool
+	read      bool
+	data      []byte
+	truncated bool
+}
+
+// Serve processes requests from rw until the client disconnects.
+func (s *Server) Serve(rw io.ReadWriter) error {
+	s.handles = make(map[string]*handle)
+	defer s.closeAll()
+	for {
+		typ, body, err := readPacket(rw)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if typ == fxpInit {
+			w := newWriter(fxpVersion)
+			w.uint32(3)
+			if err := w.send(rw); err != nil {
+				return err
+			}
+			continue
+		}
+		r := &reader{b: body}
+		id := r.uint32()
+		if r.err != nil {
+			return errBadMessage
+		}
+		resp := s.dispatch(typ, id, r)
+		if err := resp.send(rw); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) dispatch(typ byte, id uint32, r *reader) *writer {
+	switch typ {
+	case fxpRealpath:
+		// Like OpenSSH, the resolved path is returned without attributes.
+		return nameResponse(id, []nameEntry{{name: s.abs(r.string())}}, s.FS)
+	case fxpStat, fxpLstat:
+		n, err := s.FS.Stat(s.abs(r.string()))
+		if err != nil {
+			return statusResponse(id, err)
+		}
+		return attrsResponse(id, n, s.FS)
+	case fxpFstat:
+		h, ok := s.handles[r.string()]
+		if !ok {
+			return statusResponse(id, fs.ErrInvalid)
+		}
+		if h.write {
+			return attrsResponse(id, &vfs.Node{Mode: 0644, Owner: s.User, ModTime: time.Now(), Data: h.data}, s.FS)
+		}
+		n, err := s.FS.Stat(h.path)
+		if err != nil {
+			return statusResponse(id, err)
+		}
+		return attrsResponse(id, n, s.FS)
+	case fxpOpen:
+		return s.open(id, r)
+	case fxpClose:
+		return s.close(id, r.string())
+	case fxpRead:
+		return s.read(id, r)
+	case fxpWrite:
+		return s.write(id, r)
+	case fxpOpendir:
+		p := s.abs(r.string())
+		entries, err := s.FS.ReadDir(p)
+		if err != nil {
+			return statusResponse(id, err)
+		}
+		return s.newHandle(id, &handle{path: p, dir: true, entries: entries})
+	case fxpReaddir:
+		h, ok := s.handles[r.string()]
+		if !ok || !h.dir {
+			return statusResponse(id, fs.ErrInvalid)
+		}
+		if h.listed {
+			return statusCode(id, fxEOF, "End of file")
+		}
+		h.listed = true
+		var out []nameEntry
+		if self, err := s.FS.Stat(h.path); err == nil {
+			out = append(out, nameEntry{name: ".", node: self})
+		}
+		if parent, err := s.FS.Stat(path.Dir(h.path)); err == nil {
+			out = append(out, nameEntry{name: "..", node: parent})
+		}
+		for _, e := range h.entries {
+			out = append(out, nameEntry{name: e.Name, node: e})
+		}
+		return nameResponse(id, out, s.FS)
+	case fxpRemove, fxpRmdir:
+		p := s.abs(r.string())
+		n, err := s.FS.Stat(p)
+		if err == nil && n.IsDir() != (typ == fxpRmdir) {
+			err = fs.ErrPermission
+		}
+		if err == nil {
+			err = s.FS.Remove(p)
+		}
+		return statusResponse(id, err)
+	case fxpMkdir:
+		p := s.abs(r.string())
+		if _, err := s.FS.Stat(p); err == nil {
+			return statusCode(id, fxFailure, "Failure")
+		}
+		if _, err := s.FS.Stat(path.Dir(p)); err != nil {
+			return statusResponse(id, err)
+		}
+		return statusResponse(id, s.FS.MkdirAll(p, 0755, s.User))
+	case fxpRename:
+		oldPath, newPath := s.abs(r.string()), s.abs(r.string())
+		if _, err := s.FS.Stat(newPath); err == nil {
+			return statusCode(id, fxFailure, "Failure")
+		}
+		return statusResponse(id, s.FS.Rename(oldPath, newPath))
+	case fxpSetstat:
+		p := s.abs(r.string())
+		return statusResponse(id, s.setstat(p, r))
+	case fxpFsetstat:
+		h, ok := s.handles[r.string()]
+		if !ok {
+			return statusResponse(id, fs.ErrInvalid)
+		}
+		if h.write {
+			return statusCode(id, fxOK, "Success")
+		}
+		return statusResponse(id, s.setstat(h.path, r))
+	case fxpReadlink, fxpSymlink, fxpExtended:
+		return statusCode(id, fxOpUnsupported, "Operation unsupported")
+	}
+	return statusCode(id, fxOpUnsupported, "Operation unsupported")
+}
+
+func (s *Server) open(id uint32, r *reader) *writer {
+	p := s.abs(r.string())
+	flags := r.uint32()
+	if r.err != nil {
+		return statusCode(id, fxBadMessage, "Bad message")
+	}
+	n, err := s.FS.Stat(p)
+	if err == nil && n.IsDir() {
+		return statusCode(id, fxFailure, "Failure")
+	}
+	if flags&fxfWrite == 0 {
+		if err != nil {
+			return statusResponse(id, err)
+		}
+		data, err := s.FS.ReadFile(p)
+		if err != nil {
+			return statusResponse(id, err)
+		}
+		return s.newHandle(id, &handle{path: p, data: data})
+	}
+
+	if err == nil && flags&fxfExcl != 0 {
+		return statusCode(id, fxFailure, "Failure")
+	}
+	if err != nil && flags&fxfCreat == 0 {
+		return statusResponse(id, err)
+	}
+	if parent, err := s.FS.Stat(path.Dir(p)); err != nil || !parent.IsDir() {
+		return statusCode(id, fxNoSuchFile, "No such file")
+	}
+	h := &handle{path: p, write: true}
+	if err == nil && flags&fxfTrunc == 0 {
+		h.data, _ = s.FS.ReadFile(p)
+		s.buffered += int64(len(h.data))
+	}
+	return s.newHandle(id, h)
+}
+
+func (s *Server) read(id uint32, r *reader) *writer {
+	h, ok := s.handles[r.string()]
+	off, length := r.uint64(), r.uint32()
+	if !ok || h.dir || r.err != nil {
+		return statusResponse(id, fs.ErrInvalid)
+	}
+	if off >= uint64(len(h.data)) {
+		return statusCode(id, fxEOF, "End of file")
+	}
+	if length > maxReadSize {
+		length = maxReadSize
+	}
+	end := off + uint64(length)
+	if end > uint64(len(h.data)) {
+		end = uint64(len(h.data))
+	}
+	h.read = true
+	w := newWriter(fxpData)
+	w.uint32(id)
+	w.bytes(h.data[off:end])
+	return w
+}
+
+func (s *Server) write(id uint32, r *reader) *writer {
+	h, ok := s.handles[r.string()]
+	off := r.uint64()
+	data := r.bytes()
+	if !ok || !h.write || r.err != nil {
+		return statusResponse(id, fs.ErrInvalid)
+	}
+	// Checked without computing off+len, which an offset near 2^64 would
+	// overflow past the limit.
+	limit := uint64(DefaultMaxFileSize)
+	if s.MaxFileSize > 0 {
+		limit = uint64(s.MaxFileSize)
+	}
+	if off > limit || uint64(len(data)) > limit-off {
+		h.truncated = true
+		return statusCode(id, fxFailure, "Failure")
+	}
+	end := off + uint64(len(data))
+	if end > uint64(len(h.data)) {
+		// Buffered data has yet to be written to FS, so it counts against
+		// the room FS has left as well.
+		buffered := s.buffered + int64(end) - int64(len(h.data))
+		if buffered > min(maxBuffered, s.FS.Room()) {
+			h.truncated = true
+			return statusCode(id, fxFailure, "Failure")
+		}
+		s.buffered = buffered
+		grown := make([]byte, end)
+		copy(grown, h.data)
+		h.data = grown
+	}
+	copy(h.data[off:], data)
+	return statusCode(id, fxOK, "Success")
+}
+
+func (s *Server) close(id uint32, name string) *writer {
+	h, ok := s.handles[name]
+	if !ok {
+		return statusResponse(id, fs.ErrInvalid)
+	}
+	delete(s.handles, name)
+	return statusResponse(id, s.finish(h))
+}
+
+// finish flushes a write handle into the filesystem and reports transfers.
+// An upload is reported even when the filesystem has no room for it.
+func (s *Server) finish(h *handle) error {
+	switch {
+	case h.write:
+		s.buffered -= int64(len(h.data))
+		err := s.FS.WriteFile(h.path, h.data, 0644, s.User)
+		if s.OnUpload != nil && (err == nil || errors.Is(err, vfs.ErrNoSpace)) {
+			s.OnUpload(h.path, h.data, h.truncated)
+		}
+		if err != nil {
+			return err
+		}
+	case h.read && s.OnDownload != nil:
+		s.OnDownload(h.path, int64(len(h.data)))
+	}
+	return nil
+}
+
+// closeAll finishes handles the client never closed, so abandoned uploads are still captured.
+func (s *Server) closeAll() {
+	for name, h := range s.handles {
+		delete(s.handles, name)
+		s.finish(h)
+	}
+}
+
+func (s *Server) setstat(p string, r *reader) error {
+	if _, err := s.FS.Stat(p); err != nil {
+		return err
+	}
+	flags := r.uint32()
+	if flags&attrSize != 0 {
+		r.uint64()
+	}
+	if flags&attrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&attrPermissions != 0 {
+		if perm := r.uint32(); r.err == nil {
+			return s.FS.Chmod(p, fs.FileMode(perm&0777))
+		}
+	}
+	return nil
+}
+
+func (s *Server) newHandle(id uint32, h *handle) *writer {
+	if len(s.handles) >= maxHandles {
+		return statusCode(id, fxFailure, "Failure")
+	}
+	s.nextID++
+	name := strconv.Itoa(s.nextID)
+	s.handles[name] = h
+	w := newWriter(fxpHandle)
+	w.uint32(id)
+	w.string(name)
+	return w
+}
+
+func (s *Server) abs(p string) string {
+	if p == "" {
+		p = "."
+	}
+	return vfs.Clean(s.Home, p)
+}
+
+// nameEntry is one element of an SSH_FXP_NAME response; node may be nil.
+type nameEntry struct {
+	name string
+	node *vfs.Node
+}
+
+func nameResponse(id uint32, entries []nameEntry, fsys *vfs.FS) *writer {
+	w := newWriter(fxpName)
+	w.uint32(id)
+	w.uint32(uint32(len(entries)))
+	for _, e := range entries {
+		w.string(e.name)
+		if e.node == nil {
+			w.string(e.name)
+			w.uint32(0)
+			continue
+		}
+		w.string(longName(e.name, e.node, fsys))
+		writeAttrs(w, e.node, fsys)
+	}
+	return w
+}
+
+func attrsResponse(id uint32, n *vfs.Node, fsys *vfs.FS) *writer {
+	w := newWriter(fxpAttrs)
+	w.uint32(id)
+	writeAttrs(w, n, fsys)
+	return w
+}
+
+func writeAttrs(w *writer, n *vfs.Node, fsys *vfs.FS) {
+	w.uint32(attrSize | attrUIDGID | attrPermissions | attrACModTime)
+	w.uint64(uint64(n.Size()))
+	id := userID(fsys, n.Owner)
+	w.uint32(id)
+	w.uint32(id)
+	w.uint32(unixMode(n.Mode))
+	w.uint32(uint32(n.ModTime.Unix()))
+	w.uint32(uint32(n.ModTime.Unix()))
+}
+
+// longName formats an entry the way OpenSSH's sftp-server does for "ls -l".
+func longName(name string, n *vfs.Node, fsys *vfs.FS) string {
+	links := 1
+	if n.IsDir() {
+		links = 2
+	}
+	owner := n.Owner
+	if owner == "" {
+		owner = "root"
+	}
+	return fmt.Sprintf("%s %4d %-8s %-8s %8d %s %s", lsMode(n.Mode), links, owner, owner, n.Size(), n.ModTime.Format("Jan _2 15:04"), name)
+}
+
+func lsMode(m fs.FileMode) string {
+	s := []byte("-rwxrwxrwx")
+	switch {
+	case m.IsDir():
+		s[0] = 'd'
+	case m&fs.ModeSymlink != 0:
+		s[0] = 'l'
+	}
+	for i := 0; i < 9; i++ {
+		if m&(1<<uint(8-i)) == 0 {
+			s[i+1] = '-'
+		}
+	}
+	return string(s)
+}
+
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		return mode | 0040000
+	case m&fs.ModeSymlink != 0:
+		return mode | 0120000
+	}
+	return mode | 0100000
+}
+
+// userID looks the owner up in the virtual /etc/passwd so ids match what the shell shows.
+func userID(fsys *vfs.FS, owner string) uint32 {
+	if owner == "" || owner == "root" {
+		return 0
+	}
+	data, err := fsys.ReadFile("/etc/passwd")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Split(line, ":")
+			if len(f) > 2 && f[0] == owner {
+				if n, err := strconv.Atoi(f[2]); err == nil {
+					return uint32(n)
+				}
+			}
+		}
+	}
+	return 1000
+}
+
+func statusResponse(id uint32, err error) *writer {
+	switch {
+	case err == nil:
+		return statusCode(id, fxOK, "Success")
+	case errors.Is(err, fs.ErrNotExist):
+		return statusCode(id, fxNoSuchFile, "No such file")
+	case errors.Is(err, fs.ErrPermission):
+		return statusCode(id, fxPermissionDenied, "Permission denied")
+	}
+	return statusCode(id, fxFailure, "Failure")
+}
+
+func statusCode(id uint32, code uint32, msg string) *writer {
+	w := newWriter(fxpStatus)
+	w.uint32(id)
+	w.uint32(code)
+	w.string(msg)
+	w.string("")
+	return w
+}
+
+// readPacket reads one length-prefixed packet.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > maxPacket {
+		return 0, nil, errBadMessage
+	}
+	body := make([]byte, n-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], body, nil
+}
+
+// reader decodes SSH wire types, recording the first error.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.b)) < n {
+		r.err = errBadMessage
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+// writer encodes a response packet.
+type writer struct {
+	b []byte
+}
+
+func newWriter(typ byte) *writer {
+	return &writer{b: []byte{0, 0, 0, 0, typ}}
+}
+
+func (w *writer) uint32(v uint32) { w.b = binary.BigEndian.AppendUint32(w.b, v) }
+func (w *writer) uint64(v uint64) { w.b = binary.BigEndian.AppendUint64(w.b, v) }
+func (w *writer) bytes(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.b = append(w.b, v...)
+}
+func (w *writer) string(v string) { w.bytes([]byte(v)) }
+
+func (w *writer) send(out io.Writer) error {
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)-4))
+	_, err := out.Write(w.b)
+	return err
+}
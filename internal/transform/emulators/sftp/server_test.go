@@ -0,0 +1,132 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+func newTestServer(maxFileSize int64) *Server {
+	fsys := vfs.New()
+	fsys.MkdirAll("/root", 0700, "root")
+	return &Server{FS: fsys, User: "root", Home: "/root", MaxFileSize: maxFileSize, handles: make(map[string]*handle)}
+}
+
+// call dispatches one request whose fields after the id are written by fill.
+func call(t *testing.T, s *Server, typ byte, fill func(w *writer)) *writer {
+	t.Helper()
+	w := &writer{}
+	fill(w)
+	return s.dispatch(typ, 1, &reader{b: w.b})
+}
+
+func status(t *testing.T, resp *writer) uint32 {
+	t.Helper()
+	if resp.b[4] != fxpStatus {
+		t.Fatalf("response type %d, want status", resp.b[4])
+	}
+	return binary.BigEndian.Uint32(resp.b[9:])
+}
+
+func openForWrite(t *testing.T, s *Server, name string) string {
+	t.Helper()
+	resp := call(t, s, fxpOpen, func(w *writer) {
+		w.string(name)
+		w.uint32(fxfWrite | fxfCreat | fxfTrunc)
+		w.uint32(0)
+	})
+	if resp.b[4] != fxpHandle {
+		t.Fatalf("open %s: response type %d", name, resp.b[4])
+	}
+	r := &reader{b: resp.b[9:]}
+	return r.string()
+}
+
+func write(t *testing.T, s *Server, handle string, off uint64, data []byte) uint32 {
+	t.Helper()
+	return status(t, call(t, s, fxpWrite, func(w *writer) {
+		w.string(handle)
+		w.uint64(off)
+		w.bytes(data)
+	}))
+}
+
+func TestWriteOffsetOverflow(t *testing.T) {
+	for _, max := range []int64{0, 1 << 20} {
+		s := newTestServer(max)
+		h := openForWrite(t, s, "x")
+		if code := write(t, s, h, math.MaxUint64, []byte("A")); code != fxFailure {
+			t.Errorf("MaxFileSize %d: write at 2^64-1 returned %d, want failure", max, code)
+		}
+		if code := write(t, s, h, math.MaxUint64-2, []byte("ABCD")); code != fxFailure {
+			t.Errorf("MaxFileSize %d: wrapping write returned %d, want failure", max, code)
+		}
+		if !s.handles[h].truncated {
+			t.Errorf("MaxFileSize %d: rejected write not marked truncated", max)
+		}
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	s := newTestServer(10)
+	h := openForWrite(t, s, "x")
+	if code := write(t, s, h, 0, []byte("0123456789")); code != fxOK {
+		t.Fatalf("write up to the limit returned %d", code)
+	}
+	if code := write(t, s, h, 10, []byte("!")); code != fxFailure {
+		t.Errorf("write past the limit returned %d, want failure", code)
+	}
+
+	s = newTestServer(0)
+	if code := write(t, s, openForWrite(t, s, "big"), DefaultMaxFileSize, []byte("!")); code != fxFailure {
+		t.Errorf("write past DefaultMaxFileSize returned %d, want failure", code)
+	}
+}
+
+func TestWriteBudget(t *testing.T) {
+	s := newTestServer(0)
+	s.FS.SetBudget(10)
+	a, b := openForWrite(t, s, "a"), openForWrite(t, s, "b")
+	if code := write(t, s, a, 0, []byte("012345")); code != fxOK {
+		t.Fatalf("write within the budget returned %d", code)
+	}
+	// What a has buffered is not in FS yet but counts all the same.
+	if code := write(t, s, b, 0, []byte("012345")); code != fxFailure {
+		t.Errorf("write past the budget returned %d, want failure", code)
+	}
+	if !s.handles[b].truncated {
+		t.Error("rejected write not marked truncated")
+	}
+	s.closeAll()
+	if data, err := s.FS.ReadFile("/root/a"); err != nil || string(data) != "012345" {
+		t.Errorf("a = %q, %v", data, err)
+	}
+}
+
+func TestBufferedAcrossHandles(t *testing.T) {
+	s := newTestServer(0)
+	chunk := make([]byte, 1<<20)
+	var handles []string
+	for i := range maxBuffered/DefaultMaxFileSize + 1 {
+		handles = append(handles, openForWrite(t, s, string(rune('a'+i))))
+	}
+	failed := false
+	for _, h := range handles {
+		// Writing only the last byte of a full-size file buffers all of it.
+		if write(t, s, h, DefaultMaxFileSize-uint64(len(chunk)), chunk) == fxFailure {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Fatalf("buffered %d bytes across handles without a failure", s.buffered)
+	}
+	if s.buffered > maxBuffered {
+		t.Errorf("buffered %d bytes, more than %d", s.buffered, maxBuffered)
+	}
+	s.closeAll()
+	if s.buffered != 0 {
+		t.Errorf("buffered %d bytes after closing every handle", s.buffered)
+	}
+}
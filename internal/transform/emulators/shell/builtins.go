@@ -0,0 +1,426 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+func init() {
+	for name, h := range map[string]Handler{
+		"cat":     cmdCat,
+		"cd":      cmdCd,
+		"echo":    cmdEcho,
+		"exit":    cmdExit,
+		"history": cmdHistory,
+		"id":      cmdID,
+		"logout":  cmdExit,
+		"ls":      cmdLs,
+		"ps":      cmdPs,
+		"pwd":     cmdPwd,
+		"uname":   cmdUname,
+		"whoami":  cmdWhoami,
+	} {
+		Register(name, h)
+	}
+}
+
+// splitFlags separates single-dash short options from operands.
+func splitFlags(args []string) (flags string, operands []string) {
+	for i, a := range args {
+		if a == "--" {
+			return flags, append(operands, args[i+1:]...)
+		}
+		if len(a) > 1 && a[0] == '-' && a[1] != '-' {
+			flags += a[1:]
+			continue
+		}
+		operands = append(operands, a)
+	}
+	return flags, operands
+}
+
+func cmdCat(c *Call) int {
+	_, files := splitFlags(c.Args[1:])
+	if len(files) == 0 {
+		c.Stdout.Write(c.Stdin)
+		return 0
+	}
+	status := 0
+	for _, f := range files {
+		if f == "-" {
+			c.Stdout.Write(c.Stdin)
+			continue
+		}
+		data, err := c.Shell.fs.ReadFile(c.Shell.abs(f))
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "cat: %s: %s\n", f, ErrText(err))
+			status = 1
+			continue
+		}
+		c.Stdout.Write(data)
+	}
+	return status
+}
+
+func cmdCd(c *Call) int {
+	s := c.Shell
+	target := s.home
+	if len(c.Args) > 1 {
+		target = c.Args[1]
+	}
+	if target == "-" {
+		target = s.env["OLDPWD"]
+		if target == "" {
+			fmt.Fprintln(c.Stderr, "-bash: cd: OLDPWD not set")
+			return 1
+		}
+		fmt.Fprintln(c.Stdout, target)
+	}
+	p := s.abs(target)
+	n, err := s.fs.Stat(p)
+	if err == nil && !n.IsDir() {
+		err = vfs.ErrNotDir
+	}
+	if err != nil {
+		fmt.Fprintf(c.Stderr, "-bash: cd: %s: %s\n", target, ErrText(err))
+		return 1
+	}
+	s.env["OLDPWD"] = s.cwd
+	s.cwd = p
+	s.env["PWD"] = p
+	return 0
+}
+
+func cmdEcho(c *Call) int {
+	args := c.Args[1:]
+	newline, escapes := true, false
+	for len(args) > 0 && (args[0] == "-n" || args[0] == "-e" || args[0] == "-ne" || args[0] == "-en") {
+		if strings.Contains(args[0], "n") {
+			newline = false
+		}
+		if strings.Contains(args[0], "e") {
+			escapes = true
+		}
+		args = args[1:]
+	}
+	out := strings.Join(args, " ")
+	if escapes {
+		out = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\\`, `\`).Replace(out)
+	}
+	if newline {
+		out += "\n"
+	}
+	io.WriteString(c.Stdout, out)
+	return 0
+}
+
+// cmdExit leaves the shell like bash: a non-numeric status is an error
+// that still exits, with status 2, while extra arguments keep the shell
+// running.
+func cmdExit(c *Call) int {
+	s := c.Shell
+	if len(c.Args) > 2 {
+		if _, err := strconv.Atoi(c.Args[1]); err == nil {
+			fmt.Fprintf(c.Stderr, "-bash: %s: too many arguments\n", c.Args[0])
+			return 1
+		}
+	}
+	s.exited = true
+	if s.interactive {
+		fmt.Fprintln(c.Stdout, "logout")
+	}
+	if len(c.Args) > 1 {
+		n, err := strconv.Atoi(c.Args[1])
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "-bash: %s: %s: numeric argument required\n", c.Args[0], c.Args[1])
+			return 2
+		}
+		return n & 0xff
+	}
+	return s.status
+}
+
+func cmdHistory(c *Call) int {
+	for i, line := range c.Shell.history {
+		fmt.Fprintf(c.Stdout, "%5d  %s\n", i+1, line)
+	}
+	return 0
+}
+
+func cmdID(c *Call) int {
+	u := c.Shell.user
+	uid := c.Shell.uid()
+	if uid == 0 {
+		fmt.Fprintln(c.Stdout, "uid=0(root) gid=0(root) groups=0(root)")
+		return 0
+	}
+	fmt.Fprintf(c.Stdout, "uid=%d(%s) gid=%d(%s) groups=%d(%s),4(adm),24(cdrom),27(sudo),30(dip),46(plugdev)\n",
+		uid, u, uid, u, uid, u)
+	return 0
+}
+
+func cmdPwd(c *Call) int {
+	fmt.Fprintln(c.Stdout, c.Shell.cwd)
+	return 0
+}
+
+func cmdWhoami(c *Call) int {
+	fmt.Fprintln(c.Stdout, c.Shell.user)
+	return 0
+}
+
+func cmdUname(c *Call) int {
+	flags, _ := splitFlags(c.Args[1:])
+	if strings.Contains(flags, "a") {
+		fmt.Fprintln(c.Stdout, strings.Join([]string{persona.KernelName, c.Shell.persona.Hostname, persona.KernelRelease, persona.KernelVersion, persona.Machine, persona.Machine, persona.Machine, persona.OSName}, " "))
+		return 0
+	}
+	if flags == "" {
+		flags = "s"
+	}
+	var parts []string
+	for _, f := range "snrvmpio" {
+		if !strings.ContainsRune(flags, f) {
+			continue
+		}
+		switch f {
+		case 's':
+			parts = append(parts, persona.KernelName)
+		case 'n':
+			parts = append(parts, c.Shell.persona.Hostname)
+		case 'r':
+			parts = append(parts, persona.KernelRelease)
+		case 'v':
+			parts = append(parts, persona.KernelVersion)
+		case 'm', 'p', 'i':
+			parts = append(parts, persona.Machine)
+		case 'o':
+			parts = append(parts, persona.OSName)
+		}
+	}
+	fmt.Fprintln(c.Stdout, strings.Join(parts, " "))
+	return 0
+}
+
+func cmdLs(c *Call) int {
+	s := c.Shell
+	flags, targets := splitFlags(c.Args[1:])
+	long := strings.Contains(flags, "l")
+	all := strings.Contains(flags, "a")
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+
+	status := 0
+	var files []*vfs.Node
+	var dirs []string
+	for _, t := range targets {
+		// A long listing shows a link named on the command line itself, as
+		// does any listing of a link that leads nowhere.
+		stat := s.fs.Stat
+		if long {
+			stat = s.fs.Lstat
+		}
+		n, err := stat(s.abs(t))
+		if l, lerr := s.fs.Lstat(s.abs(t)); err != nil && lerr == nil {
+			n, err = l, nil
+		}
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "ls: cannot access '%s': %s\n", t, ErrText(err))
+			status = 2
+			continue
+		}
+		if n.IsDir() && !strings.Contains(flags, "d") {
+			dirs = append(dirs, t)
+			continue
+		}
+		named := *n
+		named.Name = t
+		files = append(files, &named)
+	}
+
+	if len(files) > 0 {
+		writeListing(c.Stdout, files, long)
+	}
+	for i, d := range dirs {
+		if len(targets) > 1 {
+			if i > 0 || len(files) > 0 {
+				fmt.Fprintln(c.Stdout)
+			}
+			fmt.Fprintf(c.Stdout, "%s:\n", d)
+		}
+		entries, _ := s.fs.ReadDir(s.abs(d))
+		var shown []*vfs.Node
+		if all {
+			self, _ := s.fs.Stat(s.abs(d))
+			parent, _ := s.fs.Stat(path.Dir(s.abs(d)))
+			dot, dotdot := *self, *parent
+			dot.Name, dotdot.Name = ".", ".."
+			shown = append(shown, &dot, &dotdot)
+		}
+		for _, e := range entries {
+			if all || !strings.HasPrefix(e.Name, ".") {
+				shown = append(shown, e)
+			}
+		}
+		if long {
+			var blocks int64
+			for _, e := range shown {
+				blocks += (e.Size() + 4095) / 4096 * 4
+			}
+			fmt.Fprintf(c.Stdout, "total %d\n", blocks)
+		}
+		writeListing(c.Stdout, shown, long)
+	}
+	return status
+}
+
+func writeListing(w io.Writer, nodes []*vfs.Node, long bool) {
+	if !long {
+		names := make([]string, len(nodes))
+		for i, n := range nodes {
+			names[i] = n.Name
+		}
+		if len(names) > 0 {
+			fmt.Fprintln(w, strings.Join(names, "  "))
+		}
+		return
+	}
+	sixMonthsAgo := time.Now().AddDate(0, -6, 0)
+	for _, n := range nodes {
+		links := 1
+		if n.IsDir() {
+			links = 2
+		}
+		stamp := n.ModTime.Format("Jan _2 15:04")
+		if n.ModTime.Before(sixMonthsAgo) {
+			stamp = n.ModTime.Format("Jan _2  2006")
+		}
+		name := n.Name
+		if n.IsSymlink() {
+			name += " -> " + string(n.Data)
+		}
+		fmt.Fprintf(w, "%s %d %s %s %5d %s %s\n", modeString(n.Mode), links, n.Owner, n.Group, n.Size(), stamp, name)
+	}
+}
+
+// modeString renders permissions the way ls does ("drwxr-xr-x", "-rw-r--r--").
+func modeString(m fs.FileMode) string {
+	s := []byte("-rwxrwxrwx")
+	switch {
+	case m.IsDir():
+		s[0] = 'd'
+	case m&fs.ModeSymlink != 0:
+		s[0] = 'l'
+	}
+	for i := 0; i < 9; i++ {
+		if m&(1<<uint(8-i)) == 0 {
+			s[i+1] = '-'
+		}
+	}
+	return string(s)
+}
+
+// process is an entry in the fake process table. Services started at boot
+// take their start time from the persona; %MEM is derived from its RAM.
+type process struct {
+	user    string
+	pid     int
+	cpu     string
+	vsz     int
+	rss     int
+	tty     string
+	stat    string
+	time    string
+	command string
+}
+
+var processTable = []process{
+	{"root", 1, "0.0", 167744, 13112, "?", "Ss", "0:21", "/sbin/init"},
+	{"root", 2, "0.0", 0, 0, "?", "S", "0:00", "[kthreadd]"},
+	{"root", 3, "0.0", 0, 0, "?", "I<", "0:00", "[rcu_gp]"},
+	{"root", 412, "0.0", 64376, 16524, "?", "S<s", "0:09", "/lib/systemd/systemd-journald"},
+	{"root", 448, "0.0", 25436, 6292, "?", "Ss", "0:01", "/lib/systemd/systemd-udevd"},
+	{"systemd+", 540, "0.0", 16120, 5916, "?", "Ss", "0:02", "/lib/systemd/systemd-networkd"},
+	{"systemd+", 602, "0.0", 25532, 7400, "?", "Ss", "0:03", "/lib/systemd/systemd-resolved"},
+	{"root", 688, "0.0", 6892, 2820, "?", "Ss", "0:00", "/usr/sbin/cron -f"},
+	{"message+", 689, "0.0", 8776, 4820, "?", "Ss", "0:02", "@dbus-daemon --system --address=systemd: --nofork"},
+	{"syslog", 702, "0.0", 222400, 5284, "?", "Ssl", "0:04", "/usr/sbin/rsyslogd -n -iNONE"},
+	{"root", 741, "0.0", 15432, 7300, "?", "Ss", "0:00", "sshd: /usr/sbin/sshd -D [listener] 0 of 10-100 startups"},
+	{"root", 757, "0.0", 55228, 1648, "?", "Ss", "0:00", "nginx: master process /usr/sbin/nginx -g daemon on; master_process on;"},
+	{"www-data", 758, "0.0", 55896, 5520, "?", "S", "0:12", "nginx: worker process"},
+	{"mysql", 801, "0.2", 2429360, 398276, "?", "Ssl", "31:07", "/usr/sbin/mysqld"},
+}
+
+// sessionProcesses returns the attacker's own login shell and the command being run.
+func (s *Shell) sessionProcesses(cmdline string) []process {
+	return []process{
+		{s.user, 2214, "0.0", 10032, 5248, "pts/0", "Ss", "0:00", "-bash"},
+		{s.user, 2287, "0.0", 10876, 3360, "pts/0", "R+", "0:00", cmdline},
+	}
+}
+
+func cmdPs(c *Call) int {
+	s := c.Shell
+	flags, operands := splitFlags(c.Args[1:])
+	bsd := len(operands) > 0 && strings.ContainsAny(operands[0], "ax")
+	sysv := strings.ContainsAny(flags, "eA")
+	self := s.sessionProcesses(strings.Join(c.Args, " "))
+	boot := s.persona.BootTime.Format("Jan02")
+	login := s.started.Format("15:04")
+	if !bsd && !sysv {
+		fmt.Fprintln(c.Stdout, "    PID TTY          TIME CMD")
+		for _, p := range self {
+			fmt.Fprintf(c.Stdout, "%7d %-8s 00:00:00 %s\n", p.pid, p.tty, strings.Fields(p.command)[0])
+		}
+		return 0
+	}
+	if sysv {
+		fmt.Fprintln(c.Stdout, "UID          PID    PPID  C STIME TTY          TIME CMD")
+		for _, p := range processTable {
+			fmt.Fprintf(c.Stdout, "%-8s %7d %7d  0 %-5s %-8s 00:00:00 %s\n", p.user, p.pid, 1, boot, p.tty, p.command)
+		}
+		for _, p := range self {
+			fmt.Fprintf(c.Stdout, "%-8s %7d %7d  0 %-5s %-8s 00:00:00 %s\n", p.user, p.pid, 1, login, p.tty, p.command)
+		}
+		return 0
+	}
+	fmt.Fprintln(c.Stdout, "USER         PID %CPU %MEM    VSZ   RSS TTY      STAT START   TIME COMMAND")
+	memKB := float64(s.persona.MemoryKB)
+	for i, p := range append(processTable, self...) {
+		start := boot
+		if i >= len(processTable) {
+			start = login
+		}
+		fmt.Fprintf(c.Stdout, "%-8s %7d %4s %4.1f %6d %5d %-8s %-4s %-5s %6s %s\n",
+			p.user, p.pid, p.cpu, float64(p.rss)*100/memKB, p.vsz, p.rss, p.tty, p.stat, start, p.time, p.command)
+	}
+	return 0
+}
+
+// uid returns the numeric user ID from /etc/passwd, defaulting to 1000.
+func (s *Shell) uid() int {
+	if s.user == "root" {
+		return 0
+	}
+	data, err := s.fs.ReadFile("/etc/passwd")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Split(line, ":")
+			if len(f) > 2 && f[0] == s.user {
+				if n, err := strconv.Atoi(f[2]); err == nil {
+					return n
+				}
+			}
+		}
+	}
+	return 1000
+}
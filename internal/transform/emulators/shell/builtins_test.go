@@ -0,0 +1,34 @@
+package shell
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   string
+		status int
+		exited bool
+	}{
+		{line: "exit", exited: true},
+		{line: "false; exit", status: 1, exited: true},
+		{line: "exit 3", status: 3, exited: true},
+		{line: "exit 257", status: 1, exited: true},
+		{line: "exit abc", want: "-bash: exit: abc: numeric argument required\n", status: 2, exited: true},
+		{line: "exit 1 2", want: "-bash: exit: too many arguments\n", status: 1},
+		{line: "exit abc 2", want: "-bash: exit: abc: numeric argument required\n", status: 2, exited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			s := newTestShell(t, nil, nil)
+			var out bytes.Buffer
+			status := s.Execute(tt.line, &out)
+			if out.String() != tt.want || status != tt.status || s.Exited() != tt.exited {
+				t.Errorf("got %q, status %d, exited %v; want %q, status %d, exited %v",
+					out.String(), status, s.Exited(), tt.want, tt.status, tt.exited)
+			}
+		})
+	}
+}
@@ -0,0 +1,649 @@
+package shell
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/fetch"
+)
+
+func init() {
+	for name, h := range map[string]Handler{
+		"busybox": cmdBusybox,
+		"curl":    cmdCurl,
+		"tftp":    cmdTftp,
+		"wget":    cmdWget,
+	} {
+		Register(name, h)
+	}
+}
+
+// User agents of the tools as shipped with the persona's distribution.
+const (
+	wgetUserAgent    = "Wget/1.21.2"
+	curlUserAgent    = "curl/7.81.0"
+	busyboxUserAgent = "Wget"
+)
+
+// payload is the outcome of a download as the emulated tool reports it.
+type payload struct {
+	status      int // HTTP status, 0 for other protocols
+	contentType string
+	data        []byte
+	err         error // transport failure; the tool prints a connection error
+}
+
+// download records a URL handed to tool and, when the shell has a fetcher,
+// retrieves it into the quarantine. Without one the download is made up so
+// that the attacker carries on with the rest of the dropper. savePath is only
+// used for the event.
+func (s *Shell) download(tool, rawURL, userAgent, savePath string) payload {
+	ev := &events.Download{Tool: tool, URL: rawURL, Path: savePath}
+	var p payload
+	if s.fetcher == nil {
+		p = standIn(rawURL, savePath == "")
+	} else {
+		res, err := s.fetcher.Fetch(context.Background(), fetch.Request{URL: rawURL, UserAgent: userAgent})
+		if err != nil {
+			ev.Error = err.Error()
+			p.err = err
+		} else {
+			ev.Fetched = true
+			ev.Status = res.Status
+			ev.Size = int64(len(res.Data))
+			ev.Truncated = res.Truncated
+			if res.Status < 300 {
+				ev.SHA256 = s.keep(res.Data)
+			}
+			p = payload{status: res.Status, contentType: res.ContentType, data: res.Data}
+		}
+	}
+	if s.sess != nil {
+		ev.Meta = s.sess.Meta()
+		events.Publish(ev)
+	}
+	return p
+}
+
+// keep stores a successfully fetched payload in the quarantine and returns its hash.
+func (s *Shell) keep(data []byte) string {
+	if s.samples != nil {
+		if res, err := s.samples.Save(data); err == nil || res.SHA256 != "" {
+			return res.SHA256
+		}
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptExtensions mark URLs whose stand-in payload is a script.
+var scriptExtensions = map[string]bool{".sh": true, ".bash": true, ".py": true, ".pl": true}
+
+// standIn makes up the payload of a URL that is not fetched. Scripts, and
+// anything written to stdout where it is likely piped into sh, get an empty
+// shell script; everything else a stable, plausibly sized blob that looks
+// like a static ELF binary.
+func standIn(rawURL string, toStdout bool) payload {
+	if toStdout || scriptExtensions[path.Ext(rawURL)] {
+		return payload{status: http.StatusOK, contentType: "text/x-sh", data: []byte("#!/bin/sh\n")}
+	}
+	h := fnv.New64a()
+	io.WriteString(h, rawURL)
+	seed := h.Sum64()
+	r := rand.New(rand.NewPCG(seed, seed>>32))
+	data := make([]byte, 20480+int(seed%81920))
+	for i := range data {
+		data[i] = byte(r.UintN(256))
+	}
+	copy(data, "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00")
+	return payload{status: http.StatusOK, contentType: "application/octet-stream", data: data}
+}
+
+// parseURL accepts URLs the way wget and curl do, defaulting to http.
+func parseURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err == nil && u.Host == "" {
+		err = errors.New("missing host")
+	}
+	return u, err
+}
+
+// port returns the URL's port, or the scheme's default.
+func port(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	switch u.Scheme {
+	case "https":
+		return "443"
+	case "ftp":
+		return "21"
+	case "tftp":
+		return "69"
+	}
+	return "80"
+}
+
+// resolve returns an address for u's host without a DNS lookup, which would
+// tip off whoever runs the name server. Names map to a stable public address.
+func resolve(u *url.URL) string {
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	h := fnv.New32a()
+	io.WriteString(h, host)
+	n := h.Sum32()
+	first := [...]int{45, 91, 104, 141, 172, 185, 193, 209}[n%8]
+	return fmt.Sprintf("%d.%d.%d.%d", first, n>>8&0xff, n>>16&0xff, 2+(n>>24)%250)
+}
+
+// remoteName is the file name wget and curl -O derive from a URL.
+func remoteName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." || name == "" {
+		return "index.html"
+	}
+	return name
+}
+
+// dialError phrases a fetch failure as the kernel error a real tool would see.
+func dialError(err error) string {
+	var nerr net.Error
+	switch {
+	case errors.As(err, &nerr) && nerr.Timeout(), errors.Is(err, context.DeadlineExceeded), errors.Is(err, fetch.ErrForbiddenAddress):
+		return "Connection timed out"
+	case errors.Is(err, fetch.ErrUnsupportedScheme):
+		return "Unsupported scheme"
+	}
+	return "Connection refused"
+}
+
+// transferTime is how long a download pretends to have taken, at about 1.2 MB/s.
+func transferTime(size int) time.Duration {
+	return time.Duration(size)*time.Second/1200000 + 40*time.Millisecond
+}
+
+// wgetSize formats a byte count the way wget's Length line does.
+func wgetSize(n int) string {
+	v := float64(n)
+	for _, unit := range []string{"", "K", "M", "G"} {
+		if v < 1024 || unit == "G" {
+			if unit == "" {
+				return fmt.Sprint(n)
+			}
+			if v < 10 {
+				return fmt.Sprintf("%.1f%s", v, unit)
+			}
+			return fmt.Sprintf("%.0f%s", v, unit)
+		}
+		v /= 1024
+	}
+	return fmt.Sprint(n)
+}
+
+func cmdWget(c *Call) int {
+	return wget(c, false)
+}
+
+// wget emulates GNU wget or, when busybox is set, the busybox applet.
+func wget(c *Call, busybox bool) int {
+	s := c.Shell
+	var urls []string
+	var output, prefix string
+	quiet := false
+	userAgent := wgetUserAgent
+	if busybox {
+		userAgent = busyboxUserAgent
+	}
+	args := c.Args[1:]
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-O" || a == "--output-document" || a == "-P" || a == "--directory-prefix" || a == "-U" || a == "--user-agent" || a == "-o" || a == "-T" || a == "-t":
+			if i+1 < len(args) {
+				switch a {
+				case "-O", "--output-document":
+					output = args[i+1]
+				case "-P", "--directory-prefix":
+					prefix = args[i+1]
+				case "-U", "--user-agent":
+					userAgent = args[i+1]
+				}
+				i++
+			}
+		case strings.HasPrefix(a, "--output-document="):
+			output = strings.TrimPrefix(a, "--output-document=")
+		case strings.HasPrefix(a, "--directory-prefix="):
+			prefix = strings.TrimPrefix(a, "--directory-prefix=")
+		case strings.HasPrefix(a, "--user-agent="):
+			userAgent = strings.TrimPrefix(a, "--user-agent=")
+		case a == "--quiet":
+			quiet = true
+		case strings.HasPrefix(a, "--"):
+		case strings.HasPrefix(a, "-") && len(a) > 1:
+			// Bundled short options such as -qO- or -qO file.
+			flags := a[1:]
+			if j := strings.IndexByte(flags, 'O'); j >= 0 {
+				if rest := flags[j+1:]; rest != "" {
+					output = rest
+				} else if i+1 < len(args) {
+					output = args[i+1]
+					i++
+				}
+				flags = flags[:j]
+			}
+			if strings.Contains(flags, "q") {
+				quiet = true
+			}
+		default:
+			urls = append(urls, a)
+		}
+	}
+	if len(urls) == 0 {
+		if busybox {
+			fmt.Fprintln(c.Stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-7ubuntu3) multi-call binary.\n\nUsage: wget [-c|--continue] [--spider] [-q|--quiet] [-O|--output-document FILE]\n\t[--header 'header: value'] [-Y|--proxy on/off] [-P DIR]\n\t[-S|--server-response] [-U|--user-agent AGENT] [-T SEC] URL...")
+		} else {
+			fmt.Fprintln(c.Stderr, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.")
+		}
+		return 1
+	}
+
+	progress := c.Stderr
+	if quiet {
+		progress = io.Discard
+	}
+	tool := "wget"
+	if busybox {
+		tool = "busybox wget"
+	}
+	status := 0
+	for _, raw := range urls {
+		u, err := parseURL(raw)
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "%s: bad address '%s'\n", tool, raw)
+			status = 1
+			continue
+		}
+		name := output
+		if name == "" {
+			name = remoteName(u)
+			if prefix != "" {
+				name = path.Join(prefix, name)
+			}
+			if !busybox {
+				name = s.freeName(name)
+			}
+		}
+		target := ""
+		if name != "-" {
+			target = s.abs(name)
+		}
+		p := s.download(tool, u.String(), userAgent, target)
+		var ok bool
+		if busybox {
+			ok = busyboxWgetReport(c, progress, u, name, p)
+		} else {
+			ok = wgetReport(progress, u, name, p)
+		}
+		if !ok {
+			if busybox {
+				status = 1
+			} else if p.err != nil {
+				status = 4
+			} else {
+				status = 8
+			}
+			continue
+		}
+		if name == "-" {
+			c.Stdout.Write(p.data)
+			continue
+		}
+		if err := s.writeInDir(target, p.data); err != nil {
+			fmt.Fprintf(c.Stderr, "%s: %s: %s\n", tool, name, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// freeName returns name, or name.1, name.2, ... if it already exists, as
+// wget does instead of overwriting.
+func (s *Shell) freeName(name string) string {
+	candidate := name
+	for i := 1; ; i++ {
+		if _, err := s.fs.Stat(s.abs(candidate)); err != nil {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.%d", name, i)
+	}
+}
+
+// wgetReport prints GNU wget's progress for a download and reports whether it succeeded.
+func wgetReport(w io.Writer, u *url.URL, name string, p payload) bool {
+	now := time.Now()
+	fmt.Fprintf(w, "--%s--  %s\n", now.Format("2006-01-02 15:04:05"), u)
+	ip, host := resolve(u), u.Hostname()
+	if ip == host {
+		fmt.Fprintf(w, "Connecting to %s:%s... ", host, port(u))
+	} else {
+		fmt.Fprintf(w, "Resolving %s (%s)... %s\n", host, host, ip)
+		fmt.Fprintf(w, "Connecting to %s (%s)|%s|:%s... ", host, host, ip, port(u))
+	}
+	if p.err != nil {
+		fmt.Fprintf(w, "failed: %s.\n", dialError(p.err))
+		return false
+	}
+	fmt.Fprintln(w, "connected.")
+	text := http.StatusText(p.status)
+	fmt.Fprintf(w, "HTTP request sent, awaiting response... %d %s\n", p.status, text)
+	if p.status >= 400 {
+		fmt.Fprintf(w, "%s ERROR %d: %s.\n\n", now.Format("2006-01-02 15:04:05"), p.status, text)
+		return false
+	}
+	size := len(p.data)
+	contentType := p.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if size < 1024 {
+		fmt.Fprintf(w, "Length: %d [%s]\n", size, contentType)
+	} else {
+		fmt.Fprintf(w, "Length: %d (%s) [%s]\n", size, wgetSize(size), contentType)
+	}
+	if name == "-" {
+		fmt.Fprint(w, "Saving to: ‘STDOUT’\n\n")
+	} else {
+		fmt.Fprintf(w, "Saving to: ‘%s’\n\n", name)
+	}
+	took := transferTime(size)
+	label := path.Base(name)
+	if name == "-" {
+		label = "-"
+	}
+	fmt.Fprintf(w, "%-19.19s 100%%[===================>] %7s  --.-KB/s    in %.2fs   \n\n",
+		label, fmt.Sprintf("%.2fK", float64(size)/1024), took.Seconds())
+	rate := float64(size) / took.Seconds() / (1 << 20)
+	if name == "-" {
+		fmt.Fprintf(w, "%s (%.2f MB/s) - written to stdout [%d/%d]\n\n", now.Add(took).Format("2006-01-02 15:04:05"), rate, size, size)
+	} else {
+		fmt.Fprintf(w, "%s (%.2f MB/s) - ‘%s’ saved [%d/%d]\n\n", now.Add(took).Format("2006-01-02 15:04:05"), rate, name, size, size)
+	}
+	return true
+}
+
+// busyboxWgetReport prints the busybox applet's terse progress.
+func busyboxWgetReport(c *Call, w io.Writer, u *url.URL, name string, p payload) bool {
+	ip := resolve(u)
+	fmt.Fprintf(w, "Connecting to %s (%s:%s)\n", u.Hostname(), ip, port(u))
+	if p.err != nil {
+		fmt.Fprintf(c.Stderr, "wget: can't connect to remote host (%s): %s\n", ip, dialError(p.err))
+		return false
+	}
+	if p.status >= 400 {
+		fmt.Fprintf(c.Stderr, "wget: server returned error: HTTP/1.1 %d %s\n", p.status, http.StatusText(p.status))
+		return false
+	}
+	if name == "-" {
+		fmt.Fprintln(w, "writing to stdout")
+	} else {
+		fmt.Fprintf(w, "saving to '%s'\n", name)
+	}
+	fmt.Fprintf(w, "%-20.20s 100%% |********************************| %s  0:00:00 ETA\n", path.Base(name), wgetSize(len(p.data)))
+	if name == "-" {
+		fmt.Fprintln(w, "written to stdout")
+	} else {
+		fmt.Fprintf(w, "'%s' saved\n", name)
+	}
+	return true
+}
+
+// curlValueOptions are the curl options that take an argument.
+var curlValueOptions = map[string]bool{
+	"-o": true, "--output": true, "-A": true, "--user-agent": true, "-H": true, "--header": true,
+	"-X": true, "--request": true, "-d": true, "--data": true, "--data-binary": true, "-e": true, "--referer": true,
+	"-u": true, "--user": true, "-m": true, "--max-time": true, "--connect-timeout": true, "-x": true, "--proxy": true,
+	"-b": true, "--cookie": true, "-c": true, "--cookie-jar": true, "--retry": true,
+}
+
+func cmdCurl(c *Call) int {
+	s := c.Shell
+	var urls []string
+	var output string
+	userAgent := curlUserAgent
+	remoteOutput, silent, showErrors, failOnError := false, false, false, false
+	args := c.Args[1:]
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if strings.HasPrefix(a, "--") {
+			name, value, hasValue := strings.Cut(a, "=")
+			if curlValueOptions[name] && !hasValue && i+1 < len(args) {
+				value = args[i+1]
+				i++
+			}
+			switch name {
+			case "--output":
+				output = value
+			case "--user-agent":
+				userAgent = value
+			case "--remote-name":
+				remoteOutput = true
+			case "--silent":
+				silent = true
+			case "--show-error":
+				showErrors = true
+			case "--fail":
+				failOnError = true
+			}
+			continue
+		}
+		if len(a) < 2 || a[0] != '-' {
+			urls = append(urls, a)
+			continue
+		}
+		// Bundled short options; one taking a value consumes the rest of
+		// the word or the next argument.
+		for j := 1; j < len(a); j++ {
+			opt := "-" + a[j:j+1]
+			if curlValueOptions[opt] {
+				value := a[j+1:]
+				if value == "" && i+1 < len(args) {
+					value = args[i+1]
+					i++
+				}
+				switch opt {
+				case "-o":
+					output = value
+				case "-A":
+					userAgent = value
+				}
+				break
+			}
+			switch opt {
+			case "-O":
+				remoteOutput = true
+			case "-s":
+				silent = true
+			case "-S":
+				showErrors = true
+			case "-f":
+				failOnError = true
+			}
+		}
+	}
+	if len(urls) == 0 {
+		fmt.Fprintln(c.Stderr, "curl: try 'curl --help' or 'curl --manual' for more information")
+		return 2
+	}
+
+	status := 0
+	for _, raw := range urls {
+		u, err := parseURL(raw)
+		if err != nil {
+			if !silent || showErrors {
+				fmt.Fprintf(c.Stderr, "curl: (3) URL using bad/illegal format or missing URL\n")
+			}
+			status = 3
+			continue
+		}
+		name := output
+		if remoteOutput && name == "" {
+			name = remoteName(u)
+		}
+		target := ""
+		if name != "" && name != "-" {
+			target = s.abs(name)
+		}
+		p := s.download("curl", u.String(), userAgent, target)
+		if p.err != nil {
+			if !silent || showErrors {
+				fmt.Fprintf(c.Stderr, "curl: (7) Failed to connect to %s port %s after %d ms: %s\n", u.Hostname(), port(u), 3+len(raw)%40, dialError(p.err))
+			}
+			status = 7
+			continue
+		}
+		if failOnError && p.status >= 400 {
+			if !silent || showErrors {
+				fmt.Fprintf(c.Stderr, "curl: (22) The requested URL returned error: %d\n", p.status)
+			}
+			status = 22
+			continue
+		}
+		if target == "" {
+			c.Stdout.Write(p.data)
+			continue
+		}
+		if !silent {
+			curlProgress(c.Stderr, len(p.data))
+		}
+		if err := s.writeInDir(target, p.data); err != nil {
+			if !silent || showErrors {
+				fmt.Fprintf(c.Stderr, "curl: (23) Failure writing output to destination\n")
+			}
+			status = 23
+		}
+	}
+	return status
+}
+
+// curlProgress prints curl's final progress meter for a completed transfer.
+func curlProgress(w io.Writer, size int) {
+	speed := fmt.Sprintf("%dk", int(float64(size)/transferTime(size).Seconds()/1024))
+	fmt.Fprintf(w, "  %% Total    %% Received %% Xferd  Average Speed   Time    Time     Time  Current\n"+
+		"                                 Dload  Upload   Total   Spent    Left  Speed\n"+
+		"100 %6s  100 %6s    0     0  %5s      0 --:--:-- --:--:-- --:--:-- %5s\n",
+		wgetSize(size), wgetSize(size), speed, speed)
+}
+
+// cmdTftp accepts both the tftp-hpa form (tftp HOST -c get FILE [LOCAL]) and
+// the busybox one (tftp -g -r FILE [-l LOCAL] HOST [PORT]).
+func cmdTftp(c *Call) int {
+	s := c.Shell
+	args := c.Args[1:]
+	var host, port, remote, local string
+	get, busybox := false, strings.HasPrefix(c.Args[0], "busybox")
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-g":
+			get, busybox = true, true
+		case a == "-r" || a == "-l" || a == "-m" || a == "-b":
+			if i+1 < len(args) {
+				if a == "-r" {
+					remote = args[i+1]
+				} else if a == "-l" {
+					local = args[i+1]
+				}
+				i++
+			}
+		case a == "-c":
+			// tftp-hpa: the rest of the line is a command.
+			rest := args[i+1:]
+			if len(rest) >= 2 && rest[0] == "get" {
+				get, remote = true, rest[1]
+				if len(rest) > 2 {
+					local = rest[2]
+				}
+			}
+			i = len(args)
+		case strings.HasPrefix(a, "-"):
+		default:
+			operands = append(operands, a)
+		}
+	}
+	if len(operands) > 0 {
+		host = operands[0]
+	}
+	if len(operands) > 1 {
+		port = operands[1]
+	}
+	if !get || remote == "" || host == "" {
+		if busybox {
+			fmt.Fprintln(c.Stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-7ubuntu3) multi-call binary.\n\nUsage: tftp [OPTIONS] HOST [PORT]\n\nTransfer a file from/to tftp server\n\n\t-l FILE\tLocal FILE\n\t-r FILE\tRemote FILE\n\t-g\tGet file\n\t-p\tPut file")
+		} else {
+			fmt.Fprintln(c.Stderr, "usage: tftp [-4][-6][-v][-V][-l][-m mode][-R port:port] [host [port]] [-c command]")
+		}
+		return 1
+	}
+	if local == "" {
+		local = path.Base(remote)
+	}
+	u := &url.URL{Scheme: "tftp", Host: host, Path: "/" + strings.TrimPrefix(remote, "/")}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	target := s.abs(local)
+	p := s.download("tftp", u.String(), "", target)
+	if p.err != nil {
+		if busybox {
+			fmt.Fprintln(c.Stderr, "tftp: timeout")
+		} else {
+			fmt.Fprintln(c.Stderr, "Transfer timed out.")
+		}
+		return 1
+	}
+	if err := s.writeInDir(target, p.data); err != nil {
+		fmt.Fprintf(c.Stderr, "tftp: %s: %s\n", local, ErrText(err))
+		return 1
+	}
+	return 0
+}
+
+// cmdBusybox runs an applet; wget and tftp get busybox's own behaviour.
+func cmdBusybox(c *Call) int {
+	if len(c.Args) < 2 {
+		fmt.Fprintln(c.Stdout, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-7ubuntu3) multi-call binary.\nBusyBox is copyrighted by many authors between 1998-2015.\nLicensed under GPLv2. See source distribution for detailed\ncopyright notices.\n\nUsage: busybox [function [arguments]...]\n   or: busybox --list[-full]\n   or: function [arguments]...")
+		return 0
+	}
+	applet := &Call{Shell: c.Shell, Args: c.Args[1:], Stdin: c.Stdin, Stdout: c.Stdout, Stderr: c.Stderr}
+	switch c.Args[1] {
+	case "wget":
+		return wget(applet, true)
+	case "tftp":
+		applet.Args = append([]string{"busybox tftp"}, c.Args[2:]...)
+		return cmdTftp(applet)
+	}
+	if _, ok := registry[c.Args[1]]; !ok || strings.Contains(c.Args[1], "/") {
+		fmt.Fprintf(c.Stderr, "%s: applet not found\n", c.Args[1])
+		return 127
+	}
+	return c.Shell.dispatch(applet)
+}
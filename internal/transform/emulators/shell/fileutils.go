@@ -0,0 +1,1052 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+func init() {
+	for name, h := range map[string]Handler{
+		"awk":    cmdAwk,
+		"base64": cmdBase64,
+		"chmod":  cmdChmod,
+		"cp":     cmdCp,
+		"grep":   cmdGrep,
+		"egrep":  cmdGrep,
+		"head":   cmdHead,
+		"ln":     cmdLn,
+		"mkdir":  cmdMkdir,
+		"mv":     cmdMv,
+		"rm":     cmdRm,
+		"sed":    cmdSed,
+		"tail":   cmdTail,
+		"touch":  cmdTouch,
+		"wc":     cmdWc,
+	} {
+		Register(name, h)
+	}
+}
+
+// missingOperand prints coreutils' complaint about a command run without arguments.
+func missingOperand(c *Call) int {
+	fmt.Fprintf(c.Stderr, "%s: missing operand\nTry '%s --help' for more information.\n", c.Args[0], c.Args[0])
+	return 1
+}
+
+// inputs returns the contents of the files named in operands, or stdin when
+// there are none. Unreadable files are reported and skipped.
+func (c *Call) inputs(operands []string) (data [][]byte, names []string, status int) {
+	if len(operands) == 0 {
+		return [][]byte{c.Stdin}, []string{""}, 0
+	}
+	for _, f := range operands {
+		if f == "-" {
+			data, names = append(data, c.Stdin), append(names, "(standard input)")
+			continue
+		}
+		b, err := c.Shell.fs.ReadFile(c.Shell.abs(f))
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "%s: %s: %s\n", path.Base(c.Args[0]), f, ErrText(err))
+			status = 1
+			continue
+		}
+		data, names = append(data, b), append(names, f)
+	}
+	return data, names, status
+}
+
+func cmdMkdir(c *Call) int {
+	s := c.Shell
+	flags, dirs := splitFlags(c.Args[1:])
+	if len(dirs) == 0 {
+		return missingOperand(c)
+	}
+	status := 0
+	for _, d := range dirs {
+		p := s.abs(d)
+		var err error
+		if n, serr := s.fs.Stat(p); serr == nil {
+			if !strings.Contains(flags, "p") || !n.IsDir() {
+				err = fs.ErrExist
+			}
+		} else if parent, perr := s.fs.Stat(path.Dir(p)); !strings.Contains(flags, "p") && (perr != nil || !parent.IsDir()) {
+			err = fs.ErrNotExist
+		} else {
+			err = s.fs.MkdirAll(p, 0755, s.user)
+		}
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "mkdir: cannot create directory '%s': %s\n", d, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+func cmdRm(c *Call) int {
+	s := c.Shell
+	flags, targets := splitFlags(c.Args[1:])
+	recursive := strings.ContainsAny(flags, "rR")
+	force := strings.Contains(flags, "f")
+	if len(targets) == 0 {
+		if force {
+			return 0
+		}
+		return missingOperand(c)
+	}
+	status := 0
+	for _, t := range targets {
+		p := s.abs(t)
+		n, err := s.fs.Stat(p)
+		switch {
+		case err != nil:
+			if force {
+				continue
+			}
+		case n.IsDir() && !recursive:
+			err = vfs.ErrIsDir
+		case p == "/":
+			fmt.Fprintln(c.Stderr, "rm: it is dangerous to operate recursively on '/'\nrm: use --no-preserve-root to override this failsafe")
+			status = 1
+			continue
+		default:
+			err = s.fs.RemoveAll(p)
+		}
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "rm: cannot remove '%s': %s\n", t, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+func cmdTouch(c *Call) int {
+	s := c.Shell
+	_, files := splitFlags(c.Args[1:])
+	if len(files) == 0 {
+		fmt.Fprintln(c.Stderr, "touch: missing file operand\nTry 'touch --help' for more information.")
+		return 1
+	}
+	status := 0
+	for _, f := range files {
+		p := s.abs(f)
+		data, err := s.fs.ReadFile(p)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			err = s.writeInDir(p, data)
+		}
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "touch: cannot touch '%s': %s\n", f, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// writeInDir writes a file owned by the user, failing like a real system
+// would when the parent directory does not exist.
+func (s *Shell) writeInDir(p string, data []byte) error {
+	if n, err := s.fs.Stat(path.Dir(p)); err != nil {
+		return err
+	} else if !n.IsDir() {
+		return vfs.ErrNotDir
+	}
+	mode := fs.FileMode(0644)
+	if n, err := s.fs.Stat(p); err == nil {
+		mode = n.Mode.Perm()
+	}
+	return s.fs.WriteFile(p, data, mode, s.user)
+}
+
+// destination resolves where cp or mv should put src when the last operand is dst.
+func (s *Shell) destination(src, dst string) string {
+	p := s.abs(dst)
+	if n, err := s.fs.Stat(p); err == nil && n.IsDir() {
+		return path.Join(p, path.Base(src))
+	}
+	return p
+}
+
+func cmdCp(c *Call) int {
+	s := c.Shell
+	flags, operands := splitFlags(c.Args[1:])
+	if len(operands) < 2 {
+		return missingOperand(c)
+	}
+	recursive := strings.ContainsAny(flags, "rRa")
+	dst := operands[len(operands)-1]
+	status := 0
+	for _, src := range operands[:len(operands)-1] {
+		if err := s.copyTree(s.abs(src), s.destination(src, dst), recursive); err != nil {
+			if err == vfs.ErrIsDir {
+				fmt.Fprintf(c.Stderr, "cp: -r not specified; omitting directory '%s'\n", src)
+			} else {
+				fmt.Fprintf(c.Stderr, "cp: cannot stat '%s': %s\n", src, ErrText(err))
+			}
+			status = 1
+		}
+	}
+	return status
+}
+
+func (s *Shell) copyTree(src, dst string, recursive bool) error {
+	n, err := s.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !n.IsDir() {
+		return s.writeInDir(dst, n.Data)
+	}
+	if !recursive {
+		return vfs.ErrIsDir
+	}
+	if err := s.fs.MkdirAll(dst, n.Mode.Perm(), s.user); err != nil {
+		return err
+	}
+	children, err := s.fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := s.copyTree(path.Join(src, child.Name), path.Join(dst, child.Name), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdMv(c *Call) int {
+	s := c.Shell
+	_, operands := splitFlags(c.Args[1:])
+	if len(operands) < 2 {
+		return missingOperand(c)
+	}
+	dst := operands[len(operands)-1]
+	status := 0
+	for _, src := range operands[:len(operands)-1] {
+		if err := s.fs.Rename(s.abs(src), s.destination(src, dst)); err != nil {
+			fmt.Fprintf(c.Stderr, "mv: cannot stat '%s': %s\n", src, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// cmdLn makes symbolic links with -s. Hard links become copies, which the
+// virtual filesystem cannot tell apart from them.
+func cmdLn(c *Call) int {
+	s := c.Shell
+	flags, operands := splitFlags(c.Args[1:])
+	symbolic := strings.Contains(flags, "s")
+	kind := "hard link"
+	if symbolic {
+		kind = "symbolic link"
+	}
+	if len(operands) == 0 {
+		fmt.Fprintln(c.Stderr, "ln: missing file operand\nTry 'ln --help' for more information.")
+		return 1
+	}
+
+	// With one operand the link goes in the working directory; with more,
+	// into the last one if it is a directory.
+	targets, last, inDir := operands, ".", true
+	if len(operands) > 1 {
+		targets, last = operands[:len(operands)-1], operands[len(operands)-1]
+		n, err := s.fs.Stat(s.abs(last))
+		inDir = err == nil && n.IsDir()
+		if l, err := s.fs.Lstat(s.abs(last)); err == nil && l.IsSymlink() && strings.ContainsAny(flags, "nT") {
+			inDir = false
+		}
+		if !inDir && len(targets) > 1 {
+			fmt.Fprintf(c.Stderr, "ln: target '%s' is not a directory\n", last)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, t := range targets {
+		name := last
+		if inDir {
+			name = path.Join(last, path.Base(t))
+		}
+		link := s.abs(name)
+		var data []byte
+		mode := fs.FileMode(0644)
+		if !symbolic {
+			n, err := s.fs.Stat(s.abs(t))
+			if err != nil {
+				fmt.Fprintf(c.Stderr, "ln: failed to access '%s': %s\n", t, ErrText(err))
+				status = 1
+				continue
+			}
+			if n.IsDir() {
+				fmt.Fprintf(c.Stderr, "ln: %s: hard link not allowed for directory\n", t)
+				status = 1
+				continue
+			}
+			data, mode = n.Data, n.Mode.Perm()
+		}
+		if old, err := s.fs.Lstat(link); err == nil && strings.Contains(flags, "f") && !old.IsDir() {
+			s.fs.Remove(link)
+		}
+		var err error
+		switch {
+		case symbolic:
+			err = s.fs.Symlink(t, link, s.user)
+		default:
+			if _, lerr := s.fs.Lstat(link); lerr == nil {
+				err = fs.ErrExist
+			} else if err = s.writeInDir(link, data); err == nil {
+				err = s.fs.Chmod(link, mode)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "ln: failed to create %s '%s': %s\n", kind, name, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// cmdChmod accepts octal modes and the symbolic forms droppers use, such as
+// +x, u+x and go-w.
+func cmdChmod(c *Call) int {
+	s := c.Shell
+	args := c.Args[1:]
+	for len(args) > 0 && (args[0] == "-R" || args[0] == "-v" || args[0] == "-f") {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return missingOperand(c)
+	}
+	spec, files := args[0], args[1:]
+	status := 0
+	for _, f := range files {
+		p := s.abs(f)
+		n, err := s.fs.Stat(p)
+		if err == nil {
+			mode, ok := applyMode(n.Mode.Perm(), spec)
+			if !ok {
+				fmt.Fprintf(c.Stderr, "chmod: invalid mode: '%s'\nTry 'chmod --help' for more information.\n", spec)
+				return 1
+			}
+			err = s.fs.Chmod(p, mode)
+		}
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "chmod: cannot access '%s': %s\n", f, ErrText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+var symbolicMode = regexp.MustCompile(`^([ugoa]*)([-+=])([rwx]*)$`)
+
+func applyMode(mode fs.FileMode, spec string) (fs.FileMode, bool) {
+	if n, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		return fs.FileMode(n) & fs.ModePerm, true
+	}
+	for _, clause := range strings.Split(spec, ",") {
+		m := symbolicMode.FindStringSubmatch(clause)
+		if m == nil {
+			return mode, false
+		}
+		var who fs.FileMode
+		for _, r := range m[1] {
+			who |= map[rune]fs.FileMode{'u': 0700, 'g': 0070, 'o': 0007, 'a': 0777}[r]
+		}
+		if who == 0 {
+			who = 0777
+		}
+		var bits fs.FileMode
+		for _, r := range m[3] {
+			bits |= map[rune]fs.FileMode{'r': 0444, 'w': 0222, 'x': 0111}[r]
+		}
+		bits &= who
+		switch m[2] {
+		case "+":
+			mode |= bits
+		case "-":
+			mode &^= bits
+		case "=":
+			mode = mode&^who | bits
+		}
+	}
+	return mode, true
+}
+
+// lineCount parses the -n N / -N argument of head and tail.
+func lineCount(args []string) (n int, files []string) {
+	n = 10
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-n" && i+1 < len(args):
+			n, _ = strconv.Atoi(strings.TrimPrefix(args[i+1], "+"))
+			i++
+		case strings.HasPrefix(a, "-n"):
+			n, _ = strconv.Atoi(a[2:])
+		case len(a) > 1 && a[0] == '-' && a[1] >= '0' && a[1] <= '9':
+			n, _ = strconv.Atoi(a[1:])
+		case strings.HasPrefix(a, "-"):
+		default:
+			files = append(files, a)
+		}
+	}
+	return n, files
+}
+
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func cmdHead(c *Call) int {
+	n, files := lineCount(c.Args[1:])
+	data, _, status := c.inputs(files)
+	for _, d := range data {
+		lines := splitLines(d)
+		c.Stdout.Write([]byte(strings.Join(lines[:min(n, len(lines))], "")))
+	}
+	return status
+}
+
+func cmdTail(c *Call) int {
+	n, files := lineCount(c.Args[1:])
+	data, _, status := c.inputs(files)
+	for _, d := range data {
+		lines := splitLines(d)
+		c.Stdout.Write([]byte(strings.Join(lines[max(0, len(lines)-n):], "")))
+	}
+	return status
+}
+
+func cmdWc(c *Call) int {
+	flags, files := splitFlags(c.Args[1:])
+	if flags == "" {
+		flags = "lwc"
+	}
+	data, names, status := c.inputs(files)
+	var total [3]int
+	emit := func(counts [3]int, name string) {
+		var cols []string
+		for i, f := range "lwc" {
+			if strings.ContainsRune(flags, f) || f == 'c' && strings.Contains(flags, "m") {
+				cols = append(cols, fmt.Sprintf("%7d", counts[i]))
+			}
+		}
+		line := strings.Join(cols, " ")
+		if len(cols) == 1 && name == "" {
+			line = strings.TrimSpace(line)
+		}
+		if name != "" {
+			line += " " + name
+		}
+		fmt.Fprintln(c.Stdout, line)
+	}
+	for i, d := range data {
+		counts := [3]int{bytes.Count(d, []byte("\n")), len(bytes.Fields(d)), len(d)}
+		for j := range total {
+			total[j] += counts[j]
+		}
+		emit(counts, names[i])
+	}
+	if len(data) > 1 {
+		emit(total, "total")
+	}
+	return status
+}
+
+func cmdGrep(c *Call) int {
+	args := c.Args[1:]
+	var flags, pattern string
+	var files []string
+	havePattern := false
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-e" && i+1 < len(args):
+			pattern, havePattern = args[i+1], true
+			i++
+		case len(a) > 1 && a[0] == '-' && a[1] != '-':
+			flags += a[1:]
+		case strings.HasPrefix(a, "--"):
+		case !havePattern:
+			pattern, havePattern = a, true
+		default:
+			files = append(files, a)
+		}
+	}
+	if !havePattern {
+		fmt.Fprintln(c.Stderr, "Usage: grep [OPTION]... PATTERNS [FILE]...\nTry 'grep --help' for more information.")
+		return 2
+	}
+	expr := pattern
+	if strings.Contains(flags, "F") {
+		expr = regexp.QuoteMeta(pattern)
+	} else if !strings.Contains(flags, "E") && path.Base(c.Args[0]) != "egrep" {
+		// Basic regular expressions treat these as literals unless escaped.
+		expr = strings.NewReplacer(`\|`, `|`, `\(`, `(`, `\)`, `)`, `\+`, `+`, `\?`, `?`,
+			`|`, `\|`, `(`, `\(`, `)`, `\)`, `+`, `\+`, `?`, `\?`).Replace(pattern)
+	}
+	if strings.Contains(flags, "i") {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		fmt.Fprintln(c.Stderr, "grep: Unmatched ( or \\(")
+		return 2
+	}
+	invert := strings.Contains(flags, "v")
+	data, names, status := c.inputs(files)
+	if status != 0 {
+		status = 2
+	}
+	matched := false
+	for i, d := range data {
+		prefix := ""
+		if len(files) > 1 && !strings.Contains(flags, "h") {
+			prefix = names[i] + ":"
+		}
+		count := 0
+		for n, line := range splitLines(d) {
+			text := strings.TrimSuffix(line, "\n")
+			if re.MatchString(text) == invert {
+				continue
+			}
+			count++
+			matched = true
+			switch {
+			case strings.ContainsAny(flags, "qcl"):
+			case strings.Contains(flags, "n"):
+				fmt.Fprintf(c.Stdout, "%s%d:%s\n", prefix, n+1, text)
+			default:
+				fmt.Fprintf(c.Stdout, "%s%s\n", prefix, text)
+			}
+		}
+		switch {
+		case strings.Contains(flags, "q"):
+		case strings.Contains(flags, "c"):
+			fmt.Fprintf(c.Stdout, "%s%d\n", prefix, count)
+		case strings.Contains(flags, "l") && count > 0:
+			fmt.Fprintln(c.Stdout, names[i])
+		}
+	}
+	if status != 0 && !strings.Contains(flags, "q") {
+		return status
+	}
+	if !matched {
+		return 1
+	}
+	return 0
+}
+
+var awkPrint = regexp.MustCompile(`^\s*\{\s*print\s*(.*?)\s*;?\s*\}\s*$`)
+
+// cmdAwk understands only '{print $N, ...}' programs, which covers the field
+// extraction recon one-liners use.
+func cmdAwk(c *Call) int {
+	args := c.Args[1:]
+	sep := ""
+	for len(args) > 0 && strings.HasPrefix(args[0], "-F") {
+		if args[0] == "-F" && len(args) > 1 {
+			sep, args = args[1], args[2:]
+		} else {
+			sep, args = args[0][2:], args[1:]
+		}
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(c.Stderr, "usage: awk [-F fs][-v var=value][prog | -f progfile][file ...]")
+		return 2
+	}
+	m := awkPrint.FindStringSubmatch(args[0])
+	if m == nil {
+		fmt.Fprintf(c.Stderr, "awk: line 1: syntax error at or near %s\n", strings.Fields(args[0] + " end")[0])
+		return 2
+	}
+	var exprs []string
+	if m[1] != "" {
+		exprs = regexp.MustCompile(`\s*,\s*`).Split(m[1], -1)
+	}
+	data, _, status := c.inputs(args[1:])
+	for _, d := range data {
+		for _, line := range splitLines(d) {
+			line = strings.TrimSuffix(line, "\n")
+			var fields []string
+			if sep == "" {
+				fields = strings.Fields(line)
+			} else {
+				fields = strings.Split(line, sep)
+			}
+			if len(exprs) == 0 {
+				fmt.Fprintln(c.Stdout, line)
+				continue
+			}
+			out := make([]string, len(exprs))
+			for i, e := range exprs {
+				switch {
+				case e == "$0":
+					out[i] = line
+				case e == "NF":
+					out[i] = strconv.Itoa(len(fields))
+				case e == "$NF":
+					if len(fields) > 0 {
+						out[i] = fields[len(fields)-1]
+					}
+				case strings.HasPrefix(e, "$"):
+					if n, err := strconv.Atoi(e[1:]); err == nil && n >= 1 && n <= len(fields) {
+						out[i] = fields[n-1]
+					}
+				case strings.HasPrefix(e, `"`) && strings.HasSuffix(e, `"`) && len(e) > 1:
+					out[i] = e[1 : len(e)-1]
+				}
+			}
+			fmt.Fprintln(c.Stdout, strings.Join(out, " "))
+		}
+	}
+	return status
+}
+
+// cmdBase64 encodes, wrapping at 76 columns unless -w says otherwise, or
+// decodes with -d.
+func cmdBase64(c *Call) int {
+	decode, wrap := false, 76
+	var operands []string
+	args := c.Args[1:]
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-d" || a == "--decode":
+			decode = true
+		case a == "-i" || a == "--ignore-garbage":
+		case a == "-w" && i+1 < len(args):
+			wrap, _ = strconv.Atoi(args[i+1])
+			i++
+		case strings.HasPrefix(a, "-w") || strings.HasPrefix(a, "--wrap="):
+			wrap, _ = strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(a, "-w"), "--wrap="))
+		case strings.HasPrefix(a, "-") && a != "-":
+			fmt.Fprintf(c.Stderr, "base64: invalid option -- '%s'\nTry 'base64 --help' for more information.\n", strings.TrimLeft(a, "-"))
+			return 1
+		default:
+			operands = append(operands, a)
+		}
+	}
+	if len(operands) > 1 {
+		fmt.Fprintf(c.Stderr, "base64: extra operand '%s'\nTry 'base64 --help' for more information.\n", operands[1])
+		return 1
+	}
+	data, _, status := c.inputs(operands)
+	if status != 0 {
+		return 1
+	}
+	in := data[0]
+
+	if decode {
+		in = bytes.ReplaceAll(in, []byte("\n"), nil)
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(in)))
+		n, err := base64.StdEncoding.Decode(out, in)
+		c.Stdout.Write(out[:n])
+		if err != nil {
+			fmt.Fprintln(c.Stderr, "base64: invalid input")
+			return 1
+		}
+		return 0
+	}
+	enc := base64.StdEncoding.EncodeToString(in)
+	for wrap > 0 && len(enc) > wrap {
+		fmt.Fprintln(c.Stdout, enc[:wrap])
+		enc = enc[wrap:]
+	}
+	if enc != "" {
+		fmt.Fprintln(c.Stdout, enc)
+	}
+	return 0
+}
+
+// sedCommand is one command of a sed script: s, d or p, with an optional
+// line number, $ or /regexp/ address.
+type sedCommand struct {
+	line   int // 0 without a line address, -1 for $
+	match  *regexp.Regexp
+	op     byte
+	re     *regexp.Regexp
+	repl   string // s replacement in regexp.Expand syntax
+	global bool
+	print  bool
+}
+
+// cmdSed runs the subset of sed that droppers use to edit config files and
+// massage command output: s///, d and p, addressed or not, with -n, -i, -e
+// and -E.
+func cmdSed(c *Call) int {
+	s := c.Shell
+	var scripts, operands []string
+	quiet, inPlace, ere := false, false, false
+	args := c.Args[1:]
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case a == "-e" || a == "--expression":
+			if i+1 == len(args) {
+				fmt.Fprintf(c.Stderr, "sed: option requires an argument -- 'e'\n")
+				return 1
+			}
+			scripts = append(scripts, args[i+1])
+			i++
+		case strings.HasPrefix(a, "--expression="):
+			scripts = append(scripts, strings.TrimPrefix(a, "--expression="))
+		case a == "-n" || a == "--quiet" || a == "--silent":
+			quiet = true
+		case a == "-E" || a == "-r" || a == "--regexp-extended":
+			ere = true
+		case strings.HasPrefix(a, "-i") || strings.HasPrefix(a, "--in-place"):
+			inPlace = true
+		case len(a) > 1 && a[0] == '-' && a[1] != '-':
+			// Grouped short options, such as -ne or -i.bak.
+			for j := 1; j < len(a); j++ {
+				switch a[j] {
+				case 'n':
+					quiet = true
+				case 'E', 'r':
+					ere = true
+				case 'i':
+					inPlace, j = true, len(a)
+				case 'e':
+					if j+1 < len(a) {
+						scripts = append(scripts, a[j+1:])
+					} else if i+1 < len(args) {
+						scripts = append(scripts, args[i+1])
+						i++
+					}
+					j = len(a)
+				default:
+					fmt.Fprintf(c.Stderr, "sed: invalid option -- '%c'\n", a[j])
+					return 1
+				}
+			}
+		default:
+			operands = append(operands, a)
+		}
+	}
+	if len(scripts) == 0 {
+		if len(operands) == 0 {
+			fmt.Fprintln(c.Stderr, "Usage: sed [OPTION]... {script-only-if-no-other-script} [input-file]...")
+			return 1
+		}
+		scripts, operands = operands[:1], operands[1:]
+	}
+	cmds, err := parseSed(strings.Join(scripts, "\n"), ere)
+	if err != nil {
+		fmt.Fprintf(c.Stderr, "sed: -e expression #1, %v\n", err)
+		return 1
+	}
+
+	if inPlace {
+		if len(operands) == 0 {
+			fmt.Fprintln(c.Stderr, "sed: no input files")
+			return 1
+		}
+		status := 0
+		for _, f := range operands {
+			p := s.abs(f)
+			data, err := s.fs.ReadFile(p)
+			if err == nil {
+				var out bytes.Buffer
+				runSed(cmds, splitLines(data), quiet, &out)
+				err = s.writeInDir(p, out.Bytes())
+			}
+			if err != nil {
+				fmt.Fprintf(c.Stderr, "sed: can't read %s: %s\n", f, ErrText(err))
+				status = 2
+			}
+		}
+		return status
+	}
+
+	if len(operands) == 0 {
+		operands = []string{"-"}
+	}
+	var lines []string
+	status := 0
+	for _, f := range operands {
+		data := c.Stdin
+		if f != "-" {
+			var err error
+			if data, err = s.fs.ReadFile(s.abs(f)); err != nil {
+				fmt.Fprintf(c.Stderr, "sed: can't read %s: %s\n", f, ErrText(err))
+				status = 2
+				continue
+			}
+		}
+		lines = append(lines, splitLines(data)...)
+	}
+	runSed(cmds, lines, quiet, c.Stdout)
+	return status
+}
+
+// runSed applies cmds to each line, which keeps its newline if it had one.
+func runSed(cmds []sedCommand, lines []string, quiet bool, w io.Writer) {
+	for i, line := range lines {
+		text, nl := strings.CutSuffix(line, "\n")
+		deleted := false
+		for _, cmd := range cmds {
+			if !cmd.addresses(i+1, i == len(lines)-1, text) {
+				continue
+			}
+			if cmd.op == 'd' {
+				deleted = true
+				break
+			}
+			if cmd.op == 's' {
+				var ok bool
+				if text, ok = cmd.substitute(text); !ok || !cmd.print {
+					continue
+				}
+			}
+			writeLine(w, text, nl)
+		}
+		if !deleted && !quiet {
+			writeLine(w, text, nl)
+		}
+	}
+}
+
+func writeLine(w io.Writer, text string, newline bool) {
+	if newline {
+		text += "\n"
+	}
+	io.WriteString(w, text)
+}
+
+func (cmd *sedCommand) addresses(n int, last bool, text string) bool {
+	switch {
+	case cmd.line > 0:
+		return n == cmd.line
+	case cmd.line < 0:
+		return last
+	case cmd.match != nil:
+		return cmd.match.MatchString(text)
+	}
+	return true
+}
+
+// substitute performs an s command on text and reports whether it matched.
+func (cmd *sedCommand) substitute(text string) (string, bool) {
+	n := 1
+	if cmd.global {
+		n = -1
+	}
+	matches := cmd.re.FindAllStringSubmatchIndex(text, n)
+	if matches == nil {
+		return text, false
+	}
+	var out []byte
+	prev := 0
+	for _, m := range matches {
+		out = append(out, text[prev:m[0]]...)
+		out = cmd.re.ExpandString(out, cmd.repl, text, m)
+		prev = m[1]
+	}
+	return string(append(out, text[prev:]...)), true
+}
+
+// parseSed parses a script of commands separated by newlines or semicolons.
+// Errors carry sed's "char N: " position.
+func parseSed(script string, ere bool) ([]sedCommand, error) {
+	var cmds []sedCommand
+	i := 0
+	fail := func(msg string) error {
+		return fmt.Errorf("char %d: %s", min(i+1, len(script)), msg)
+	}
+	for {
+		for i < len(script) && strings.IndexByte(" \t\n;", script[i]) >= 0 {
+			i++
+		}
+		if i == len(script) {
+			return cmds, nil
+		}
+		var cmd sedCommand
+		switch {
+		case script[i] >= '0' && script[i] <= '9':
+			j := i
+			for j < len(script) && script[j] >= '0' && script[j] <= '9' {
+				j++
+			}
+			cmd.line, _ = strconv.Atoi(script[i:j])
+			i = j
+			if cmd.line == 0 {
+				return nil, fail("invalid usage of line address 0")
+			}
+		case script[i] == '$':
+			cmd.line = -1
+			i++
+		case script[i] == '/':
+			pat, next, ok := sedDelimited(script, i+1, '/')
+			if !ok {
+				i = len(script)
+				return nil, fail("unterminated address regex")
+			}
+			re, err := sedRegexp(pat, ere, false)
+			if err != nil {
+				return nil, fail("Invalid preceding regular expression")
+			}
+			cmd.match, i = re, next
+		}
+		for i < len(script) && script[i] == ' ' {
+			i++
+		}
+		if i == len(script) {
+			return nil, fail("missing command")
+		}
+		cmd.op = script[i]
+		i++
+		switch cmd.op {
+		case 'd', 'p':
+		case 's':
+			if i == len(script) || script[i] == '\n' || script[i] == '\\' {
+				return nil, fail("unterminated `s' command")
+			}
+			delim := script[i]
+			pat, next, ok := sedDelimited(script, i+1, delim)
+			if ok {
+				var repl string
+				repl, next, ok = sedDelimited(script, next, delim)
+				cmd.repl = sedReplacement(repl)
+			}
+			if !ok {
+				i = len(script)
+				return nil, fail("unterminated `s' command")
+			}
+			i = next
+			fold := false
+			for ; i < len(script) && strings.IndexByte(" \t\n;}", script[i]) < 0; i++ {
+				switch script[i] {
+				case 'g':
+					cmd.global = true
+				case 'p':
+					cmd.print = true
+				case 'i', 'I':
+					fold = true
+				default:
+					return nil, fail("unknown option to `s'")
+				}
+			}
+			re, err := sedRegexp(pat, ere, fold)
+			if err != nil {
+				return nil, fail("Invalid preceding regular expression")
+			}
+			cmd.re = re
+		default:
+			i--
+			return nil, fail(fmt.Sprintf("unknown command: `%c'", cmd.op))
+		}
+		for i < len(script) && (script[i] == ' ' || script[i] == '\t') {
+			i++
+		}
+		if i < len(script) && script[i] != ';' && script[i] != '\n' {
+			return nil, fail("extra characters after command")
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// sedDelimited reads up to the next unescaped delim, returning the text
+// with escaped delimiters unescaped and the index after the delimiter.
+func sedDelimited(script string, i int, delim byte) (string, int, bool) {
+	var b strings.Builder
+	for ; i < len(script); i++ {
+		switch ch := script[i]; {
+		case ch == delim:
+			return b.String(), i + 1, true
+		case ch == '\\' && i+1 < len(script):
+			i++
+			if script[i] != delim {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(script[i])
+		case ch == '\n':
+			return "", i, false
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return "", i, false
+}
+
+// sedRegexp compiles a POSIX basic regular expression, or an extended one,
+// into Go syntax. In a BRE, \( \) \{ \} \+ \? \| are the operators and the
+// bare characters are literals.
+func sedRegexp(pat string, ere, fold bool) (*regexp.Regexp, error) {
+	if !ere {
+		var b strings.Builder
+		for i := 0; i < len(pat); i++ {
+			ch := pat[i]
+			switch {
+			case ch == '\\' && i+1 < len(pat):
+				i++
+				if strings.IndexByte("(){}+?|", pat[i]) >= 0 {
+					b.WriteByte(pat[i])
+				} else {
+					b.WriteByte('\\')
+					b.WriteByte(pat[i])
+				}
+			case strings.IndexByte("(){}+?|", ch) >= 0:
+				b.WriteByte('\\')
+				b.WriteByte(ch)
+			default:
+				b.WriteByte(ch)
+			}
+		}
+		pat = b.String()
+	}
+	if fold {
+		pat = "(?i)" + pat
+	}
+	return regexp.Compile(pat)
+}
+
+// sedReplacement turns an s replacement, with & and \1 to \9, into a
+// regexp.Expand template.
+func sedReplacement(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		ch := repl[i]
+		switch {
+		case ch == '&':
+			b.WriteString("${0}")
+		case ch == '$':
+			b.WriteString("$$")
+		case ch == '\\' && i+1 < len(repl):
+			i++
+			switch next := repl[i]; {
+			case next >= '0' && next <= '9':
+				fmt.Fprintf(&b, "${%c}", next)
+			case next == 'n':
+				b.WriteByte('\n')
+			case next == 't':
+				b.WriteByte('\t')
+			case next == '$':
+				b.WriteString("$$")
+			default:
+				b.WriteByte(next)
+			}
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package shell
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSed(t *testing.T) {
+	setup := func(s *Shell) {
+		s.fs.WriteFile("/etc/ssh/sshd_config", []byte("Port 22\nPermitRootLogin no\n"), 0644, "root")
+	}
+	runLines(t, []lineTest{
+		{line: "echo hello world | sed 's/o/0/g'", want: "hell0 w0rld\n"},
+		{line: "echo hello world | sed s/o/0/", want: "hell0 world\n"},
+		{line: `echo abc | sed 's/\(b\)/[\1]/'`, want: "a[b]c\n"},
+		{line: "echo a+b | sed 's/a+b/x/'", want: "x\n"},
+		{line: "echo aab | sed -E 's/(a+)/<\\1>/'", want: "<aa>b\n"},
+		{line: "echo bin | sed 's|bin|/usr/&|'", want: "/usr/bin\n"},
+		{line: "echo ABC | sed 's/b/x/I'", want: "AxC\n"},
+		{line: "echo a.b | sed 's/\\./$/'", want: "a$b\n"},
+		{line: `echo -e 'a\nb\nc' | sed -n 2p`, want: "b\n"},
+		{line: `echo -e 'a\nb\nc' | sed '$d'`, want: "a\nb\n"},
+		{line: `echo -e 'a\nb\nc' | sed '/b/d'`, want: "a\nc\n"},
+		{line: `echo -e 'a\nb\nc' | sed -n '/[ac]/p'`, want: "a\nc\n"},
+		{line: `echo -e 'a\nb' | sed -ne 's/a/A/p'`, want: "A\n"},
+		{line: "echo abc | sed -e 's/a/A/' -e 's/c/C/'", want: "AbC\n"},
+		{line: "echo abc | sed 's/a/A/; s/b/B/'", want: "ABc\n"},
+		{line: "echo -n abc | sed s/c/C/", want: "abC"},
+		{line: "sed -n 2p /etc/ssh/sshd_config", want: "PermitRootLogin no\n"},
+		{
+			line: "sed -i 's/PermitRootLogin no/PermitRootLogin yes/' /etc/ssh/sshd_config; cat /etc/ssh/sshd_config",
+			want: "Port 22\nPermitRootLogin yes\n",
+		},
+		{line: "sed p /nope", want: "sed: can't read /nope: No such file or directory\n", status: 2},
+		{line: "echo | sed q", want: "sed: -e expression #1, char 1: unknown command: `q'\n", status: 1},
+		{line: "echo | sed s/a/b", want: "sed: -e expression #1, char 5: unterminated `s' command\n", status: 1},
+		{line: "echo | sed s/a/b/x", want: "sed: -e expression #1, char 7: unknown option to `s'\n", status: 1},
+		{line: "sed", want: "Usage: sed [OPTION]... {script-only-if-no-other-script} [input-file]...\n", status: 1},
+	}, setup)
+}
+
+func TestBase64(t *testing.T) {
+	runLines(t, []lineTest{
+		{line: "echo hi | base64", want: "aGkK\n"},
+		{line: "echo hi | base64 -w 2", want: "aG\nkK\n"},
+		{line: "echo " + strings.Repeat("x", 60) + " | base64 | head -1 | wc -c", want: "77\n"},
+		{line: "echo " + strings.Repeat("x", 60) + " | base64 -w0 | wc -l", want: "1\n"},
+		{line: "echo aGkK | base64 -d", want: "hi\n"},
+		{line: "echo aGkK | base64 --decode", want: "hi\n"},
+		{line: "echo ZWNobyBwd25lZAo= | base64 -d | sh", want: "pwned\n"},
+		{line: "echo '!!' | base64 -d", want: "base64: invalid input\n", status: 1},
+		{line: "base64 /nope", want: "base64: /nope: No such file or directory\n", status: 1},
+	}, nil)
+}
+
+func TestLn(t *testing.T) {
+	setup := func(s *Shell) {
+		s.fs.MkdirAll("/opt", 0755, "root")
+		s.fs.WriteFile("/tmp/a", []byte("A\n"), 0755, "root")
+	}
+	runLines(t, []lineTest{
+		{line: "ln -s /tmp/a l; cat l", want: "A\n"},
+		{line: "ln -s ../tmp/a /opt/l; cat /opt/l", want: "A\n"},
+		{line: "ln -s /tmp /root/t; cat t/a; ls /root/t", want: "A\na\n"},
+		{line: "ln -s /tmp/a /opt; ls /opt", want: "a\n"},
+		{line: "ln -s /tmp/a; ls", want: "a\n"},
+		{line: "ln -s /tmp/a l; echo B > l; cat /tmp/a", want: "B\n"},
+		{line: "ln -s /tmp/a l; rm l; cat /tmp/a", want: "A\n"},
+		{line: "ln -s /nope l; ls l; cat l", want: "l\ncat: l: No such file or directory\n", status: 1},
+		{line: "ln -s /tmp/a l; ln -s /tmp/b l", want: "ln: failed to create symbolic link 'l': File exists\n", status: 1},
+		{line: "ln -s /tmp/a l; ln -sf /nope l; cat l", want: "cat: l: No such file or directory\n", status: 1},
+		{line: "ln -s l1 l2; ln -s l2 l1; cat l1", want: "cat: l1: Too many levels of symbolic links\n", status: 1},
+		{line: "ln /tmp/a h; echo B > /tmp/a; cat h", want: "A\n"},
+		{line: "ln /nope h", want: "ln: failed to access '/nope': No such file or directory\n", status: 1},
+		{line: "ln /tmp h", want: "ln: /tmp: hard link not allowed for directory\n", status: 1},
+		{line: "ln -s /tmp/a /tmp/a /tmp/a", want: "ln: target '/tmp/a' is not a directory\n", status: 1},
+		{line: "ln", want: "ln: missing file operand\nTry 'ln --help' for more information.\n", status: 1},
+	}, setup)
+
+	s := newTestShell(t, nil, nil)
+	setup(s)
+	var out bytes.Buffer
+	s.Execute("ln -s /tmp/a l; ls -l l; ls -l", &out)
+	if got := out.String(); strings.Count(got, "lrwxrwxrwx 1 root root     6 ") != 2 || strings.Count(got, " l -> /tmp/a\n") != 2 {
+		t.Errorf("ls -l:\n%s", got)
+	}
+}
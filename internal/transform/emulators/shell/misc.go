@@ -0,0 +1,335 @@
+package shell
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	for name, h := range map[string]Handler{
+		"chpasswd": cmdChpasswd,
+		"clear":    cmdClear,
+		"crontab":  cmdCrontab,
+		"env":      cmdEnv,
+		"export":   cmdExport,
+		"false":    func(*Call) int { return 1 },
+		"groups":   cmdGroups,
+		"kill":     cmdKill,
+		"passwd":   cmdPasswd,
+		"printenv": cmdPrintenv,
+		"sleep":    cmdSleep,
+		"sudo":     cmdSudo,
+		"true":     func(*Call) int { return 0 },
+		"which":    cmdWhich,
+	} {
+		Register(name, h)
+	}
+}
+
+// maxSleep caps sleep so that a script cannot hold a session open for long.
+const maxSleep = 5 * time.Second
+
+// shellBuiltins are commands bash implements itself; which finds no file for them.
+var shellBuiltins = map[string]bool{"cd": true, "exit": true, "export": true, "history": true, "kill": true, "logout": true}
+
+func cmdEnv(c *Call) int {
+	if len(c.Args) > 1 {
+		// env VAR=value command: run the command, ignoring the assignments.
+		args := c.Args[1:]
+		for len(args) > 0 && strings.Contains(args[0], "=") {
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			return c.Shell.dispatch(&Call{Shell: c.Shell, Args: args, Stdin: c.Stdin, Stdout: c.Stdout, Stderr: c.Stderr})
+		}
+	}
+	return cmdPrintenv(&Call{Shell: c.Shell, Args: c.Args[:1], Stdout: c.Stdout, Stderr: c.Stderr})
+}
+
+func cmdPrintenv(c *Call) int {
+	env := c.Shell.env
+	if len(c.Args) > 1 {
+		status := 0
+		for _, name := range c.Args[1:] {
+			v, ok := env[name]
+			if !ok {
+				status = 1
+				continue
+			}
+			fmt.Fprintln(c.Stdout, v)
+		}
+		return status
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.Stdout, "%s=%s\n", name, env[name])
+	}
+	return 0
+}
+
+func cmdExport(c *Call) int {
+	for _, a := range c.Args[1:] {
+		if name, value, ok := strings.Cut(a, "="); ok {
+			c.Shell.env[name] = value
+		}
+	}
+	return 0
+}
+
+func cmdWhich(c *Call) int {
+	_, names := splitFlags(c.Args[1:])
+	status := 0
+	for _, name := range names {
+		_, ok := registry[name]
+		if !ok || shellBuiltins[name] {
+			status = 1
+			continue
+		}
+		fmt.Fprintln(c.Stdout, binPath(name))
+	}
+	return status
+}
+
+// binPath is where a command's executable lives on the emulated system.
+func binPath(name string) string {
+	switch name {
+	case "ifconfig", "netstat", "chpasswd", "ip", "ss":
+		return "/usr/sbin/" + name
+	}
+	return "/usr/bin/" + name
+}
+
+func cmdSleep(c *Call) int {
+	if len(c.Args) < 2 {
+		fmt.Fprintln(c.Stderr, "sleep: missing operand\nTry 'sleep --help' for more information.")
+		return 1
+	}
+	secs, err := strconv.ParseFloat(strings.TrimSuffix(c.Args[1], "s"), 64)
+	if err != nil || secs < 0 {
+		fmt.Fprintf(c.Stderr, "sleep: invalid time interval '%s'\nTry 'sleep --help' for more information.\n", c.Args[1])
+		return 1
+	}
+	time.Sleep(min(time.Duration(secs*float64(time.Second)), maxSleep))
+	return 0
+}
+
+func cmdClear(c *Call) int {
+	fmt.Fprint(c.Stdout, "\x1b[H\x1b[2J\x1b[3J")
+	return 0
+}
+
+// cmdGroups agrees with the memberships id reports.
+func cmdGroups(c *Call) int {
+	if c.Shell.uid() == 0 {
+		fmt.Fprintln(c.Stdout, "root")
+		return 0
+	}
+	fmt.Fprintln(c.Stdout, c.Shell.user+" adm cdrom sudo dip plugdev")
+	return 0
+}
+
+func (s *Shell) crontabPath() string {
+	return path.Join("/var/spool/cron/crontabs", s.user)
+}
+
+// cmdCrontab keeps the user's crontab in the virtual filesystem, so a
+// persistence attempt can be listed back and shows up in the captured state.
+func cmdCrontab(c *Call) int {
+	s := c.Shell
+	flags, operands := splitFlags(c.Args[1:])
+	p := s.crontabPath()
+	switch {
+	case strings.Contains(flags, "l"):
+		data, err := s.fs.ReadFile(p)
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "no crontab for %s\n", s.user)
+			return 1
+		}
+		c.Stdout.Write(data)
+	case strings.Contains(flags, "r"):
+		if err := s.fs.Remove(p); err != nil {
+			fmt.Fprintf(c.Stderr, "no crontab for %s\n", s.user)
+			return 1
+		}
+	case len(operands) > 0:
+		data := c.Stdin
+		if operands[0] != "-" {
+			var err error
+			if data, err = s.fs.ReadFile(s.abs(operands[0])); err != nil {
+				fmt.Fprintf(c.Stderr, "%s: %s\n", operands[0], ErrText(err))
+				return 1
+			}
+		}
+		if err := s.fs.WriteFile(p, data, 0600, s.user); err != nil {
+			fmt.Fprintf(c.Stderr, "crontab: %s\n", ErrText(err))
+			return 1
+		}
+	case strings.Contains(flags, "e"):
+		fmt.Fprintln(c.Stderr, "no crontab for "+s.user+" - using an empty one\ncrontab: installing new crontab")
+	default:
+		fmt.Fprintln(c.Stderr, "crontab: usage error: file name or - (for stdin) must be specified")
+		return 1
+	}
+	return 0
+}
+
+// cmdSudo runs the command directly for root and otherwise fails the way
+// sudo does when no password can be read.
+func cmdSudo(c *Call) int {
+	args := c.Args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		if args[0] == "-u" && len(args) > 1 {
+			args = args[1:]
+		}
+		args = args[1:]
+	}
+	if c.Shell.user != "root" {
+		fmt.Fprintf(c.Stdout, "[sudo] password for %s: \n", c.Shell.user)
+		fmt.Fprintln(c.Stderr, "sudo: a password is required")
+		return 1
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(c.Stderr, "usage: sudo -h | -K | -k | -V\nusage: sudo [-u user] command")
+		return 1
+	}
+	return c.Shell.dispatch(&Call{Shell: c.Shell, Args: args, Stdin: c.Stdin, Stdout: c.Stdout, Stderr: c.Stderr})
+}
+
+func cmdPasswd(c *Call) int {
+	fmt.Fprintf(c.Stdout, "Changing password for %s.\n", c.Shell.user)
+	fmt.Fprintln(c.Stderr, "passwd: Authentication token manipulation error\npasswd: password unchanged")
+	return 10
+}
+
+// cmdChpasswd accepts user:password lines silently, as it does on success.
+func cmdChpasswd(c *Call) int {
+	if c.Shell.user != "root" {
+		fmt.Fprintln(c.Stderr, "chpasswd: Permission denied.")
+		return 1
+	}
+	return 0
+}
+
+// signals are the signal names kill knows, indexed by number.
+var signals = []string{1: "HUP", "INT", "QUIT", "ILL", "TRAP", "ABRT", "BUS", "FPE", "KILL", "USR1", "SEGV",
+	"USR2", "PIPE", "ALRM", "TERM", "STKFLT", "CHLD", "CONT", "STOP", "TSTP", "TTIN", "TTOU", "URG", "XCPU",
+	"XFSZ", "VTALRM", "PROF", "WINCH", "IO", "PWR", "SYS"}
+
+// signalNumber parses a signal given by number or by name, with or without
+// the SIG prefix.
+func signalNumber(spec string) (int, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		return n, n >= 0 && n < len(signals)
+	}
+	name := strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	for n, s := range signals {
+		if s != "" && s == name {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// cmdKill signals processes in the fake process table. Only root may signal
+// other users' processes; the processes are scenery and stay in ps.
+func cmdKill(c *Call) int {
+	s := c.Shell
+	usage := func() int {
+		fmt.Fprintln(c.Stderr, "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]")
+		return 2
+	}
+	invalid := func(spec string) int {
+		fmt.Fprintf(c.Stderr, "-bash: kill: %s: invalid signal specification\n", spec)
+		return 1
+	}
+	args := c.Args[1:]
+	if len(args) == 0 {
+		return usage()
+	}
+	switch a := args[0]; {
+	case a == "-l" || a == "-L":
+		return listSignals(c, args[1:])
+	case a == "-s" || a == "-n":
+		if len(args) < 2 {
+			fmt.Fprintf(c.Stderr, "-bash: kill: %s: option requires an argument\n", a)
+			return usage()
+		}
+		if _, ok := signalNumber(args[1]); !ok {
+			return invalid(args[1])
+		}
+		args = args[2:]
+	case a == "--":
+		args = args[1:]
+	case len(a) > 1 && a[0] == '-':
+		if _, ok := signalNumber(a[1:]); !ok {
+			return invalid(a[1:])
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	status := 0
+	for _, a := range args {
+		pid, err := strconv.Atoi(a)
+		if err != nil {
+			fmt.Fprintf(c.Stderr, "-bash: kill: %s: arguments must be process or job IDs\n", a)
+			status = 1
+			continue
+		}
+		owner := ""
+		for _, p := range append(processTable, s.sessionProcesses("")...) {
+			if p.pid == pid {
+				owner = p.user
+			}
+		}
+		switch {
+		case owner == "":
+			fmt.Fprintf(c.Stderr, "-bash: kill: (%d) - No such process\n", pid)
+		case owner != s.user && s.uid() != 0:
+			fmt.Fprintf(c.Stderr, "-bash: kill: (%d) - Operation not permitted\n", pid)
+		default:
+			continue
+		}
+		status = 1
+	}
+	return status
+}
+
+// listSignals implements kill -l: the whole table, or the name or number
+// of each signal given.
+func listSignals(c *Call, specs []string) int {
+	if len(specs) == 0 {
+		for n := 1; n < len(signals); n++ {
+			sep := "\t"
+			if n%5 == 0 || n == len(signals)-1 {
+				sep = "\n"
+			}
+			fmt.Fprintf(c.Stdout, "%2d) SIG%s%s", n, signals[n], sep)
+		}
+		return 0
+	}
+	status := 0
+	for _, spec := range specs {
+		n, ok := signalNumber(spec)
+		switch {
+		case !ok || n == 0:
+			fmt.Fprintf(c.Stderr, "-bash: kill: %s: invalid signal specification\n", spec)
+			status = 1
+		case spec == strconv.Itoa(n):
+			fmt.Fprintln(c.Stdout, signals[n])
+		default:
+			fmt.Fprintln(c.Stdout, n)
+		}
+	}
+	return status
+}
@@ -0,0 +1,25 @@
+package shell
+
+import "testing"
+
+func TestKill(t *testing.T) {
+	runLines(t, []lineTest{
+		{line: "kill 741"},
+		{line: "kill -9 758 2214"},
+		{line: "kill -SIGTERM 801"},
+		{line: "kill -s KILL 688"},
+		{line: "kill -n 9 688"},
+		{line: "kill 31337", want: "-bash: kill: (31337) - No such process\n", status: 1},
+		{line: "kill -9 x", want: "-bash: kill: x: arguments must be process or job IDs\n", status: 1},
+		{line: "kill -FOO 1", want: "-bash: kill: FOO: invalid signal specification\n", status: 1},
+		{line: "kill", want: "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\n", status: 2},
+		{line: "kill -l 9 TERM", want: "KILL\n15\n"},
+		{line: "kill -l | head -1", want: " 1) SIGHUP\t 2) SIGINT\t 3) SIGQUIT\t 4) SIGILL\t 5) SIGTRAP\n"},
+	}, nil)
+
+	// Other users' processes are out of reach of an unprivileged account.
+	runLines(t, []lineTest{
+		{line: "kill 2287"},
+		{line: "kill -9 801", want: "-bash: kill: (801) - Operation not permitted\n", status: 1},
+	}, func(s *Shell) { s.user = "admin" })
+}
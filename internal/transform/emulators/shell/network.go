@@ -0,0 +1,226 @@
+package shell
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+func init() {
+	for name, h := range map[string]Handler{
+		"ifconfig": cmdIfconfig,
+		"ip":       cmdIP,
+		"netstat":  cmdNetstat,
+		"ss":       cmdSS,
+	} {
+		Register(name, h)
+	}
+}
+
+// hwAddr is the MAC address of eth0.
+const hwAddr = "0a:3c:5e:91:7d:b2"
+
+// socket is a row of the socket table shared by netstat and ss.
+type socket struct {
+	proto, local, remote, state string
+	pid                         int
+	program                     string
+}
+
+// sockets lists the listeners of the services in processTable, plus the
+// attacker's own connection to sshd.
+func (s *Shell) sockets() []socket {
+	local := s.localIP()
+	socks := []socket{
+		{"tcp", "127.0.0.53:53", "0.0.0.0:*", "LISTEN", 602, "systemd-resolve"},
+		{"tcp", "0.0.0.0:22", "0.0.0.0:*", "LISTEN", 741, "sshd"},
+		{"tcp", "0.0.0.0:80", "0.0.0.0:*", "LISTEN", 757, "nginx"},
+		{"tcp", "127.0.0.1:3306", "0.0.0.0:*", "LISTEN", 801, "mysqld"},
+		{"tcp6", ":::22", ":::*", "LISTEN", 741, "sshd"},
+		{"tcp6", ":::80", ":::*", "LISTEN", 757, "nginx"},
+		{"udp", "127.0.0.53:53", "0.0.0.0:*", "", 602, "systemd-resolve"},
+		{"udp", local + ":68", "0.0.0.0:*", "", 540, "systemd-network"},
+	}
+	if s.sess != nil && s.sess.Src != "" {
+		socks = append(socks, socket{"tcp", local + ":22", s.sess.Src, "ESTABLISHED", 2198, "sshd"})
+	}
+	return socks
+}
+
+func cmdNetstat(c *Call) int {
+	s := c.Shell
+	flags, _ := splitFlags(c.Args[1:])
+	if flags == "" {
+		flags = "tu"
+	}
+	if strings.Contains(flags, "r") {
+		fmt.Fprintln(c.Stdout, "Kernel IP routing table")
+		fmt.Fprintln(c.Stdout, "Destination     Gateway         Genmask         Flags   MSS Window  irtt Iface")
+		fmt.Fprintf(c.Stdout, "0.0.0.0         %-15s 0.0.0.0         UG        0 0          0 eth0\n", gateway(s.localIP()))
+		fmt.Fprintf(c.Stdout, "%-15s 0.0.0.0         255.255.255.0   U         0 0          0 eth0\n", network(s.localIP()))
+		return 0
+	}
+	tcp := strings.Contains(flags, "t")
+	udp := strings.Contains(flags, "u")
+	if !tcp && !udp {
+		tcp, udp = true, true
+	}
+	all := strings.Contains(flags, "a")
+	listening := strings.Contains(flags, "l")
+	programs := strings.Contains(flags, "p")
+
+	switch {
+	case all:
+		fmt.Fprintln(c.Stdout, "Active Internet connections (servers and established)")
+	case listening:
+		fmt.Fprintln(c.Stdout, "Active Internet connections (only servers)")
+	default:
+		fmt.Fprintln(c.Stdout, "Active Internet connections (w/o servers)")
+	}
+	header := "Proto Recv-Q Send-Q Local Address           Foreign Address         State      "
+	if programs {
+		header += " PID/Program name"
+	}
+	fmt.Fprintln(c.Stdout, strings.TrimRight(header, " "))
+	for _, k := range s.sockets() {
+		isTCP := strings.HasPrefix(k.proto, "tcp")
+		if isTCP && !tcp || !isTCP && !udp {
+			continue
+		}
+		listener := k.state == "LISTEN" || k.state == ""
+		if !all && listener != listening {
+			continue
+		}
+		line := fmt.Sprintf("%-5s %6d %6d %-23s %-23s %-11s", k.proto, 0, 0, k.local, k.remote, k.state)
+		if programs {
+			owner := "-"
+			if s.user == "root" {
+				owner = fmt.Sprintf("%d/%s", k.pid, k.program)
+			}
+			line += " " + owner
+		}
+		fmt.Fprintln(c.Stdout, strings.TrimRight(line, " "))
+	}
+	if programs && s.user != "root" {
+		fmt.Fprintln(c.Stderr, "(Not all processes could be identified, non-owned process info\n will not be shown, you would have to be root to see it all.)")
+	}
+	return 0
+}
+
+func cmdSS(c *Call) int {
+	s := c.Shell
+	flags, _ := splitFlags(c.Args[1:])
+	tcp := strings.Contains(flags, "t")
+	udp := strings.Contains(flags, "u")
+	if !tcp && !udp {
+		tcp, udp = true, true
+	}
+	all := strings.Contains(flags, "a")
+	listening := strings.Contains(flags, "l")
+	programs := strings.Contains(flags, "p")
+
+	fmt.Fprintln(c.Stdout, "Netid State  Recv-Q Send-Q  Local Address:Port   Peer Address:Port Process")
+	for _, k := range s.sockets() {
+		isTCP := strings.HasPrefix(k.proto, "tcp")
+		if isTCP && !tcp || !isTCP && !udp {
+			continue
+		}
+		listener := k.state == "LISTEN" || k.state == ""
+		if !all && listener != listening {
+			continue
+		}
+		state := map[string]string{"LISTEN": "LISTEN", "ESTABLISHED": "ESTAB", "": "UNCONN"}[k.state]
+		local := strings.Replace(k.local, ":::", "[::]:", 1)
+		peer := strings.Replace(k.remote, ":::*", "[::]:*", 1)
+		proc := ""
+		if programs && s.user == "root" {
+			proc = fmt.Sprintf(`users:(("%s",pid=%d,fd=3))`, k.program, k.pid)
+		}
+		line := fmt.Sprintf("%-5s %-6s %-6d %-6d %20s %19s %s", k.proto[:3], state, 0, 0, local, peer, proc)
+		fmt.Fprintln(c.Stdout, strings.TrimRight(line, " "))
+	}
+	return 0
+}
+
+func cmdIfconfig(c *Call) int {
+	ip := c.Shell.localIP()
+	fmt.Fprintf(c.Stdout, `eth0: flags=4163<UP,BROADCAST,RUNNING,MULTICAST>  mtu 9001
+        inet %s  netmask 255.255.255.0  broadcast %s
+        inet6 fe80::83c:5eff:fe91:7db2  prefixlen 64  scopeid 0x20<link>
+        ether %s  txqueuelen 1000  (Ethernet)
+        RX packets 4817334  bytes 3821176403 (3.8 GB)
+        RX errors 0  dropped 0  overruns 0  frame 0
+        TX packets 2915086  bytes 701839512 (701.8 MB)
+        TX errors 0  dropped 0 overruns 0  carrier 0  collisions 0
+
+lo: flags=73<UP,LOOPBACK,RUNNING>  mtu 65536
+        inet 127.0.0.1  netmask 255.0.0.0
+        inet6 ::1  prefixlen 128  scopeid 0x10<host>
+        loop  txqueuelen 1000  (Local Loopback)
+        RX packets 88213  bytes 9127431 (9.1 MB)
+        RX errors 0  dropped 0  overruns 0  frame 0
+        TX packets 88213  bytes 9127431 (9.1 MB)
+        TX errors 0  dropped 0 overruns 0  carrier 0  collisions 0
+
+`, ip, broadcast(ip), hwAddr)
+	return 0
+}
+
+// cmdIP implements the addr, route and link objects of iproute2, accepting
+// the usual abbreviations.
+func cmdIP(c *Call) int {
+	ip := c.Shell.localIP()
+	_, operands := splitFlags(c.Args[1:])
+	object := "help"
+	if len(operands) > 0 {
+		object = operands[0]
+	}
+	switch {
+	case strings.HasPrefix("addr", object) || strings.HasPrefix("address", object):
+		fmt.Fprintf(c.Stdout, `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN group default qlen 1000
+    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00
+    inet 127.0.0.1/8 scope host lo
+       valid_lft forever preferred_lft forever
+    inet6 ::1/128 scope host
+       valid_lft forever preferred_lft forever
+2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 9001 qdisc fq_codel state UP group default qlen 1000
+    link/ether %s brd ff:ff:ff:ff:ff:ff
+    inet %s/24 metric 100 brd %s scope global dynamic eth0
+       valid_lft 2851sec preferred_lft 2851sec
+    inet6 fe80::83c:5eff:fe91:7db2/64 scope link
+       valid_lft forever preferred_lft forever
+`, hwAddr, ip, broadcast(ip))
+	case strings.HasPrefix("route", object):
+		fmt.Fprintf(c.Stdout, "default via %s dev eth0 proto dhcp src %s metric 100\n", gateway(ip), ip)
+		fmt.Fprintf(c.Stdout, "%s/24 dev eth0 proto kernel scope link src %s metric 100\n", network(ip), ip)
+		fmt.Fprintf(c.Stdout, "%s dev eth0 proto dhcp scope link src %s metric 100\n", gateway(ip), ip)
+	case strings.HasPrefix("link", object):
+		fmt.Fprintf(c.Stdout, `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00
+2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 9001 qdisc fq_codel state UP mode DEFAULT group default qlen 1000
+    link/ether %s brd ff:ff:ff:ff:ff:ff
+`, hwAddr)
+	default:
+		fmt.Fprintln(c.Stderr, `Usage: ip [ OPTIONS ] OBJECT { COMMAND | help }
+where  OBJECT := { address | link | route }`)
+		return 255
+	}
+	return 0
+}
+
+// octets returns the IPv4 address ip as four bytes, falling back to the
+// default address for anything else.
+func octets(ip string) net.IP {
+	if v4 := net.ParseIP(ip).To4(); v4 != nil {
+		return v4
+	}
+	return net.ParseIP(defaultLocalIP).To4()
+}
+
+// The emulated host sits on a /24 whose gateway is the .1 address.
+func network(ip string) string { o := octets(ip); return fmt.Sprintf("%d.%d.%d.0", o[0], o[1], o[2]) }
+func gateway(ip string) string { o := octets(ip); return fmt.Sprintf("%d.%d.%d.1", o[0], o[1], o[2]) }
+func broadcast(ip string) string {
+	o := octets(ip)
+	return fmt.Sprintf("%d.%d.%d.255", o[0], o[1], o[2])
+}
@@ -0,0 +1,373 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// part is a literal piece of a word, or a variable reference or command
+// substitution to expand at run time.
+type part struct {
+	lit     string
+	varName string
+	cmd     string // command line of a $(...) or `...` substitution
+}
+
+// word is a shell word whose variables are expanded when its command runs, so
+// that "false; echo $?" sees the status of the previous command.
+type word []part
+
+// expand resolves the word's variables with lookup and runs its command
+// substitutions with run.
+func (w word) expand(lookup, run func(string) string) string {
+	var b strings.Builder
+	for _, p := range w {
+		switch {
+		case p.varName != "":
+			b.WriteString(lookup(p.varName))
+		case p.cmd != "":
+			b.WriteString(run(p.cmd))
+		default:
+			b.WriteString(p.lit)
+		}
+	}
+	return b.String()
+}
+
+// substitutes reports whether the word contains a command substitution.
+func (w word) substitutes() bool {
+	for _, p := range w {
+		if p.cmd != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// assignment reports whether the word is a NAME=value assignment, which
+// bash recognises before any expansion.
+func (w word) assignment() bool {
+	if len(w) == 0 || w[0].varName != "" || w[0].cmd != "" {
+		return false
+	}
+	name, _, ok := strings.Cut(w[0].lit, "=")
+	return ok && validName(name)
+}
+
+// validName reports whether s can name a shell variable.
+func validName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// token is a word or an operator produced by the lexer. Quoted text is never an operator.
+type token struct {
+	word word
+	op   string
+}
+
+// redirect is an output or input redirection attached to a command.
+type redirect struct {
+	fd     int    // 0 for <, 1 for > and >>, 2 for 2> and 2>>
+	op     string // "<", ">", ">>" or ">&"
+	target word
+}
+
+// command is one simple command: its words and redirections.
+type command struct {
+	args   []word
+	redirs []redirect
+}
+
+// pipeline is a sequence of commands joined by |.
+type pipeline []command
+
+// andOr links a pipeline to the previous one with ";", "&&" or "||".
+type andOr struct {
+	op   string
+	pipe pipeline
+}
+
+var operators = []string{"&&", "||", ">>", "2>&1", "2>>", "2>", ">&", ";", "|", "&", ">", "<"}
+
+// lex splits a command line into words and operators, handling quotes,
+// backslash escapes, variable references and command substitutions the way a
+// POSIX shell would for the subset of syntax attackers actually use.
+func lex(line string) ([]token, error) {
+	var out []token
+	var cur word
+	var lit strings.Builder
+	inWord := false
+	flushLit := func() {
+		if lit.Len() > 0 {
+			cur = append(cur, part{lit: lit.String()})
+			lit.Reset()
+		}
+	}
+	flush := func() {
+		flushLit()
+		if inWord {
+			out = append(out, token{word: cur})
+			cur = nil
+			inWord = false
+		}
+	}
+	variable := func(s string) int {
+		name, n := varRef(s)
+		if name == "" {
+			lit.WriteByte('$')
+			return 1
+		}
+		flushLit()
+		cur = append(cur, part{varName: name})
+		return n
+	}
+	substitution := func(s string) (int, error) {
+		cmd, n, err := commandSubstitution(s)
+		if err != nil {
+			return 0, err
+		}
+		flushLit()
+		if strings.TrimSpace(cmd) != "" {
+			cur = append(cur, part{cmd: cmd})
+		}
+		return n, nil
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '#' && !inWord:
+			flush()
+			return out, nil
+		case c == '\\':
+			inWord = true
+			if i+1 < len(line) {
+				i++
+				lit.WriteByte(line[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unexpected EOF while looking for matching `''")
+			}
+			lit.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				switch {
+				case line[j] == '\\' && j+1 < len(line) && strings.IndexByte("\"\\$`", line[j+1]) >= 0:
+					j++
+					lit.WriteByte(line[j])
+				case line[j] == '`' || strings.HasPrefix(line[j:], "$("):
+					n, err := substitution(line[j:])
+					if err != nil {
+						return nil, err
+					}
+					j += n - 1
+				case line[j] == '$':
+					j += variable(line[j:]) - 1
+				default:
+					lit.WriteByte(line[j])
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unexpected EOF while looking for matching `\"'")
+			}
+			i = j
+		case c == '`' || strings.HasPrefix(line[i:], "$("):
+			inWord = true
+			n, err := substitution(line[i:])
+			if err != nil {
+				return nil, err
+			}
+			i += n - 1
+		case c == '$':
+			inWord = true
+			i += variable(line[i:]) - 1
+		case c == '~' && !inWord && (i+1 == len(line) || strings.IndexByte("/ \t;|&<>", line[i+1]) >= 0):
+			inWord = true
+			cur = append(cur, part{varName: "HOME"})
+		default:
+			if op := matchOperator(line[i:], inWord); op != "" {
+				flush()
+				out = append(out, token{op: op})
+				i += len(op) - 1
+				continue
+			}
+			inWord = true
+			lit.WriteByte(c)
+		}
+	}
+	flush()
+	return out, nil
+}
+
+// matchOperator returns the operator at the start of s, if any. "2>" only
+// counts as an operator at the start of a word.
+func matchOperator(s string, inWord bool) string {
+	for _, op := range operators {
+		if strings.HasPrefix(op, "2") && inWord {
+			continue
+		}
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// commandSubstitution returns the command line of the $(...) or `...` at the
+// start of s and the length of the whole construct.
+func commandSubstitution(s string) (string, int, error) {
+	if s[0] == '`' {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\\", s[i+1]) >= 0:
+				i++
+				b.WriteByte(s[i])
+			case s[i] == '`':
+				return b.String(), i + 1, nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", 0, fmt.Errorf("unexpected EOF while looking for matching ``'")
+	}
+	depth := 0
+	for i := 2; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return "", 0, fmt.Errorf("unexpected EOF while looking for matching `''")
+			}
+			i += end + 1
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return s[2:i], i + 1, nil
+			}
+			depth--
+		}
+	}
+	return "", 0, fmt.Errorf("unexpected EOF while looking for matching `)'")
+}
+
+// varRef parses the variable reference at the start of s ("$NAME", "${NAME}",
+// "$?") and returns its name and length, or "" if s holds a literal dollar sign.
+func varRef(s string) (string, int) {
+	if len(s) < 2 {
+		return "", 1
+	}
+	if s[1] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", 1
+		}
+		return s[2:end], end + 1
+	}
+	if strings.IndexByte("?$#0123456789", s[1]) >= 0 {
+		return s[1:2], 2
+	}
+	n := 1
+	for n < len(s) && (s[n] == '_' || s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z' || n > 1 && s[n] >= '0' && s[n] <= '9') {
+		n++
+	}
+	if n == 1 {
+		return "", 1
+	}
+	return s[1:n], n
+}
+
+// parse groups tokens into and-or lists of pipelines.
+func parse(tokens []token) ([]andOr, error) {
+	var list []andOr
+	var pipe pipeline
+	var cmd command
+	op := ";"
+
+	endCommand := func() error {
+		if len(cmd.args) == 0 {
+			if len(cmd.redirs) > 0 || len(pipe) > 0 {
+				return fmt.Errorf("syntax error near unexpected token")
+			}
+			return nil
+		}
+		pipe = append(pipe, cmd)
+		cmd = command{}
+		return nil
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.op == "" {
+			cmd.args = append(cmd.args, t.word)
+			continue
+		}
+		switch t.op {
+		case ">", ">>", "<", "2>", "2>>", ">&":
+			if i+1 >= len(tokens) || tokens[i+1].op != "" {
+				return nil, fmt.Errorf("syntax error near unexpected token `newline'")
+			}
+			r := redirect{fd: 1, op: t.op, target: tokens[i+1].word}
+			switch t.op {
+			case "<":
+				r.fd = 0
+			case "2>":
+				r.fd, r.op = 2, ">"
+			case "2>>":
+				r.fd, r.op = 2, ">>"
+			}
+			cmd.redirs = append(cmd.redirs, r)
+			i++
+		case "2>&1":
+			cmd.redirs = append(cmd.redirs, redirect{fd: 2, op: ">&", target: word{{lit: "1"}}})
+		case "|":
+			if len(cmd.args) == 0 {
+				return nil, fmt.Errorf("syntax error near unexpected token `|'")
+			}
+			endCommand()
+		case ";", "&", "&&", "||":
+			if len(cmd.args) == 0 && len(pipe) == 0 {
+				return nil, fmt.Errorf("syntax error near unexpected token `%s'", t.op)
+			}
+			if err := endCommand(); err != nil {
+				return nil, err
+			}
+			list = append(list, andOr{op: op, pipe: pipe})
+			pipe = nil
+			op = t.op
+			if op == "&" {
+				op = ";"
+			}
+		}
+	}
+	if err := endCommand(); err != nil {
+		return nil, err
+	}
+	if len(pipe) > 0 {
+		list = append(list, andOr{op: op, pipe: pipe})
+	}
+	return list, nil
+}
@@ -0,0 +1,55 @@
+package shell
+
+import (
+	"io"
+	"sort"
+
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// Call carries the arguments and streams of one command invocation.
+type Call struct {
+	Shell  *Shell
+	Args   []string
+	Stdin  []byte
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Handler implements a command and returns its exit status.
+type Handler func(c *Call) int
+
+var registry = make(map[string]Handler)
+
+// Register makes a command available to every shell, replacing any handler
+// already registered under name. It must be called before shells are started,
+// normally from an init function.
+func Register(name string, h Handler) {
+	registry[name] = h
+}
+
+// Commands returns the names of all registered commands, sorted.
+func Commands() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// User returns the name of the logged-in user.
+func (s *Shell) User() string { return s.user }
+
+// Persona returns the machine the shell pretends to run on.
+func (s *Shell) Persona() *persona.Persona { return s.persona }
+
+// FS returns the session's virtual filesystem.
+func (s *Shell) FS() *vfs.FS { return s.fs }
+
+// Abs resolves p against the working directory.
+func (s *Shell) Abs(p string) string { return s.abs(p) }
+
+// Getenv returns the value of a shell variable.
+func (s *Shell) Getenv(name string) string { return s.lookup(name) }
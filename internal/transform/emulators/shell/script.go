@@ -0,0 +1,108 @@
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+)
+
+func init() {
+	Register("sh", cmdSh)
+	Register("bash", cmdSh)
+}
+
+// maxScriptDepth bounds scripts that run other scripts, or themselves.
+const maxScriptDepth = 8
+
+// cmdSh runs a script from -c, a file or stdin through the emulated shell,
+// so that `curl ... | sh` and downloaded installers unfold into the commands
+// they contain, each of which is emulated in turn.
+func cmdSh(c *Call) int {
+	s := c.Shell
+	// /bin/sh is dash on the persona's distribution, which words errors differently.
+	dash := path.Base(c.Args[0]) == "sh"
+	args := c.Args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		if args[0] == "-c" {
+			if len(args) < 2 {
+				fmt.Fprintf(c.Stderr, "%s: -c: option requires an argument\n", c.Args[0])
+				return 2
+			}
+			return s.runScript(c, []byte(args[1]))
+		}
+		args = args[1:]
+	}
+	name, data := "-", c.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		var err error
+		name = args[0]
+		data, err = s.fs.ReadFile(s.abs(name))
+		if err != nil {
+			if dash {
+				fmt.Fprintf(c.Stderr, "sh: 0: cannot open %s: No such file\n", name)
+				return 2
+			}
+			fmt.Fprintf(c.Stderr, "bash: %s: %s\n", name, ErrText(err))
+			return 127
+		}
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		fmt.Fprintf(c.Stderr, "%s: %s: cannot execute binary file\n", c.Args[0], name)
+		return 126
+	}
+	return s.runScript(c, data)
+}
+
+// runFile executes a file from the virtual filesystem named by path, as in
+// ./bot.sh. Scripts are interpreted; binaries are never run and just exit
+// as if they had daemonised.
+func (s *Shell) runFile(c *Call) int {
+	name := c.Args[0]
+	n, err := s.fs.Stat(s.abs(name))
+	switch {
+	case err != nil:
+		fmt.Fprintf(c.Stderr, "-bash: %s: %s\n", name, ErrText(err))
+		return 127
+	case n.IsDir():
+		fmt.Fprintf(c.Stderr, "-bash: %s: Is a directory\n", name)
+		return 126
+	case n.Mode&0111 == 0:
+		fmt.Fprintf(c.Stderr, "-bash: %s: Permission denied\n", name)
+		return 126
+	}
+	if bytes.IndexByte(n.Data, 0) >= 0 {
+		return 0
+	}
+	return s.runScript(c, n.Data)
+}
+
+// runScript interprets script line by line in a subshell: the working
+// directory, environment and exit are local to it.
+func (s *Shell) runScript(c *Call, script []byte) int {
+	if s.depth >= maxScriptDepth {
+		fmt.Fprintf(c.Stderr, "-bash: %s: Resource temporarily unavailable\n", c.Args[0])
+		return 126
+	}
+	cwd, env := s.cwd, maps.Clone(s.env)
+	s.depth++
+	defer func() {
+		s.depth--
+		s.cwd, s.env, s.exited = cwd, env, false
+	}()
+
+	out := c.Stdout
+	status := 0
+	scanner := bufio.NewScanner(bytes.NewReader(script))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for !s.exited && scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		status = s.interpret(line, out, c.Stderr)
+	}
+	return status
+}
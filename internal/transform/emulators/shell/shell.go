@@ -0,0 +1,445 @@
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/fetch"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+
+	"golang.org/x/term"
+)
+
+// Config describes the session a shell is started for.
+type Config struct {
+	User    string
+	Persona *persona.Persona
+	FS      *vfs.FS
+	Session *events.Session
+	// Fetcher retrieves the payloads wget, curl and tftp are pointed at; when
+	// nil only the URLs are recorded and the tools pretend to succeed.
+	Fetcher fetch.Fetcher
+	// Samples keeps fetched payloads; it may be nil.
+	Samples *quarantine.Store
+}
+
+// Shell is a bash look-alike that runs entirely against a virtual filesystem.
+// Nothing an attacker types is ever executed on the host.
+type Shell struct {
+	user    string
+	persona *persona.Persona
+	home    string
+	cwd     string
+	fs      *vfs.FS
+	sess    *events.Session
+	fetcher fetch.Fetcher
+	samples *quarantine.Store
+	env     map[string]string
+	history []string
+	status  int
+	exited  bool
+	started time.Time
+	depth   int // nesting of scripts being interpreted
+
+	// interactive is set while Run drives a terminal; it changes what exit prints.
+	interactive bool
+
+	mu            sync.Mutex
+	term          *term.Terminal
+	width, height int
+}
+
+// HomeDir returns the home directory of user on the emulated system.
+func HomeDir(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return "/home/" + user
+}
+
+// New prepares a shell for cfg.User, creating its home directory if needed.
+func New(cfg Config) *Shell {
+	home := HomeDir(cfg.User)
+	if n, err := cfg.FS.Stat(home); err != nil || !n.IsDir() {
+		cfg.FS.MkdirAll(home, 0755, cfg.User)
+	}
+	s := &Shell{
+		user:    cfg.User,
+		persona: cfg.Persona,
+		home:    home,
+		cwd:     home,
+		fs:      cfg.FS,
+		sess:    cfg.Session,
+		fetcher: cfg.Fetcher,
+		samples: cfg.Samples,
+		started: time.Now(),
+	}
+	s.env = map[string]string{
+		"HOME":    home,
+		"USER":    cfg.User,
+		"LOGNAME": cfg.User,
+		"SHELL":   "/bin/bash",
+		"PATH":    "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"LANG":    "en_US.UTF-8",
+		"TERM":    "xterm-256color",
+		"PWD":     home,
+	}
+	return s
+}
+
+// Setenv sets a variable in the shell's environment, e.g. one sent by the client.
+func (s *Shell) Setenv(name, value string) {
+	s.env[name] = value
+}
+
+// Resize records a new terminal size; it is applied to the line editor.
+func (s *Shell) Resize(width, height int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.width, s.height = width, height
+	if s.term != nil && width > 0 && height > 0 {
+		s.term.SetSize(width, height)
+	}
+}
+
+// Run serves an interactive session on rw with line editing until the
+// attacker exits or closes the stream, and returns the exit status.
+func (s *Shell) Run(rw io.ReadWriter) int {
+	t := term.NewTerminal(rw, s.prompt())
+	s.mu.Lock()
+	s.term = t
+	if s.width > 0 && s.height > 0 {
+		t.SetSize(s.width, s.height)
+	}
+	s.mu.Unlock()
+	s.interactive = true
+
+	fmt.Fprint(t, s.motd())
+	for !s.exited {
+		line, err := t.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				fmt.Fprint(t, "logout\n")
+			}
+			break
+		}
+		s.Execute(line, t)
+		t.SetPrompt(s.prompt())
+	}
+	return s.status
+}
+
+// RunScript executes commands read line by line from r without a prompt or
+// echo, the way bash behaves when its input is not a terminal.
+func (s *Shell) RunScript(r io.Reader, w io.Writer) int {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for !s.exited && scanner.Scan() {
+		s.Execute(scanner.Text(), w)
+	}
+	return s.status
+}
+
+// Exited reports whether the attacker has run exit or logout.
+func (s *Shell) Exited() bool {
+	return s.exited
+}
+
+// Execute runs one command line, writing its output to out, and returns the
+// exit status. Every non-empty line is published as a command event.
+func (s *Shell) Execute(line string, out io.Writer) int {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return s.status
+	}
+	if s.sess != nil {
+		events.Publish(&events.Command{Meta: s.sess.Meta(), Input: line})
+	}
+	s.history = append(s.history, line)
+	return s.interpret(line, out, out)
+}
+
+// interpret parses and runs line without recording it.
+func (s *Shell) interpret(line string, out, errOut io.Writer) int {
+	tokens, err := lex(line)
+	if err == nil {
+		var list []andOr
+		list, err = parse(tokens)
+		if err == nil {
+			s.runList(list, out, errOut)
+			return s.status
+		}
+	}
+	fmt.Fprintf(errOut, "-bash: %v\n", err)
+	s.status = 2
+	return s.status
+}
+
+// substitute runs line in a subshell for a command substitution and returns
+// its output without the trailing newlines. The working directory,
+// environment and exit are local to the subshell; its status is kept as $?.
+func (s *Shell) substitute(line string, errOut io.Writer) string {
+	if s.depth >= maxScriptDepth {
+		fmt.Fprintln(errOut, "-bash: fork: Resource temporarily unavailable")
+		s.status = 126
+		return ""
+	}
+	cwd, env := s.cwd, maps.Clone(s.env)
+	s.depth++
+	defer func() {
+		s.depth--
+		s.cwd, s.env, s.exited = cwd, env, false
+	}()
+	var out bytes.Buffer
+	s.interpret(line, &out, errOut)
+	return strings.TrimRight(out.String(), "\n")
+}
+
+func (s *Shell) runList(list []andOr, out, errOut io.Writer) {
+	for _, item := range list {
+		if s.exited {
+			return
+		}
+		switch {
+		case item.op == "&&" && s.status != 0:
+			continue
+		case item.op == "||" && s.status == 0:
+			continue
+		}
+		s.status = s.runPipeline(item.pipe, out, errOut)
+	}
+}
+
+// runPipeline feeds each command's output to the next one as its stdin;
+// error output goes straight to errOut.
+func (s *Shell) runPipeline(p pipeline, out, errOut io.Writer) int {
+	var stdin []byte
+	status := 0
+	for i, cmd := range p {
+		var buf bytes.Buffer
+		w := io.Writer(&buf)
+		if i == len(p)-1 {
+			w = out
+		}
+		status = s.runCommand(cmd, stdin, w, errOut)
+		stdin = buf.Bytes()
+	}
+	return status
+}
+
+// fileRedirect is an output redirection of fd to a file in the virtual
+// filesystem. The output is collected in data and written once the command
+// is done.
+type fileRedirect struct {
+	fd       int
+	appendTo bool
+	target   string
+	data     bytes.Buffer
+}
+
+// runCommand expands words, applies assignments and redirections and
+// dispatches to the builtin.
+func (s *Shell) runCommand(cmd command, stdin []byte, out, errOut io.Writer) int {
+	run := func(line string) string { return s.substitute(line, errOut) }
+	args := make([]string, len(cmd.args))
+	for i, w := range cmd.args {
+		args[i] = w.expand(s.lookup, run)
+	}
+
+	// Leading NAME=value words set shell variables when they stand alone,
+	// and only the command's environment when they prefix one.
+	n := 0
+	for n < len(args) && cmd.args[n].assignment() {
+		n++
+	}
+	if n == len(args) {
+		status := 0
+		for i, a := range args {
+			name, value, _ := strings.Cut(a, "=")
+			s.env[name] = value
+			if cmd.args[i].substitutes() {
+				status = s.status
+			}
+		}
+		return status
+	}
+	if n > 0 {
+		type saved struct {
+			value string
+			ok    bool
+		}
+		prev := map[string]saved{}
+		for _, a := range args[:n] {
+			name, value, _ := strings.Cut(a, "=")
+			if _, seen := prev[name]; !seen {
+				old, ok := s.env[name]
+				prev[name] = saved{old, ok}
+			}
+			s.env[name] = value
+		}
+		defer func() {
+			for name, p := range prev {
+				if p.ok {
+					s.env[name] = p.value
+				} else {
+					delete(s.env, name)
+				}
+			}
+		}()
+		args = args[n:]
+	}
+
+	// Redirections apply in order, so "> f 2>&1" sends both to f while
+	// "2>&1 > f" leaves stderr where stdout was.
+	stdout, stderr := out, errOut
+	var files []*fileRedirect
+	for _, r := range cmd.redirs {
+		target := r.target.expand(s.lookup, run)
+		switch {
+		case r.fd == 0:
+			data, err := s.fs.ReadFile(s.abs(target))
+			if err != nil {
+				fmt.Fprintf(errOut, "-bash: %s: %s\n", target, ErrText(err))
+				return 1
+			}
+			stdin = data
+		case r.op == ">&" && target == "1":
+			stderr = stdout
+		case target == "/dev/null":
+			if r.fd == 2 {
+				stderr = io.Discard
+			} else {
+				stdout = io.Discard
+			}
+		default:
+			f := &fileRedirect{fd: r.fd, appendTo: r.op == ">>", target: target}
+			files = append(files, f)
+			if f.fd == 2 {
+				stderr = &f.data
+			} else {
+				stdout = &f.data
+			}
+		}
+	}
+
+	status := s.dispatch(&Call{Shell: s, Args: args, Stdin: stdin, Stdout: stdout, Stderr: stderr})
+
+	for _, r := range files {
+		p := s.abs(r.target)
+		data := r.data.Bytes()
+		if r.appendTo {
+			if prev, err := s.fs.ReadFile(p); err == nil {
+				data = append(prev, data...)
+			}
+		}
+		if err := s.fs.WriteFile(p, data, 0644, s.user); err != nil {
+			fmt.Fprintf(errOut, "-bash: %s: %s\n", r.target, ErrText(err))
+			return 1
+		}
+	}
+	return status
+}
+
+// dispatch runs the registered handler for c.Args[0], or the file it names.
+func (s *Shell) dispatch(c *Call) int {
+	name := c.Args[0]
+	h, ok := registry[name]
+	if !ok {
+		h, ok = registry[path.Base(name)]
+		ok = ok && strings.Contains(name, "/")
+	}
+	switch {
+	case ok:
+		return h(c)
+	case strings.Contains(name, "/"):
+		return s.runFile(c)
+	}
+	fmt.Fprintf(c.Stderr, "-bash: %s: command not found\n", name)
+	return 127
+}
+
+func (s *Shell) prompt() string {
+	cwd := s.cwd
+	if cwd == s.home {
+		cwd = "~"
+	} else if strings.HasPrefix(cwd, s.home+"/") {
+		cwd = "~" + strings.TrimPrefix(cwd, s.home)
+	}
+	sigil := "$"
+	if s.user == "root" {
+		sigil = "#"
+	}
+	return fmt.Sprintf("%s@%s:%s%s ", s.user, s.persona.Hostname, cwd, sigil)
+}
+
+// previousLogin returns when the account last logged in before this
+// session. The motd and last show it as coming from the session's own
+// address, as they would for someone returning to a box they use.
+func (s *Shell) previousLogin() time.Time {
+	return s.started.Add(-26*time.Hour - 13*time.Minute)
+}
+
+func (s *Shell) motd() string {
+	last := s.previousLogin()
+	return fmt.Sprintf("Welcome to %s (%s %s %s)\n\n", persona.Distro, persona.OSName, persona.KernelRelease, persona.Machine) +
+		" * Documentation:  https://help.ubuntu.com\n" +
+		" * Management:     https://landscape.canonical.com\n" +
+		" * Support:        https://ubuntu.com/advantage\n\n" +
+		"Last login: " + last.Format("Mon Jan _2 15:04:05 2006") + " from " + s.remoteIP() + "\n"
+}
+
+// lookup resolves a shell variable for expansion.
+func (s *Shell) lookup(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(s.status)
+	case "$":
+		return "2214"
+	case "0":
+		return "-bash"
+	case "#":
+		return "0"
+	}
+	return s.env[name]
+}
+
+// abs resolves p against the working directory.
+func (s *Shell) abs(p string) string {
+	return vfs.Clean(s.cwd, p)
+}
+
+// ErrText renders a filesystem error the way coreutils does.
+func ErrText(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "No such file or directory"
+	case errors.Is(err, vfs.ErrIsDir):
+		return "Is a directory"
+	case errors.Is(err, vfs.ErrNotDir), errors.Is(err, fs.ErrInvalid):
+		return "Not a directory"
+	case errors.Is(err, vfs.ErrNotEmpty):
+		return "Directory not empty"
+	case errors.Is(err, fs.ErrPermission):
+		return "Permission denied"
+	case errors.Is(err, fs.ErrExist):
+		return "File exists"
+	case errors.Is(err, vfs.ErrLoop):
+		return "Too many levels of symbolic links"
+	case errors.Is(err, vfs.ErrNoSpace):
+		return "No space left on device"
+	}
+	return err.Error()
+}
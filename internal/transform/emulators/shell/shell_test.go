@@ -0,0 +1,119 @@
+package shell
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCommandSubstitution(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{line: "echo $(echo hi)", want: "hi\n"},
+		{line: "echo `echo hi`", want: "hi\n"},
+		{line: `echo "[$(echo a; echo; echo)]"`, want: "[a]\n"},
+		{line: "echo $(echo $(echo nested))", want: "nested\n"},
+		{line: "echo `echo \\`echo nested\\``", want: "nested\n"},
+		{line: "echo $(echo ')')", want: ")\n"},
+		{line: "echo x$(true)y", want: "xy\n"},
+		{line: "echo $()", want: "\n"},
+		{line: "cd /tmp; echo $(cd /; pwd) $(pwd)", want: "/ /tmp\n"},
+		{line: "echo $(X=1; echo $X)$X", want: "1\n"},
+		{line: "echo $(exit 3)$?", want: "3\n"},
+		{line: "echo $(uname)", want: "Linux\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			s := newTestShell(t, nil, nil)
+			s.fs.MkdirAll("/tmp", 0777, "root")
+			var out bytes.Buffer
+			s.Execute(tt.line, &out)
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+			if s.Exited() {
+				t.Error("substitution exited the shell")
+			}
+		})
+	}
+}
+
+func TestCommandSubstitutionErrors(t *testing.T) {
+	for _, line := range []string{"echo $(echo", "echo `echo", `echo "$(echo"`} {
+		s := newTestShell(t, nil, nil)
+		var out bytes.Buffer
+		if status := s.Execute(line, &out); status != 2 || !bytes.Contains(out.Bytes(), []byte("unexpected EOF")) {
+			t.Errorf("%s: status %d, output %q", line, status, out.String())
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   string
+		status int
+	}{
+		{line: "X=1; echo $X", want: "1\n"},
+		{line: "X=1 Y=$X; echo $Y", want: "\n"},
+		{line: "X=1; Y=$X; echo $Y", want: "1\n"},
+		{line: "X=$(echo a b); echo $X", want: "a b\n"},
+		{line: "X=$(false)", status: 1},
+		{line: "X=1 printenv X; echo [$X]", want: "1\n[]\n"},
+		{line: "X=0; X=1 printenv X; echo $X", want: "1\n0\n"},
+		{line: "HISTFILE=/dev/null PATH=/bin sh -c 'echo $HISTFILE'", want: "/dev/null\n"},
+		{line: "1X=2", want: "-bash: 1X=2: command not found\n", status: 127},
+		{line: "$X=2", want: "-bash: =2: command not found\n", status: 127},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			s := newTestShell(t, nil, nil)
+			var out bytes.Buffer
+			status := s.Execute(tt.line, &out)
+			if out.String() != tt.want || status != tt.status {
+				t.Errorf("got %q, status %d; want %q, status %d", out.String(), status, tt.want, tt.status)
+			}
+		})
+	}
+}
+
+// lineTest is a command line and the output and status it should give.
+type lineTest struct {
+	line   string
+	want   string
+	status int
+}
+
+// runLines runs each test in a fresh shell, prepared by setup when it is not nil.
+func runLines(t *testing.T, tests []lineTest, setup func(*Shell)) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			s := newTestShell(t, nil, nil)
+			if setup != nil {
+				setup(s)
+			}
+			var out bytes.Buffer
+			status := s.Execute(tt.line, &out)
+			if out.String() != tt.want || status != tt.status {
+				t.Errorf("got %q, status %d; want %q, status %d", out.String(), status, tt.want, tt.status)
+			}
+		})
+	}
+}
+
+func TestRedirections(t *testing.T) {
+	runLines(t, []lineTest{
+		{line: "cat /nope 2>/tmp/e; echo [$?]; cat /tmp/e", want: "[1]\ncat: /nope: No such file or directory\n"},
+		{line: "cat /nope 2>/tmp/e; cat /nope 2>>/tmp/e; cat /tmp/e", want: "cat: /nope: No such file or directory\ncat: /nope: No such file or directory\n"},
+		{line: "cat /nope 2>/dev/null", status: 1},
+		{line: "echo hi 2>/tmp/e; cat /tmp/e", want: "hi\n"},
+		{line: "cat /nope >/tmp/o 2>&1; cat /tmp/o", want: "cat: /nope: No such file or directory\n"},
+		{line: "cat /nope 2>&1 >/tmp/o; echo [$(cat /tmp/o)]", want: "cat: /nope: No such file or directory\n[]\n"},
+		{line: "echo a >/tmp/a >/tmp/b; cat /tmp/a /tmp/b", want: "a\n"},
+		{line: "echo out >/tmp/o 2>/tmp/e; cat /tmp/o /tmp/e", want: "out\n"},
+	}, func(s *Shell) {
+		s.fs.MkdirAll("/tmp", 0777, "root")
+	})
+}
@@ -0,0 +1,358 @@
+package shell
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/transform/emulators/persona"
+)
+
+func init() {
+	for name, h := range map[string]Handler{
+		"arch":        cmdArch,
+		"date":        cmdDate,
+		"df":          cmdDf,
+		"free":        cmdFree,
+		"hostname":    cmdHostname,
+		"last":        cmdLast,
+		"lsb_release": cmdLsbRelease,
+		"lsblk":       cmdLsblk,
+		"lscpu":       cmdLscpu,
+		"nproc":       cmdNproc,
+		"top":         cmdTop,
+		"uptime":      cmdUptime,
+		"w":           cmdW,
+		"who":         cmdWho,
+	} {
+		Register(name, h)
+	}
+}
+
+// Fallback addresses for sessions whose endpoints are unknown.
+const (
+	defaultLocalIP  = "10.0.0.12"
+	defaultRemoteIP = "10.0.0.5"
+)
+
+// localIP is the machine's primary address: the one the attacker connected to.
+func (s *Shell) localIP() string {
+	if s.sess != nil {
+		if host, _, err := net.SplitHostPort(s.sess.Dst); err == nil && host != "0.0.0.0" && host != "::" {
+			return host
+		}
+	}
+	return defaultLocalIP
+}
+
+// remoteIP is where the attacker's session comes from.
+func (s *Shell) remoteIP() string {
+	if s.sess != nil {
+		if host, _, err := net.SplitHostPort(s.sess.Src); err == nil {
+			return host
+		}
+	}
+	return defaultRemoteIP
+}
+
+func cmdArch(c *Call) int {
+	fmt.Fprintln(c.Stdout, persona.Machine)
+	return 0
+}
+
+func cmdHostname(c *Call) int {
+	flags, _ := splitFlags(c.Args[1:])
+	switch {
+	case strings.Contains(flags, "I"):
+		fmt.Fprintln(c.Stdout, c.Shell.localIP()+" ")
+	case strings.Contains(flags, "i"):
+		fmt.Fprintln(c.Stdout, "127.0.1.1")
+	default:
+		fmt.Fprintln(c.Stdout, c.Shell.persona.Hostname)
+	}
+	return 0
+}
+
+func cmdNproc(c *Call) int {
+	fmt.Fprintln(c.Stdout, c.Shell.persona.CPUs)
+	return 0
+}
+
+// cmdDate supports the default format and the strftime verbs scripts use.
+func cmdDate(c *Call) int {
+	now := time.Now().UTC()
+	for _, a := range c.Args[1:] {
+		if f, ok := strings.CutPrefix(a, "+"); ok {
+			fmt.Fprintln(c.Stdout, strftime(now, f))
+			return 0
+		}
+	}
+	fmt.Fprintln(c.Stdout, now.Format("Mon Jan _2 15:04:05 MST 2006"))
+	return 0
+}
+
+func strftime(t time.Time, f string) string {
+	r := strings.NewReplacer(
+		"%s", fmt.Sprint(t.Unix()),
+		"%Y", t.Format("2006"), "%y", t.Format("06"),
+		"%m", t.Format("01"), "%d", t.Format("02"), "%e", t.Format("_2"),
+		"%H", t.Format("15"), "%M", t.Format("04"), "%S", t.Format("05"),
+		"%F", t.Format("2006-01-02"), "%T", t.Format("15:04:05"),
+		"%a", t.Format("Mon"), "%b", t.Format("Jan"), "%Z", t.Format("MST"),
+		"%%", "%",
+	)
+	return r.Replace(f)
+}
+
+// uptimeLine is the header shared by uptime, w and top.
+func (s *Shell) uptimeLine(now time.Time) string {
+	la := persona.LoadAvg
+	return fmt.Sprintf(" %s up %s,  1 user,  load average: %.2f, %.2f, %.2f",
+		now.Format("15:04:05"), persona.UptimeString(s.persona.Uptime(now)), la[0], la[1], la[2])
+}
+
+func cmdUptime(c *Call) int {
+	now := time.Now()
+	flags, _ := splitFlags(c.Args[1:])
+	switch {
+	case strings.Contains(flags, "p"):
+		d := c.Shell.persona.Uptime(now)
+		days, hours, mins := int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60
+		fmt.Fprintf(c.Stdout, "up %d weeks, %d days, %d hours, %d minutes\n", days/7, days%7, hours, mins)
+	case strings.Contains(flags, "s"):
+		fmt.Fprintln(c.Stdout, c.Shell.persona.BootTime.Format("2006-01-02 15:04:05"))
+	default:
+		fmt.Fprintln(c.Stdout, c.Shell.uptimeLine(now))
+	}
+	return 0
+}
+
+func cmdW(c *Call) int {
+	s := c.Shell
+	fmt.Fprintln(c.Stdout, s.uptimeLine(time.Now()))
+	fmt.Fprintln(c.Stdout, "USER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT")
+	fmt.Fprintf(c.Stdout, "%-8s pts/0    %-16s %s    0.00s  0.02s  0.00s w\n", s.user, s.remoteIP(), s.started.Format("15:04"))
+	return 0
+}
+
+func cmdWho(c *Call) int {
+	s := c.Shell
+	fmt.Fprintf(c.Stdout, "%-8s pts/0        %s (%s)\n", s.user, s.started.Format("2006-01-02 15:04"), s.remoteIP())
+	return 0
+}
+
+func cmdLast(c *Call) int {
+	s := c.Shell
+	prev := s.previousLogin()
+	boot := s.persona.BootTime
+	const stamp = "Mon Jan _2 15:04"
+	fmt.Fprintf(c.Stdout, "%-8s pts/0        %-16s %s   still logged in\n", s.user, s.remoteIP(), s.started.Format(stamp))
+	fmt.Fprintf(c.Stdout, "%-8s pts/0        %-16s %s - %s  (00:51)\n", s.user, s.remoteIP(), prev.Format(stamp), prev.Add(51*time.Minute).Format("15:04"))
+	fmt.Fprintf(c.Stdout, "reboot   system boot  %-16.16s %s   still running\n", persona.KernelRelease, boot.Format(stamp))
+	fmt.Fprintf(c.Stdout, "\nwtmp begins %s\n", boot.Format("Mon Jan _2 15:04:05 2006"))
+	return 0
+}
+
+func cmdLsbRelease(c *Call) int {
+	flags, _ := splitFlags(c.Args[1:])
+	if flags == "" {
+		flags = "v"
+	}
+	fmt.Fprintln(c.Stderr, "No LSB modules are available.")
+	short := strings.Contains(flags, "s")
+	field := func(name, value string) {
+		if short {
+			fmt.Fprintln(c.Stdout, value)
+		} else {
+			fmt.Fprintf(c.Stdout, "%s:\t%s\n", name, value)
+		}
+	}
+	all := strings.Contains(flags, "a")
+	if all || strings.Contains(flags, "i") {
+		field("Distributor ID", "Ubuntu")
+	}
+	if all || strings.Contains(flags, "d") {
+		field("Description", persona.Distro)
+	}
+	if all || strings.Contains(flags, "r") {
+		field("Release", "22.04")
+	}
+	if all || strings.Contains(flags, "c") {
+		field("Codename", persona.Codename)
+	}
+	return 0
+}
+
+func cmdLscpu(c *Call) int {
+	p := c.Shell.persona
+	online := "0"
+	if p.CPUs > 1 {
+		online = fmt.Sprintf("0-%d", p.CPUs-1)
+	}
+	instances := func(n int) string {
+		if n == 1 {
+			return "1 instance"
+		}
+		return fmt.Sprintf("%d instances", n)
+	}
+	fmt.Fprintf(c.Stdout, `Architecture:            %s
+  CPU op-mode(s):        32-bit, 64-bit
+  Address sizes:         46 bits physical, 48 bits virtual
+  Byte Order:            Little Endian
+CPU(s):                  %d
+  On-line CPU(s) list:   %s
+Vendor ID:               GenuineIntel
+  Model name:            %s
+    CPU family:          6
+    Model:               63
+    Thread(s) per core:  1
+    Core(s) per socket:  %d
+    Socket(s):           1
+    Stepping:            2
+    BogoMIPS:            4799.99
+Virtualization features:
+  Hypervisor vendor:     Xen
+  Virtualization type:   full
+Caches (sum of all):
+  L1d:                   %d KiB (%s)
+  L1i:                   %d KiB (%s)
+  L2:                    %d KiB (%s)
+  L3:                    30 MiB (1 instance)
+NUMA:
+  NUMA node(s):          1
+  NUMA node0 CPU(s):     %s
+`, persona.Machine, p.CPUs, online, persona.CPUModel, p.CPUs,
+		32*p.CPUs, instances(p.CPUs), 32*p.CPUs, instances(p.CPUs), 256*p.CPUs, instances(p.CPUs), online)
+	return 0
+}
+
+func cmdFree(c *Call) int {
+	flags, _ := splitFlags(c.Args[1:])
+	m := c.Shell.persona.Memory()
+	format := func(kb int64) string { return fmt.Sprint(kb) }
+	switch {
+	case strings.Contains(flags, "h"):
+		format = humanKB
+	case strings.Contains(flags, "g"):
+		format = func(kb int64) string { return fmt.Sprint(kb >> 20) }
+	case strings.Contains(flags, "m"):
+		format = func(kb int64) string { return fmt.Sprint(kb >> 10) }
+	case strings.Contains(flags, "b"):
+		format = func(kb int64) string { return fmt.Sprint(kb << 10) }
+	}
+	fmt.Fprintln(c.Stdout, "               total        used        free      shared  buff/cache   available")
+	fmt.Fprintf(c.Stdout, "Mem:    %12s%12s%12s%12s%12s%12s\n",
+		format(m.Total), format(m.Used), format(m.Free), format(m.Shared), format(m.Buffers+m.Cached), format(m.Available))
+	fmt.Fprintf(c.Stdout, "Swap:   %12s%12s%12s\n", format(0), format(0), format(0))
+	return 0
+}
+
+// humanKB renders a size in kilobytes the way free -h and df -h do.
+func humanKB(kb int64) string {
+	if kb == 0 {
+		return "0B"
+	}
+	v := float64(kb)
+	for _, unit := range []string{"Ki", "Mi", "Gi", "Ti"} {
+		if v < 1024 {
+			if v < 10 {
+				return fmt.Sprintf("%.1f%s", v, unit)
+			}
+			return fmt.Sprintf("%.0f%s", v, unit)
+		}
+		v /= 1024
+	}
+	return fmt.Sprintf("%.0fPi", v)
+}
+
+// mount is a filesystem reported by df.
+type mount struct {
+	source, fstype, target string
+	size, used             int64
+}
+
+func (s *Shell) mounts() []mount {
+	run := s.persona.MemoryKB / 10
+	return []mount{
+		{"tmpfs", "tmpfs", "/run", run, 1104},
+		{"/dev/xvda1", "ext4", "/", persona.DiskKB, persona.DiskUsedKB},
+		{"tmpfs", "tmpfs", "/dev/shm", s.persona.MemoryKB / 2, 0},
+		{"tmpfs", "tmpfs", "/run/lock", 5120, 0},
+		{"/dev/xvda15", "vfat", "/boot/efi", 106858, 6182},
+		{"tmpfs", "tmpfs", "/run/user/0", run, 4},
+	}
+}
+
+func cmdDf(c *Call) int {
+	flags, _ := splitFlags(c.Args[1:])
+	human := strings.Contains(flags, "h")
+	withType := strings.Contains(flags, "T")
+	header := "Filesystem     1K-blocks     Used Available Use% Mounted on"
+	if human {
+		header = "Filesystem      Size  Used Avail Use% Mounted on"
+	}
+	if withType {
+		header = strings.Replace(header, "Filesystem    ", "Filesystem     Type ", 1)
+	}
+	fmt.Fprintln(c.Stdout, header)
+	for _, m := range c.Shell.mounts() {
+		avail := m.size - m.used
+		if m.target == "/" {
+			avail = m.size*95/100 - m.used // ext4 reserves 5% for root
+		}
+		use := (m.used*100 + m.size - 1) / m.size
+		source := fmt.Sprintf("%-14s", m.source)
+		if withType {
+			source = fmt.Sprintf("%-14s %-5s", m.source, m.fstype)
+		}
+		if human {
+			fmt.Fprintf(c.Stdout, "%s %5s %5s %5s %3d%% %s\n", source, dfHuman(m.size), dfHuman(m.used), dfHuman(avail), use, m.target)
+		} else {
+			fmt.Fprintf(c.Stdout, "%s %9d %8d %9d %3d%% %s\n", source, m.size, m.used, avail, use, m.target)
+		}
+	}
+	return 0
+}
+
+// dfHuman is humanKB without the "i" suffix, as df -h prints it.
+func dfHuman(kb int64) string {
+	if kb == 0 {
+		return "0"
+	}
+	return strings.Replace(humanKB(kb), "i", "", 1)
+}
+
+func cmdLsblk(c *Call) int {
+	fmt.Fprintln(c.Stdout, `NAME     MAJ:MIN RM  SIZE RO TYPE MOUNTPOINTS
+xvda     202:0    0   30G  0 disk
+├─xvda1  202:1    0 29.9G  0 part /
+├─xvda14 202:14   0    4M  0 part
+└─xvda15 202:15   0  106M  0 part /boot/efi`)
+	return 0
+}
+
+// cmdTop prints a single batch-mode frame; there is no interactive display.
+func cmdTop(c *Call) int {
+	s := c.Shell
+	now := time.Now()
+	m := s.persona.Memory()
+	procs := append(append([]process(nil), processTable...), s.sessionProcesses("top")...)
+	fmt.Fprintf(c.Stdout, "top -%s\n", strings.TrimPrefix(s.uptimeLine(now), " "))
+	fmt.Fprintf(c.Stdout, "Tasks: %3d total,   1 running, %3d sleeping,   0 stopped,   0 zombie\n", 98+len(procs), 97+len(procs))
+	fmt.Fprintln(c.Stdout, "%Cpu(s):  0.3 us,  0.2 sy,  0.0 ni, 99.5 id,  0.0 wa,  0.0 hi,  0.0 si,  0.0 st")
+	fmt.Fprintf(c.Stdout, "MiB Mem : %8.1f total, %8.1f free, %8.1f used, %8.1f buff/cache\n",
+		float64(m.Total)/1024, float64(m.Free)/1024, float64(m.Used)/1024, float64(m.Buffers+m.Cached)/1024)
+	fmt.Fprintf(c.Stdout, "MiB Swap:      0.0 total,      0.0 free,      0.0 used. %8.1f avail Mem \n\n", float64(m.Available)/1024)
+	fmt.Fprintln(c.Stdout, "    PID USER      PR  NI    VIRT    RES    SHR S  %CPU  %MEM     TIME+ COMMAND")
+	for _, p := range procs {
+		name := strings.Fields(p.command)[0]
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		fmt.Fprintf(c.Stdout, "%7d %-8.8s  20   0 %7d %6d %6d %s  %4s  %4.1f   0:00.00 %s\n",
+			p.pid, p.user, p.vsz, p.rss, p.rss/2, p.stat[:1], p.cpu, float64(p.rss)*100/float64(s.persona.MemoryKB), name)
+	}
+	return 0
+}
@@ -0,0 +1,22 @@
+package shell
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoginsShowSourceAddress(t *testing.T) {
+	s := newTestShell(t, nil, nil)
+	s.sess.Src = "203.0.113.7:51234"
+	for _, line := range []string{"w", "who", "last"} {
+		var out bytes.Buffer
+		s.Execute(line, &out)
+		if !strings.Contains(out.String(), "203.0.113.7") || strings.Contains(out.String(), defaultRemoteIP) {
+			t.Errorf("%s:\n%s", line, out.String())
+		}
+	}
+	if motd := s.motd(); !strings.Contains(motd, "from 203.0.113.7\n") {
+		t.Errorf("motd:\n%s", motd)
+	}
+}
@@ -0,0 +1,868 @@
+package emulators
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/transform/emulators/ntlm"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// --- SMB Emulator ---
+
+const (
+	smbIdleTimeout = 5 * time.Minute
+	// smbMaxIO is the largest read, write or transaction advertised; a
+	// frame may hold one plus its headers.
+	smbMaxIO      = 8 << 20
+	smbMaxMessage = smbMaxIO + 64<<10
+)
+
+// SMB2 commands.
+const (
+	smb2Negotiate uint16 = iota
+	smb2SessionSetup
+	smb2Logoff
+	smb2TreeConnect
+	smb2TreeDisconnect
+	smb2Create
+	smb2Close
+	smb2Flush
+	smb2Read
+	smb2Write
+	smb2Lock
+	smb2IOCTL
+	smb2Cancel
+	smb2Echo
+	smb2QueryDirectory
+	smb2ChangeNotify
+	smb2QueryInfo
+	smb2SetInfo
+	smb2OplockBreak
+)
+
+// NTSTATUS codes answered by the emulator.
+const (
+	statusSuccess                = 0x00000000
+	statusBufferOverflow         = 0x80000005
+	statusNoMoreFiles            = 0x80000006
+	statusNotImplemented         = 0xC0000002
+	statusInvalidInfoClass       = 0xC0000003
+	statusInvalidParameter       = 0xC000000D
+	statusNoSuchFile             = 0xC000000F
+	statusInvalidDeviceRequest   = 0xC0000010
+	statusEndOfFile              = 0xC0000011
+	statusMoreProcessingRequired = 0xC0000016
+	statusAccessDenied           = 0xC0000022
+	statusBufferTooSmall         = 0xC0000023
+	statusObjectNameNotFound     = 0xC0000034
+	statusObjectNameCollision    = 0xC0000035
+	statusObjectPathNotFound     = 0xC000003A
+	statusLogonFailure           = 0xC000006D
+	statusFileIsADirectory       = 0xC00000BA
+	statusNotSupported           = 0xC00000BB
+	statusNetworkNameDeleted     = 0xC00000C9
+	statusBadNetworkName         = 0xC00000CC
+	statusPipeEmpty              = 0xC00000D9
+	statusNotADirectory          = 0xC0000103
+	statusFileClosed             = 0xC0000128
+	statusFSDriverRequired       = 0xC000019C
+	statusUserSessionDeleted     = 0xC0000203
+	statusInsuffServerResources  = 0xC0000205
+)
+
+const (
+	smb2FlagResponse = 0x00000001
+	smb2FlagRelated  = 0x00000004
+
+	smb2SessionGuest = 0x0001
+	smb2SessionNull  = 0x0002
+)
+
+// smbDialects are the SMB2 dialects spoken, best first, as by Samba 4.15.
+var smbDialects = []uint16{0x0311, 0x0302, 0x0300, 0x0210, 0x0202}
+
+// smbServer holds the state shared by all SMB connections.
+type smbServer struct {
+	netbios   string // upper-case NetBIOS name
+	dnsName   string
+	workgroup string
+	guest     bool
+	shares    []*smbShare
+	guid      [16]byte
+	// fs is never written over SMB, so every connection reads the template.
+	fs *vfs.FS
+}
+
+// smbShare is a share offered to clients; IPC$ has no path.
+type smbShare struct {
+	name    string
+	path    string
+	comment string
+	ipc     bool
+}
+
+func startSMBEmulator(addr string, cfg *config.Config, host *persona.Persona, fsys *vfs.FS) {
+	srv := newSMBServer(cfg, host, fsys)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[SMB] Failed to listen on %s: %v", addr, err)
+	}
+	log.Printf("[SMB] Listening on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// newSMBServer names the server after the persona and offers the
+// configured shares that exist in the decoy tree.
+func newSMBServer(cfg *config.Config, host *persona.Persona, fsys *vfs.FS) *smbServer {
+	netbios := strings.ToUpper(strings.SplitN(host.Hostname, ".", 2)[0])
+	if len(netbios) > 15 {
+		netbios = netbios[:15]
+	}
+	srv := &smbServer{
+		netbios:   netbios,
+		dnsName:   strings.ToLower(host.Hostname),
+		workgroup: strings.ToUpper(cfg.SMB.Workgroup),
+		guest:     cfg.SMB.Guest,
+		fs:        fsys,
+	}
+	sum := sha256.Sum256([]byte("smb:" + host.Hostname))
+	copy(srv.guid[:], sum[:])
+	for _, s := range cfg.SMB.Shares {
+		n, err := fsys.Stat(path.Clean("/" + s.Path))
+		if err != nil || !n.IsDir() {
+			log.Printf("[SMB] Share %s is not offered: %s is not a directory of the decoy tree", s.Name, s.Path)
+			continue
+		}
+		srv.shares = append(srv.shares, &smbShare{name: s.Name, path: path.Clean("/" + s.Path), comment: s.Comment})
+	}
+	srv.shares = append(srv.shares, &smbShare{name: "IPC$", comment: "IPC Service (" + host.Hostname + " server (Samba, Ubuntu))", ipc: true})
+	return srv
+}
+
+func (srv *smbServer) share(name string) *smbShare {
+	for _, s := range srv.shares {
+		if strings.EqualFold(s.name, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// smbConn is one client connection and what it has set up: SMB2 sessions,
+// tree connects and open files, or the SMBv1 equivalent.
+type smbConn struct {
+	srv  *smbServer
+	conn net.Conn
+	sess *events.Session
+
+	messages int    // frames received so far
+	dialect  uint16 // 0 until negotiated; 0x02FF after an SMBv1 upgrade
+	logons   map[uint64]*smbLogon
+	trees    map[uint32]*smbTree
+	files    map[uint64]*smbFile
+	nextID   uint32
+	// chain carries IDs from one request of a compound to the next.
+	chain struct {
+		sessionID uint64
+		treeID    uint32
+		fileID    uint64
+		status    uint32
+	}
+
+	v1 smbV1State
+	// reported holds the exploit signatures already reported, so a probe
+	// repeated on one connection is reported once.
+	reported map[string]bool
+}
+
+// smbLogon is an SMB2 session, in the middle of or after authentication.
+type smbLogon struct {
+	ntlm   *ntlm.Server
+	spnego bool // the client wraps NTLMSSP in SPNEGO
+	done   bool
+}
+
+type smbTree struct {
+	share     *smbShare
+	sessionID uint64
+}
+
+func (srv *smbServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	c := &smbConn{
+		srv:      srv,
+		conn:     conn,
+		sess:     events.NewSession("smb", conn.LocalAddr(), conn.RemoteAddr()),
+		logons:   make(map[uint64]*smbLogon),
+		trees:    make(map[uint32]*smbTree),
+		files:    make(map[uint64]*smbFile),
+		reported: make(map[string]bool),
+	}
+	events.Publish(&events.ConnectionOpened{Meta: c.sess.Meta()})
+	defer publishClosed(c.sess)
+	defer func() {
+		for id := range c.files {
+			c.closeFile(id)
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(smbIdleTimeout))
+		msg, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		c.messages++
+		var ok bool
+		switch {
+		case bytes.HasPrefix(msg, smb1Magic) && c.dialect == 0:
+			ok = c.handleV1(msg)
+		case bytes.HasPrefix(msg, smb2Magic):
+			ok = c.handleV2(msg)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+var (
+	smb1Magic = []byte("\xffSMB")
+	smb2Magic = []byte("\xfeSMB")
+)
+
+// readMessage reads one NetBIOS session message. Session requests, which
+// some clients send even on 445, are accepted and keepalives skipped.
+func (c *smbConn) readMessage() ([]byte, error) {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		if n > smbMaxMessage {
+			return nil, errors.New("message too large")
+		}
+		if hdr[0] != 0 {
+			if _, err := io.CopyN(io.Discard, c.conn, int64(n)); err != nil {
+				return nil, err
+			}
+			if hdr[0] == 0x81 {
+				c.conn.Write([]byte{0x82, 0, 0, 0})
+			}
+			continue
+		}
+		msg := make([]byte, n)
+		// Look at the start of a first message before waiting for the rest:
+		// EternalBlue's grooming connections send a little of a large frame
+		// and then hold it open.
+		head := min(n, 16)
+		if _, err := io.ReadFull(c.conn, msg[:head]); err != nil {
+			return nil, err
+		}
+		if c.messages == 0 && n >= 0xff00 && !isNegotiate(msg[:head]) {
+			c.exploit(sigEternalBlueGroom, "large first frame that is not a negotiate")
+		}
+		if _, err := io.ReadFull(c.conn, msg[head:]); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+func isNegotiate(head []byte) bool {
+	switch {
+	case bytes.HasPrefix(head, smb1Magic):
+		return len(head) > 4 && head[4] == smb1Negotiate
+	case bytes.HasPrefix(head, smb2Magic):
+		return len(head) >= 14 && le16(head[4:]) == 64 && le16(head[12:]) == smb2Negotiate
+	}
+	return false
+}
+
+// smb2Header is the part of an SMB2 request header the emulator uses.
+type smb2Header struct {
+	command   uint16
+	credits   uint16
+	flags     uint32
+	messageID uint64
+	processID uint32
+	treeID    uint32
+	sessionID uint64
+}
+
+func parseSMB2Header(b []byte) smb2Header {
+	return smb2Header{
+		command:   le16(b[12:]),
+		credits:   le16(b[14:]),
+		flags:     le32(b[16:]),
+		messageID: le64(b[24:]),
+		processID: le32(b[32:]),
+		treeID:    le32(b[36:]),
+		sessionID: le64(b[40:]),
+	}
+}
+
+// handleV2 answers an SMB2 message, which may be a compound of several
+// requests; the responses go back as one compound.
+func (c *smbConn) handleV2(msg []byte) bool {
+	var out [][]byte
+	for {
+		if len(msg) < 64 || le16(msg[4:]) != 64 {
+			return false
+		}
+		next := int(le32(msg[20:]))
+		req := msg
+		if next != 0 {
+			if next < 64 || next > len(msg) || next%8 != 0 {
+				return false
+			}
+			req = msg[:next]
+		}
+		h := parseSMB2Header(req)
+		if c.dialect == 0 && h.command != smb2Negotiate {
+			return false
+		}
+		status, body := c.dispatch(&h, req)
+		if h.command == smb2Negotiate && status == statusSuccess && body == nil {
+			return false
+		}
+		if h.command != smb2Cancel {
+			if body == nil || status != statusSuccess && !smb2KeepsBody(status, h.command) {
+				body = smb2ErrorBody
+			}
+			out = append(out, c.smb2Response(&h, status, body))
+		}
+		if next == 0 {
+			break
+		}
+		msg = msg[next:]
+	}
+	if len(out) == 0 {
+		return true
+	}
+	for i := range out[:len(out)-1] {
+		pad := (8 - len(out[i])%8) % 8
+		out[i] = append(out[i], make([]byte, pad)...)
+		binary.LittleEndian.PutUint32(out[i][20:], uint32(len(out[i])))
+	}
+	return c.send(bytes.Join(out, nil))
+}
+
+// smb2KeepsBody reports whether a response with a non-success status still
+// carries the command's own body rather than an error body.
+func smb2KeepsBody(status uint32, command uint16) bool {
+	switch status {
+	case statusMoreProcessingRequired:
+		return command == smb2SessionSetup
+	case statusBufferOverflow:
+		return command == smb2Read || command == smb2QueryInfo || command == smb2IOCTL
+	}
+	return false
+}
+
+var smb2ErrorBody = []byte{9, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func (c *smbConn) smb2Response(h *smb2Header, status uint32, body []byte) []byte {
+	b := make([]byte, 64, 64+len(body))
+	copy(b, smb2Magic)
+	binary.LittleEndian.PutUint16(b[4:], 64)
+	binary.LittleEndian.PutUint32(b[8:], status)
+	binary.LittleEndian.PutUint16(b[12:], h.command)
+	binary.LittleEndian.PutUint16(b[14:], max(h.credits, 1))
+	binary.LittleEndian.PutUint32(b[16:], smb2FlagResponse|h.flags&smb2FlagRelated)
+	binary.LittleEndian.PutUint64(b[24:], h.messageID)
+	binary.LittleEndian.PutUint32(b[32:], h.processID)
+	binary.LittleEndian.PutUint32(b[36:], h.treeID)
+	binary.LittleEndian.PutUint64(b[40:], h.sessionID)
+	return append(b, body...)
+}
+
+// send writes one NetBIOS session message.
+func (c *smbConn) send(msg []byte) bool {
+	frame := make([]byte, 4, 4+len(msg))
+	frame[1], frame[2], frame[3] = byte(len(msg)>>16), byte(len(msg)>>8), byte(len(msg))
+	_, err := c.conn.Write(append(frame, msg...))
+	return err == nil
+}
+
+// dispatch runs one request of a message. A nil body with a success status
+// means the request was answered with an error body.
+func (c *smbConn) dispatch(h *smb2Header, req []byte) (uint32, []byte) {
+	related := h.flags&smb2FlagRelated != 0
+	if related {
+		if h.sessionID == ^uint64(0) {
+			h.sessionID = c.chain.sessionID
+		}
+		if h.treeID == ^uint32(0) {
+			h.treeID = c.chain.treeID
+		}
+		if c.chain.status != statusSuccess {
+			return c.chain.status, nil
+		}
+	} else {
+		c.chain.fileID, c.chain.status = 0, statusSuccess
+	}
+	c.chain.sessionID, c.chain.treeID = h.sessionID, h.treeID
+	body := req[64:]
+
+	status, out := c.run(h, req, body)
+	if status != statusSuccess && status != statusMoreProcessingRequired && status != statusBufferOverflow {
+		c.chain.status = status
+	}
+	return status, out
+}
+
+func (c *smbConn) run(h *smb2Header, req, body []byte) (uint32, []byte) {
+	switch h.command {
+	case smb2Negotiate:
+		return c.negotiate(body)
+	case smb2SessionSetup:
+		return c.sessionSetup(h, req, body)
+	case smb2Echo:
+		return statusSuccess, []byte{4, 0, 0, 0}
+	case smb2Cancel:
+		return statusSuccess, nil
+	}
+
+	logon := c.logons[h.sessionID]
+	if logon == nil || !logon.done {
+		return statusUserSessionDeleted, nil
+	}
+	switch h.command {
+	case smb2Logoff:
+		delete(c.logons, h.sessionID)
+		for id, t := range c.trees {
+			if t.sessionID == h.sessionID {
+				c.disconnect(id)
+			}
+		}
+		return statusSuccess, []byte{4, 0, 0, 0}
+	case smb2TreeConnect:
+		return c.treeConnect(h, req, body)
+	}
+
+	tree := c.trees[h.treeID]
+	if tree == nil || tree.sessionID != h.sessionID {
+		return statusNetworkNameDeleted, nil
+	}
+	switch h.command {
+	case smb2TreeDisconnect:
+		c.disconnect(h.treeID)
+		return statusSuccess, []byte{4, 0, 0, 0}
+	case smb2Create:
+		return c.create(tree, req, body)
+	case smb2Write, smb2SetInfo:
+		if h.command == smb2Write && len(body) >= 32 {
+			if f := c.file(body[16:]); f != nil && f.pipe != nil {
+				return c.writePipe(f, req, body)
+			}
+		}
+		return statusAccessDenied, nil
+	case smb2ChangeNotify, smb2OplockBreak:
+		return statusNotSupported, nil
+	}
+
+	// Everything else works on an open file.
+	var fileID []byte
+	switch h.command {
+	case smb2Close, smb2Flush, smb2QueryDirectory:
+		fileID = sub(body, 8, 16)
+	case smb2Read:
+		fileID = sub(body, 16, 16)
+	case smb2Lock, smb2IOCTL:
+		fileID = sub(body, 8, 16)
+	case smb2QueryInfo:
+		fileID = sub(body, 24, 16)
+	default:
+		return statusNotSupported, nil
+	}
+	if fileID == nil {
+		return statusInvalidParameter, nil
+	}
+	if h.command == smb2IOCTL && le32(body[4:]) != fsctlPipeTransceive {
+		// Most FSCTLs are about the connection, not a file.
+		return c.ioctl(nil, body)
+	}
+	f := c.file(fileID)
+	if f == nil || f.tree != tree {
+		return statusFileClosed, nil
+	}
+	switch h.command {
+	case smb2Close:
+		return c.closeReply(f, body)
+	case smb2Flush, smb2Lock:
+		return statusSuccess, []byte{4, 0, 0, 0}
+	case smb2Read:
+		return c.read(f, body)
+	case smb2IOCTL:
+		return c.ioctl(f, body)
+	case smb2QueryDirectory:
+		return c.queryDirectory(f, req, body)
+	default:
+		return c.queryInfo(f, body)
+	}
+}
+
+// negotiate picks the best dialect both sides speak.
+func (c *smbConn) negotiate(body []byte) (uint32, []byte) {
+	if c.dialect != 0 && c.dialect != 0x02FF {
+		// A second NEGOTIATE ends the connection.
+		return statusSuccess, nil
+	}
+	if len(body) < 36 {
+		return statusInvalidParameter, nil
+	}
+	count := int(le16(body[2:]))
+	offered := make(map[uint16]bool)
+	for i := range count {
+		if d := sub(body, 36+2*i, 2); d != nil {
+			offered[le16(d)] = true
+		}
+	}
+	for _, d := range smbDialects {
+		if offered[d] {
+			c.dialect = d
+			return statusSuccess, c.negotiateBody(d)
+		}
+	}
+	return statusNotSupported, nil
+}
+
+// negotiateBody is a NEGOTIATE response for dialect d, which may be the
+// 0x02FF wildcard answered to an SMBv1 client that offers SMB2.
+func (c *smbConn) negotiateBody(d uint16) []byte {
+	blob := ntlm.InitToken()
+	b := make([]byte, 64, 64+len(blob)+64)
+	binary.LittleEndian.PutUint16(b[0:], 65)
+	binary.LittleEndian.PutUint16(b[2:], 0x0001) // signing enabled, not required
+	binary.LittleEndian.PutUint16(b[4:], d)
+	copy(b[8:], c.srv.guid[:])
+	if d >= 0x0210 && d != 0x02FF {
+		binary.LittleEndian.PutUint32(b[24:], 0x00000004) // large MTU
+		binary.LittleEndian.PutUint32(b[28:], smbMaxIO)
+		binary.LittleEndian.PutUint32(b[32:], smbMaxIO)
+		binary.LittleEndian.PutUint32(b[36:], smbMaxIO)
+	} else {
+		binary.LittleEndian.PutUint32(b[28:], 64<<10)
+		binary.LittleEndian.PutUint32(b[32:], 64<<10)
+		binary.LittleEndian.PutUint32(b[36:], 64<<10)
+	}
+	binary.LittleEndian.PutUint64(b[40:], filetime(time.Now()))
+	binary.LittleEndian.PutUint16(b[56:], 64+64)
+	binary.LittleEndian.PutUint16(b[58:], uint16(len(blob)))
+	b = append(b, blob...)
+	if d == 0x0311 {
+		// One context: SHA-512 preauthentication integrity with a fresh salt.
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+		binary.LittleEndian.PutUint16(b[6:], 1)
+		binary.LittleEndian.PutUint32(b[60:], uint32(64+len(b)))
+		salt := make([]byte, 32)
+		rand.Read(salt)
+		b = binary.LittleEndian.AppendUint16(b, 1)
+		b = binary.LittleEndian.AppendUint16(b, 38)
+		b = append(b, 0, 0, 0, 0)
+		b = binary.LittleEndian.AppendUint16(b, 1)
+		b = binary.LittleEndian.AppendUint16(b, 32)
+		b = binary.LittleEndian.AppendUint16(b, 1)
+		b = append(b, salt...)
+	}
+	return b
+}
+
+// sessionSetup runs the NTLM exchange: the first request gets a challenge
+// and a new session, the second carries the response that is captured.
+func (c *smbConn) sessionSetup(h *smb2Header, req, body []byte) (uint32, []byte) {
+	if len(body) < 24 {
+		return statusInvalidParameter, nil
+	}
+	blob := sub(req, int(le16(body[12:])), int(le16(body[14:])))
+	token, spnego := ntlm.Unwrap(blob)
+	if token == nil {
+		return statusInvalidParameter, nil
+	}
+
+	logon := c.logons[h.sessionID]
+	if h.sessionID == 0 {
+		logon = &smbLogon{
+			ntlm: &ntlm.Server{
+				NetBIOSComputer: c.srv.netbios,
+				NetBIOSDomain:   c.srv.netbios,
+				DNSComputer:     c.srv.dnsName,
+			},
+			spnego: spnego,
+		}
+		challenge, err := logon.ntlm.Challenge(token)
+		if err != nil {
+			return statusInvalidParameter, nil
+		}
+		h.sessionID = c.newSessionID()
+		c.logons[h.sessionID] = logon
+		c.chain.sessionID = h.sessionID
+		if spnego {
+			challenge = ntlm.Continue(challenge)
+		}
+		return statusMoreProcessingRequired, sessionSetupBody(0, challenge)
+	}
+	if logon == nil || logon.done {
+		return statusUserSessionDeleted, nil
+	}
+
+	r, err := logon.ntlm.Authenticate(token)
+	if err != nil {
+		delete(c.logons, h.sessionID)
+		return statusInvalidParameter, nil
+	}
+	c.recordLogon(r)
+	if !c.srv.guest {
+		delete(c.logons, h.sessionID)
+		return statusLogonFailure, nil
+	}
+	logon.done = true
+	flags := uint16(smb2SessionGuest)
+	if r.Anonymous() {
+		flags = smb2SessionNull
+	}
+	var final []byte
+	if logon.spnego {
+		final = ntlm.Accept()
+	}
+	return statusSuccess, sessionSetupBody(flags, final)
+}
+
+func sessionSetupBody(flags uint16, blob []byte) []byte {
+	b := make([]byte, 8, 8+len(blob))
+	binary.LittleEndian.PutUint16(b[0:], 9)
+	binary.LittleEndian.PutUint16(b[2:], flags)
+	binary.LittleEndian.PutUint16(b[4:], 64+8)
+	binary.LittleEndian.PutUint16(b[6:], uint16(len(blob)))
+	if len(blob) == 0 {
+		return append(b, 0)
+	}
+	return append(b, blob...)
+}
+
+func (c *smbConn) newSessionID() uint64 {
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		id := le64(b[:]) &^ (1 << 63)
+		if id != 0 && c.logons[id] == nil {
+			return id
+		}
+	}
+}
+
+// recordLogon publishes a captured NTLM response. Success reflects whether
+// the session is let in as a guest.
+func (c *smbConn) recordLogon(r *ntlm.Response) {
+	ev := &events.AuthAttempt{
+		Meta:        c.sess.Meta(),
+		Method:      "ntlm",
+		Username:    r.User,
+		Domain:      r.Domain,
+		Workstation: r.Workstation,
+		Success:     c.srv.guest,
+	}
+	if r.Anonymous() {
+		log.Printf("[SMB] Anonymous login from %s", c.sess.Src)
+	} else if len(r.NT) > 0 {
+		ev.Hash, ev.HashcatMode = r.Hashcat(), r.HashcatMode()
+		log.Printf("[SMB] Captured %s from %s", r, c.sess.Src)
+	} else {
+		log.Printf("[SMB] Login without a response for %q from %s", r.User, c.sess.Src)
+	}
+	events.Publish(ev)
+}
+
+func (c *smbConn) treeConnect(h *smb2Header, req, body []byte) (uint32, []byte) {
+	if len(body) < 8 {
+		return statusInvalidParameter, nil
+	}
+	unc := decodeUTF16(sub(req, int(le16(body[4:])), int(le16(body[6:]))))
+	events.Publish(&events.Command{Meta: c.sess.Meta(), Input: "TREE_CONNECT " + unc})
+	name := unc[strings.LastIndexByte(unc, '\\')+1:]
+	share := c.srv.share(name)
+	if share == nil {
+		return statusBadNetworkName, nil
+	}
+	log.Printf("[SMB] %s connected to share %s", c.sess.Src, share.name)
+	c.nextID++
+	h.treeID = c.nextID
+	c.chain.treeID = h.treeID
+	c.trees[h.treeID] = &smbTree{share: share, sessionID: h.sessionID}
+
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint16(b[0:], 16)
+	if share.ipc {
+		b[2] = 0x02                                     // pipe
+		binary.LittleEndian.PutUint32(b[4:], 0x30)      // no caching
+		binary.LittleEndian.PutUint32(b[12:], 0x1f01ff) // full access
+	} else {
+		b[2] = 0x01
+		binary.LittleEndian.PutUint32(b[12:], accessReadOnly)
+	}
+	return statusSuccess, b
+}
+
+func (c *smbConn) disconnect(treeID uint32) {
+	tree := c.trees[treeID]
+	delete(c.trees, treeID)
+	for id, f := range c.files {
+		if f.tree == tree {
+			c.closeFile(id)
+		}
+	}
+}
+
+// file looks up an open file by the 16-byte FileId at b. The all-ones ID
+// of a related compound request means the file the chain last opened.
+func (c *smbConn) file(b []byte) *smbFile {
+	id := le64(b[8:])
+	if id == ^uint64(0) {
+		id = c.chain.fileID
+	}
+	return c.files[id]
+}
+
+const fsctlPipeTransceive = 0x0011C017
+
+// ioctl answers the FSCTLs clients send on their own: validating the
+// negotiation, asking for DFS referrals, and RPC over a pipe.
+func (c *smbConn) ioctl(f *smbFile, body []byte) (uint32, []byte) {
+	if len(body) < 56 {
+		return statusInvalidParameter, nil
+	}
+	code := le32(body[4:])
+	var out []byte
+	switch code {
+	case 0x00140204: // FSCTL_VALIDATE_NEGOTIATE_INFO
+		out = binary.LittleEndian.AppendUint32(nil, le32(c.negotiateBody(c.dialect)[24:]))
+		out = append(out, c.srv.guid[:]...)
+		out = binary.LittleEndian.AppendUint16(out, 0x0001)
+		out = binary.LittleEndian.AppendUint16(out, c.dialect)
+	case 0x00060194, 0x000601B0: // FSCTL_DFS_GET_REFERRALS(_EX)
+		return statusFSDriverRequired, nil
+	case fsctlPipeTransceive:
+		if f.pipe == nil {
+			return statusInvalidDeviceRequest, nil
+		}
+		in := sub(body, int(le32(body[24:]))-64, int(le32(body[28:])))
+		if in == nil {
+			return statusInvalidParameter, nil
+		}
+		f.pipe.write(in)
+		out = f.pipe.take(int(le32(body[44:])))
+	default:
+		return statusNotSupported, nil
+	}
+	b := make([]byte, 48, 48+len(out))
+	binary.LittleEndian.PutUint16(b[0:], 49)
+	binary.LittleEndian.PutUint32(b[4:], code)
+	copy(b[8:24], body[8:24])
+	binary.LittleEndian.PutUint32(b[24:], 64+48)
+	binary.LittleEndian.PutUint32(b[32:], 64+48)
+	binary.LittleEndian.PutUint32(b[36:], uint32(len(out)))
+	status := uint32(statusSuccess)
+	if f != nil && f.pipe != nil && len(f.pipe.out) > 0 {
+		status = statusBufferOverflow
+	}
+	return status, append(b, out...)
+}
+
+func (c *smbConn) writePipe(f *smbFile, req, body []byte) (uint32, []byte) {
+	data := sub(req, int(le16(body[2:])), int(le32(body[4:])))
+	if data == nil {
+		return statusInvalidParameter, nil
+	}
+	f.pipe.write(data)
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint16(b[0:], 17)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	return statusSuccess, b
+}
+
+// Exploit signatures recognised in SMB traffic.
+var (
+	sigMS17010Check = events.Signature{
+		ID: "ms17-010-check", Name: "MS17-010 vulnerability check", CVE: "CVE-2017-0143", Severity: "high",
+	}
+	sigEternalBlue = events.Signature{
+		ID: "eternalblue", Name: "EternalBlue SMBv1 transaction overflow", CVE: "CVE-2017-0144", Severity: "critical",
+	}
+	sigEternalBlueGroom = events.Signature{
+		ID: "eternalblue-groom", Name: "EternalBlue pool grooming", CVE: "CVE-2017-0144", Severity: "critical",
+	}
+	sigDoublePulsar = events.Signature{
+		ID: "doublepulsar-ping", Name: "DoublePulsar implant check", Severity: "critical",
+	}
+)
+
+// exploit reports an exploit attempt, once per signature and connection.
+func (c *smbConn) exploit(sig events.Signature, detail string) {
+	if c.reported[sig.ID] {
+		return
+	}
+	c.reported[sig.ID] = true
+	log.Printf("[SMB] Exploit attempt from %s: %s (%s)", c.sess.Src, sig.Name, detail)
+	events.Publish(&events.ExploitAttempt{Meta: c.sess.Meta(), Signature: sig, Detail: detail})
+}
+
+// sub returns n bytes of b at off, or nil if they are not all there.
+func sub(b []byte, off, n int) []byte {
+	if off < 0 || n < 0 || off+n > len(b) {
+		return nil
+	}
+	return b[off : off+n]
+}
+
+func le16(b []byte) uint16 { return binary.LittleEndian.Uint16(b) }
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+func le64(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+func encodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = le16(b[2*i:])
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
+
+// filetime converts t to a Windows FILETIME: 100ns intervals since 1601.
+func filetime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano()/100 + 116444736000000000)
+}
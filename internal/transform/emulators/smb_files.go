@@ -0,0 +1,525 @@
+package emulators
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// smbFile is an open file, directory or pipe.
+type smbFile struct {
+	tree *smbTree
+	path string // in the decoy tree; empty for a pipe
+	node *vfs.Node
+	pipe *rpcPipe
+	// listing holds the directory entries QUERY_DIRECTORY has still to
+	// return, from the first query or the last restart.
+	listing []*vfs.Node
+	listed  bool
+	read    int64 // bytes served, reported as a download on close
+}
+
+// Access mask bits (MS-SMB2 2.2.13.1).
+const (
+	accessReadData    = 0x00000001
+	accessGenericAll  = 0x10000000
+	accessGenericRead = 0x80000000
+	// accessWrite is everything that would change a file or directory.
+	accessWrite = 0x00000002 | 0x00000004 | 0x00000010 | 0x00000040 | 0x00000100 |
+		0x00010000 | 0x00040000 | 0x00080000 | 0x40000000 | accessGenericAll
+	// accessReadOnly is what a read-only share grants.
+	accessReadOnly = 0x001200a9
+)
+
+// Create dispositions and options.
+const (
+	fileOpen      = 1
+	fileCreate    = 2
+	fileOpenIf    = 3
+	fileOverwrite = 4
+
+	fileDirectoryFile    = 0x00000001
+	fileNonDirectoryFile = 0x00000040
+	fileDeleteOnClose    = 0x00001000
+)
+
+// File attributes.
+const (
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrNormal    = 0x80
+)
+
+// create opens a file, directory or pipe. Shares are read-only: anything
+// that would create, change or delete is refused, and so is reading files
+// that nobody but their owner can read, as Samba would refuse a guest.
+func (c *smbConn) create(tree *smbTree, req, body []byte) (uint32, []byte) {
+	if len(body) < 56 {
+		return statusInvalidParameter, nil
+	}
+	access := le32(body[24:])
+	disposition := le32(body[36:])
+	options := le32(body[40:])
+	name := decodeUTF16(sub(req, int(le16(body[44:])), int(le16(body[46:]))))
+
+	f := &smbFile{tree: tree}
+	if tree.share.ipc {
+		if !strings.EqualFold(strings.TrimPrefix(name, `\`), "srvsvc") {
+			return statusObjectNameNotFound, nil
+		}
+		f.pipe = &rpcPipe{conn: c}
+	} else {
+		if stream := strings.IndexByte(name, ':'); stream >= 0 {
+			if !strings.EqualFold(name[stream:], "::$DATA") {
+				return statusObjectNameNotFound, nil
+			}
+			name = name[:stream]
+		}
+		p := path.Join(tree.share.path, vfs.Clean("/", strings.ReplaceAll(name, `\`, "/")))
+		real, n, err := c.resolve(p)
+		switch {
+		case err != nil:
+			if _, parent, err := c.resolve(path.Dir(p)); err != nil || !parent.IsDir() {
+				return statusObjectPathNotFound, nil
+			}
+			if disposition == fileOpen || disposition == fileOverwrite {
+				return statusObjectNameNotFound, nil
+			}
+			return statusAccessDenied, nil
+		case disposition == fileCreate:
+			return statusObjectNameCollision, nil
+		case disposition != fileOpen && disposition != fileOpenIf,
+			access&accessWrite != 0, options&fileDeleteOnClose != 0:
+			return statusAccessDenied, nil
+		case options&fileDirectoryFile != 0 && !n.IsDir():
+			return statusNotADirectory, nil
+		case options&fileNonDirectoryFile != 0 && n.IsDir():
+			return statusFileIsADirectory, nil
+		case access&(accessReadData|accessGenericRead) != 0 && n.Mode.Perm()&0004 == 0:
+			return statusAccessDenied, nil
+		}
+		f.path, f.node = real, n
+	}
+
+	c.nextID++
+	id := uint64(c.nextID)
+	c.files[id] = f
+	c.chain.fileID = id
+
+	b := make([]byte, 88)
+	binary.LittleEndian.PutUint16(b[0:], 89)
+	binary.LittleEndian.PutUint32(b[4:], 1) // FILE_OPENED
+	copy(b[8:], f.networkOpenInfo())
+	binary.LittleEndian.PutUint64(b[64:], id)
+	binary.LittleEndian.PutUint64(b[72:], id)
+	return statusSuccess, b
+}
+
+// resolve finds p in the decoy tree and returns its real path. A name that
+// does not exist as given is matched ignoring case, as Samba does.
+func (c *smbConn) resolve(p string) (string, *vfs.Node, error) {
+	if n, err := c.srv.fs.Stat(p); err == nil || p == "/" {
+		return p, n, err
+	}
+	dir, _, err := c.resolve(path.Dir(p))
+	if err != nil {
+		return "", nil, err
+	}
+	entries, err := c.srv.fs.ReadDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name, path.Base(p)) {
+			return path.Join(dir, e.Name), e, nil
+		}
+	}
+	return "", nil, fs.ErrNotExist
+}
+
+// closeFile forgets an open file and reports what was read from it.
+func (c *smbConn) closeFile(id uint64) {
+	f := c.files[id]
+	delete(c.files, id)
+	if f == nil || f.read == 0 {
+		return
+	}
+	log.Printf("[SMB] Download by %s: %s (%d bytes)", c.sess.Src, f.path, f.read)
+	events.Publish(&events.FileTransfer{
+		Meta:      c.sess.Meta(),
+		Direction: "download",
+		Path:      f.path,
+		Size:      f.read,
+		Via:       "smb",
+	})
+}
+
+func (c *smbConn) closeReply(f *smbFile, body []byte) (uint32, []byte) {
+	flags := le16(body[2:])
+	for id, open := range c.files {
+		if open == f {
+			c.closeFile(id)
+		}
+	}
+	b := make([]byte, 60)
+	binary.LittleEndian.PutUint16(b[0:], 60)
+	if flags&1 != 0 { // SMB2_CLOSE_FLAG_POSTQUERY_ATTRIB
+		binary.LittleEndian.PutUint16(b[2:], 1)
+		copy(b[8:], f.networkOpenInfo()[:52])
+	}
+	return statusSuccess, b
+}
+
+func (c *smbConn) read(f *smbFile, body []byte) (uint32, []byte) {
+	length := int(le32(body[4:]))
+	offset := le64(body[8:])
+	var data []byte
+	status := uint32(statusSuccess)
+	switch {
+	case f.pipe != nil:
+		if len(f.pipe.out) == 0 {
+			return statusPipeEmpty, nil
+		}
+		data = f.pipe.take(length)
+		if len(f.pipe.out) > 0 {
+			status = statusBufferOverflow
+		}
+	case f.node.IsDir():
+		return statusInvalidDeviceRequest, nil
+	case offset >= uint64(len(f.node.Data)):
+		return statusEndOfFile, nil
+	default:
+		data = f.node.Data[offset:min(offset+uint64(length), uint64(len(f.node.Data)))]
+		f.read += int64(len(data))
+	}
+	b := make([]byte, 16, 16+len(data))
+	binary.LittleEndian.PutUint16(b[0:], 17)
+	b[2] = 64 + 16
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	return status, append(b, data...)
+}
+
+// queryDirectory lists a directory in the requested information class,
+// as many entries as fit the client's buffer at a time.
+func (c *smbConn) queryDirectory(f *smbFile, req, body []byte) (uint32, []byte) {
+	if len(body) < 32 {
+		return statusInvalidParameter, nil
+	}
+	class := body[2]
+	flags := body[3]
+	pattern := decodeUTF16(sub(req, int(le16(body[24:])), int(le16(body[26:]))))
+	limit := int(le32(body[28:]))
+	if f.node == nil || !f.node.IsDir() {
+		return statusInvalidParameter, nil
+	}
+	if _, ok := dirEntryHeader[class]; !ok {
+		return statusInvalidInfoClass, nil
+	}
+
+	if !f.listed || flags&0x11 != 0 { // RESTART_SCANS or REOPEN
+		f.listed = true
+		f.listing = nil
+		self, parent := *f.node, *f.node
+		self.Name, parent.Name = ".", ".."
+		entries, _ := c.srv.fs.ReadDir(f.path)
+		for _, e := range append([]*vfs.Node{&self, &parent}, entries...) {
+			if matchPattern(pattern, e.Name) {
+				f.listing = append(f.listing, e)
+			}
+		}
+		if len(f.listing) == 0 {
+			return statusNoSuchFile, nil
+		}
+	}
+	if len(f.listing) == 0 {
+		return statusNoMoreFiles, nil
+	}
+
+	var out []byte
+	last := 0
+	for len(f.listing) > 0 {
+		e := dirEntry(class, f.listing[0], path.Join(f.path, f.listing[0].Name))
+		start := (len(out) + 7) &^ 7
+		if start+len(e) > limit {
+			break
+		}
+		if len(out) > 0 {
+			out = append(out, make([]byte, start-len(out))...)
+			binary.LittleEndian.PutUint32(out[last:], uint32(start-last))
+		}
+		last = start
+		out = append(out, e...)
+		f.listing = f.listing[1:]
+		if flags&0x02 != 0 { // RETURN_SINGLE_ENTRY
+			break
+		}
+	}
+	if out == nil {
+		return statusBufferTooSmall, nil
+	}
+	b := make([]byte, 8, 8+len(out))
+	binary.LittleEndian.PutUint16(b[0:], 9)
+	binary.LittleEndian.PutUint16(b[2:], 64+8)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(out)))
+	return statusSuccess, append(b, out...)
+}
+
+// maxPatternLen bounds a QUERY_DIRECTORY search pattern, in characters;
+// no file name on Windows is longer.
+const maxPatternLen = 255
+
+// matchPattern matches a name against a Windows wildcard pattern, where
+// '*' is any run of characters and '?' any one, ignoring case. A mismatch
+// only backtracks to the most recent '*', so the work is bounded by the
+// product of the lengths. Over-long patterns match nothing.
+func matchPattern(pattern, name string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	p, n := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(name))
+	if len(p) > maxPatternLen {
+		return false
+	}
+	pi, ni := 0, 0
+	star, resume := -1, 0 // the last '*' seen and where its run would end next
+	for ni < len(n) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, resume = pi, ni
+			pi++
+		case pi < len(p) && (p[pi] == '?' || p[pi] == n[ni]):
+			pi++
+			ni++
+		case star >= 0:
+			// Let the last '*' take one more character and retry after it.
+			resume++
+			pi, ni = star+1, resume
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// dirEntryHeader is the fixed size of an entry in each directory
+// information class; the name follows it.
+var dirEntryHeader = map[byte]int{
+	0x01: 64,  // FileDirectoryInformation
+	0x02: 68,  // FileFullDirectoryInformation
+	0x03: 94,  // FileBothDirectoryInformation
+	0x0C: 12,  // FileNamesInformation
+	0x25: 104, // FileIdBothDirectoryInformation
+	0x26: 80,  // FileIdFullDirectoryInformation
+}
+
+func dirEntry(class byte, n *vfs.Node, p string) []byte {
+	name := encodeUTF16(n.Name)
+	header := dirEntryHeader[class]
+	b := make([]byte, header, header+len(name))
+	if class == 0x0C {
+		binary.LittleEndian.PutUint32(b[8:], uint32(len(name)))
+		return append(b, name...)
+	}
+	info := networkOpenInfo(n)
+	copy(b[8:40], info[:32])    // times
+	copy(b[40:48], info[40:48]) // end of file
+	copy(b[48:56], info[32:40]) // allocation size
+	copy(b[56:60], info[48:52]) // attributes
+	binary.LittleEndian.PutUint32(b[60:], uint32(len(name)))
+	switch class {
+	case 0x25:
+		binary.LittleEndian.PutUint64(b[96:], fileIndex(p))
+	case 0x26:
+		binary.LittleEndian.PutUint64(b[72:], fileIndex(p))
+	}
+	return append(b, name...)
+}
+
+// networkOpenInfo is FileNetworkOpenInformation for an open file: its
+// times, sizes and attributes.
+func (f *smbFile) networkOpenInfo() []byte {
+	if f.pipe != nil {
+		b := make([]byte, 56)
+		binary.LittleEndian.PutUint32(b[48:], attrNormal)
+		return b
+	}
+	return networkOpenInfo(f.node)
+}
+
+func networkOpenInfo(n *vfs.Node) []byte {
+	b := make([]byte, 56)
+	t := filetime(n.ModTime)
+	for i := range 4 {
+		binary.LittleEndian.PutUint64(b[8*i:], t)
+	}
+	if !n.IsDir() {
+		binary.LittleEndian.PutUint64(b[32:], uint64(n.Size()+4095)&^4095)
+		binary.LittleEndian.PutUint64(b[40:], uint64(n.Size()))
+	}
+	binary.LittleEndian.PutUint32(b[48:], attributes(n))
+	return b
+}
+
+// attributes maps a node to DOS attributes the way Samba does by default:
+// files are archived, dotfiles hidden, and nothing the guest could write.
+func attributes(n *vfs.Node) uint32 {
+	attr := uint32(attrArchive)
+	if n.IsDir() {
+		attr = attrDirectory
+	}
+	if strings.HasPrefix(n.Name, ".") && n.Name != "." && n.Name != ".." {
+		attr |= attrHidden
+	}
+	if n.Mode.Perm()&0222 == 0 {
+		attr |= attrReadOnly
+	}
+	return attr
+}
+
+// fileIndex is a stable inode-like number for a path.
+func fileIndex(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64() >> 16
+}
+
+// queryInfo answers the file and filesystem information classes that
+// clients query when browsing and copying. Security descriptors are not
+// handed to guests.
+func (c *smbConn) queryInfo(f *smbFile, body []byte) (uint32, []byte) {
+	infoType, class := body[2], body[3]
+	limit := int(le32(body[4:]))
+	var out []byte
+	switch infoType {
+	case 1:
+		out = f.fileInfo(class)
+	case 2:
+		out = c.fsInfo(f, class)
+	case 3:
+		return statusAccessDenied, nil
+	default:
+		return statusNotSupported, nil
+	}
+	if out == nil {
+		return statusInvalidInfoClass, nil
+	}
+	status := uint32(statusSuccess)
+	if len(out) > limit {
+		out, status = out[:limit], statusBufferOverflow
+	}
+	b := make([]byte, 8, 8+len(out))
+	binary.LittleEndian.PutUint16(b[0:], 9)
+	binary.LittleEndian.PutUint16(b[2:], 64+8)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(out)))
+	return status, append(b, out...)
+}
+
+func (f *smbFile) fileInfo(class byte) []byte {
+	open := f.networkOpenInfo()
+	isDir := f.node != nil && f.node.IsDir()
+	basic := make([]byte, 40)
+	copy(basic, open[:32])
+	copy(basic[32:], open[48:52])
+	standard := make([]byte, 24)
+	copy(standard, open[32:48])
+	binary.LittleEndian.PutUint32(standard[16:], 1)
+	if isDir {
+		standard[21] = 1
+	}
+	internal := make([]byte, 8)
+	if f.pipe == nil {
+		binary.LittleEndian.PutUint64(internal, fileIndex(f.path))
+	}
+	access := binary.LittleEndian.AppendUint32(nil, accessReadOnly)
+	name := encodeUTF16(strings.ReplaceAll(strings.TrimPrefix(f.path, f.tree.share.path), "/", `\`))
+
+	switch class {
+	case 4: // FileBasicInformation
+		return basic
+	case 5: // FileStandardInformation
+		return standard
+	case 6: // FileInternalInformation
+		return internal
+	case 7: // FileEaInformation
+		return make([]byte, 4)
+	case 8: // FileAccessInformation
+		return access
+	case 14: // FilePositionInformation
+		return make([]byte, 8)
+	case 16, 17: // FileModeInformation, FileAlignmentInformation
+		return make([]byte, 4)
+	case 18: // FileAllInformation
+		b := append(basic, standard...)
+		b = append(b, internal...)
+		b = append(b, 0, 0, 0, 0)
+		b = append(b, access...)
+		b = append(b, make([]byte, 16)...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(name)))
+		return append(b, name...)
+	case 22: // FileStreamInformation
+		if isDir {
+			return []byte{}
+		}
+		stream := encodeUTF16("::$DATA")
+		b := make([]byte, 24)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(stream)))
+		copy(b[8:], open[40:48])
+		copy(b[16:], open[32:40])
+		return append(b, stream...)
+	case 34: // FileNetworkOpenInformation
+		return open
+	case 35: // FileAttributeTagInformation
+		return append(open[48:52:52], 0, 0, 0, 0)
+	}
+	return nil
+}
+
+func (c *smbConn) fsInfo(f *smbFile, class byte) []byte {
+	const (
+		blockSize   = 4096
+		totalBlocks = 61 << 30 / blockSize // a 61 GiB root filesystem
+		freeBlocks  = 38 << 30 / blockSize
+	)
+	switch class {
+	case 1: // FileFsVolumeInformation
+		label := encodeUTF16(f.tree.share.name)
+		b := make([]byte, 18, 18+len(label))
+		binary.LittleEndian.PutUint64(b, filetime(time.Now().AddDate(-1, -2, 0).Truncate(24*time.Hour)))
+		binary.LittleEndian.PutUint32(b[8:], uint32(fileIndex(c.srv.dnsName)))
+		binary.LittleEndian.PutUint32(b[12:], uint32(len(label)))
+		return append(b, label...)
+	case 3: // FileFsSizeInformation
+		b := binary.LittleEndian.AppendUint64(nil, totalBlocks)
+		b = binary.LittleEndian.AppendUint64(b, freeBlocks)
+		b = binary.LittleEndian.AppendUint32(b, blockSize/512)
+		return binary.LittleEndian.AppendUint32(b, 512)
+	case 4: // FileFsDeviceInformation
+		b := binary.LittleEndian.AppendUint32(nil, 0x07) // FILE_DEVICE_DISK
+		return binary.LittleEndian.AppendUint32(b, 0x20)
+	case 5: // FileFsAttributeInformation
+		name := encodeUTF16("NTFS")
+		b := binary.LittleEndian.AppendUint32(nil, 0x0008002F) // case preserved, ACLs, read-only volume
+		b = binary.LittleEndian.AppendUint32(b, 255)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(name)))
+		return append(b, name...)
+	case 7: // FileFsFullSizeInformation
+		b := binary.LittleEndian.AppendUint64(nil, totalBlocks)
+		b = binary.LittleEndian.AppendUint64(b, freeBlocks)
+		b = binary.LittleEndian.AppendUint64(b, freeBlocks)
+		b = binary.LittleEndian.AppendUint32(b, blockSize/512)
+		return binary.LittleEndian.AppendUint32(b, 512)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package emulators
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "a.txt", true},
+		{"*", "a.txt", true},
+		{"*.txt", "A.TXT", true},
+		{"*.txt", "a.txt.bak", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"*a*", "bab", true},
+		{"**", "", true},
+		{"a*", "", false},
+		{"desktop.ini", "Desktop.ini", true},
+		{"é*", "Été", true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPatternPathological(t *testing.T) {
+	// With a backtracking matcher every further "*a" group multiplies the
+	// work; this one would not finish.
+	pattern := strings.Repeat("*a", 60) + "z"
+	name := strings.Repeat("a", 200)
+	start := time.Now()
+	if matchPattern(pattern, name) {
+		t.Error("matched")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %s", took)
+	}
+	if matchPattern(strings.Repeat("*", maxPatternLen+1), "a") {
+		t.Error("over-long pattern matched")
+	}
+}
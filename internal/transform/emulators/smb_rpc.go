@@ -0,0 +1,222 @@
+package emulators
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"zecx-deploy/internal/events"
+)
+
+// rpcPipe is the srvsvc named pipe, enough DCE/RPC for a client to bind
+// and list the shares with NetrShareEnum, as `smbclient -L` and scanners
+// do. Every PDU is expected whole in one write.
+type rpcPipe struct {
+	conn *smbConn
+	out  []byte // responses not yet read
+}
+
+// DCE/RPC packet types.
+const (
+	rpcRequest  = 0
+	rpcResponse = 2
+	rpcFault    = 3
+	rpcBind     = 11
+	rpcBindAck  = 12
+)
+
+var (
+	// srvsvc v3.0 and NDR v2.0, as they appear in a bind.
+	srvsvcSyntax = []byte{0xc8, 0x4f, 0x32, 0x4b, 0x70, 0x16, 0xd3, 0x01, 0x12, 0x78, 0x5a, 0x47, 0xbf, 0x6e, 0xe1, 0x88, 3, 0, 0, 0}
+	ndrSyntax    = []byte{0x04, 0x5d, 0x88, 0x8a, 0xeb, 0x1c, 0xc9, 0x11, 0x9f, 0xe8, 0x08, 0x00, 0x2b, 0x10, 0x48, 0x60, 2, 0, 0, 0}
+)
+
+func (p *rpcPipe) write(b []byte) {
+	for len(b) >= 16 && b[0] == 5 {
+		n := int(le16(b[8:]))
+		if n < 16 || n > len(b) {
+			return
+		}
+		p.handle(b[:n])
+		b = b[n:]
+	}
+}
+
+// take returns up to n bytes of pending output.
+func (p *rpcPipe) take(n int) []byte {
+	n = min(n, len(p.out))
+	out := p.out[:n]
+	p.out = p.out[n:]
+	return out
+}
+
+func (p *rpcPipe) handle(pdu []byte) {
+	callID := le32(pdu[12:])
+	switch pdu[2] {
+	case rpcBind:
+		p.bind(pdu, callID)
+	case rpcRequest:
+		if len(pdu) < 24 {
+			return
+		}
+		ctxID, opnum := le16(pdu[20:]), le16(pdu[22:])
+		stub := pdu[24:]
+		if pdu[3]&0x80 != 0 { // object UUID present
+			stub = sub(stub, 16, len(stub)-16)
+		}
+		if opnum != 15 { // NetrShareEnum
+			p.reply(rpcFault, callID, ctxID, binary.LittleEndian.AppendUint32(nil, 0x1c010002))
+			return
+		}
+		p.reply(rpcResponse, callID, ctxID, p.shareEnum(stub))
+	}
+}
+
+// bind accepts srvsvc over NDR and turns down every other context offered.
+func (p *rpcPipe) bind(pdu []byte, callID uint32) {
+	if len(pdu) < 28 {
+		return
+	}
+	count := int(pdu[24])
+	b := append([]byte(nil), pdu[16:20]...) // max xmit and recv frag
+	b = binary.LittleEndian.AppendUint32(b, 0x12345f)
+	addr := append([]byte(`\PIPE\srvsvc`), 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(addr)))
+	b = append(b, addr...)
+	for (16+len(b))%4 != 0 {
+		b = append(b, 0)
+	}
+	b = append(b, byte(count), 0, 0, 0)
+	off := 28
+	for range count {
+		ctx := sub(pdu, off, 24)
+		if ctx == nil {
+			return
+		}
+		n := int(ctx[2])
+		syntaxes := sub(pdu, off+24, 20*n)
+		if syntaxes == nil {
+			return
+		}
+		off += 24 + 20*n
+		accept := bytes.Equal(ctx[4:24], srvsvcSyntax)
+		hasNDR := false
+		for i := range n {
+			hasNDR = hasNDR || bytes.Equal(syntaxes[20*i:20*i+20], ndrSyntax)
+		}
+		switch {
+		case accept && hasNDR:
+			b = append(b, 0, 0, 0, 0)
+			b = append(b, ndrSyntax...)
+		case accept:
+			b = append(b, 2, 0, 2, 0) // transfer syntaxes not supported
+			b = append(b, make([]byte, 20)...)
+		default:
+			b = append(b, 2, 0, 1, 0) // abstract syntax not supported
+			b = append(b, make([]byte, 20)...)
+		}
+	}
+	p.out = append(p.out, rpcHeader(rpcBindAck, callID, len(b))...)
+	p.out = append(p.out, b...)
+}
+
+func (p *rpcPipe) reply(ptype byte, callID uint32, ctxID uint16, stub []byte) {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(stub)))
+	b = binary.LittleEndian.AppendUint16(b, ctxID)
+	b = append(b, 0, 0)
+	b = append(b, stub...)
+	if ptype == rpcFault {
+		b = append(b, 0, 0, 0, 0)
+	}
+	p.out = append(p.out, rpcHeader(ptype, callID, len(b))...)
+	p.out = append(p.out, b...)
+}
+
+func rpcHeader(ptype byte, callID uint32, body int) []byte {
+	h := []byte{5, 0, ptype, 0x03, 0x10, 0, 0, 0}
+	h = binary.LittleEndian.AppendUint16(h, uint16(16+body))
+	h = binary.LittleEndian.AppendUint16(h, 0)
+	return binary.LittleEndian.AppendUint32(h, callID)
+}
+
+// shareEnum answers NetrShareEnum at info level 0 or 1; other levels need
+// an administrator and are refused.
+func (p *rpcPipe) shareEnum(stub []byte) []byte {
+	c := p.conn
+	log.Printf("[SMB] Share list requested by %s", c.sess.Src)
+	events.Publish(&events.Command{Meta: c.sess.Meta(), Input: "srvsvc NetrShareEnum"})
+
+	// The server name, a unique pointer to a conformant varying string,
+	// comes before the level.
+	off := 4
+	if len(stub) >= 4 && le32(stub) != 0 {
+		if len(stub) < 16 {
+			return nil
+		}
+		off = 16 + int(le32(stub[12:]))*2
+		off = (off + 3) &^ 3
+	}
+	level := uint32(1)
+	if b := sub(stub, off, 4); b != nil {
+		level = le32(b)
+	}
+
+	var w ndrWriter
+	w.u32(level)
+	w.u32(level)
+	if level > 1 {
+		w.u32(0) // no container
+		w.u32(0) // total entries
+		w.u32(0) // no resume handle
+		w.u32(5) // ERROR_ACCESS_DENIED
+		return w.b
+	}
+	shares := c.srv.shares
+	w.u32(0x20000)
+	w.u32(uint32(len(shares)))
+	w.u32(0x20004)
+	w.u32(uint32(len(shares)))
+	for i, s := range shares {
+		w.u32(0x20008 + uint32(i)*8)
+		if level == 1 {
+			kind := uint32(0) // STYPE_DISKTREE
+			if s.ipc {
+				kind = 0x80000003 // STYPE_IPC | STYPE_SPECIAL
+			}
+			w.u32(kind)
+			w.u32(0x2000c + uint32(i)*8)
+		}
+	}
+	for _, s := range shares {
+		w.str(s.name)
+		if level == 1 {
+			w.str(s.comment)
+		}
+	}
+	w.u32(uint32(len(shares)))
+	w.u32(0x20000 + 8*uint32(len(shares)+2))
+	w.u32(0) // resume handle
+	w.u32(0) // WERR_OK
+	return w.b
+}
+
+// ndrWriter encodes the little NDR that NetrShareEnum needs.
+type ndrWriter struct {
+	b []byte
+}
+
+func (w *ndrWriter) u32(v uint32) {
+	w.b = binary.LittleEndian.AppendUint32(w.b, v)
+}
+
+// str writes a conformant varying string with its terminating NUL.
+func (w *ndrWriter) str(s string) {
+	u := append(encodeUTF16(s), 0, 0)
+	w.u32(uint32(len(u) / 2))
+	w.u32(0)
+	w.u32(uint32(len(u) / 2))
+	w.b = append(w.b, u...)
+	for len(w.b)%4 != 0 {
+		w.b = append(w.b, 0)
+	}
+}
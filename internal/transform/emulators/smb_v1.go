@@ -0,0 +1,323 @@
+package emulators
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/transform/emulators/ntlm"
+)
+
+// SMBv1 is spoken only as far as old clients and exploit tools need: a
+// negotiate without extended security, whose LM and NT responses are
+// captured like NTLM ones, a tree connect, and the transactions that
+// EternalBlue and its checks send.
+
+// SMBv1 commands.
+const (
+	smb1Trans           = 0x25
+	smb1TransSecondary  = 0x26
+	smb1Echo            = 0x2B
+	smb1Trans2          = 0x32
+	smb1Trans2Secondary = 0x33
+	smb1TreeDisconnect  = 0x71
+	smb1Negotiate       = 0x72
+	smb1SessionSetup    = 0x73
+	smb1Logoff          = 0x74
+	smb1TreeConnect     = 0x75
+	smb1NTTrans         = 0xA0
+	smb1NTTransSecond   = 0xA1
+)
+
+const (
+	smb1FlagsReply      = 0x80
+	smb1Flags2Unicode   = 0x8000
+	smb1Flags2NTStatus  = 0x4000
+	smb1Flags2ExtSecure = 0x0800
+)
+
+type smbV1State struct {
+	challenge [8]byte
+	uid       uint16
+	trees     map[uint16]*smbShare
+	nextTID   uint16
+}
+
+// smb1Request is one SMBv1 message split into its parts.
+type smb1Request struct {
+	msg     []byte
+	command byte
+	words   []byte
+	data    []byte
+	dataOff int // offset of data in msg
+	unicode bool
+}
+
+func (c *smbConn) handleV1(msg []byte) bool {
+	if len(msg) < 35 {
+		return false
+	}
+	r := &smb1Request{msg: msg, command: msg[4], unicode: le16(msg[10:])&smb1Flags2Unicode != 0}
+	wc := int(msg[32])
+	r.words = sub(msg, 33, 2*wc)
+	if r.words == nil || len(msg) < 35+2*wc {
+		return false
+	}
+	r.dataOff = 35 + 2*wc
+	// Exploit traffic often lies about its byte count, so take what is there.
+	r.data = msg[r.dataOff:]
+	if n := int(le16(msg[33+2*wc:])); n < len(r.data) {
+		r.data = r.data[:n]
+	}
+
+	switch r.command {
+	case smb1Negotiate:
+		return c.negotiateV1(r)
+	case smb1SessionSetup:
+		return c.sessionSetupV1(r)
+	case smb1TreeConnect:
+		return c.treeConnectV1(r)
+	case smb1Trans, smb1Trans2:
+		return c.transV1(r)
+	case smb1NTTrans:
+		return c.ntTransV1(r)
+	case smb1TransSecondary, smb1Trans2Secondary, smb1NTTransSecond:
+		// Secondaries are never answered.
+		return true
+	case smb1Echo:
+		return c.replyV1(r, statusSuccess, []byte{1, 0}, r.data)
+	case smb1Logoff:
+		c.v1.uid = 0
+		return c.replyV1(r, statusSuccess, []byte{0xff, 0, 0, 0}, nil)
+	case smb1TreeDisconnect:
+		delete(c.v1.trees, le16(msg[24:]))
+		return c.replyV1(r, statusSuccess, nil, nil)
+	}
+	return c.replyV1(r, statusNotImplemented, nil, nil)
+}
+
+// replyV1 answers r with the given parameter words and data.
+func (c *smbConn) replyV1(r *smb1Request, status uint32, words, data []byte) bool {
+	b := make([]byte, 32, 35+len(words)+len(data))
+	copy(b, r.msg[:32])
+	binary.LittleEndian.PutUint32(b[5:], status)
+	b[9] |= smb1FlagsReply
+	flags2 := le16(b[10:])&^smb1Flags2ExtSecure | smb1Flags2NTStatus
+	binary.LittleEndian.PutUint16(b[10:], flags2)
+	binary.LittleEndian.PutUint16(b[28:], c.v1.uid)
+	if status != statusSuccess {
+		words, data = nil, nil
+	}
+	b = append(b, byte(len(words)/2))
+	b = append(b, words...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+	return c.send(append(b, data...))
+}
+
+// negotiateV1 answers an SMBv1 negotiate. A client that also offers SMB2
+// is moved to it, as Samba does; otherwise NT LM 0.12 is chosen.
+func (c *smbConn) negotiateV1(r *smb1Request) bool {
+	var dialects []string
+	for _, d := range bytes.Split(r.data, []byte{0}) {
+		if len(d) > 0 && d[0] == 0x02 {
+			dialects = append(dialects, string(d[1:]))
+		}
+	}
+	for _, d := range []struct {
+		name    string
+		dialect uint16
+	}{{"SMB 2.???", 0x02FF}, {"SMB 2.002", 0x0202}} {
+		for _, offered := range dialects {
+			if offered == d.name {
+				c.dialect = d.dialect
+				h := smb2Header{command: smb2Negotiate}
+				return c.send(c.smb2Response(&h, statusSuccess, c.negotiateBody(d.dialect)))
+			}
+		}
+	}
+
+	index := -1
+	for i, d := range dialects {
+		if d == "NT LM 0.12" {
+			index = i
+		}
+	}
+	if index < 0 {
+		return c.replyV1(r, statusSuccess, []byte{0xff, 0xff}, nil)
+	}
+	rand.Read(c.v1.challenge[:])
+	w := binary.LittleEndian.AppendUint16(nil, uint16(index))
+	w = append(w, 0x03)                                 // user security, encrypted passwords
+	w = binary.LittleEndian.AppendUint16(w, 50)         // max mpx
+	w = binary.LittleEndian.AppendUint16(w, 1)          // max VCs
+	w = binary.LittleEndian.AppendUint32(w, 16644)      // max buffer
+	w = binary.LittleEndian.AppendUint32(w, 65536)      // max raw
+	w = binary.LittleEndian.AppendUint32(w, 0)          // session key
+	w = binary.LittleEndian.AppendUint32(w, 0x0000f3fd) // capabilities, no extended security
+	w = binary.LittleEndian.AppendUint64(w, filetime(time.Now()))
+	w = binary.LittleEndian.AppendUint16(w, 0)
+	w = append(w, 8)
+	data := append([]byte(nil), c.v1.challenge[:]...)
+	data = append(data, smb1String(c.srv.workgroup, r.unicode)...)
+	data = append(data, smb1String(c.srv.netbios, r.unicode)...)
+	return c.replyV1(r, statusSuccess, w, data)
+}
+
+// sessionSetupV1 captures the LM and NT responses of a login without
+// extended security, which are NetNTLMv1 or NTLMv2 responses to the
+// negotiate's challenge.
+func (c *smbConn) sessionSetupV1(r *smb1Request) bool {
+	if len(r.words) != 26 {
+		return c.replyV1(r, statusNotSupported, nil, nil)
+	}
+	lmLen, ntLen := int(le16(r.words[14:])), int(le16(r.words[16:]))
+	if lmLen+ntLen > len(r.data) {
+		return c.replyV1(r, statusInvalidParameter, nil, nil)
+	}
+	resp := &ntlm.Response{
+		LM:        bytes.Clone(r.data[:lmLen]),
+		NT:        bytes.Clone(r.data[lmLen : lmLen+ntLen]),
+		Challenge: c.v1.challenge,
+	}
+	strs := smb1Strings(r, r.dataOff+lmLen+ntLen, 4)
+	resp.User, resp.Domain = strs[0], strs[1]
+	c.recordLogon(resp)
+	if !c.srv.guest {
+		return c.replyV1(r, statusLogonFailure, nil, nil)
+	}
+	c.v1.uid = 100
+	action := uint16(1) // logged in as guest
+	if resp.Anonymous() {
+		action = 0
+	}
+	w := []byte{0xff, 0, 0, 0}
+	w = binary.LittleEndian.AppendUint16(w, action)
+	var data []byte
+	if r.unicode {
+		data = append(data, 0) // 41 bytes precede the data
+	}
+	data = append(data, smb1String("Windows 6.1", r.unicode)...)
+	data = append(data, smb1String("Samba 4.15.13-Ubuntu", r.unicode)...)
+	data = append(data, smb1String(c.srv.workgroup, r.unicode)...)
+	return c.replyV1(r, statusSuccess, w, data)
+}
+
+func (c *smbConn) treeConnectV1(r *smb1Request) bool {
+	if len(r.words) != 8 {
+		return c.replyV1(r, statusInvalidParameter, nil, nil)
+	}
+	if c.v1.uid == 0 || le16(r.msg[28:]) != c.v1.uid {
+		return c.replyV1(r, statusAccessDenied, nil, nil)
+	}
+	unc := smb1Strings(r, r.dataOff+int(le16(r.words[6:])), 1)[0]
+	events.Publish(&events.Command{Meta: c.sess.Meta(), Input: "TREE_CONNECT " + unc})
+	share := c.srv.share(unc[strings.LastIndexByte(unc, '\\')+1:])
+	if share == nil {
+		return c.replyV1(r, statusBadNetworkName, nil, nil)
+	}
+	if c.v1.trees == nil {
+		c.v1.trees = make(map[uint16]*smbShare)
+	}
+	c.v1.nextTID++
+	c.v1.trees[c.v1.nextTID] = share
+	binary.LittleEndian.PutUint16(r.msg[24:], c.v1.nextTID) // the reply echoes the header
+
+	w := []byte{0xff, 0, 0, 0, 1, 0} // optional support: search bits
+	service := "A:"
+	if share.ipc {
+		service = "IPC"
+	}
+	data := append([]byte(service), 0)
+	if r.unicode {
+		if (41+len(data))%2 != 0 {
+			data = append(data, 0)
+		}
+		data = append(data, 0)
+	}
+	data = append(data, 0) // no native filesystem
+	return c.replyV1(r, statusSuccess, w, data)
+}
+
+// transV1 recognises the transactions that check for MS17-010 and for the
+// DoublePulsar implant. The check is told what a vulnerable host says, so
+// that the exploit follows.
+func (c *smbConn) transV1(r *smb1Request) bool {
+	if len(r.words) < 28 {
+		return c.replyV1(r, statusInvalidParameter, nil, nil)
+	}
+	setup := sub(r.words, 28, 2*int(r.words[26]))
+	if len(setup) >= 2 {
+		switch sub := le16(setup); {
+		case r.command == smb1Trans && sub == 0x23 && len(setup) >= 4 && le16(setup[2:]) == 0:
+			c.exploit(sigMS17010Check, "PeekNamedPipe on FID 0 in "+c.v1Tree(r))
+			return c.replyV1(r, statusInsuffServerResources, nil, nil)
+		case r.command == smb1Trans2 && sub == 0x0e:
+			c.exploit(sigDoublePulsar, fmt.Sprintf("TRANS2_SESSION_SETUP with timeout %#x", le32(r.words[12:])))
+			// A clean host answers with the multiplex ID unchanged.
+			return c.replyV1(r, statusNotImplemented, nil, nil)
+		}
+	}
+	return c.replyV1(r, statusNotSupported, nil, nil)
+}
+
+// ntTransV1 recognises EternalBlue's opening NT_TRANSACT: function 0 with
+// more data announced than sent, the rest to follow in TRANS2 secondaries.
+// It is given the interim response that lets the client continue.
+func (c *smbConn) ntTransV1(r *smb1Request) bool {
+	if len(r.words) < 38 {
+		return c.replyV1(r, statusInvalidParameter, nil, nil)
+	}
+	total, sent := le32(r.words[7:]), le32(r.words[27:])
+	if le16(r.words[36:]) == 0 && total > sent {
+		c.exploit(sigEternalBlue, fmt.Sprintf("NT_TRANSACT function 0 announcing %d bytes, %d sent", total, sent))
+		return c.replyV1(r, statusSuccess, nil, nil)
+	}
+	return c.replyV1(r, statusNotSupported, nil, nil)
+}
+
+// v1Tree names the share the request's TID refers to.
+func (c *smbConn) v1Tree(r *smb1Request) string {
+	if s := c.v1.trees[le16(r.msg[24:])]; s != nil {
+		return s.name
+	}
+	return fmt.Sprintf("unknown tree %d", le16(r.msg[24:]))
+}
+
+// smb1Strings reads n NUL-terminated strings starting at off in the
+// message, aligning Unicode ones to two bytes from the header.
+func smb1Strings(r *smb1Request, off, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		if r.unicode {
+			off += off % 2
+			end := off
+			for end+1 < len(r.msg) && (r.msg[end] != 0 || r.msg[end+1] != 0) {
+				end += 2
+			}
+			if end+1 >= len(r.msg) {
+				return out
+			}
+			out[i] = decodeUTF16(r.msg[off:end])
+			off = end + 2
+		} else {
+			end := bytes.IndexByte(r.msg[min(off, len(r.msg)):], 0)
+			if end < 0 {
+				return out
+			}
+			out[i] = string(r.msg[off : off+end])
+			off += end + 1
+		}
+	}
+	return out
+}
+
+func smb1String(s string, unicode bool) []byte {
+	if unicode {
+		return append(encodeUTF16(s), 0, 0)
+	}
+	return append([]byte(s), 0)
+}
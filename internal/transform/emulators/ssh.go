@@ -0,0 +1,209 @@
+package emulators
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/fetch"
+	"zecx-deploy/internal/hostkeys"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/recording"
+	"zecx-deploy/internal/transform/emulators/auth"
+	"zecx-deploy/internal/transform/emulators/persona"
+	"zecx-deploy/internal/transform/emulators/vfs"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// --- SSH Emulator ---
+
+// sshServer holds the state shared by all SSH connections.
+type sshServer struct {
+	hostKeys []ssh.Signer
+	persona  *persona.Persona
+	fs       *vfs.FS // template; every session works on its own clone
+	auth     *auth.Policy
+
+	samples   *quarantine.Store // nil when the quarantine could not be opened
+	maxUpload int64             // bytes of one upload kept, 0 for no limit
+	budget    int64             // bytes a session may add to its filesystem
+	fetcher   fetch.Fetcher     // retrieves wget/curl/tftp payloads; nil records URLs only
+	recordDir string            // asciicast recordings; empty disables them
+
+	forwardCapture int // bytes of a forwarded stream kept
+}
+
+func startSSHEmulator(addr string, cfg *config.Config, host *persona.Persona, fsys *vfs.FS, samples *quarantine.Store) {
+	policy, err := auth.NewPolicy(cfg.SSH.Auth)
+	if err != nil {
+		log.Fatalf("[SSH] Invalid authentication policy: %v", err)
+	}
+	srv := &sshServer{persona: host, fs: fsys, auth: policy, samples: samples}
+	srv.maxUpload = cfg.Quarantine.MaxFileSizeMB << 20
+	srv.budget = sessionBudget(cfg)
+
+	if cfg.Downloads.Fetch {
+		srv.fetcher = &fetch.Client{MaxSize: cfg.Downloads.MaxSizeMB << 20, Timeout: time.Duration(cfg.Downloads.Timeout)}
+	}
+
+	srv.recordDir = recording.Dir(cfg.StateDir)
+	srv.forwardCapture = cfg.SSH.ForwardCaptureBytes
+
+	srv.hostKeys, err = hostkeys.Load(hostkeys.Dir(cfg.StateDir))
+	if err != nil {
+		log.Fatalf("[SSH] Failed to load host keys: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[SSH] Failed to listen on %s: %v", addr, err)
+	}
+	log.Printf("[SSH] Listening on %s", addr)
+
+	for {
+		nConn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[SSH] Failed to accept incoming connection: %v", err)
+			continue
+		}
+		go srv.handleConn(nConn)
+	}
+}
+
+// serverConfig builds the per-connection server configuration so that
+// authentication callbacks can attribute attempts to the connection's session.
+func (srv *sshServer) serverConfig(sess *events.Session) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			decision := srv.auth.Check(remoteIP(c.RemoteAddr()), c.User(), string(pass))
+			events.Publish(&events.AuthAttempt{
+				Meta:     sess.Meta(),
+				Method:   "password",
+				Username: c.User(),
+				Password: string(pass),
+				Success:  decision.Accept,
+			})
+			if !decision.Accept {
+				return nil, fmt.Errorf("password rejected for %q", c.User())
+			}
+			log.Printf("[SSH] Accepted password for %s from %s (%s)", c.User(), c.RemoteAddr(), decision.Reason)
+			return &ssh.Permissions{Extensions: map[string]string{"auth-method": "password"}}, nil
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			fingerprint := ssh.FingerprintSHA256(key)
+			decision := srv.auth.CheckKey(fingerprint)
+			events.Publish(&events.AuthAttempt{
+				Meta:        sess.Meta(),
+				Method:      "publickey",
+				Username:    c.User(),
+				Success:     decision.Accept,
+				KeyType:     key.Type(),
+				Fingerprint: fingerprint,
+				PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			})
+			if !decision.Accept {
+				return nil, fmt.Errorf("public key %s rejected for %q", fingerprint, c.User())
+			}
+			log.Printf("[SSH] Accepted public key %s for %s from %s", fingerprint, c.User(), c.RemoteAddr())
+			return &ssh.Permissions{Extensions: map[string]string{"auth-method": "publickey", "pubkey-fp": fingerprint}}, nil
+		},
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			// Ask the single password prompt that PAM shows for a stock sshd.
+			answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			var pass string
+			if len(answers) > 0 {
+				pass = answers[0]
+			}
+			decision := srv.auth.Check(remoteIP(c.RemoteAddr()), c.User(), pass)
+			events.Publish(&events.AuthAttempt{
+				Meta:     sess.Meta(),
+				Method:   "keyboard-interactive",
+				Username: c.User(),
+				Password: pass,
+				Success:  decision.Accept,
+				Answers:  answers,
+			})
+			if !decision.Accept {
+				return nil, fmt.Errorf("keyboard-interactive rejected for %q", c.User())
+			}
+			log.Printf("[SSH] Accepted keyboard-interactive for %s from %s (%s)", c.User(), c.RemoteAddr(), decision.Reason)
+			return &ssh.Permissions{Extensions: map[string]string{"auth-method": "keyboard-interactive"}}, nil
+		},
+	}
+	for _, key := range srv.hostKeys {
+		config.AddHostKey(key)
+	}
+	return config
+}
+
+func (srv *sshServer) handleConn(nConn net.Conn) {
+	sess := events.NewSession("ssh", nConn.LocalAddr(), nConn.RemoteAddr())
+	defer publishClosed(sess)
+	defer nConn.Close()
+
+	// The opened event waits for the key exchange so that it can carry the
+	// client's fingerprint; clients that never get that far are still reported.
+	sniffer := &kexSniffer{Conn: nConn}
+	var opened sync.Once
+	publishOpened := func(version string) {
+		opened.Do(func() {
+			ev := &events.ConnectionOpened{Meta: sess.Meta()}
+			client := sniffer.Client()
+			if version != "" {
+				client.Version = version
+			}
+			if client.Version != "" {
+				ev.SSH = &client
+				log.Printf("[SSH] Client %s from %s (hassh %s)", client.Version, sess.Src, client.HASSH)
+			}
+			events.Publish(ev)
+		})
+	}
+
+	config := srv.serverConfig(sess)
+	config.PreAuthConnCallback = func(c ssh.ServerPreAuthConn) {
+		publishOpened(string(c.ClientVersion()))
+	}
+	conn, chans, reqs, err := ssh.NewServerConn(sniffer, config)
+	publishOpened("")
+	if err != nil {
+		log.Printf("[SSH] Failed to handshake (%s)", err)
+		return
+	}
+	defer conn.Close()
+
+	go srv.handleGlobalRequests(sess, reqs)
+
+	fsys := srv.fs.Clone()
+	writeProcFiles(fsys, srv.persona)
+	fsys.SetBudget(srv.budget)
+	rec := &connRecording{dir: srv.recordDir, sess: sess}
+	defer rec.close()
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go srv.handleSession(conn, sess, fsys, rec, newChannel)
+		case "direct-tcpip":
+			go srv.handleDirectTCPIP(sess, newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,310 @@
+package emulators
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/transform/emulators/sftp"
+	"zecx-deploy/internal/transform/emulators/shell"
+	"zecx-deploy/internal/transform/emulators/vfs"
+)
+
+// serveSFTP runs the sftp subsystem on the session's filesystem.
+func (s *sshSession) serveSFTP() {
+	user := s.conn.User()
+	home := shell.HomeDir(user)
+	if _, err := s.fs.Stat(home); err != nil {
+		s.fs.MkdirAll(home, 0755, user)
+	}
+	srv := &sftp.Server{
+		FS:          s.fs,
+		User:        user,
+		Home:        home,
+		MaxFileSize: s.srv.maxUpload,
+		OnUpload: func(p string, data []byte, truncated bool) {
+			recordUpload(s.srv.samples, s.sess.Meta(), "SSH", "sftp", p, data, truncated)
+		},
+		OnDownload: func(p string, size int64) {
+			s.recordDownload("sftp", p, size)
+		},
+	}
+	if err := srv.Serve(s.channel); err != nil {
+		log.Printf("[SSH] SFTP session from %s ended: %v", s.sess.Src, err)
+	}
+	s.exit(0)
+}
+
+// scpCommand recognises the remote end of an scp transfer ("scp -t" to
+// receive, "scp -f" to send) and returns its mode, target and recursion flag.
+func scpCommand(command string) (mode byte, target string, recursive, ok bool) {
+	fields := strings.Fields(command)
+	if len(fields) < 2 || path.Base(fields[0]) != "scp" {
+		return 0, "", false, false
+	}
+	for _, f := range fields[1:] {
+		switch {
+		case f == "--":
+		case strings.HasPrefix(f, "-"):
+			for _, c := range f[1:] {
+				switch c {
+				case 't', 'f':
+					mode = byte(c)
+				case 'r':
+					recursive = true
+				}
+			}
+		default:
+			target = f
+		}
+	}
+	if mode == 0 {
+		return 0, "", false, false
+	}
+	if target == "" {
+		target = "."
+	}
+	return mode, target, recursive, true
+}
+
+// scp speaks the legacy rcp protocol on the session channel.
+type scp struct {
+	s   *sshSession
+	r   *bufio.Reader
+	cwd string
+}
+
+func (s *sshSession) runSCP(mode byte, target string, recursive bool) {
+	c := &scp{s: s, r: bufio.NewReader(s.channel), cwd: shell.HomeDir(s.conn.User())}
+	var err error
+	if mode == 't' {
+		err = c.sink(target)
+	} else {
+		err = c.source(target, recursive)
+	}
+	status := 0
+	if err != nil {
+		status = 1
+		if !errors.Is(err, io.EOF) {
+			log.Printf("[SSH] SCP transfer from %s failed: %v", s.sess.Src, err)
+		}
+	}
+	s.exit(status)
+}
+
+func (c *scp) ack() error {
+	_, err := c.s.channel.Write([]byte{0})
+	return err
+}
+
+// fail reports a fatal error to the client the way scp does.
+func (c *scp) fail(format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(c.s.channel, "\x01scp: %s\n", msg)
+	return errors.New(msg)
+}
+
+// readAck waits for the peer's confirmation byte.
+func (c *scp) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0 {
+		msg, _ := c.r.ReadString('\n')
+		return fmt.Errorf("peer error: %s", strings.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sink receives files into target, which is either a directory or the name
+// of the single file being uploaded.
+func (c *scp) sink(target string) error {
+	dir := vfs.Clean(c.cwd, target)
+	n, err := c.s.fs.Stat(dir)
+	intoDir := err == nil && n.IsDir()
+	stack := []string{}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) && line == "" {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return c.fail("protocol error: empty line")
+		}
+		switch line[0] {
+		case 'T':
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(stack) == 0 {
+				return c.fail("protocol error: unexpected E")
+			}
+			dir, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseSCPHeader(line)
+			if err != nil {
+				return c.fail("%v", err)
+			}
+			dest := dir
+			if intoDir || len(stack) > 0 {
+				dest = path.Join(dir, name)
+			}
+			if line[0] == 'D' {
+				if err := c.s.fs.MkdirAll(dest, mode, c.s.conn.User()); err != nil {
+					return c.fail("%s: %s", dest, shell.ErrText(err))
+				}
+				stack = append(stack, dir)
+				dir = dest
+				if err := c.ack(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := c.receive(dest, mode, size); err != nil {
+				return err
+			}
+		case '\x01', '\x02':
+			return fmt.Errorf("peer error: %s", line[1:])
+		default:
+			return c.fail("protocol error: unexpected %q", line[:1])
+		}
+	}
+}
+
+// receive reads one file body, keeping at most the configured upload size
+// or, when that is unlimited, sftp.DefaultMaxFileSize.
+func (c *scp) receive(dest string, mode fs.FileMode, size int64) error {
+	if err := c.ack(); err != nil {
+		return err
+	}
+	// The size comes from the client, so the buffer grows with what
+	// actually arrives rather than being allocated up front.
+	limit := c.s.srv.maxUpload
+	if limit <= 0 {
+		limit = sftp.DefaultMaxFileSize
+	}
+	keep := min(size, limit)
+	data, err := io.ReadAll(io.LimitReader(c.r, keep))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < keep {
+		return io.ErrUnexpectedEOF
+	}
+	if _, err := io.CopyN(io.Discard, c.r, size-keep); err != nil {
+		return err
+	}
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	err = c.s.fs.WriteFile(dest, data, mode, c.s.conn.User())
+	if err == nil || errors.Is(err, vfs.ErrNoSpace) {
+		recordUpload(c.s.srv.samples, c.s.sess.Meta(), "SSH", "scp", dest, data, keep < size)
+	}
+	if err != nil {
+		return c.fail("%s: %s", dest, shell.ErrText(err))
+	}
+	return c.ack()
+}
+
+// source sends the file or, with -r, the directory tree at target.
+func (c *scp) source(target string, recursive bool) error {
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	return c.send(vfs.Clean(c.cwd, target), recursive)
+}
+
+func (c *scp) send(p string, recursive bool) error {
+	n, err := c.s.fs.Stat(p)
+	if err != nil {
+		return c.fail("%s: %s", p, shell.ErrText(err))
+	}
+	if n.IsDir() {
+		if !recursive {
+			return c.fail("%s: not a regular file", p)
+		}
+		fmt.Fprintf(c.s.channel, "D%04o 0 %s\n", n.Mode.Perm(), n.Name)
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		children, err := c.s.fs.ReadDir(p)
+		if err != nil {
+			return c.fail("%s: %s", p, shell.ErrText(err))
+		}
+		for _, child := range children {
+			if err := c.send(path.Join(p, child.Name), recursive); err != nil {
+				return err
+			}
+		}
+		fmt.Fprint(c.s.channel, "E\n")
+		return c.readAck()
+	}
+
+	data, err := c.s.fs.ReadFile(p)
+	if err != nil {
+		return c.fail("%s: %s", p, shell.ErrText(err))
+	}
+	fmt.Fprintf(c.s.channel, "C%04o %d %s\n", n.Mode.Perm(), len(data), n.Name)
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	if _, err := c.s.channel.Write(data); err != nil {
+		return err
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	c.s.recordDownload("scp", p, int64(len(data)))
+	return c.readAck()
+}
+
+// parseSCPHeader parses a "C0644 1234 name" or "D0755 0 name" line.
+func parseSCPHeader(line string) (fs.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad header %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("protocol error: bad mode")
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad size")
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("error: unexpected filename: %s", name)
+	}
+	return fs.FileMode(mode) & fs.ModePerm, size, name, nil
+}
+
+func (s *sshSession) recordDownload(via, p string, size int64) {
+	events.Publish(&events.FileTransfer{
+		Meta:      s.sess.Meta(),
+		Direction: "download",
+		Path:      p,
+		Size:      size,
+		Via:       via,
+	})
+}
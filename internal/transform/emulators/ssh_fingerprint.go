@@ -0,0 +1,132 @@
+package emulators
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+
+	"zecx-deploy/internal/events"
+)
+
+const (
+	msgKexInit = 20
+
+	// maxIdentBytes bounds the bytes accepted before the version line.
+	maxIdentBytes = 8 * 1024
+	// maxKexInitPacket is the largest packet RFC 4253 requires us to accept.
+	maxKexInitPacket = 35000
+)
+
+// kexSniffer passes a connection through to the SSH server while reading the
+// client's version line and first KEXINIT from the cleartext start of the
+// stream, which the ssh package does not expose.
+type kexSniffer struct {
+	net.Conn
+
+	mu     sync.Mutex
+	buf    []byte
+	done   bool
+	client events.SSHClient
+}
+
+func (c *kexSniffer) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.observe(p[:n])
+	}
+	return n, err
+}
+
+// Client returns what has been learned about the client so far.
+func (c *kexSniffer) Client() events.SSHClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+func (c *kexSniffer) observe(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	c.buf = append(c.buf, b...)
+
+	for c.client.Version == "" {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			if len(c.buf) > maxIdentBytes {
+				c.stop()
+			}
+			return
+		}
+		line := strings.TrimRight(string(c.buf[:i]), "\r")
+		c.buf = c.buf[i+1:]
+		if strings.HasPrefix(line, "SSH-") {
+			c.client.Version = line
+		}
+	}
+
+	if len(c.buf) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(c.buf)
+	if length > maxKexInitPacket {
+		c.stop()
+		return
+	}
+	if len(c.buf) < 4+int(length) {
+		return
+	}
+	padding := int(c.buf[4])
+	if padding+1 <= int(length) {
+		parseKexInit(c.buf[5:4+int(length)-padding], &c.client)
+	}
+	c.stop()
+}
+
+func (c *kexSniffer) stop() {
+	c.done = true
+	c.buf = nil
+}
+
+// parseKexInit fills in the algorithm lists and HASSH from an
+// SSH_MSG_KEXINIT payload (RFC 4253 section 7.1).
+func parseKexInit(payload []byte, client *events.SSHClient) {
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return
+	}
+	b := payload[17:] // message type and cookie
+	var lists [10][]string
+	for i := range lists {
+		if len(b) < 4 {
+			return
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(b[4:4+n]), ",")
+		}
+		b = b[4+n:]
+	}
+	client.KexAlgorithms = lists[0]
+	client.HostKeyAlgorithms = lists[1]
+	client.Ciphers = lists[2]
+	client.MACs = lists[4]
+	client.Compression = lists[6]
+
+	client.HASSHAlgorithms = strings.Join([]string{
+		strings.Join(lists[0], ","),
+		strings.Join(lists[2], ","),
+		strings.Join(lists[4], ","),
+		strings.Join(lists[6], ","),
+	}, ";")
+	sum := md5.Sum([]byte(client.HASSHAlgorithms))
+	client.HASSH = hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,285 @@
+package emulators
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"zecx-deploy/internal/events"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// forwardTimeout bounds how long a forwarded channel is kept open.
+	forwardTimeout = 30 * time.Second
+	// forwardMaxLine bounds a line read from a forwarded stream.
+	forwardMaxLine = 4096
+)
+
+// Payloads of the port forwarding messages defined in RFC 4254 section 7.
+type (
+	directTCPIPMessage struct {
+		Host           string
+		Port           uint32
+		OriginatorIP   string
+		OriginatorPort uint32
+	}
+	tcpipForwardMessage struct {
+		BindAddr string
+		BindPort uint32
+	}
+)
+
+// handleGlobalRequests answers connection-level requests. Remote forwarding is
+// acknowledged and recorded, but nothing is ever bound on the host.
+func (srv *sshServer) handleGlobalRequests(sess *events.Session, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var m tcpipForwardMessage
+			if err := ssh.Unmarshal(req.Payload, &m); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			events.Publish(&events.PortForward{Meta: sess.Meta(), Request: req.Type, Host: m.BindAddr, Port: m.BindPort})
+			log.Printf("[SSH] Remote forward of %s:%d requested from %s", m.BindAddr, m.BindPort, sess.Src)
+			var reply []byte
+			if m.BindPort == 0 {
+				// The client asked us to pick a port; name a plausible ephemeral one.
+				reply = binary.BigEndian.AppendUint32(nil, uint32(32768+rand.IntN(28232)))
+			}
+			req.Reply(true, reply)
+		case "cancel-tcpip-forward":
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// handleDirectTCPIP accepts a local forward as if the target were reachable,
+// captures what the client sends and answers with an emulated service.
+func (srv *sshServer) handleDirectTCPIP(sess *events.Session, newChannel ssh.NewChannel) {
+	var m directTCPIPMessage
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &m); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed request")
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Printf("[SSH] Could not accept channel: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+	timer := time.AfterFunc(forwardTimeout, func() { channel.Close() })
+	defer timer.Stop()
+
+	log.Printf("[SSH] Forward to %s:%d requested from %s", m.Host, m.Port, sess.Src)
+	capture := &captureWriter{max: srv.forwardCapture}
+	in := bufio.NewReaderSize(io.TeeReader(channel, capture), forwardMaxLine)
+	switch m.Port {
+	case 25, 465, 587, 2525:
+		fakeSMTP(in, channel, srv.persona.Hostname, func(mechanism, username, password string) {
+			log.Printf("[SSH] SMTP %s login for %q from %s through a forward to %s:%d", mechanism, username, sess.Src, m.Host, m.Port)
+			events.Publish(&events.AuthAttempt{
+				Meta:     sess.Meta(),
+				Method:   "smtp-" + strings.ToLower(mechanism),
+				Username: username,
+				Password: password,
+				Success:  true,
+			})
+		})
+	default:
+		fakeService(in, channel)
+	}
+
+	events.Publish(&events.PortForward{
+		Meta:           sess.Meta(),
+		Request:        "direct-tcpip",
+		Host:           m.Host,
+		Port:           m.Port,
+		OriginatorIP:   m.OriginatorIP,
+		OriginatorPort: m.OriginatorPort,
+		Payload:        capture.buf,
+		BytesIn:        capture.total,
+	})
+}
+
+// captureWriter keeps the first max bytes written to it and counts the rest.
+type captureWriter struct {
+	max   int
+	buf   []byte
+	total int64
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if room := c.max - len(c.buf); room > 0 {
+		c.buf = append(c.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// readLine reads a line of up to the size of in's buffer. The rest of a
+// longer line is discarded and tooLong set, so that a client cannot make
+// the emulator buffer without bound.
+func readLine(in *bufio.Reader) (line string, tooLong bool, err error) {
+	b, err := in.ReadSlice('\n')
+	line = strings.TrimRight(string(b), "\r\n")
+	for errors.Is(err, bufio.ErrBufferFull) {
+		tooLong = true
+		_, err = in.ReadSlice('\n')
+	}
+	return line, tooLong, err
+}
+
+// fakeSMTP plays a mail server that accepts everything, which is what spam
+// bots relaying through the honeypot want to see. Credentials given with
+// AUTH are passed to onAuth.
+func fakeSMTP(in *bufio.Reader, out io.Writer, hostname string, onAuth func(mechanism, username, password string)) {
+	fmt.Fprintf(out, "220 %s ESMTP Postfix (Ubuntu)\r\n", hostname)
+	data := false
+	for {
+		line, tooLong, err := readLine(in)
+		if err != nil {
+			return
+		}
+		if data {
+			if line == "." && !tooLong {
+				data = false
+				fmt.Fprintf(out, "250 2.0.0 Ok: queued as %X\r\n", time.Now().UnixNano()&0xFFFFFFFFFF)
+			}
+			continue
+		}
+		if tooLong {
+			fmt.Fprint(out, "500 5.5.0 Error: line too long\r\n")
+			continue
+		}
+		verb, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			fmt.Fprintf(out, "250-%s\r\n250-PIPELINING\r\n250-SIZE 10240000\r\n250-8BITMIME\r\n250 AUTH PLAIN LOGIN\r\n", hostname)
+		case "HELO":
+			fmt.Fprintf(out, "250 %s\r\n", hostname)
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(args, " ")
+			mechanism = strings.ToUpper(mechanism)
+			username, password, err := smtpAuth(in, out, mechanism, initial)
+			var reply smtpReply
+			switch {
+			case errors.As(err, &reply):
+				fmt.Fprintf(out, "%s\r\n", reply)
+			case err != nil:
+				return
+			default:
+				onAuth(mechanism, username, password)
+				fmt.Fprint(out, "235 2.7.0 Authentication successful\r\n")
+			}
+		case "DATA":
+			data = true
+			fmt.Fprint(out, "354 End data with <CR><LF>.<CR><LF>\r\n")
+		case "QUIT":
+			fmt.Fprint(out, "221 2.0.0 Bye\r\n")
+			return
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			fmt.Fprint(out, "250 2.1.0 Ok\r\n")
+		default:
+			fmt.Fprint(out, "502 5.5.2 Error: command not recognized\r\n")
+		}
+	}
+}
+
+// smtpReply is an error answered with its own text as the SMTP reply.
+type smtpReply string
+
+func (r smtpReply) Error() string { return string(r) }
+
+// smtpAuth runs the SASL exchange of an AUTH command for PLAIN and LOGIN,
+// prompting with 334 for whatever the initial response left out, and
+// returns the decoded credentials.
+func smtpAuth(in *bufio.Reader, out io.Writer, mechanism, initial string) (username, password string, err error) {
+	decode := func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", smtpReply("501 5.5.2 Cannot decode response")
+		}
+		return string(b), nil
+	}
+	// answer returns the initial response if there is one, or else the
+	// client's reply to challenge.
+	answer := func(initial, challenge string) (string, error) {
+		if initial != "" {
+			return decode(initial)
+		}
+		fmt.Fprintf(out, "334 %s\r\n", challenge)
+		line, tooLong, err := readLine(in)
+		switch {
+		case err != nil:
+			return "", err
+		case tooLong:
+			return "", smtpReply("500 5.5.0 Error: line too long")
+		case line == "*":
+			return "", smtpReply("501 5.7.0 Authentication aborted")
+		}
+		return decode(line)
+	}
+	switch mechanism {
+	case "PLAIN":
+		// authorization identity, NUL, user name, NUL, password
+		resp, err := answer(initial, "")
+		if err != nil {
+			return "", "", err
+		}
+		parts := strings.SplitN(resp, "\x00", 3)
+		if len(parts) != 3 {
+			return "", "", smtpReply("535 5.7.8 Error: authentication failed: authentication failure")
+		}
+		return parts[1], parts[2], nil
+	case "LOGIN":
+		if username, err = answer(initial, "VXNlcm5hbWU6"); err != nil {
+			return "", "", err
+		}
+		if password, err = answer("", "UGFzc3dvcmQ6"); err != nil {
+			return "", "", err
+		}
+		return username, password, nil
+	}
+	return "", "", smtpReply("535 5.7.8 Error: authentication failed: Invalid authentication mechanism")
+}
+
+// fakeService answers HTTP requests with a bland page and otherwise just
+// swallows the stream until the client gives up or the timeout fires.
+func fakeService(in *bufio.Reader, out io.Writer) {
+	if _, err := in.Peek(1); err != nil {
+		return
+	}
+	first, _ := in.Peek(in.Buffered())
+	method, _, _ := bytes.Cut(first, []byte(" "))
+	switch string(method) {
+	case "GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "CONNECT":
+		for {
+			line, _, err := readLine(in)
+			if err != nil || line == "" {
+				break
+			}
+		}
+		body := "<html><head><title>OK</title></head><body>OK</body></html>\n"
+		fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nServer: nginx\r\nDate: %s\r\nContent-Type: text/html\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			time.Now().UTC().Format(http.TimeFormat), len(body), body)
+	default:
+		io.Copy(io.Discard, in)
+	}
+}
@@ -0,0 +1,98 @@
+package emulators
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// smtpSession runs fakeSMTP over the given client lines and returns its
+// replies, one per line, and the credentials it passed on.
+func smtpSession(t *testing.T, lines ...string) ([]string, []string) {
+	t.Helper()
+	var out bytes.Buffer
+	var creds []string
+	in := bufio.NewReaderSize(strings.NewReader(strings.Join(lines, "\r\n")+"\r\n"), forwardMaxLine)
+	fakeSMTP(in, &out, "web01", func(mechanism, username, password string) {
+		creds = append(creds, mechanism+" "+username+" "+password)
+	})
+	return strings.Split(strings.TrimSuffix(out.String(), "\r\n"), "\r\n"), creds
+}
+
+func TestSMTPAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		replies []string // after the greeting
+		creds   []string
+	}{
+		{
+			name:    "login",
+			lines:   []string{"AUTH LOGIN", "dXNlckBleGFtcGxlLmNvbQ==", "c2VjcmV0"},
+			replies: []string{"334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6", "235 2.7.0 Authentication successful"},
+			creds:   []string{"LOGIN user@example.com secret"},
+		},
+		{
+			name:    "login with initial response",
+			lines:   []string{"auth login dXNlckBleGFtcGxlLmNvbQ==", "c2VjcmV0"},
+			replies: []string{"334 UGFzc3dvcmQ6", "235 2.7.0 Authentication successful"},
+			creds:   []string{"LOGIN user@example.com secret"},
+		},
+		{
+			name:    "plain",
+			lines:   []string{"AUTH PLAIN", "AHVzZXJAZXhhbXBsZS5jb20Ac2VjcmV0"},
+			replies: []string{"334 ", "235 2.7.0 Authentication successful"},
+			creds:   []string{"PLAIN user@example.com secret"},
+		},
+		{
+			name:    "plain with initial response",
+			lines:   []string{"AUTH PLAIN AHVzZXJAZXhhbXBsZS5jb20Ac2VjcmV0"},
+			replies: []string{"235 2.7.0 Authentication successful"},
+			creds:   []string{"PLAIN user@example.com secret"},
+		},
+		{
+			name:    "aborted",
+			lines:   []string{"AUTH LOGIN", "*"},
+			replies: []string{"334 VXNlcm5hbWU6", "501 5.7.0 Authentication aborted"},
+		},
+		{
+			name:    "not base64",
+			lines:   []string{"AUTH PLAIN !!!"},
+			replies: []string{"501 5.5.2 Cannot decode response"},
+		},
+		{
+			name:    "unknown mechanism",
+			lines:   []string{"AUTH CRAM-MD5"},
+			replies: []string{"535 5.7.8 Error: authentication failed: Invalid authentication mechanism"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, creds := smtpSession(t, tt.lines...)
+			if !slices.Equal(replies[1:], tt.replies) {
+				t.Errorf("replies = %q, want %q", replies[1:], tt.replies)
+			}
+			if !slices.Equal(creds, tt.creds) {
+				t.Errorf("credentials = %q, want %q", creds, tt.creds)
+			}
+		})
+	}
+}
+
+func TestSMTPLongLines(t *testing.T) {
+	long := strings.Repeat("A", 3*forwardMaxLine)
+	replies, _ := smtpSession(t,
+		"HELO "+long,
+		"DATA",
+		long,
+		long+".",
+		".",
+		"QUIT",
+	)
+	if len(replies) != 5 || replies[1] != "500 5.5.0 Error: line too long" ||
+		!strings.HasPrefix(replies[3], "250 2.0.0 Ok: queued as ") || replies[4] != "221 2.0.0 Bye" {
+		t.Errorf("replies = %q", replies)
+	}
+}
@@ -0,0 +1,72 @@
+package emulators
+
+import (
+	"io"
+	"log"
+	"sync"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/recording"
+)
+
+// connRecording starts the asciicast recording of one SSH connection when its
+// first shell or command runs. Every channel of the connection writes to the
+// same file, named by the session ID.
+type connRecording struct {
+	dir  string // empty disables recording
+	sess *events.Session
+
+	mu     sync.Mutex
+	rec    *recording.Recorder
+	failed bool
+}
+
+// start returns the connection's recorder, creating it with the given
+// terminal on first use, or nil when recording is unavailable.
+func (c *connRecording) start(pty *ptyRequest) *recording.Recorder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rec != nil || c.failed || c.dir == "" {
+		return c.rec
+	}
+	h := recording.Header{Width: 80, Height: 24, Title: c.sess.Src, Env: map[string]string{"SHELL": "/bin/bash"}}
+	if pty != nil {
+		if pty.Width > 0 && pty.Height > 0 {
+			h.Width, h.Height = int(pty.Width), int(pty.Height)
+		}
+		h.Env["TERM"] = pty.Term
+	}
+	rec, err := recording.Create(c.dir, c.sess.ID, h)
+	if err != nil {
+		log.Printf("[SSH] Session %s will not be recorded: %v", c.sess.ID, err)
+		c.failed = true
+		return nil
+	}
+	c.rec = rec
+	return rec
+}
+
+// tee records rw if recording is available.
+func (c *connRecording) tee(rw io.ReadWriter, pty *ptyRequest) io.ReadWriter {
+	if rec := c.start(pty); rec != nil {
+		return rec.Tee(rw)
+	}
+	return rw
+}
+
+func (c *connRecording) resize(width, height uint32) {
+	c.mu.Lock()
+	rec := c.rec
+	c.mu.Unlock()
+	if rec != nil {
+		rec.Resize(int(width), int(height))
+	}
+}
+
+func (c *connRecording) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rec != nil {
+		c.rec.Close()
+	}
+}
@@ -0,0 +1,269 @@
+package emulators
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"strings"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/transform/emulators/shell"
+	"zecx-deploy/internal/transform/emulators/vfs"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Payloads of the session channel requests defined in RFC 4254 section 6.
+type (
+	ptyRequest struct {
+		Term     string
+		Width    uint32
+		Height   uint32
+		PxWidth  uint32
+		PxHeight uint32
+		Modes    string
+	}
+	envRequest struct {
+		Name  string
+		Value string
+	}
+	execRequest struct {
+		Command string
+	}
+	subsystemRequest struct {
+		Name string
+	}
+	windowChangeRequest struct {
+		Width    uint32
+		Height   uint32
+		PxWidth  uint32
+		PxHeight uint32
+	}
+	signalRequest struct {
+		Signal string
+	}
+	exitSignalMessage struct {
+		Signal     string
+		CoreDumped bool
+		Message    string
+		Lang       string
+	}
+)
+
+// maxEnvVars caps how many environment variables a client may set.
+const maxEnvVars = 64
+
+// sshSession is the state of one "session" channel.
+type sshSession struct {
+	srv     *sshServer
+	conn    *ssh.ServerConn
+	sess    *events.Session
+	fs      *vfs.FS
+	rec     *connRecording
+	channel ssh.Channel
+
+	pty    *ptyRequest
+	env    map[string]string
+	shell  *shell.Shell
+	active bool // a shell, exec or subsystem has been started
+}
+
+// handleSession serves one "session" channel, answering the standard session
+// requests and running the fake shell for shell and exec requests.
+func (srv *sshServer) handleSession(conn *ssh.ServerConn, sess *events.Session, fsys *vfs.FS, rec *connRecording, newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Printf("[SSH] Could not accept channel: %v", err)
+		return
+	}
+	defer channel.Close()
+
+	s := &sshSession{srv: srv, conn: conn, sess: sess, fs: fsys, rec: rec, channel: channel, env: make(map[string]string)}
+	for req := range requests {
+		ok := s.handleRequest(req)
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// handleRequest processes one channel request and reports whether it succeeded.
+func (s *sshSession) handleRequest(req *ssh.Request) bool {
+	switch req.Type {
+	case "pty-req":
+		var p ptyRequest
+		if err := ssh.Unmarshal(req.Payload, &p); err != nil || s.active {
+			return false
+		}
+		s.pty = &p
+		return true
+
+	case "env":
+		var e envRequest
+		if err := ssh.Unmarshal(req.Payload, &e); err != nil || len(s.env) >= maxEnvVars {
+			return false
+		}
+		s.env[e.Name] = e.Value
+		return true
+
+	case "window-change":
+		var w windowChangeRequest
+		if err := ssh.Unmarshal(req.Payload, &w); err != nil {
+			return false
+		}
+		if s.pty != nil {
+			s.pty.Width, s.pty.Height = w.Width, w.Height
+		}
+		s.rec.resize(w.Width, w.Height)
+		if s.shell != nil {
+			s.shell.Resize(int(w.Width), int(w.Height))
+		}
+		return true
+
+	case "shell":
+		if s.active {
+			return false
+		}
+		s.active = true
+		s.publishMetadata("shell", "")
+		sh := s.newShell()
+		stream := s.rec.tee(s.channel, s.pty)
+		go func() {
+			var status int
+			if s.pty != nil {
+				status = sh.Run(stream)
+			} else {
+				status = sh.RunScript(stream, stream)
+			}
+			s.exit(status)
+		}()
+		return true
+
+	case "exec":
+		var e execRequest
+		if err := ssh.Unmarshal(req.Payload, &e); err != nil || s.active {
+			return false
+		}
+		s.active = true
+		s.publishMetadata("exec", e.Command)
+		if mode, target, recursive, ok := scpCommand(e.Command); ok {
+			go s.runSCP(mode, target, recursive)
+			return true
+		}
+		go s.exec(s.newShell(), s.rec.tee(s.channel, s.pty), e.Command)
+		return true
+
+	case "subsystem":
+		var sub subsystemRequest
+		if err := ssh.Unmarshal(req.Payload, &sub); err != nil || s.active {
+			return false
+		}
+		s.publishMetadata("subsystem", sub.Name)
+		if sub.Name != "sftp" {
+			log.Printf("[SSH] Unsupported subsystem %q requested from %s", sub.Name, s.sess.Src)
+			return false
+		}
+		s.active = true
+		go s.serveSFTP()
+		return true
+
+	case "signal":
+		var sig signalRequest
+		if err := ssh.Unmarshal(req.Payload, &sig); err != nil {
+			return false
+		}
+		switch sig.Signal {
+		case "KILL", "TERM", "HUP", "INT":
+			if s.active {
+				s.channel.SendRequest("exit-signal", false, ssh.Marshal(&exitSignalMessage{Signal: sig.Signal}))
+				s.channel.Close()
+			}
+		}
+		return true
+
+	default:
+		log.Printf("[SSH] Unhandled request type %s from %s, payload %q", req.Type, s.sess.Src, req.Payload)
+		return false
+	}
+}
+
+// newShell creates the shell for this session, applying the client's terminal and environment.
+func (s *sshSession) newShell() *shell.Shell {
+	sh := shell.New(shell.Config{
+		User:    s.conn.User(),
+		Persona: s.srv.persona,
+		FS:      s.fs,
+		Session: s.sess,
+		Fetcher: s.srv.fetcher,
+		Samples: s.srv.samples,
+	})
+	for k, v := range s.env {
+		sh.Setenv(k, v)
+	}
+	if s.pty != nil {
+		if s.pty.Term != "" {
+			sh.Setenv("TERM", s.pty.Term)
+		}
+		sh.Resize(int(s.pty.Width), int(s.pty.Height))
+	}
+	s.shell = sh
+	return sh
+}
+
+// exec runs a single command line the way "bash -c" would. A bare shell name
+// reads the script from the client's stdin instead, as bots often do.
+func (s *sshSession) exec(sh *shell.Shell, stream io.ReadWriter, command string) {
+	var out io.Writer = stream
+	if s.pty != nil {
+		out = crlfWriter{stream}
+	}
+	var status int
+	switch strings.TrimSpace(command) {
+	case "sh", "bash", "/bin/sh", "/bin/bash", "sh -s", "bash -s":
+		status = sh.RunScript(stream, out)
+	default:
+		status = sh.Execute(command, out)
+	}
+	s.exit(status)
+}
+
+// exit reports the exit status and closes the channel.
+func (s *sshSession) exit(status int) {
+	sendExitStatus(s.channel, status)
+	s.channel.CloseWrite()
+	s.channel.Close()
+}
+
+func (s *sshSession) publishMetadata(request, command string) {
+	m := &events.SessionMetadata{Meta: s.sess.Meta(), Request: request, Command: command}
+	if s.pty != nil {
+		m.Term, m.Width, m.Height = s.pty.Term, s.pty.Width, s.pty.Height
+	}
+	if len(s.env) > 0 {
+		m.Env = make(map[string]string, len(s.env))
+		for k, v := range s.env {
+			m.Env[k] = v
+		}
+	}
+	events.Publish(m)
+}
+
+// sendExitStatus reports a command's exit code to the client (RFC 4254 6.10).
+func sendExitStatus(channel ssh.Channel, status int) {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(status))
+	channel.SendRequest("exit-status", false, payload[:])
+}
+
+// crlfWriter translates "\n" to "\r\n" for output to a pseudo-terminal.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
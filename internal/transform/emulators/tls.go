@@ -0,0 +1,38 @@
+package emulators
+
+import (
+	"bufio"
+	"net"
+
+	"zecx-deploy/internal/events"
+	"zecx-deploy/internal/tlsfp"
+)
+
+// bufferedConn reads through r, which may already hold bytes read from
+// Conn, so that a protocol can switch to TLS mid-stream.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// tlsClient converts a parsed ClientHello into its event form.
+func tlsClient(ch *tlsfp.ClientHello) *events.TLSClient {
+	if ch == nil {
+		return nil
+	}
+	ja3String, ja3 := ch.JA3()
+	return &events.TLSClient{
+		JA3:          ja3,
+		JA3String:    ja3String,
+		JA4:          ch.JA4(),
+		Version:      ch.Version,
+		ServerName:   ch.ServerName,
+		ALPN:         ch.ALPN,
+		CipherSuites: ch.CipherSuites,
+		Extensions:   ch.Extensions,
+	}
+}
@@ -0,0 +1,401 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node is a file or directory in the virtual filesystem.
+type Node struct {
+	Name    string
+	Mode    fs.FileMode
+	Owner   string
+	Group   string
+	ModTime time.Time
+	Data    []byte
+
+	children map[string]*Node
+}
+
+// IsDir reports whether the node is a directory.
+func (n *Node) IsDir() bool { return n.Mode.IsDir() }
+
+// IsSymlink reports whether the node is a symbolic link; its Data holds the target.
+func (n *Node) IsSymlink() bool { return n.Mode&fs.ModeSymlink != 0 }
+
+// Size returns the length of a file, or the conventional 4096 for directories.
+func (n *Node) Size() int64 {
+	if n.IsDir() {
+		return 4096
+	}
+	return int64(len(n.Data))
+}
+
+// FS is an in-memory filesystem presented to attackers. It never touches the
+// host: everything an attacker creates lives only in memory.
+type FS struct {
+	mu   sync.RWMutex
+	root *Node
+	used int64 // bytes of file and link data
+	max  int64 // cap on used set by SetBudget, 0 for none
+}
+
+// New returns a filesystem containing only the root directory.
+func New() *FS {
+	return &FS{root: &Node{Name: "/", Mode: fs.ModeDir | 0755, Owner: "root", Group: "root", ModTime: time.Now()}}
+}
+
+// SetBudget lets the files grow by at most n more bytes in total; writes
+// beyond that fail with ErrNoSpace. A session sets it on its clone so that
+// every way of uploading draws on the same allowance.
+func (f *FS) SetBudget(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.max = f.used + n
+}
+
+// Room returns how many more bytes the files may grow by, or
+// math.MaxInt64 when there is no budget.
+func (f *FS) Room() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.max == 0 {
+		return math.MaxInt64
+	}
+	return max(f.max-f.used, 0)
+}
+
+// grow accounts for n more bytes of data, failing if the budget is spent.
+func (f *FS) grow(n int64) error {
+	if f.max != 0 && n > 0 && f.used+n > f.max {
+		return ErrNoSpace
+	}
+	f.used += n
+	return nil
+}
+
+// Clean resolves p relative to cwd into an absolute, cleaned path.
+func Clean(cwd, p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(cwd, p)
+	}
+	return path.Clean("/" + p)
+}
+
+// maxLinks bounds how many symbolic links a lookup follows, as the kernel's ELOOP limit does.
+const maxLinks = 40
+
+// lookup walks to the node at the absolute path p, following symbolic links.
+func (f *FS) lookup(p string) (*Node, error) {
+	return f.walk(p, true, 0)
+}
+
+// walk walks to the node at the absolute path p. Symbolic links in the
+// directories on the way are always followed; follow decides whether a
+// link at the end is too. hops counts the links followed so far.
+func (f *FS) walk(p string, follow bool, hops int) (*Node, error) {
+	n, dir := f.root, "/"
+	parts := strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if !n.IsDir() {
+			return nil, fs.ErrInvalid
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		dir = path.Join(dir, part)
+		if child.IsSymlink() && (follow || i < len(parts)-1) {
+			if hops == maxLinks {
+				return nil, ErrLoop
+			}
+			target := f.target(dir, child)
+			var err error
+			if child, err = f.walk(target, true, hops+1); err != nil {
+				return nil, err
+			}
+			dir = target
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// target resolves the link n found at p into an absolute path.
+func (f *FS) target(p string, n *Node) string {
+	return Clean(path.Dir(p), string(n.Data))
+}
+
+// Stat returns the node at p, following symbolic links.
+func (f *FS) Stat(p string) (*Node, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.lookup(p)
+}
+
+// Lstat returns the node at p; a symbolic link there is returned itself.
+func (f *FS) Lstat(p string) (*Node, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.walk(p, false, 0)
+}
+
+// ReadFile returns the contents of the file at p.
+func (f *FS) ReadFile(p string) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	n, err := f.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return nil, ErrIsDir
+	}
+	return append([]byte(nil), n.Data...), nil
+}
+
+// ReadDir returns the entries of the directory at p sorted by name.
+func (f *FS) ReadDir(p string) ([]*Node, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	n, err := f.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDir() {
+		return nil, ErrNotDir
+	}
+	out := make([]*Node, 0, len(n.children))
+	for _, c := range n.children {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// MkdirAll creates the directory p and any missing parents.
+func (f *FS) MkdirAll(p string, mode fs.FileMode, owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.mkdirAll(p, mode, owner)
+	return err
+}
+
+func (f *FS) mkdirAll(p string, mode fs.FileMode, owner string) (*Node, error) {
+	n, dir := f.root, "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		child, ok := n.children[part]
+		if ok && child.IsSymlink() {
+			var err error
+			if child, err = f.lookup(dir); err != nil {
+				return nil, err
+			}
+		}
+		if !ok {
+			child = &Node{Name: part, Mode: fs.ModeDir | mode.Perm(), Owner: owner, Group: owner, ModTime: time.Now()}
+			n.add(child)
+		} else if !child.IsDir() {
+			return nil, ErrNotDir
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// WriteFile creates or replaces the file at p, creating parent directories.
+// Writing to a symbolic link writes to the file it points to.
+func (f *FS) WriteFile(p string, data []byte, mode fs.FileMode, owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = path.Clean(p)
+	for hops := 0; ; hops++ {
+		dir, err := f.mkdirAll(path.Dir(p), 0755, owner)
+		if err != nil {
+			return err
+		}
+		name := path.Base(p)
+		existing, ok := dir.children[name]
+		switch {
+		case ok && existing.IsSymlink():
+			if hops == maxLinks {
+				return ErrLoop
+			}
+			p = f.target(p, existing)
+			continue
+		case ok && existing.IsDir():
+			return ErrIsDir
+		}
+		old := 0
+		if ok {
+			old = len(existing.Data)
+		}
+		if err := f.grow(int64(len(data) - old)); err != nil {
+			return err
+		}
+		dir.add(&Node{Name: name, Mode: mode.Perm(), Owner: owner, Group: owner, ModTime: time.Now(), Data: append([]byte(nil), data...)})
+		return nil
+	}
+}
+
+// Symlink creates a symbolic link at p pointing to target.
+func (f *FS) Symlink(target, p, owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = path.Clean(p)
+	dir, err := f.lookup(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if !dir.IsDir() {
+		return ErrNotDir
+	}
+	if _, ok := dir.children[path.Base(p)]; ok {
+		return fs.ErrExist
+	}
+	if err := f.grow(int64(len(target))); err != nil {
+		return err
+	}
+	dir.add(&Node{Name: path.Base(p), Mode: fs.ModeSymlink | 0777, Owner: owner, Group: owner, ModTime: time.Now(), Data: []byte(target)})
+	return nil
+}
+
+// Remove deletes the file or empty directory at p.
+func (f *FS) Remove(p string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = path.Clean(p)
+	if p == "/" {
+		return fs.ErrPermission
+	}
+	parent, err := f.lookup(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	n, ok := parent.children[path.Base(p)]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if n.IsDir() && len(n.children) > 0 {
+		return ErrNotEmpty
+	}
+	delete(parent.children, n.Name)
+	f.used -= n.bytes()
+	return nil
+}
+
+// RemoveAll deletes the node at p and everything below it.
+func (f *FS) RemoveAll(p string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = path.Clean(p)
+	if p == "/" {
+		return fs.ErrPermission
+	}
+	parent, err := f.lookup(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	n, ok := parent.children[path.Base(p)]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	delete(parent.children, n.Name)
+	f.used -= n.bytes()
+	return nil
+}
+
+// Rename moves the node at oldPath to newPath.
+func (f *FS) Rename(oldPath, newPath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldPath, newPath = path.Clean(oldPath), path.Clean(newPath)
+	oldParent, err := f.lookup(path.Dir(oldPath))
+	if err != nil {
+		return err
+	}
+	n, ok := oldParent.children[path.Base(oldPath)]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	newParent, err := f.lookup(path.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	if !newParent.IsDir() {
+		return ErrNotDir
+	}
+	if replaced, ok := newParent.children[path.Base(newPath)]; ok && replaced != n {
+		f.used -= replaced.bytes()
+	}
+	delete(oldParent.children, n.Name)
+	n.Name = path.Base(newPath)
+	newParent.add(n)
+	return nil
+}
+
+// Chmod changes the permission bits of the node at p.
+func (f *FS) Chmod(p string, mode fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.lookup(p)
+	if err != nil {
+		return err
+	}
+	n.Mode = n.Mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+// Clone returns a deep copy so that one session's changes are invisible to others.
+func (f *FS) Clone() *FS {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &FS{root: f.root.clone(), used: f.used}
+}
+
+func (n *Node) add(child *Node) {
+	if n.children == nil {
+		n.children = make(map[string]*Node)
+	}
+	n.children[child.Name] = child
+}
+
+// bytes returns the data held by n and everything below it.
+func (n *Node) bytes() int64 {
+	total := int64(len(n.Data))
+	for _, c := range n.children {
+		total += c.bytes()
+	}
+	return total
+}
+
+func (n *Node) clone() *Node {
+	c := *n
+	c.Data = append([]byte(nil), n.Data...)
+	c.children = nil
+	for _, child := range n.children {
+		c.add(child.clone())
+	}
+	return &c
+}
+
+// Errors returned in addition to the io/fs sentinels.
+var (
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotDir   = errors.New("not a directory")
+	ErrNotEmpty = errors.New("directory not empty")
+	ErrLoop     = errors.New("too many levels of symbolic links")
+	ErrNoSpace  = errors.New("no space left on device")
+)
@@ -0,0 +1,58 @@
+package vfs
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestBudget(t *testing.T) {
+	f := New()
+	f.WriteFile("/etc/motd", make([]byte, 100), 0644, "root")
+	if f.Room() != math.MaxInt64 {
+		t.Fatalf("Room without a budget = %d", f.Room())
+	}
+
+	// The budget counts from the tree as it is, so the seeded files are free.
+	f.SetBudget(10)
+	if err := f.WriteFile("/tmp/a", []byte("0123456"), 0644, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteFile("/tmp/b", []byte("0123"), 0644, "root"); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("write past the budget: %v, want ErrNoSpace", err)
+	}
+	if _, err := f.Stat("/tmp/b"); err == nil {
+		t.Error("refused write created the file")
+	}
+	// Replacing a file only draws the difference.
+	if err := f.WriteFile("/tmp/a", []byte("0123456789"), 0644, "root"); err != nil {
+		t.Errorf("growing a file within the budget: %v", err)
+	}
+	if f.Room() != 0 {
+		t.Errorf("Room = %d, want 0", f.Room())
+	}
+
+	// Removing files gives the room back, however they go.
+	if err := f.Remove("/tmp/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteFile("/tmp/c/d", []byte("0123456789"), 0644, "root"); err != nil {
+		t.Fatalf("write after Remove: %v", err)
+	}
+	if err := f.RemoveAll("/tmp/c"); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteFile("/tmp/e", []byte("01234"), 0644, "root")
+	f.WriteFile("/tmp/f", []byte("01234"), 0644, "root")
+	if err := f.Rename("/tmp/e", "/tmp/f"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Room() != 5 {
+		t.Errorf("Room after renaming over a file = %d, want 5", f.Room())
+	}
+
+	// Each clone gets its own budget.
+	if c := f.Clone(); c.Room() != math.MaxInt64 {
+		t.Errorf("clone Room = %d", c.Room())
+	}
+}
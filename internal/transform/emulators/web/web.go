@@ -0,0 +1,325 @@
+package web
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed sites
+var bundle embed.FS
+
+// maxFormBytes bounds the request body read when capturing a login.
+const maxFormBytes = 64 * 1024
+
+// Site is one persona from the embedded bundle: its pages, headers and
+// cookies, and which of its routes take credentials.
+type Site struct {
+	Name  string
+	files fs.FS
+	m     manifest
+	html  map[string]*htmltemplate.Template
+	text  map[string]*texttemplate.Template
+}
+
+// manifest is a site's site.json.
+type manifest struct {
+	Headers  map[string]string `json:"headers"`
+	Cookies  []cookie          `json:"cookies"`
+	Routes   []route           `json:"routes"`
+	NotFound string            `json:"not_found"`
+}
+
+type cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path"`
+	HttpOnly bool   `json:"http_only"`
+	// Random replaces Value with this many random bytes in hex, per visitor.
+	Random int `json:"random"`
+}
+
+type route struct {
+	Path string `json:"path"`
+	// Prefix makes the route match everything below Path as well.
+	Prefix      bool   `json:"prefix"`
+	File        string `json:"file"`
+	ContentType string `json:"content_type"`
+	Status      int    `json:"status"`
+	Redirect    string `json:"redirect"`
+	// BasicAuth is a realm; the route answers 401 and captures any
+	// credentials sent with the request.
+	BasicAuth string `json:"basic_auth"`
+	Login     *login `json:"login"`
+}
+
+// login describes a route that takes credentials in a POST. Every attempt
+// fails: the Failure page is rendered, or the client redirected.
+type login struct {
+	// Username and Password name the form fields.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Failure  string `json:"failure"`
+	Redirect string `json:"redirect"`
+	// XMLRPC reads the credentials from a WordPress XML-RPC call instead.
+	XMLRPC bool `json:"xmlrpc"`
+}
+
+// Names lists the personas in the bundle.
+func Names() []string {
+	entries, _ := bundle.ReadDir("sites")
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load parses the named persona and its templates.
+func Load(name string) (*Site, error) {
+	files, err := fs.Sub(bundle, path.Join("sites", name))
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(files, "site.json")
+	if err != nil {
+		return nil, fmt.Errorf("unknown HTTP persona %q (have %s)", name, strings.Join(Names(), ", "))
+	}
+	s := &Site{
+		Name:  name,
+		files: files,
+		html:  map[string]*htmltemplate.Template{},
+		text:  map[string]*texttemplate.Template{},
+	}
+	if err := json.Unmarshal(data, &s.m); err != nil {
+		return nil, fmt.Errorf("persona %s: %w", name, err)
+	}
+	pages := []string{s.m.NotFound}
+	for _, r := range s.m.Routes {
+		pages = append(pages, r.File)
+		if r.Login != nil {
+			pages = append(pages, r.Login.Failure)
+		}
+	}
+	for _, p := range pages {
+		if err := s.parse(p); err != nil {
+			return nil, fmt.Errorf("persona %s: %w", name, err)
+		}
+	}
+	return s, nil
+}
+
+// parse compiles a page as a template according to its type; other files
+// are served as they are.
+func (s *Site) parse(name string) error {
+	if name == "" || s.html[name] != nil || s.text[name] != nil {
+		return nil
+	}
+	data, err := fs.ReadFile(s.files, name)
+	if err != nil {
+		return err
+	}
+	switch path.Ext(name) {
+	case ".html":
+		s.html[name], err = htmltemplate.New(name).Parse(string(data))
+	case ".txt", ".xml", ".json":
+		s.text[name], err = texttemplate.New(name).Parse(string(data))
+	}
+	return err
+}
+
+// page is what templates see.
+type page struct {
+	Hostname string // the persona's hostname
+	Host     string // the Host header of the request
+	Path     string
+	Query    string
+	// Username is what the last login attempt submitted, for pages that
+	// echo it back.
+	Username string
+	Failed   bool
+	Year     int
+	// Token is random per response, for CSRF fields and nonces.
+	Token string
+}
+
+// Server serves a site. OnLogin is called with every credential pair a
+// client submits; method is "http-form", "http-basic" or "xmlrpc".
+type Server struct {
+	Site     *Site
+	Hostname string
+	OnLogin  func(r *http.Request, method, username, password string)
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	site := srv.Site
+	for k, v := range site.m.Headers {
+		w.Header().Set(k, v)
+	}
+	for _, c := range site.m.Cookies {
+		if _, err := r.Cookie(c.Name); err == nil {
+			continue
+		}
+		value := c.Value
+		if c.Random > 0 {
+			value = randomHex(c.Random)
+		}
+		http.SetCookie(w, &http.Cookie{Name: c.Name, Value: value, Path: c.Path, HttpOnly: c.HttpOnly})
+	}
+
+	p := srv.page(r)
+	rt := site.match(r.URL.Path)
+	if rt == nil {
+		site.render(w, site.m.NotFound, http.StatusNotFound, "", p)
+		return
+	}
+	status := rt.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	switch {
+	case rt.BasicAuth != "":
+		if user, pass, ok := r.BasicAuth(); ok {
+			srv.login(r, "http-basic", user, pass)
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", rt.BasicAuth))
+		site.render(w, rt.File, http.StatusUnauthorized, rt.ContentType, p)
+		return
+	case rt.Login != nil && r.Method == http.MethodPost:
+		user, pass := srv.credentials(w, r, rt.Login)
+		method := "http-form"
+		if rt.Login.XMLRPC {
+			method = "xmlrpc"
+		}
+		if user != "" || pass != "" {
+			srv.login(r, method, user, pass)
+		}
+		p.Username, p.Failed = user, true
+		if rt.Login.Redirect != "" {
+			http.Redirect(w, r, rt.Login.Redirect, http.StatusFound)
+			return
+		}
+		site.render(w, rt.Login.Failure, http.StatusOK, "", p)
+		return
+	case rt.Redirect != "":
+		if status == http.StatusOK {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, expand(rt.Redirect, r), status)
+		return
+	}
+	site.render(w, rt.File, status, rt.ContentType, p)
+}
+
+func (srv *Server) page(r *http.Request) page {
+	return page{
+		Hostname: srv.Hostname,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Year:     time.Now().Year(),
+		Token:    randomHex(16),
+	}
+}
+
+func (srv *Server) login(r *http.Request, method, user, pass string) {
+	if srv.OnLogin != nil {
+		srv.OnLogin(r, method, user, pass)
+	}
+}
+
+// xmlrpcString matches the string parameters of a method call, which may
+// or may not be wrapped in <string>.
+var xmlrpcString = regexp.MustCompile(`<value>\s*(?:<string>)?([^<]*)(?:</string>)?\s*</value>`)
+
+// credentials reads the username and password a login route was sent.
+func (srv *Server) credentials(w http.ResponseWriter, r *http.Request, l *login) (string, string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+	if !l.XMLRPC {
+		r.ParseForm()
+		return r.PostForm.Get(l.Username), r.PostForm.Get(l.Password)
+	}
+	// wp.getUsersBlogs and the other methods brute-forcers use take the
+	// username and password as their first two strings.
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	m := xmlrpcString.FindAllStringSubmatch(body.String(), 2)
+	if len(m) < 2 {
+		return "", ""
+	}
+	return unescapeXML(m[0][1]), unescapeXML(m[1][1])
+}
+
+var xmlUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&quot;", `"`, "&apos;", "'", "&amp;", "&")
+
+func unescapeXML(s string) string {
+	return xmlUnescaper.Replace(s)
+}
+
+// match finds the route for p: an exact path first, then the longest prefix.
+func (s *Site) match(p string) *route {
+	var best *route
+	for i := range s.m.Routes {
+		rt := &s.m.Routes[i]
+		switch {
+		case rt.Path == p:
+			return rt
+		case rt.Prefix && strings.HasPrefix(p, rt.Path) && (best == nil || len(rt.Path) > len(best.Path)):
+			best = rt
+		}
+	}
+	return best
+}
+
+// render writes a page, executing it first if it is a template.
+func (s *Site) render(w http.ResponseWriter, name string, status int, contentType string, p page) {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" || strings.HasPrefix(contentType, "text/html") {
+		contentType = "text/html; charset=UTF-8"
+	}
+	var body bytes.Buffer
+	switch {
+	case name == "":
+	case s.html[name] != nil:
+		s.html[name].Execute(&body, p)
+	case s.text[name] != nil:
+		s.text[name].Execute(&body, p)
+	default:
+		data, _ := fs.ReadFile(s.files, name)
+		body.Write(data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// expand fills in a redirect target: {path} is the request path and {from}
+// the query-escaped request URI, as in Jenkins' /login?from=%2Fmanage.
+func expand(target string, r *http.Request) string {
+	return strings.NewReplacer("{path}", r.URL.Path, "{from}", url.QueryEscape(r.URL.RequestURI())).Replace(target)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,235 @@
+package firewall
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zecx-deploy/internal/config"
+)
+
+// OutputChain is the filter chain that holds the iptables egress policy.
+const OutputChain = "ZECX-OUTPUT"
+
+// egressLogPrefix marks the kernel log lines of refused connections.
+const egressLogPrefix = "zecx-egress: "
+
+// Egress is the outbound policy applied to the honeypot's own processes,
+// selected by UID or by cgroup v2 path.
+type Egress struct {
+	UID    string
+	Cgroup string
+	// Allow are the destinations reachable besides DNS and loopback.
+	Allow []Destination
+	// Rate lets other new TCP connections through at this rate, such as
+	// "10/minute"; empty drops them all.
+	Rate string
+	Log  bool
+}
+
+// Destination is an address range and, unless Port is 0, a TCP/UDP port.
+type Destination struct {
+	Net  *net.IPNet
+	Port int
+}
+
+func (d Destination) String() string {
+	if d.Port == 0 {
+		return d.Net.String()
+	}
+	return net.JoinHostPort(d.Net.String(), strconv.Itoa(d.Port))
+}
+
+var rateSyntax = regexp.MustCompile(`^[0-9]+/(second|minute|hour|day)$`)
+
+// NewEgress builds the policy cfg.Egress describes, allowing the dashboard
+// endpoint. It returns nil when the policy is disabled or there is no safe
+// way to select the honeypot's processes.
+func NewEgress(cfg *config.Config) (*Egress, error) {
+	ec := cfg.Egress
+	if !ec.Enabled {
+		return nil, nil
+	}
+	e := &Egress{UID: ec.User, Cgroup: strings.Trim(ec.Cgroup, "/"), Rate: ec.RateLimit, Log: ec.Log}
+	if e.Rate != "" && !rateSyntax.MatchString(e.Rate) {
+		return nil, fmt.Errorf("egress rate_limit %q is not like \"10/minute\"", e.Rate)
+	}
+	if e.UID == "" && e.Cgroup == "" {
+		e.Cgroup = ownService()
+	}
+	if e.UID == "" && e.Cgroup == "" {
+		if os.Getuid() == 0 {
+			log.Println("Egress containment skipped: running as root outside a systemd service, set egress.user or egress.cgroup to select the honeypot's processes.")
+			return nil, nil
+		}
+		e.UID = strconv.Itoa(os.Getuid())
+	}
+
+	if u := cfg.Tunnel.DashboardURL; u != "" {
+		dests, err := dashboardDestinations(u)
+		if err != nil {
+			// Without it the tunnel is cut off, but the events stay in the
+			// spool and the honeypot is still contained.
+			log.Printf("Egress containment will block the dashboard: %v", err)
+		}
+		e.Allow = append(e.Allow, dests...)
+	}
+	for _, a := range ec.Allow {
+		dests, err := parseDestination(a)
+		if err != nil {
+			return nil, fmt.Errorf("egress allow entry %q: %w", a, err)
+		}
+		e.Allow = append(e.Allow, dests...)
+	}
+	return e, nil
+}
+
+// ownService returns the cgroup v2 path of this process when it is a
+// systemd service, which contains nothing but the honeypot.
+func ownService() string {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::/"); ok && strings.HasSuffix(path, ".service") {
+			return path
+		}
+	}
+	return ""
+}
+
+func dashboardDestinations(rawURL string) ([]Destination, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "ws" || u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return parseDestination(net.JoinHostPort(u.Hostname(), port))
+}
+
+// parseDestination reads an address, CIDR or host name, optionally with a
+// port. Host names are resolved now; the rules hold addresses.
+func parseDestination(s string) ([]Destination, error) {
+	host, port := s, 0
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		if port, err = strconv.Atoi(p); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		host = h
+	}
+	if _, n, err := net.ParseCIDR(host); err == nil {
+		return []Destination{{Net: n, Port: port}}, nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+	}
+	var dests []Destination
+	for _, ip := range ips {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		dests = append(dests, Destination{Net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, Port: port})
+	}
+	return dests, nil
+}
+
+// selector describes the processes the policy applies to, for logs.
+func (e *Egress) selector() string {
+	if e.Cgroup != "" {
+		return "cgroup " + e.Cgroup
+	}
+	return "UID " + e.UID
+}
+
+// iptablesMatch is the OUTPUT match that selects the honeypot's processes.
+func (e *Egress) iptablesMatch() string {
+	if e.Cgroup != "" {
+		return "-m cgroup --path " + e.Cgroup
+	}
+	return "-m owner --uid-owner " + e.UID
+}
+
+// iptablesRules renders the body of OutputChain for iptables, or for
+// ip6tables when ip6 is set; each gets the Allow entries of its own
+// family. Allowed traffic returns to OUTPUT rather than being accepted, so
+// the host's own rules still apply to it.
+func (e *Egress) iptablesRules(ip6 bool) []string {
+	rules := []string{
+		"-m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-o lo -j RETURN",
+		"-p udp -m udp --dport 53 -j RETURN",
+		"-p tcp -m tcp --dport 53 -j RETURN",
+	}
+	for _, d := range e.Allow {
+		if (d.Net.IP.To4() == nil) != ip6 {
+			continue
+		}
+		if d.Port == 0 {
+			rules = append(rules, "-d "+d.Net.String()+" -j RETURN")
+			continue
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			rules = append(rules, fmt.Sprintf("-d %s -p %s -m %s --dport %d -j RETURN", d.Net, proto, proto, d.Port))
+		}
+	}
+	if e.Log {
+		rules = append(rules, `-p tcp -m tcp --tcp-flags SYN,ACK SYN -m limit --limit 10/minute -j LOG --log-prefix "`+egressLogPrefix+`"`)
+	}
+	if e.Rate != "" {
+		rules = append(rules, "-p tcp -m tcp --tcp-flags SYN,ACK SYN -m limit --limit "+e.Rate+" -j RETURN")
+	}
+	return append(rules, "-j DROP")
+}
+
+// nftMatch is the output match that selects the honeypot's processes.
+func (e *Egress) nftMatch() string {
+	if e.Cgroup != "" {
+		return fmt.Sprintf("socket cgroupv2 level %d %q", strings.Count(e.Cgroup, "/")+1, e.Cgroup)
+	}
+	return "meta skuid " + e.UID
+}
+
+// nftRules renders the body of the egress chain, in the inet family so it
+// covers IPv4 and IPv6 alike.
+func (e *Egress) nftRules() []string {
+	rules := []string{
+		"ct state established,related return",
+		`oifname "lo" return`,
+		"meta l4proto { tcp, udp } th dport 53 return",
+	}
+	for _, d := range e.Allow {
+		family := "ip6"
+		if d.Net.IP.To4() != nil {
+			family = "ip"
+		}
+		rule := fmt.Sprintf("%s daddr %s", family, d.Net)
+		if d.Port != 0 {
+			rule += fmt.Sprintf(" meta l4proto { tcp, udp } th dport %d", d.Port)
+		}
+		rules = append(rules, rule+" return")
+	}
+	if e.Log {
+		rules = append(rules, fmt.Sprintf("tcp flags & (syn | ack) == syn limit rate 10/minute log prefix %q", egressLogPrefix))
+	}
+	if e.Rate != "" {
+		rules = append(rules, "tcp flags & (syn | ack) == syn limit rate "+e.Rate+" return")
+	}
+	return append(rules, "drop")
+}
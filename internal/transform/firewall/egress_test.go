@@ -0,0 +1,128 @@
+package firewall
+
+import (
+	"slices"
+	"testing"
+
+	"zecx-deploy/internal/config"
+)
+
+// testEgress is a policy for UID 1000 that allows the dashboard and a few
+// destinations, without resolving any names.
+func testEgress(t *testing.T) *Egress {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Tunnel.DashboardURL = "wss://192.0.2.10:9443/ingest"
+	cfg.Egress = config.Egress{
+		Enabled:   true,
+		User:      "1000",
+		Allow:     []string{"203.0.113.0/24", "198.51.100.7:8080", "[2001:db8::1]:443"},
+		RateLimit: "10/minute",
+		Log:       true,
+	}
+	e, err := NewEgress(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestNewEgress(t *testing.T) {
+	e := testEgress(t)
+	var allow []string
+	for _, d := range e.Allow {
+		allow = append(allow, d.String())
+	}
+	want := []string{"192.0.2.10/32:9443", "203.0.113.0/24", "198.51.100.7/32:8080", "[2001:db8::1/128]:443"}
+	if !slices.Equal(allow, want) {
+		t.Errorf("allow = %q, want %q", allow, want)
+	}
+	if e.selector() != "UID 1000" || e.Rate != "10/minute" || !e.Log {
+		t.Errorf("egress = %+v", e)
+	}
+
+	cfg := config.Default()
+	cfg.Egress.Enabled = false
+	if e, err := NewEgress(cfg); e != nil || err != nil {
+		t.Errorf("disabled: got %+v, %v", e, err)
+	}
+
+	for _, ec := range []config.Egress{
+		{Enabled: true, User: "1000", RateLimit: "lots"},
+		{Enabled: true, User: "1000", Allow: []string{"192.0.2.1:http"}},
+		{Enabled: true, User: "1000", Allow: []string{"192.0.2.1:70000"}},
+	} {
+		cfg.Egress = ec
+		if _, err := NewEgress(cfg); err == nil {
+			t.Errorf("%+v: no error", ec)
+		}
+	}
+}
+
+func TestEgressCgroup(t *testing.T) {
+	cfg := config.Default()
+	cfg.Egress = config.Egress{Enabled: true, Cgroup: "/system.slice/zecx.service/"}
+	e, err := NewEgress(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.iptablesMatch(); got != "-m cgroup --path system.slice/zecx.service" {
+		t.Errorf("iptables match = %q", got)
+	}
+	if got := e.nftMatch(); got != `socket cgroupv2 level 2 "system.slice/zecx.service"` {
+		t.Errorf("nft match = %q", got)
+	}
+}
+
+func TestEgressIPTablesRules(t *testing.T) {
+	want := []string{
+		"-m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-o lo -j RETURN",
+		"-p udp -m udp --dport 53 -j RETURN",
+		"-p tcp -m tcp --dport 53 -j RETURN",
+		"-d 192.0.2.10/32 -p tcp -m tcp --dport 9443 -j RETURN",
+		"-d 192.0.2.10/32 -p udp -m udp --dport 9443 -j RETURN",
+		"-d 203.0.113.0/24 -j RETURN",
+		"-d 198.51.100.7/32 -p tcp -m tcp --dport 8080 -j RETURN",
+		"-d 198.51.100.7/32 -p udp -m udp --dport 8080 -j RETURN",
+		`-p tcp -m tcp --tcp-flags SYN,ACK SYN -m limit --limit 10/minute -j LOG --log-prefix "zecx-egress: "`,
+		"-p tcp -m tcp --tcp-flags SYN,ACK SYN -m limit --limit 10/minute -j RETURN",
+		"-j DROP",
+	}
+	if got := testEgress(t).iptablesRules(false); !slices.Equal(got, want) {
+		t.Errorf("rules =\n%q\nwant\n%q", got, want)
+	}
+
+	want = []string{
+		"-m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-o lo -j RETURN",
+		"-p udp -m udp --dport 53 -j RETURN",
+		"-p tcp -m tcp --dport 53 -j RETURN",
+		"-d 2001:db8::1/128 -p tcp -m tcp --dport 443 -j RETURN",
+		"-d 2001:db8::1/128 -p udp -m udp --dport 443 -j RETURN",
+		`-p tcp -m tcp --tcp-flags SYN,ACK SYN -m limit --limit 10/minute -j LOG --log-prefix "zecx-egress: "`,
+		"-p tcp -m tcp --tcp-flags SYN,ACK SYN -m limit --limit 10/minute -j RETURN",
+		"-j DROP",
+	}
+	if got := testEgress(t).iptablesRules(true); !slices.Equal(got, want) {
+		t.Errorf("ip6tables rules =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestEgressNFTRules(t *testing.T) {
+	want := []string{
+		"ct state established,related return",
+		`oifname "lo" return`,
+		"meta l4proto { tcp, udp } th dport 53 return",
+		"ip daddr 192.0.2.10/32 meta l4proto { tcp, udp } th dport 9443 return",
+		"ip daddr 203.0.113.0/24 return",
+		"ip daddr 198.51.100.7/32 meta l4proto { tcp, udp } th dport 8080 return",
+		"ip6 daddr 2001:db8::1/128 meta l4proto { tcp, udp } th dport 443 return",
+		`tcp flags & (syn | ack) == syn limit rate 10/minute log prefix "zecx-egress: "`,
+		"tcp flags & (syn | ack) == syn limit rate 10/minute return",
+		"drop",
+	}
+	if got := testEgress(t).nftRules(); !slices.Equal(got, want) {
+		t.Errorf("rules =\n%q\nwant\n%q", got, want)
+	}
+}
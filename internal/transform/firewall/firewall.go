@@ -1,10 +1,15 @@
 package firewall
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
+
+	"zecx-deploy/internal/config"
 )
 
 // PortMapping defines a redirection from a source port to a target port.
@@ -14,80 +19,160 @@ type PortMapping struct {
 	Protocol   string
 }
 
+func (m PortMapping) String() string {
+	return fmt.Sprintf("%s %d -> %d", m.Protocol, m.SourcePort, m.TargetPort)
+}
+
 var mappings = []PortMapping{
-	{SourcePort: 21, TargetPort: 2121, Protocol: "tcp"}, // FTP
-	{SourcePort: 22, TargetPort: 2222, Protocol: "tcp"}, // SSH
-	{SourcePort: 80, TargetPort: 8080, Protocol: "tcp"}, // HTTP
-	{SourcePort: 443, TargetPort: 8443, Protocol: "tcp"},// HTTPS
-	{SourcePort: 445, TargetPort: 4445, Protocol: "tcp"},// SMB
+	{SourcePort: 21, TargetPort: 2121, Protocol: "tcp"},  // FTP
+	{SourcePort: 22, TargetPort: 2222, Protocol: "tcp"},  // SSH
+	{SourcePort: 80, TargetPort: 8080, Protocol: "tcp"},  // HTTP
+	{SourcePort: 443, TargetPort: 8443, Protocol: "tcp"}, // HTTPS
+	{SourcePort: 445, TargetPort: 4445, Protocol: "tcp"}, // SMB
 }
 
-// runIptables executes an iptables command and logs its output.
-func runIptables(args ...string) error {
-	cmd := exec.Command("iptables", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("iptables command failed: iptables %s", strings.Join(args, " "))
-		log.Printf("Output: %s", string(output))
-		return fmt.Errorf("iptables error: %w", err)
+// ErrNoBackend is returned by Detect when neither iptables nor nft is installed.
+var ErrNoBackend = errors.New("no firewall backend found (need iptables or nft)")
+
+// Backend installs and removes the honeypot's redirect rules with one
+// firewall tool.
+type Backend interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// Apply installs a redirect rule for every mapping and, unless egress
+	// is nil, the egress policy; a nil egress removes any installed one.
+	Apply(mappings []PortMapping, egress *Egress) error
+	// Remove deletes the rules Apply installed, egress policy included. It
+	// is the fallback when there is no snapshot to restore from.
+	Remove(mappings []PortMapping) error
+	// Save dumps the host's full ruleset in the tool's own format.
+	Save() ([]byte, error)
+	// Parse splits a dump from Save into its units.
+	Parse(dump []byte) Ruleset
+	// Revert deletes the added units and puts back the removed ones, in
+	// the place they had in before.
+	Revert(added, removed, before Ruleset) error
+	// Verify lists how the installed redirects differ from mappings.
+	Verify(mappings []PortMapping) ([]Discrepancy, error)
+}
+
+// Runner runs an external command with stdin as its input and returns its
+// combined output. Backends run every command through one, so that tests
+// can substitute a fake.
+type Runner func(stdin []byte, name string, args ...string) ([]byte, error)
+
+// Exec is the Runner that runs real commands.
+func Exec(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
 	}
-	log.Printf("iptables command successful: iptables %s", strings.Join(args, " "))
-	return nil
+	return cmd.CombinedOutput()
 }
 
-// Configure sets up the firewall rules to redirect traffic to the honeypot emulators.
-func Configure() error {
+// Detect picks the backend for this host. The nft backend is used when nft
+// is installed and iptables is either missing or the nf_tables variant, so
+// the rules live in the same kernel subsystem as the host's own; a legacy
+// (x_tables) iptables is driven directly instead.
+func Detect(run Runner) (Backend, error) {
+	iptVersion, iptErr := run(nil, "iptables", "--version")
+	_, nftErr := run(nil, "nft", "--version")
+	switch {
+	case nftErr == nil && (iptErr != nil || strings.Contains(string(iptVersion), "nf_tables")):
+		return &NFTables{Run: run}, nil
+	case iptErr == nil:
+		return &IPTables{Run: run}, nil
+	}
+	return nil, ErrNoBackend
+}
+
+// backendNamed returns the backend called name, as recorded in a snapshot.
+func backendNamed(name string, run Runner) (Backend, error) {
+	for _, b := range []Backend{&IPTables{Run: run}, &NFTables{Run: run}} {
+		if b.Name() == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q", name)
+}
+
+// Configure sets up the firewall rules to redirect traffic to the honeypot
+// emulators, and the egress policy that contains them. The host's ruleset
+// is snapshotted under the state directory first, so Restore can put it
+// back exactly.
+func Configure(cfg *config.Config) error {
 	log.Println("Initializing firewall configuration...")
 
-	// Check if iptables is available
-	if _, err := exec.LookPath("iptables"); err != nil {
-		log.Println("iptables command not found, skipping firewall configuration. This may be expected on non-Linux systems.")
+	b, err := Detect(Exec)
+	if err != nil {
+		log.Printf("%v, skipping firewall configuration. This may be expected on non-Linux systems.", err)
 		return nil // Not a fatal error, allows testing on Windows/macOS
 	}
-
-	for _, m := range mappings {
-		// Add rule to the PREROUTING chain in the nat table
-		args := []string{
-			"-t", "nat",
-			"-A", "PREROUTING",
-			"-p", m.Protocol,
-			"--dport", fmt.Sprintf("%d", m.SourcePort),
-			"-j", "REDIRECT",
-			"--to-port", fmt.Sprintf("%d", m.TargetPort),
-		}
-		if err := runIptables(args...); err != nil {
-			// If one rule fails, log it but try to apply the others
-			log.Printf("Failed to apply firewall rule for port %d: %v", m.SourcePort, err)
-		}
+	log.Printf("Using the %s firewall backend.", b.Name())
+	egress, err := NewEgress(cfg)
+	if err != nil {
+		return err
+	}
+	if egress != nil {
+		log.Printf("Containing outbound traffic of the honeypot's processes (%s), allowing %d destinations besides DNS.", egress.selector(), len(egress.Allow))
+	}
+	dir := Dir(cfg.StateDir)
+	if err := saveBefore(dir, b); err != nil {
+		return fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	applyErr := b.Apply(mappings, egress)
+	// Record what was applied even if some of it failed, so that Restore
+	// undoes a partial setup too.
+	if err := saveAfter(dir, b); err != nil {
+		return fmt.Errorf("%s: %w", b.Name(), errors.Join(applyErr, err))
+	}
+	if applyErr != nil {
+		return fmt.Errorf("%s: %w", b.Name(), applyErr)
 	}
 
 	fmt.Println("Firewall configured.")
 	return nil
 }
 
-// Restore resets the firewall rules to their original state.
-func Restore() error {
+// Restore resets the firewall rules to their original state, undoing the
+// changes recorded in the snapshot under stateDir. Without a snapshot it
+// falls back to deleting the redirect rules one by one.
+func Restore(stateDir string) error {
 	log.Println("Restoring original firewall rules...")
 
-	if _, err := exec.LookPath("iptables"); err != nil {
-		log.Println("iptables command not found, skipping firewall restoration.")
-		return nil
+	dir := Dir(stateDir)
+	snap, err := loadSnapshot(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No firewall snapshot in %s, removing the redirect rules directly.", dir)
+		return removeRules()
 	}
-
-	for _, m := range mappings {
-		// Delete the rule from the PREROUTING chain
-		args := []string{
-			"-t", "nat",
-			"-D", "PREROUTING",
-			"-p", m.Protocol,
-			"--dport", fmt.Sprintf("%d", m.SourcePort),
-			"-j", "REDIRECT",
-			"--to-port", fmt.Sprintf("%d", m.TargetPort),
-		}
-		// We don't treat errors here as fatal, as a rule might not exist if setup failed.
-		_ = runIptables(args...)
+	if err != nil {
+		return fmt.Errorf("failed to load firewall snapshot: %w", err)
+	}
+	b, err := backendNamed(snap.backend, Exec)
+	if err != nil {
+		return err
 	}
+	if err := revert(b, snap, dir); err != nil {
+		return fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove firewall snapshot %s: %v", dir, err)
+	}
+
+	log.Println("Firewall restoration complete.")
+	return nil
+}
 
+func removeRules() error {
+	b, err := Detect(Exec)
+	if err != nil {
+		log.Printf("%v, skipping firewall restoration.", err)
+		return nil
+	}
+	if err := b.Remove(mappings); err != nil {
+		return fmt.Errorf("%s: %w", b.Name(), err)
+	}
 	log.Println("Firewall restoration complete.")
 	return nil
 }
@@ -0,0 +1,350 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// errExit stands in for the exit status of a failed command.
+var errExit = errors.New("exit status 1")
+
+// fakeIPTables emulates the iptables, iptables-save and iptables-restore
+// commands the backend runs, against an in-memory ruleset. Rules are kept
+// in the form iptables -S prints them. The ip6tables commands run against
+// v6, and are not installed when it is nil; routes6 is what ip -6 route
+// prints.
+type fakeIPTables struct {
+	tables  map[string]*fakeTable
+	v6      *fakeIPTables
+	routes6 string
+}
+
+type fakeTable struct {
+	chains []string            // built-in chains first, then in creation order
+	policy map[string]string   // "-" for user-defined chains
+	rules  map[string][]string // rule specifications without "-A CHAIN"
+}
+
+func newFakeIPTables() *fakeIPTables {
+	f := newFakeFamily()
+	f.v6 = newFakeFamily()
+	return f
+}
+
+func newFakeFamily() *fakeIPTables {
+	return &fakeIPTables{tables: map[string]*fakeTable{
+		"filter": newFakeTable("INPUT", "FORWARD", "OUTPUT"),
+		"nat":    newFakeTable("PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"),
+	}}
+}
+
+func newFakeTable(builtin ...string) *fakeTable {
+	t := &fakeTable{policy: map[string]string{}, rules: map[string][]string{}}
+	for _, c := range builtin {
+		t.chains = append(t.chains, c)
+		t.policy[c] = "ACCEPT"
+	}
+	return t
+}
+
+func (t *fakeTable) clone() *fakeTable {
+	c := &fakeTable{chains: slices.Clone(t.chains), policy: map[string]string{}, rules: map[string][]string{}}
+	for k, v := range t.policy {
+		c.policy[k] = v
+	}
+	for k, v := range t.rules {
+		c.rules[k] = slices.Clone(v)
+	}
+	return c
+}
+
+// do applies one operation, as iptables or a line of iptables-restore would.
+func (t *fakeTable) do(op, chain, arg string) error {
+	_, exists := t.policy[chain]
+	if op == "-N" {
+		if exists {
+			return errors.New("Chain already exists.")
+		}
+		t.chains = append(t.chains, chain)
+		t.policy[chain] = "-"
+		return nil
+	}
+	if !exists {
+		return errors.New("No chain/target/match by that name.")
+	}
+	rules := t.rules[chain]
+	switch op {
+	case "-A":
+		t.rules[chain] = append(rules, arg)
+	case "-I":
+		return t.insert(chain, 1, arg)
+	case "-C", "-D":
+		i := slices.Index(rules, arg)
+		if i < 0 {
+			return errors.New("Bad rule (does a matching rule exist in that chain?).")
+		}
+		if op == "-D" {
+			t.rules[chain] = slices.Delete(rules, i, i+1)
+		}
+	case "-F":
+		delete(t.rules, chain)
+	case "-X":
+		if t.policy[chain] != "-" || len(rules) > 0 {
+			return errors.New("Directory not empty.")
+		}
+		for _, rs := range t.rules {
+			for _, r := range rs {
+				if strings.HasSuffix(r, "-j "+chain) {
+					return errors.New("Too many links.")
+				}
+			}
+		}
+		delete(t.policy, chain)
+		t.chains = slices.DeleteFunc(t.chains, func(c string) bool { return c == chain })
+	case "-P":
+		t.policy[chain] = arg
+	default:
+		return fmt.Errorf("unknown option %s", op)
+	}
+	return nil
+}
+
+// insert puts rule at position n of chain, counting from 1.
+func (t *fakeTable) insert(chain string, n int, rule string) error {
+	rules := t.rules[chain]
+	if n < 1 || n > len(rules)+1 {
+		return errors.New("Index of insertion too big.")
+	}
+	t.rules[chain] = slices.Insert(rules, n-1, rule)
+	return nil
+}
+
+// list prints chain, or the whole table when chain is empty, like -S.
+func (t *fakeTable) list(chain string) (string, error) {
+	chains := t.chains
+	if chain != "" {
+		if _, ok := t.policy[chain]; !ok {
+			return "", errors.New("No chain/target/match by that name.")
+		}
+		chains = []string{chain}
+	}
+	var b strings.Builder
+	for _, c := range chains {
+		if t.policy[c] == "-" {
+			fmt.Fprintf(&b, "-N %s\n", c)
+		} else {
+			fmt.Fprintf(&b, "-P %s %s\n", c, t.policy[c])
+		}
+	}
+	for _, c := range chains {
+		for _, r := range t.rules[c] {
+			fmt.Fprintf(&b, "-A %s %s\n", c, r)
+		}
+	}
+	return b.String(), nil
+}
+
+// rule joins command-line rule arguments into the form -S prints, which
+// names the protocol match and spells --to-port as --to-ports.
+func rule(args []string) string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--to-port" {
+			a = "--to-ports"
+		}
+		out = append(out, a)
+		if a == "-p" && i+1 < len(args) && (i+2 >= len(args) || args[i+2] != "-m") {
+			out = append(out, args[i+1], "-m", args[i+1])
+			i++
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func (f *fakeIPTables) run(stdin []byte, name string, args ...string) ([]byte, error) {
+	switch name {
+	case "iptables":
+		return f.iptables(args)
+	case "iptables-save":
+		return []byte(f.save()), nil
+	case "iptables-restore":
+		if !slices.Equal(args, []string{"--noflush"}) {
+			return []byte("iptables-restore would flush the host's rules"), errExit
+		}
+		return f.restore(string(stdin))
+	case "ip6tables", "ip6tables-save", "ip6tables-restore":
+		if f.v6 == nil {
+			return nil, exec.ErrNotFound
+		}
+		return f.v6.run(stdin, strings.Replace(name, "ip6", "ip", 1), args...)
+	case "ip":
+		if slices.Equal(args, []string{"-6", "route", "show"}) {
+			return []byte(f.routes6), nil
+		}
+	}
+	return nil, exec.ErrNotFound
+}
+
+func (f *fakeIPTables) iptables(args []string) ([]byte, error) {
+	if slices.Equal(args, []string{"--version"}) {
+		return []byte("iptables v1.8.7 (legacy)\n"), nil
+	}
+	table := "filter"
+	if len(args) >= 2 && args[0] == "-t" {
+		table, args = args[1], args[2:]
+	}
+	t := f.tables[table]
+	if t == nil || len(args) == 0 {
+		return []byte("iptables: bad arguments"), errExit
+	}
+	if args[0] == "-S" {
+		chain := ""
+		if len(args) > 1 {
+			chain = args[1]
+		}
+		out, err := t.list(chain)
+		if err != nil {
+			return []byte("iptables: " + err.Error() + "\n"), errExit
+		}
+		return []byte(out), nil
+	}
+	if len(args) < 2 {
+		return []byte("iptables: bad arguments"), errExit
+	}
+	if err := t.do(args[0], args[1], rule(args[2:])); err != nil {
+		return []byte("iptables: " + err.Error() + "\n"), errExit
+	}
+	return nil, nil
+}
+
+// restore applies an iptables-restore --noflush script: every table it
+// names is committed whole or not at all.
+func (f *fakeIPTables) restore(script string) ([]byte, error) {
+	next := make(map[string]*fakeTable)
+	for name, t := range f.tables {
+		next[name] = t.clone()
+	}
+	var t *fakeTable
+	for n, line := range strings.Split(script, "\n") {
+		var err error
+		switch {
+		case line == "", line == "COMMIT":
+		case strings.HasPrefix(line, "*"):
+			t = next[line[1:]]
+		case t == nil:
+			err = errors.New("no table")
+		case strings.HasPrefix(line, ":"):
+			decl := strings.Fields(line[1:])
+			switch {
+			case decl[1] != "-":
+				err = t.do("-P", decl[0], decl[1])
+			case t.policy[decl[0]] == "-":
+				err = t.do("-F", decl[0], "")
+			default:
+				err = t.do("-N", decl[0], "")
+			}
+		default:
+			op, rest, _ := strings.Cut(line, " ")
+			chain, arg, _ := strings.Cut(rest, " ")
+			if op != "-I" {
+				err = t.do(op, chain, arg)
+				break
+			}
+			index, rule, _ := strings.Cut(arg, " ")
+			n, convErr := strconv.Atoi(index)
+			if convErr != nil {
+				err = convErr
+				break
+			}
+			if _, ok := t.policy[chain]; !ok {
+				err = errors.New("No chain/target/match by that name.")
+				break
+			}
+			err = t.insert(chain, n, rule)
+		}
+		if err != nil {
+			return []byte(fmt.Sprintf("iptables-restore: line %d failed: %v\n", n+1, err)), errExit
+		}
+	}
+	f.tables = next
+	return nil, nil
+}
+
+func (f *fakeIPTables) save() string {
+	var b strings.Builder
+	for _, name := range []string{"filter", "nat"} {
+		t := f.tables[name]
+		fmt.Fprintf(&b, "# Generated by iptables-save\n*%s\n", name)
+		for _, c := range t.chains {
+			fmt.Fprintf(&b, ":%s %s [0:0]\n", c, t.policy[c])
+		}
+		for _, c := range t.chains {
+			for _, r := range t.rules[c] {
+				fmt.Fprintf(&b, "-A %s %s\n", c, r)
+			}
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// mustDo changes the fake ruleset the way an administrator would.
+func (f *fakeIPTables) mustDo(t *testing.T, table, op, chain, arg string) {
+	t.Helper()
+	if err := f.tables[table].do(op, chain, arg); err != nil {
+		t.Fatalf("%s %s %s: %v", op, chain, arg, err)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		iptables string // version output; empty when not installed
+		nft      bool
+		want     string
+	}{
+		{iptables: "iptables v1.8.7 (legacy)", nft: true, want: "iptables"},
+		{iptables: "iptables v1.8.7 (legacy)", want: "iptables"},
+		{iptables: "iptables v1.8.9 (nf_tables)", nft: true, want: "nftables"},
+		{iptables: "iptables v1.8.9 (nf_tables)", want: "iptables"},
+		{nft: true, want: "nftables"},
+		{},
+	}
+	for _, tt := range tests {
+		run := func(_ []byte, name string, args ...string) ([]byte, error) {
+			switch {
+			case name == "iptables" && tt.iptables != "":
+				return []byte(tt.iptables + "\n"), nil
+			case name == "nft" && tt.nft:
+				return []byte("nftables v1.0.6 (Lester Gooch #5)\n"), nil
+			}
+			return nil, exec.ErrNotFound
+		}
+		b, err := Detect(run)
+		if tt.want == "" {
+			if !errors.Is(err, ErrNoBackend) {
+				t.Errorf("%q, nft %v: err = %v, want ErrNoBackend", tt.iptables, tt.nft, err)
+			}
+			continue
+		}
+		if err != nil || b.Name() != tt.want {
+			t.Errorf("%q, nft %v: got %v, %v; want %s", tt.iptables, tt.nft, b, err, tt.want)
+		}
+	}
+}
+
+func TestBackendNamed(t *testing.T) {
+	for _, name := range []string{"iptables", "nftables"} {
+		if b, err := backendNamed(name, Exec); err != nil || b.Name() != name {
+			t.Errorf("backendNamed(%q) = %v, %v", name, b, err)
+		}
+	}
+	if _, err := backendNamed("ipfw", Exec); err == nil {
+		t.Error("backendNamed accepted an unknown backend")
+	}
+}
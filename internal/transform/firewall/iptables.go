@@ -0,0 +1,457 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Chain is the nat chain that holds the honeypot's iptables redirects.
+// PREROUTING jumps to it once, so the redirects can be checked, flushed
+// and removed without touching the host's own rules.
+const Chain = "ZECX-PREROUTING"
+
+// IPTables manages the redirects as REDIRECT rules in Chain in the nat
+// table.
+type IPTables struct {
+	Run Runner
+}
+
+// Name implements Backend.
+func (b *IPTables) Name() string { return "iptables" }
+
+// Apply implements Backend. Every redirect is checked with -C before it is
+// added, so applying twice leaves one copy of each. The jump from
+// PREROUTING is added last, once the chain is complete. A rule that fails
+// is logged and the others are still applied; the failures are returned
+// together.
+func (b *IPTables) Apply(mappings []PortMapping, egress *Egress) error {
+	if _, err := b.Run(nil, "iptables", "-t", "nat", "-S", Chain); err != nil {
+		if err := b.iptables("-t", "nat", "-N", Chain); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, m := range mappings {
+		if err := b.ensure(Chain, redirectRule(m)...); err != nil {
+			log.Printf("Failed to apply firewall rule for port %d: %v", m.SourcePort, err)
+			errs = append(errs, fmt.Errorf("port %d: %w", m.SourcePort, err))
+		}
+	}
+	if err := b.ensure("PREROUTING", "-j", Chain); err != nil {
+		errs = append(errs, fmt.Errorf("jump to %s: %w", Chain, err))
+	}
+	if err := b.applyEgress(egress); err != nil {
+		errs = append(errs, fmt.Errorf("egress policy: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// applyEgress installs the egress policy with iptables and ip6tables, so
+// that IPv6 is contained as well. Without ip6tables the policy is only
+// reported as applied when the host has no IPv6 routes to leak through.
+func (b *IPTables) applyEgress(egress *Egress) error {
+	if err := b.applyFamilyEgress("iptables", egress); err != nil {
+		return err
+	}
+	if _, err := b.Run(nil, "ip6tables", "--version"); err != nil {
+		if egress == nil {
+			return nil
+		}
+		routed, err := b.routesIPv6()
+		if err != nil {
+			return fmt.Errorf("ip6tables is not installed and the IPv6 routes are unknown: %w", err)
+		}
+		if routed {
+			return errors.New("ip6tables is not installed and the host has IPv6 routes, which the policy would leave open")
+		}
+		log.Println("ip6tables is not installed and the host has no IPv6 routes, the egress policy covers IPv4 only.")
+		return nil
+	}
+	return b.applyFamilyEgress("ip6tables", egress)
+}
+
+// applyFamilyEgress replaces the egress policy in one iptables-restore or
+// ip6tables-restore commit, as tool names: declaring OutputChain flushes
+// it, its rules are added again, and the jump from OUTPUT is replaced by
+// one at the top, ahead of any ACCEPT the host has. A nil egress leaves
+// neither chain nor jump.
+func (b *IPTables) applyFamilyEgress(tool string, egress *Egress) error {
+	jumps, err := b.outputJumps(tool)
+	if err != nil {
+		return err
+	}
+	if egress == nil && len(jumps) == 0 {
+		if _, err := b.Run(nil, tool, "-t", "filter", "-S", OutputChain); err != nil {
+			return nil
+		}
+	}
+	var cmds []string
+	for _, j := range jumps {
+		cmds = append(cmds, "-D"+strings.TrimPrefix(j, "-A"))
+	}
+	if egress == nil {
+		cmds = append(cmds, "-F "+OutputChain, "-X "+OutputChain)
+	} else {
+		cmds = append([]string{":" + OutputChain + " - [0:0]"}, cmds...)
+		for _, r := range egress.iptablesRules(tool == "ip6tables") {
+			cmds = append(cmds, "-A "+OutputChain+" "+r)
+		}
+		cmds = append(cmds, "-I OUTPUT 1 "+egress.iptablesMatch()+" -j "+OutputChain)
+	}
+	script := "*filter\n" + strings.Join(cmds, "\n") + "\nCOMMIT\n"
+	output, err := b.Run([]byte(script), tool+"-restore", "--noflush")
+	if err != nil {
+		log.Printf("%s-restore failed on:\n%s", tool, script)
+		log.Printf("Output: %s", string(output))
+		return fmt.Errorf("%s-restore error: %w", tool, err)
+	}
+	if egress == nil {
+		log.Printf("%s egress policy removed from %s.", tool, OutputChain)
+	} else {
+		log.Printf("%s egress policy applied in %s.", tool, OutputChain)
+	}
+	return nil
+}
+
+// routesIPv6 reports whether the host routes IPv6 anywhere beyond
+// loopback and link-local addresses.
+func (b *IPTables) routesIPv6() (bool, error) {
+	output, err := b.Run(nil, "ip", "-6", "route", "show")
+	if err != nil {
+		return false, fmt.Errorf("ip error: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || f[0] == "::1" || strings.HasPrefix(f[0], "fe80:") || slices.Contains(f, "lo") {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// outputJumps lists the OUTPUT rules that jump to OutputChain, as tool -S
+// prints them.
+func (b *IPTables) outputJumps(tool string) ([]string, error) {
+	output, err := b.Run(nil, tool, "-t", "filter", "-S", "OUTPUT")
+	if err != nil {
+		return nil, fmt.Errorf("%s error: %w: %s", tool, err, strings.TrimSpace(string(output)))
+	}
+	var jumps []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-A OUTPUT ") && strings.HasSuffix(line, " -j "+OutputChain) {
+			jumps = append(jumps, line)
+		}
+	}
+	return jumps, nil
+}
+
+// ensure appends rule to chain unless it is already there.
+func (b *IPTables) ensure(chain string, rule ...string) error {
+	if _, err := b.Run(nil, "iptables", append([]string{"-t", "nat", "-C", chain}, rule...)...); err == nil {
+		log.Printf("iptables rule already present: -A %s %s", chain, strings.Join(rule, " "))
+		return nil
+	}
+	return b.iptables(append([]string{"-t", "nat", "-A", chain}, rule...)...)
+}
+
+// Remove implements Backend. It also deletes the redirects that versions
+// without Chain added to PREROUTING directly.
+func (b *IPTables) Remove(mappings []PortMapping) error {
+	// We don't treat errors here as fatal, as a rule might not exist if setup failed.
+	if err := b.applyEgress(nil); err != nil {
+		log.Printf("Failed to remove the egress policy: %v", err)
+	}
+	for b.iptables("-t", "nat", "-D", "PREROUTING", "-j", Chain) == nil {
+	}
+	_ = b.iptables("-t", "nat", "-F", Chain)
+	_ = b.iptables("-t", "nat", "-X", Chain)
+	for _, m := range mappings {
+		_ = b.iptables(append([]string{"-t", "nat", "-D", "PREROUTING"}, redirectRule(m)...)...)
+	}
+	return nil
+}
+
+// Verify implements Backend.
+func (b *IPTables) Verify(mappings []PortMapping) ([]Discrepancy, error) {
+	output, err := b.Run(nil, "iptables", "-t", "nat", "-S", "PREROUTING")
+	if err != nil {
+		return nil, fmt.Errorf("iptables error: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	var ds []Discrepancy
+	jump := "-A PREROUTING -j " + Chain
+	jumps := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == jump {
+			jumps++
+		} else if m, ok := parseIPTablesRule(line); ok && slices.Contains(mappings, m) {
+			ds = append(ds, Discrepancy{Kind: "extra", Rule: line + " (outside " + Chain + ")"})
+		}
+	}
+	switch {
+	case jumps == 0:
+		ds = append(ds, Discrepancy{Kind: "missing", Rule: jump})
+	case jumps > 1:
+		for range jumps - 1 {
+			ds = append(ds, Discrepancy{Kind: "extra", Rule: jump})
+		}
+	}
+
+	output, err = b.Run(nil, "iptables", "-t", "nat", "-S", Chain)
+	if err != nil && !strings.Contains(string(output), "No chain") {
+		return nil, fmt.Errorf("iptables error: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	var installed []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		if m, ok := parseIPTablesRule(line); ok {
+			installed = append(installed, m.String())
+		} else {
+			installed = append(installed, line)
+		}
+	}
+	return append(ds, compare(mappings, installed)...), nil
+}
+
+// redirectRule builds the rule specification of the redirect for m.
+func redirectRule(m PortMapping) []string {
+	return []string{
+		"-p", m.Protocol,
+		"--dport", strconv.Itoa(m.SourcePort),
+		"-j", "REDIRECT",
+		"--to-port", strconv.Itoa(m.TargetPort),
+	}
+}
+
+// parseIPTablesRule recognises a redirect in iptables -S output, such as
+// "-A ZECX-PREROUTING -p tcp -m tcp --dport 22 -j REDIRECT --to-ports 2222".
+func parseIPTablesRule(line string) (PortMapping, bool) {
+	var m PortMapping
+	f := strings.Fields(line)
+	target := ""
+	for i := 0; i+1 < len(f); i++ {
+		switch f[i] {
+		case "-p":
+			m.Protocol = f[i+1]
+		case "--dport":
+			m.SourcePort, _ = strconv.Atoi(f[i+1])
+		case "-j":
+			target = f[i+1]
+		case "--to-ports":
+			m.TargetPort, _ = strconv.Atoi(f[i+1])
+		}
+	}
+	return m, target == "REDIRECT" && m.Protocol != "" && m.SourcePort != 0 && m.TargetPort != 0
+}
+
+// iptables executes an iptables command and logs its output.
+func (b *IPTables) iptables(args ...string) error {
+	output, err := b.Run(nil, "iptables", args...)
+	if err != nil {
+		log.Printf("iptables command failed: iptables %s", strings.Join(args, " "))
+		log.Printf("Output: %s", string(output))
+		return fmt.Errorf("iptables error: %w", err)
+	}
+	log.Printf("iptables command successful: iptables %s", strings.Join(args, " "))
+	return nil
+}
+
+// ip6Dump separates the ip6tables-save output from the iptables-save
+// output in a dump from Save.
+const ip6Dump = "# ip6tables-save"
+
+// ip6Unit prefixes the units parsed from ip6tables-save output.
+const ip6Unit = "ip6 "
+
+// Save implements Backend. The ip6tables-save output follows, when
+// ip6tables is installed.
+func (b *IPTables) Save() ([]byte, error) {
+	output, err := b.Run(nil, "iptables-save")
+	if err != nil {
+		return nil, fmt.Errorf("iptables-save error: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	if _, err := b.Run(nil, "ip6tables", "--version"); err != nil {
+		return output, nil
+	}
+	output6, err := b.Run(nil, "ip6tables-save")
+	if err != nil {
+		return nil, fmt.Errorf("ip6tables-save error: %w: %s", err, strings.TrimSpace(string(output6)))
+	}
+	return append(append(output, ip6Dump+"\n"...), output6...), nil
+}
+
+// Parse implements Backend. Each unit is a line of iptables-save output
+// prefixed with its table, and with ip6Unit too for ip6tables. Counters
+// are dropped, and so are built-in chains left at the ACCEPT policy, which
+// iptables-save lists as soon as a table is first used.
+func (b *IPTables) Parse(dump []byte) Ruleset {
+	var rs Ruleset
+	family, table := "", ""
+	for _, line := range strings.Split(string(dump), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == ip6Dump:
+			family = ip6Unit
+		case line == "", line == "COMMIT", strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			table = family + line[1:]
+		case strings.HasPrefix(line, ":"):
+			f := strings.Fields(line)
+			if len(f) < 2 || f[1] == "ACCEPT" {
+				continue
+			}
+			rs = append(rs, table+" "+f[0]+" "+f[1])
+		default:
+			rs = append(rs, table+" "+line)
+		}
+	}
+	return rs
+}
+
+// Revert implements Backend. The changes are fed to iptables-restore
+// --noflush, or ip6tables-restore for IPv6 units, which commits each table
+// atomically and leaves every rule it is not told about alone. Removed
+// rules are inserted at the position they had in before.
+func (b *IPTables) Revert(added, removed, before Ruleset) error {
+	var tables []string
+	cmds := make(map[string][]string)
+	emit := func(unit string, cmd func(line string) string) {
+		table, line := unitTable(unit)
+		c := cmd(line)
+		if c == "" {
+			return
+		}
+		if _, ok := cmds[table]; !ok {
+			tables = append(tables, table)
+		}
+		cmds[table] = append(cmds[table], c)
+	}
+	// Rules go before the chains they live in or jump to can be deleted,
+	// and chains come back before their rules.
+	for _, u := range added {
+		emit(u, func(line string) string {
+			if rule, ok := strings.CutPrefix(line, "-A "); ok {
+				return "-D " + rule
+			}
+			return ""
+		})
+	}
+	for _, u := range added {
+		emit(u, func(line string) string {
+			chain, policy, ok := chainDecl(line)
+			switch {
+			case !ok:
+				return ""
+			case policy == "-":
+				return "-X " + chain
+			}
+			return "-P " + chain + " ACCEPT"
+		})
+	}
+	for _, u := range removed {
+		emit(u, func(line string) string {
+			chain, policy, ok := chainDecl(line)
+			switch {
+			case !ok:
+				return ""
+			case policy == "-":
+				return "-N " + chain
+			}
+			return "-P " + chain + " " + policy
+		})
+	}
+	// Going through before in order, every rule ahead of a removed one is
+	// back in its chain by the time that one is inserted. Of identical
+	// rules, subtract counts the last copies as removed.
+	missing := make(map[string]int)
+	for _, u := range removed {
+		missing[u]++
+	}
+	put := make([]bool, len(before))
+	for i := len(before) - 1; i >= 0; i-- {
+		if missing[before[i]] > 0 {
+			missing[before[i]]--
+			put[i] = true
+		}
+	}
+	position := make(map[string]int)
+	for i, u := range before {
+		chain := chainOf(u)
+		if chain == "" {
+			continue
+		}
+		position[chain]++
+		if !put[i] {
+			continue
+		}
+		n := position[chain]
+		emit(u, func(line string) string {
+			name, rule, _ := strings.Cut(strings.TrimPrefix(line, "-A "), " ")
+			return fmt.Sprintf("-I %s %d %s", name, n, rule)
+		})
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		var script strings.Builder
+		for _, t := range tables {
+			if name, ip6 := strings.CutPrefix(t, ip6Unit); ip6 == (tool == "ip6tables") {
+				fmt.Fprintf(&script, "*%s\n%s\nCOMMIT\n", name, strings.Join(cmds[t], "\n"))
+			}
+		}
+		if script.Len() == 0 {
+			continue
+		}
+		output, err := b.Run([]byte(script.String()), tool+"-restore", "--noflush")
+		if err != nil {
+			log.Printf("%s-restore failed on:\n%s", tool, script.String())
+			log.Printf("Output: %s", string(output))
+			return fmt.Errorf("%s-restore error: %w", tool, err)
+		}
+	}
+	log.Printf("iptables-restore applied %d changes.", len(added)+len(removed))
+	return nil
+}
+
+// unitTable splits a unit into its table, ip6Unit included, and its line.
+func unitTable(unit string) (table, line string) {
+	family, rest := "", unit
+	if r, ok := strings.CutPrefix(unit, ip6Unit); ok {
+		family, rest = ip6Unit, r
+	}
+	table, line, _ = strings.Cut(rest, " ")
+	return family + table, line
+}
+
+// chainOf returns the table and chain of a rule unit, or "" for chain
+// declarations and for units that are not iptables rules.
+func chainOf(unit string) string {
+	table, line := unitTable(unit)
+	rest, ok := strings.CutPrefix(line, "-A ")
+	if !ok {
+		return ""
+	}
+	chain, _, _ := strings.Cut(rest, " ")
+	return table + " " + chain
+}
+
+// chainDecl splits a ":CHAIN POLICY" unit line.
+func chainDecl(line string) (chain, policy string, ok bool) {
+	rest, ok := strings.CutPrefix(line, ":")
+	if !ok {
+		return "", "", false
+	}
+	chain, policy, ok = strings.Cut(rest, " ")
+	return chain, policy, ok
+}
@@ -0,0 +1,198 @@
+package firewall
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIPTablesApplyIsIdempotent(t *testing.T) {
+	f := newFakeIPTables()
+	b := &IPTables{Run: f.run}
+	egress := testEgress(t)
+	if err := b.Apply(mappings, egress); err != nil {
+		t.Fatal(err)
+	}
+	first := f.save()
+	if err := b.Apply(mappings, egress); err != nil {
+		t.Fatal(err)
+	}
+	if f.save() != first {
+		t.Errorf("second Apply changed the ruleset:\n%s\nwas\n%s", f.save(), first)
+	}
+
+	nat := f.tables["nat"]
+	if want := []string{"-j " + Chain}; !slices.Equal(nat.rules["PREROUTING"], want) {
+		t.Errorf("PREROUTING = %q, want %q", nat.rules["PREROUTING"], want)
+	}
+	want := []string{
+		"-p tcp -m tcp --dport 21 -j REDIRECT --to-ports 2121",
+		"-p tcp -m tcp --dport 22 -j REDIRECT --to-ports 2222",
+		"-p tcp -m tcp --dport 80 -j REDIRECT --to-ports 8080",
+		"-p tcp -m tcp --dport 443 -j REDIRECT --to-ports 8443",
+		"-p tcp -m tcp --dport 445 -j REDIRECT --to-ports 4445",
+	}
+	if got := nat.rules[Chain]; !slices.Equal(got, want) {
+		t.Errorf("%s = %q, want %q", Chain, got, want)
+	}
+	for _, ip6 := range []bool{false, true} {
+		filter := f.tables["filter"]
+		if ip6 {
+			filter = f.v6.tables["filter"]
+		}
+		if want := []string{"-m owner --uid-owner 1000 -j " + OutputChain}; !slices.Equal(filter.rules["OUTPUT"], want) {
+			t.Errorf("ip6 %v: OUTPUT = %q, want %q", ip6, filter.rules["OUTPUT"], want)
+		}
+		if got := filter.rules[OutputChain]; !slices.Equal(got, egress.iptablesRules(ip6)) {
+			t.Errorf("ip6 %v: %s = %q", ip6, OutputChain, got)
+		}
+	}
+}
+
+func TestIPTablesEgressWithoutIP6Tables(t *testing.T) {
+	f := newFakeIPTables()
+	f.v6 = nil
+	f.routes6 = "::1 dev lo proto kernel metric 256 pref medium\nfe80::/64 dev eth0 proto kernel metric 256 pref medium\n"
+	b := &IPTables{Run: f.run}
+	if err := b.Apply(mappings, testEgress(t)); err != nil {
+		t.Errorf("without IPv6 routes: %v", err)
+	}
+
+	// IPv6 traffic would get around a policy in iptables alone.
+	f.routes6 += "default via fe80::1 dev eth0 proto ra metric 1024 pref medium\n"
+	if err := b.Apply(mappings, testEgress(t)); err == nil {
+		t.Error("policy reported as applied with IPv6 routes and no ip6tables")
+	}
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Errorf("removing the policy: %v", err)
+	}
+}
+
+func TestIPTablesEgressJumpComesFirst(t *testing.T) {
+	f := newFakeIPTables()
+	f.mustDo(t, "filter", "-A", "OUTPUT", "-j ACCEPT")
+	b := &IPTables{Run: f.run}
+	if err := b.Apply(mappings, testEgress(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.tables["filter"].rules["OUTPUT"]; len(got) != 2 || !strings.HasSuffix(got[0], "-j "+OutputChain) {
+		t.Errorf("OUTPUT = %q, want the jump ahead of the host's ACCEPT", got)
+	}
+}
+
+func TestIPTablesApplyWithoutEgress(t *testing.T) {
+	f := newFakeIPTables()
+	b := &IPTables{Run: f.run}
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.tables["filter"].policy[OutputChain]; ok {
+		t.Errorf("%s created without an egress policy", OutputChain)
+	}
+
+	// Disabling the policy later takes it out again.
+	if err := b.Apply(mappings, testEgress(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	filter := f.tables["filter"]
+	if _, ok := filter.policy[OutputChain]; ok || len(filter.rules["OUTPUT"]) != 0 {
+		t.Errorf("egress policy left behind:\n%s", f.save())
+	}
+}
+
+func TestIPTablesRemove(t *testing.T) {
+	f := newFakeIPTables()
+	f.mustDo(t, "filter", "-A", "INPUT", "-p tcp -m tcp --dport 22 -j ACCEPT")
+	pristine := f.save()
+	// Versions without Chain put the redirects in PREROUTING directly.
+	f.mustDo(t, "nat", "-A", "PREROUTING", "-p tcp -m tcp --dport 22 -j REDIRECT --to-ports 2222")
+	b := &IPTables{Run: f.run}
+	if err := b.Apply(mappings, testEgress(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove(mappings); err != nil {
+		t.Fatal(err)
+	}
+	if f.save() != pristine {
+		t.Errorf("after Remove:\n%s\nwant\n%s", f.save(), pristine)
+	}
+	if v6 := f.v6.save(); v6 != newFakeFamily().save() {
+		t.Errorf("ip6tables after Remove:\n%s", v6)
+	}
+	// Removing again finds nothing to do.
+	if err := b.Remove(mappings); err != nil || f.save() != pristine {
+		t.Errorf("second Remove: %v\n%s", err, f.save())
+	}
+}
+
+func TestIPTablesVerify(t *testing.T) {
+	f := newFakeIPTables()
+	b := &IPTables{Run: f.run}
+
+	ds, err := b.Verify(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1+len(mappings) || ds[0] != (Discrepancy{Kind: "missing", Rule: "-A PREROUTING -j " + Chain}) {
+		t.Errorf("before Apply: %v", ds)
+	}
+
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err := b.Verify(mappings); err != nil || len(ds) != 0 {
+		t.Errorf("after Apply: %v, %v", ds, err)
+	}
+
+	f.mustDo(t, "nat", "-D", Chain, "-p tcp -m tcp --dport 22 -j REDIRECT --to-ports 2222")
+	f.mustDo(t, "nat", "-A", Chain, "-p tcp -m tcp --dport 23 -j REDIRECT --to-ports 2323")
+	f.mustDo(t, "nat", "-A", "PREROUTING", "-j "+Chain)
+	f.mustDo(t, "nat", "-I", "PREROUTING", "-p tcp -m tcp --dport 21 -j REDIRECT --to-ports 2121")
+	ds, err = b.Verify(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Discrepancy{
+		{Kind: "extra", Rule: "-A PREROUTING -p tcp -m tcp --dport 21 -j REDIRECT --to-ports 2121 (outside " + Chain + ")"},
+		{Kind: "extra", Rule: "-A PREROUTING -j " + Chain},
+		{Kind: "missing", Rule: "tcp 22 -> 2222"},
+		{Kind: "extra", Rule: "tcp 23 -> 2323"},
+	}
+	if !slices.Equal(ds, want) {
+		t.Errorf("discrepancies =\n%v\nwant\n%v", ds, want)
+	}
+}
+
+func TestIPTablesVerifyOrder(t *testing.T) {
+	f := newFakeIPTables()
+	b := &IPTables{Run: f.run}
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	chain := f.tables["nat"].rules[Chain]
+	chain[0], chain[1] = chain[1], chain[0]
+	ds, err := b.Verify(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 2 || ds[0].Kind != "reordered" || ds[0].Rule != "tcp 22 -> 2222 at position 1, expected tcp 21 -> 2121" {
+		t.Errorf("discrepancies = %v", ds)
+	}
+}
+
+func TestParseIPTablesRule(t *testing.T) {
+	tests := map[string]bool{
+		"-A ZECX-PREROUTING -p tcp -m tcp --dport 22 -j REDIRECT --to-ports 2222":  true,
+		"-A PREROUTING -j ZECX-PREROUTING":                                         false,
+		"-A PREROUTING -p tcp -m tcp --dport 22 -j DNAT --to-destination 10.0.0.2": false,
+	}
+	for line, ok := range tests {
+		m, got := parseIPTablesRule(line)
+		if got != ok || ok && m != (PortMapping{SourcePort: 22, TargetPort: 2222, Protocol: "tcp"}) {
+			t.Errorf("parseIPTablesRule(%q) = %v, %v", line, m, got)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package firewall
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// TableName is the nftables table that holds every honeypot rule. Nothing
+// else is ever added to it, so deleting it removes the honeypot's rules in
+// one atomic step and leaves the host's own ruleset alone.
+const TableName = "zecx"
+
+// NFTables manages the rules natively with nft: the redirects in the ip
+// family table TableName, and the egress policy in the inet family table
+// of the same name, so it covers IPv6 too.
+type NFTables struct {
+	Run Runner
+}
+
+// Name implements Backend.
+func (b *NFTables) Name() string { return "nftables" }
+
+// Apply implements Backend. The tables are replaced as a whole in a single
+// nft transaction: either every rule is in place afterwards or none of
+// them changed.
+func (b *NFTables) Apply(mappings []PortMapping, egress *Egress) error {
+	return b.nft([]byte(nftScript(mappings, egress)), "-f", "-")
+}
+
+// Remove implements Backend. Tables that are already gone are not an error.
+func (b *NFTables) Remove([]PortMapping) error {
+	var s strings.Builder
+	for _, family := range []string{"ip", "inet"} {
+		fmt.Fprintf(&s, "table %s %s\ndelete table %s %s\n", family, TableName, family, TableName)
+	}
+	return b.nft([]byte(s.String()), "-f", "-")
+}
+
+// Verify implements Backend.
+func (b *NFTables) Verify(mappings []PortMapping) ([]Discrepancy, error) {
+	output, err := b.Run(nil, "nft", "list", "chain", "ip", TableName, "prerouting")
+	if err != nil && !strings.Contains(string(output), "No such file or directory") {
+		return nil, fmt.Errorf("nft error: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	var ds []Discrepancy
+	if err != nil {
+		// The output is nft's error message, not a listing.
+		ds = append(ds, Discrepancy{Kind: "missing", Rule: "chain ip " + TableName + " prerouting"})
+		output = nil
+	}
+	hooked := err != nil
+	var installed []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", line == "}", strings.HasPrefix(line, "table "), strings.HasPrefix(line, "chain "):
+		case strings.HasPrefix(line, "type nat hook prerouting "):
+			hooked = true
+		case strings.HasPrefix(line, "type "):
+		default:
+			if m, ok := parseNFTRule(line); ok {
+				installed = append(installed, m.String())
+			} else {
+				installed = append(installed, line)
+			}
+		}
+	}
+	if !hooked {
+		ds = append(ds, Discrepancy{Kind: "missing", Rule: "type nat hook prerouting"})
+	}
+	return append(ds, compare(mappings, installed)...), nil
+}
+
+// parseNFTRule recognises a redirect as nft lists it, such as
+// "tcp dport 22 redirect to :2222".
+func parseNFTRule(line string) (PortMapping, bool) {
+	f := strings.Fields(line)
+	if len(f) != 6 || f[1] != "dport" || f[3] != "redirect" || f[4] != "to" {
+		return PortMapping{}, false
+	}
+	src, err1 := strconv.Atoi(f[2])
+	dst, err2 := strconv.Atoi(strings.TrimPrefix(f[5], ":"))
+	if err1 != nil || err2 != nil {
+		return PortMapping{}, false
+	}
+	return PortMapping{SourcePort: src, TargetPort: dst, Protocol: f[0]}, true
+}
+
+// nftScript renders the ruleset Apply loads. Declaring each table before
+// deleting it makes the delete succeed whether or not the table already
+// exists, so applying twice leaves one copy of each rule. Priorities are
+// written numerically (dstnat is -100, filter 0) for nft releases older
+// than 0.9.6.
+func nftScript(mappings []PortMapping, egress *Egress) string {
+	var s strings.Builder
+	for _, family := range []string{"ip", "inet"} {
+		fmt.Fprintf(&s, "table %s %s\n", family, TableName)
+		fmt.Fprintf(&s, "delete table %s %s\n", family, TableName)
+	}
+	fmt.Fprintf(&s, "table ip %s {\n", TableName)
+	s.WriteString("\tchain prerouting {\n")
+	s.WriteString("\t\ttype nat hook prerouting priority -100; policy accept;\n")
+	for _, m := range mappings {
+		fmt.Fprintf(&s, "\t\t%s dport %d redirect to :%d\n", m.Protocol, m.SourcePort, m.TargetPort)
+	}
+	s.WriteString("\t}\n")
+	s.WriteString("}\n")
+	if egress == nil {
+		return s.String()
+	}
+	fmt.Fprintf(&s, "table inet %s {\n", TableName)
+	s.WriteString("\tchain output {\n")
+	s.WriteString("\t\ttype filter hook output priority -1; policy accept;\n")
+	fmt.Fprintf(&s, "\t\t%s jump egress\n", egress.nftMatch())
+	s.WriteString("\t}\n")
+	s.WriteString("\tchain egress {\n")
+	for _, r := range egress.nftRules() {
+		fmt.Fprintf(&s, "\t\t%s\n", r)
+	}
+	s.WriteString("\t}\n")
+	s.WriteString("}\n")
+	return s.String()
+}
+
+// nft executes an nft command, feeding it script, and logs its output.
+func (b *NFTables) nft(script []byte, args ...string) error {
+	output, err := b.Run(script, "nft", args...)
+	if err != nil {
+		log.Printf("nft command failed: nft %s", strings.Join(args, " "))
+		log.Printf("Output: %s", string(output))
+		return fmt.Errorf("nft error: %w", err)
+	}
+	log.Printf("nft command successful: nft %s", strings.Join(args, " "))
+	return nil
+}
+
+// Save implements Backend. Stateless output leaves out counters and other
+// values that change on their own.
+func (b *NFTables) Save() ([]byte, error) {
+	output, err := b.Run(nil, "nft", "-s", "list", "ruleset")
+	if err != nil {
+		return nil, fmt.Errorf("nft error: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Parse implements Backend. Each unit is one table, from its "table ... {"
+// line to the closing brace.
+func (b *NFTables) Parse(dump []byte) Ruleset {
+	var rs Ruleset
+	var block []string
+	for _, line := range strings.Split(string(dump), "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			continue
+		}
+		block = append(block, line)
+		if line == "}" {
+			rs = append(rs, strings.Join(block, "\n"))
+			block = nil
+		}
+	}
+	if block != nil {
+		rs = append(rs, strings.Join(block, "\n"))
+	}
+	return rs
+}
+
+// Revert implements Backend. Added tables are deleted and removed ones are
+// loaded again, replacing any table of the same name, all in one nft
+// transaction.
+func (b *NFTables) Revert(added, removed, _ Ruleset) error {
+	var s strings.Builder
+	for _, u := range added {
+		fmt.Fprintf(&s, "delete %s\n", tableOf(u))
+	}
+	for _, u := range removed {
+		fmt.Fprintf(&s, "%s\ndelete %s\n%s\n", tableOf(u), tableOf(u), u)
+	}
+	if s.Len() == 0 {
+		return nil
+	}
+	return b.nft([]byte(s.String()), "-f", "-")
+}
+
+// tableOf returns the "table FAMILY NAME" a unit declares.
+func tableOf(unit string) string {
+	return strings.TrimSuffix(key(unit), " {")
+}
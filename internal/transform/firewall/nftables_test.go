@@ -0,0 +1,226 @@
+package firewall
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeNFT emulates nft on whole tables, which is all the backend handles:
+// "table F N" declares a table, "delete table F N" deletes one and a
+// "table F N { ... }" block defines it.
+type fakeNFT struct {
+	order  []string          // "table F N" in creation order
+	tables map[string]string // full definitions
+	loads  []string          // scripts fed to nft -f -
+}
+
+func newFakeNFT(tables ...string) *fakeNFT {
+	f := &fakeNFT{tables: map[string]string{}}
+	for _, t := range tables {
+		f.set(tableOf(t), t)
+	}
+	return f
+}
+
+func (f *fakeNFT) set(name, def string) {
+	if _, ok := f.tables[name]; !ok {
+		f.order = append(f.order, name)
+	}
+	f.tables[name] = def
+}
+
+func (f *fakeNFT) run(stdin []byte, name string, args ...string) ([]byte, error) {
+	if name != "nft" {
+		return nil, exec.ErrNotFound
+	}
+	switch strings.Join(args, " ") {
+	case "--version":
+		return []byte("nftables v1.0.6 (Lester Gooch #5)\n"), nil
+	case "-s list ruleset":
+		var b strings.Builder
+		for _, t := range f.order {
+			b.WriteString(f.tables[t] + "\n")
+		}
+		return []byte(b.String()), nil
+	case "list chain ip " + TableName + " prerouting":
+		def, ok := f.tables["table ip "+TableName]
+		if !ok || !strings.Contains(def, "chain prerouting {") {
+			return []byte("Error: No such file or directory; did you mean table ‘zecx’ in family inet?\n"), errExit
+		}
+		return []byte(def + "\n"), nil
+	case "-f -":
+		f.loads = append(f.loads, string(stdin))
+		return f.load(string(stdin))
+	}
+	return []byte("Error: syntax error"), errExit
+}
+
+// load applies a script in one transaction.
+func (f *fakeNFT) load(script string) ([]byte, error) {
+	next := &fakeNFT{order: slices.Clone(f.order), tables: map[string]string{}}
+	for k, v := range f.tables {
+		next.tables[k] = v
+	}
+	lines := strings.Split(script, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "delete table "):
+			name := strings.TrimPrefix(line, "delete ")
+			if _, ok := next.tables[name]; !ok {
+				return []byte("Error: No such file or directory\n" + line), errExit
+			}
+			delete(next.tables, name)
+			next.order = slices.DeleteFunc(next.order, func(t string) bool { return t == name })
+		case strings.HasPrefix(line, "table ") && strings.HasSuffix(line, " {"):
+			block := []string{line}
+			for i++; i < len(lines) && lines[i] != "}"; i++ {
+				block = append(block, lines[i])
+			}
+			next.set(strings.TrimSuffix(line, " {"), strings.Join(append(block, "}"), "\n"))
+		case strings.HasPrefix(line, "table "):
+			if _, ok := next.tables[line]; !ok {
+				next.set(line, line+" {\n}")
+			}
+		default:
+			return []byte("Error: syntax error\n" + line), errExit
+		}
+	}
+	f.order, f.tables = next.order, next.tables
+	return nil, nil
+}
+
+func (f *fakeNFT) ruleset() string {
+	out, _ := f.run(nil, "nft", "-s", "list", "ruleset")
+	return string(out)
+}
+
+const hostFilter = `table inet filter {
+	chain input {
+		type filter hook input priority filter; policy drop;
+		ct state established,related accept
+		tcp dport 22 accept
+	}
+}`
+
+func TestNFTScript(t *testing.T) {
+	script := nftScript(mappings, testEgress(t))
+	for _, want := range []string{
+		"table ip zecx\ndelete table ip zecx\ntable inet zecx\ndelete table inet zecx\n",
+		"\t\ttype nat hook prerouting priority -100; policy accept;\n",
+		"\t\ttcp dport 22 redirect to :2222\n",
+		"\t\ttcp dport 445 redirect to :4445\n",
+		"\t\ttype filter hook output priority -1; policy accept;\n\t\tmeta skuid 1000 jump egress\n",
+		"\tchain egress {\n\t\tct state established,related return\n",
+		"\t\tdrop\n\t}\n}\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+
+	script = nftScript(mappings, nil)
+	if strings.Contains(script, "table inet zecx {") || !strings.Contains(script, "delete table inet zecx\n") {
+		t.Errorf("without egress:\n%s", script)
+	}
+}
+
+func TestNFTablesApplyAndRemove(t *testing.T) {
+	f := newFakeNFT(hostFilter)
+	pristine := f.ruleset()
+	b := &NFTables{Run: f.run}
+	egress := testEgress(t)
+	for range 2 {
+		if err := b.Apply(mappings, egress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.loads) != 2 || f.loads[1] != nftScript(mappings, egress) {
+		t.Errorf("loaded %q", f.loads)
+	}
+	if want := []string{"table inet filter", "table ip zecx", "table inet zecx"}; !slices.Equal(f.order, want) {
+		t.Errorf("tables = %q, want %q", f.order, want)
+	}
+	if ds, err := b.Verify(mappings); err != nil || len(ds) != 0 {
+		t.Errorf("Verify = %v, %v", ds, err)
+	}
+
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.tables["table inet zecx"]; ok {
+		t.Error("egress table left after applying without a policy")
+	}
+
+	for range 2 {
+		if err := b.Remove(mappings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.ruleset() != pristine {
+		t.Errorf("after Remove:\n%s\nwant\n%s", f.ruleset(), pristine)
+	}
+}
+
+func TestNFTablesVerify(t *testing.T) {
+	f := newFakeNFT()
+	b := &NFTables{Run: f.run}
+	ds, err := b.Verify(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1+len(mappings) || ds[0] != (Discrepancy{Kind: "missing", Rule: "chain ip zecx prerouting"}) {
+		t.Errorf("without the table: %v", ds)
+	}
+
+	f.set("table ip zecx", `table ip zecx {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		tcp dport 21 redirect to :2121
+		tcp dport 80 redirect to :8080
+		tcp dport 22 redirect to :2222
+		tcp dport 443 redirect to :8443
+		tcp dport 445 redirect to :4445
+		tcp dport 23 redirect to :2323
+		counter accept
+	}
+}`)
+	ds, err = b.Verify(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Discrepancy{
+		{Kind: "extra", Rule: "tcp 23 -> 2323"},
+		{Kind: "extra", Rule: "counter accept"},
+		{Kind: "reordered", Rule: "tcp 80 -> 8080 at position 2, expected tcp 22 -> 2222"},
+		{Kind: "reordered", Rule: "tcp 22 -> 2222 at position 3, expected tcp 80 -> 8080"},
+	}
+	if !slices.Equal(ds, want) {
+		t.Errorf("discrepancies =\n%v\nwant\n%v", ds, want)
+	}
+
+	f.tables["table ip zecx"] = "table ip zecx {\n\tchain prerouting {\n\t}\n}"
+	ds, _ = b.Verify(mappings)
+	if len(ds) == 0 || ds[0] != (Discrepancy{Kind: "missing", Rule: "type nat hook prerouting"}) {
+		t.Errorf("unhooked chain: %v", ds)
+	}
+
+	fail := func([]byte, string, ...string) ([]byte, error) {
+		return []byte("Error: Operation not permitted"), errors.New("exit status 1")
+	}
+	if _, err := (&NFTables{Run: fail}).Verify(mappings); err == nil {
+		t.Error("Verify hid a failing nft")
+	}
+}
+
+func TestNFTablesParse(t *testing.T) {
+	dump := hostFilter + "\n\ntable ip zecx {\n\tchain prerouting {\n\t}\n}\n"
+	rs := (&NFTables{}).Parse([]byte(dump))
+	if len(rs) != 2 || rs[0] != hostFilter || key(rs[1]) != "table ip zecx {" {
+		t.Errorf("units = %q", rs)
+	}
+}
@@ -0,0 +1,223 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrDrift is returned by Restore when the host's ruleset does not match
+// what Configure left behind, or did not return to what it was before.
+var ErrDrift = errors.New("firewall ruleset drifted")
+
+// A Ruleset is a parsed dump of the host's firewall, split into the units a
+// backend adds and removes one at a time: rule and chain lines prefixed
+// with their table for iptables, whole tables for nftables. A unit is
+// identified by its first line.
+type Ruleset []string
+
+// Dir returns the directory the firewall snapshot is kept in under the
+// state directory.
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, "firewall")
+}
+
+// snapshot is the host's ruleset before Configure first ran and after it
+// last ran, in the dump format of the backend that took them.
+type snapshot struct {
+	backend string
+	before  []byte
+	after   []byte
+}
+
+const (
+	backendFile = "backend"
+	beforeFile  = "before.rules"
+	afterFile   = "after.rules"
+)
+
+func loadSnapshot(dir string) (*snapshot, error) {
+	var s snapshot
+	name, err := os.ReadFile(filepath.Join(dir, backendFile))
+	if err != nil {
+		return nil, err
+	}
+	s.backend = strings.TrimSpace(string(name))
+	if s.before, err = os.ReadFile(filepath.Join(dir, beforeFile)); err != nil {
+		return nil, err
+	}
+	if s.after, err = os.ReadFile(filepath.Join(dir, afterFile)); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveBefore records the ruleset as it is before Configure first touches
+// it. An existing snapshot is kept, so a second Configure does not mistake
+// the first one's rules for the host's own.
+func saveBefore(dir string, b Backend) error {
+	if _, err := os.Stat(filepath.Join(dir, beforeFile)); err == nil {
+		prev, err := os.ReadFile(filepath.Join(dir, backendFile))
+		if err != nil {
+			return err
+		}
+		if name := strings.TrimSpace(string(prev)); name != b.Name() {
+			return fmt.Errorf("snapshot in %s was taken with %s, not %s", dir, name, b.Name())
+		}
+		return nil
+	}
+	dump, err := b.Save()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot the ruleset: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create firewall snapshot directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, backendFile), []byte(b.Name()+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, beforeFile), dump, 0600)
+}
+
+// saveAfter records the ruleset as Configure left it.
+func saveAfter(dir string, b Backend) error {
+	dump, err := b.Save()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot the ruleset: %w", err)
+	}
+	return os.WriteFile(filepath.Join(dir, afterFile), dump, 0600)
+}
+
+// revert undoes what Configure changed, as recorded in s. The honeypot's own
+// units are always removed, so that no redirect outlives it; anything else
+// is only put back when the rest of the ruleset is still exactly as
+// Configure left it. Drift is logged and reported as ErrDrift.
+func revert(b Backend, s *snapshot, dir string) error {
+	before, after := b.Parse(s.before), b.Parse(s.after)
+	dump, err := b.Save()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot the ruleset: %w", err)
+	}
+	current := b.Parse(dump)
+
+	added, removed := subtract(after, before), subtract(before, after)
+	ours := make(map[string]bool)
+	for _, u := range added {
+		ours[key(u)] = true
+	}
+	// Only copies beyond those the host had before are the honeypot's: an
+	// identical rule the administrator already had stays.
+	var present Ruleset
+	for _, u := range subtract(current, before) {
+		if ours[key(u)] {
+			present = append(present, u)
+		}
+	}
+	var drift []string
+	for _, u := range subtract(current, after) {
+		if !ours[key(u)] {
+			drift = append(drift, "added since configuration: "+u)
+		}
+	}
+	for _, u := range subtract(after, current) {
+		if !ours[key(u)] {
+			drift = append(drift, "removed since configuration: "+u)
+		}
+	}
+
+	if len(drift) > 0 {
+		report(drift)
+		if err := b.Revert(present, nil, before); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %d unrelated changes since configuration, removed only the honeypot's own rules; the original ruleset is in %s",
+			ErrDrift, len(drift), filepath.Join(dir, beforeFile))
+	}
+	if err := b.Revert(present, removed, before); err != nil {
+		return err
+	}
+
+	dump, err = b.Save()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot the ruleset: %w", err)
+	}
+	restored := b.Parse(dump)
+	for _, u := range subtract(restored, before) {
+		drift = append(drift, "not in the original ruleset: "+u)
+	}
+	for _, u := range subtract(before, restored) {
+		drift = append(drift, "missing from the original ruleset: "+u)
+	}
+	for _, chain := range reordered(restored, before) {
+		drift = append(drift, "rules in a different order than originally: "+chain)
+	}
+	if len(drift) > 0 {
+		report(drift)
+		return fmt.Errorf("%w: ruleset differs from the original in %d places after restoring", ErrDrift, len(drift))
+	}
+	return nil
+}
+
+func report(drift []string) {
+	for _, d := range drift {
+		log.Printf("Firewall drift, %s", strings.ReplaceAll(d, "\n", " "))
+	}
+}
+
+// subtract returns the units of a that are not in b, counting duplicates,
+// so a rule added twice is subtracted once per copy.
+func subtract(a, b Ruleset) Ruleset {
+	count := make(map[string]int)
+	for _, u := range b {
+		count[u]++
+	}
+	var out Ruleset
+	for _, u := range a {
+		if count[u] > 0 {
+			count[u]--
+			continue
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// reordered lists the chains whose rules a and b hold in a different
+// order. Only iptables rules have an order that matters; chains that also
+// differ in content are left to subtract.
+func reordered(a, b Ruleset) []string {
+	byChain := func(rs Ruleset) (map[string]Ruleset, []string) {
+		m := make(map[string]Ruleset)
+		var chains []string
+		for _, u := range rs {
+			chain := chainOf(u)
+			if chain == "" {
+				continue
+			}
+			if _, ok := m[chain]; !ok {
+				chains = append(chains, chain)
+			}
+			m[chain] = append(m[chain], u)
+		}
+		return m, chains
+	}
+	ma, _ := byChain(a)
+	mb, chains := byChain(b)
+	var out []string
+	for _, c := range chains {
+		ra, rb := ma[c], mb[c]
+		if !slices.Equal(ra, rb) && len(subtract(ra, rb)) == 0 && len(subtract(rb, ra)) == 0 {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func key(unit string) string {
+	first, _, _ := strings.Cut(unit, "\n")
+	return first
+}
@@ -0,0 +1,268 @@
+package firewall
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// configure does what Configure does, against b.
+func configure(t *testing.T, dir string, b Backend, egress *Egress) {
+	t.Helper()
+	if err := saveBefore(dir, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Apply(mappings, egress); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAfter(dir, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func restore(t *testing.T, dir string, b Backend) error {
+	t.Helper()
+	snap, err := loadSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.backend != b.Name() {
+		t.Fatalf("snapshot taken with %s", snap.backend)
+	}
+	return revert(b, snap, dir)
+}
+
+// hostIPTables is a host with rules of its own in both tables.
+func hostIPTables(t *testing.T) *fakeIPTables {
+	f := newFakeIPTables()
+	f.mustDo(t, "filter", "-P", "INPUT", "DROP")
+	f.mustDo(t, "filter", "-A", "INPUT", "-p tcp -m tcp --dport 22 -j ACCEPT")
+	f.mustDo(t, "filter", "-A", "OUTPUT", "-j ACCEPT")
+	f.mustDo(t, "nat", "-N", "DOCKER", "")
+	f.mustDo(t, "nat", "-A", "PREROUTING", "-m addrtype --dst-type LOCAL -j DOCKER")
+	return f
+}
+
+func TestRestoreIPTables(t *testing.T) {
+	f := hostIPTables(t)
+	f.v6.mustDo(t, "filter", "-A", "OUTPUT", "-d 2001:db8::/32 -j ACCEPT")
+	before, before6 := f.save(), f.v6.save()
+	b := &IPTables{Run: f.run}
+	dir := t.TempDir()
+	configure(t, dir, b, testEgress(t))
+	// A second run keeps the first snapshot of the host's own ruleset.
+	configure(t, dir, b, testEgress(t))
+	if saved, _ := os.ReadFile(filepath.Join(dir, beforeFile)); string(saved) != before+ip6Dump+"\n"+before6 {
+		t.Errorf("before.rules =\n%s\nwant\n%s", saved, before)
+	}
+
+	if err := restore(t, dir, b); err != nil {
+		t.Fatal(err)
+	}
+	if f.save() != before {
+		t.Errorf("after restore:\n%s\nwant\n%s", f.save(), before)
+	}
+	if f.v6.save() != before6 {
+		t.Errorf("ip6tables after restore:\n%s\nwant\n%s", f.v6.save(), before6)
+	}
+}
+
+func TestRestorePutsBackRemovedRules(t *testing.T) {
+	f := hostIPTables(t)
+	before := f.save()
+	b := &IPTables{Run: f.run}
+	dir := t.TempDir()
+	if err := saveBefore(dir, b); err != nil {
+		t.Fatal(err)
+	}
+	// Whatever Configure takes out of the host's ruleset comes back too.
+	f.mustDo(t, "filter", "-D", "OUTPUT", "-j ACCEPT")
+	f.mustDo(t, "filter", "-P", "INPUT", "ACCEPT")
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAfter(dir, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(t, dir, b); err != nil {
+		t.Fatal(err)
+	}
+	if f.save() != before {
+		t.Errorf("after restore:\n%s\nwant\n%s", f.save(), before)
+	}
+}
+
+func TestRestorePutsRemovedRulesInPlace(t *testing.T) {
+	f := hostIPTables(t)
+	f.mustDo(t, "filter", "-A", "INPUT", "-p tcp -m tcp --dport 80 -j ACCEPT")
+	f.mustDo(t, "filter", "-A", "INPUT", "-p tcp -m tcp --dport 22 -j ACCEPT")
+	f.mustDo(t, "filter", "-A", "INPUT", "-s 192.0.2.9/32 -j DROP")
+	before := f.save()
+	b := &IPTables{Run: f.run}
+	dir := t.TempDir()
+	if err := saveBefore(dir, b); err != nil {
+		t.Fatal(err)
+	}
+	// The first rule, and the later of two identical ones, are taken out;
+	// appended again, they would end up after the DROP.
+	f.mustDo(t, "filter", "-D", "INPUT", "-p tcp -m tcp --dport 22 -j ACCEPT")
+	f.tables["filter"].rules["INPUT"] = slices.Delete(f.tables["filter"].rules["INPUT"], 1, 2)
+	if err := b.Apply(mappings, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAfter(dir, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(t, dir, b); err != nil {
+		t.Fatal(err)
+	}
+	if f.save() != before {
+		t.Errorf("after restore:\n%s\nwant\n%s", f.save(), before)
+	}
+}
+
+func TestReordered(t *testing.T) {
+	before := Ruleset{
+		"filter :ZECX -",
+		"filter -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+		"filter -A INPUT -j DROP",
+		"filter -A OUTPUT -j ACCEPT",
+		"ip6 filter -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+		"ip6 filter -A INPUT -j DROP",
+	}
+	after := Ruleset{
+		"filter -A OUTPUT -j ACCEPT",
+		"filter -A INPUT -j DROP",
+		"filter -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+		"ip6 filter -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+		"ip6 filter -A INPUT -j DROP",
+		"filter :ZECX -",
+	}
+	if got := reordered(after, before); !slices.Equal(got, []string{"filter INPUT"}) {
+		t.Errorf("reordered = %q", got)
+	}
+	// A chain that lost a rule is a difference in content, not order.
+	if got := reordered(after[1:], before); !slices.Equal(got, []string{"filter INPUT"}) {
+		t.Errorf("reordered without OUTPUT = %q", got)
+	}
+	if got := reordered(after[2:], before); len(got) != 0 {
+		t.Errorf("reordered with a rule missing = %q", got)
+	}
+}
+
+func TestRestoreIPTablesDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*fakeIPTables)
+		want   func(*fakeIPTables) // adjusts a pristine host to the expected result
+	}{
+		{
+			name: "added",
+			change: func(f *fakeIPTables) {
+				f.tables["filter"].do("-A", "INPUT", "-s 192.0.2.9/32 -j DROP")
+			},
+			want: func(f *fakeIPTables) {
+				f.tables["filter"].do("-A", "INPUT", "-s 192.0.2.9/32 -j DROP")
+			},
+		},
+		{
+			name: "removed",
+			change: func(f *fakeIPTables) {
+				f.tables["filter"].do("-D", "INPUT", "-p tcp -m tcp --dport 22 -j ACCEPT")
+			},
+			want: func(f *fakeIPTables) {
+				f.tables["filter"].do("-D", "INPUT", "-p tcp -m tcp --dport 22 -j ACCEPT")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := hostIPTables(t)
+			expected := hostIPTables(t)
+			tt.want(expected)
+			b := &IPTables{Run: f.run}
+			dir := t.TempDir()
+			configure(t, dir, b, testEgress(t))
+			tt.change(f)
+
+			err := restore(t, dir, b)
+			if !errors.Is(err, ErrDrift) {
+				t.Fatalf("err = %v, want ErrDrift", err)
+			}
+			// The honeypot's rules are gone and the administrator's change stays.
+			if f.save() != expected.save() {
+				t.Errorf("after restore:\n%s\nwant\n%s", f.save(), expected.save())
+			}
+			if _, err := os.Stat(filepath.Join(dir, beforeFile)); err != nil {
+				t.Errorf("original ruleset not kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreKeepsIdenticalHostRules(t *testing.T) {
+	f := newFakeIPTables()
+	// The host already jumps to a chain of the same name.
+	f.mustDo(t, "nat", "-N", Chain, "")
+	f.mustDo(t, "nat", "-A", "PREROUTING", "-j "+Chain)
+	before := f.save()
+	b := &IPTables{Run: f.run}
+	dir := t.TempDir()
+	configure(t, dir, b, nil)
+	if err := restore(t, dir, b); err != nil {
+		t.Fatal(err)
+	}
+	if f.save() != before {
+		t.Errorf("after restore:\n%s\nwant\n%s", f.save(), before)
+	}
+}
+
+func TestRestoreNFTables(t *testing.T) {
+	f := newFakeNFT(hostFilter)
+	before := f.ruleset()
+	b := &NFTables{Run: f.run}
+	dir := t.TempDir()
+	configure(t, dir, b, testEgress(t))
+	if err := restore(t, dir, b); err != nil {
+		t.Fatal(err)
+	}
+	if f.ruleset() != before {
+		t.Errorf("after restore:\n%s\nwant\n%s", f.ruleset(), before)
+	}
+}
+
+func TestRestoreNFTablesDrift(t *testing.T) {
+	f := newFakeNFT(hostFilter)
+	b := &NFTables{Run: f.run}
+	dir := t.TempDir()
+	configure(t, dir, b, testEgress(t))
+	f.set("table ip nat", "table ip nat {\n}")
+
+	if err := restore(t, dir, b); !errors.Is(err, ErrDrift) {
+		t.Fatalf("err = %v, want ErrDrift", err)
+	}
+	if want := []string{"table inet filter", "table ip nat"}; !slices.Equal(f.order, want) {
+		t.Errorf("tables = %q, want %q", f.order, want)
+	}
+}
+
+func TestSaveBeforeRejectsOtherBackend(t *testing.T) {
+	dir := t.TempDir()
+	if err := saveBefore(dir, &IPTables{Run: newFakeIPTables().run}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBefore(dir, &NFTables{Run: newFakeNFT().run}); err == nil {
+		t.Error("snapshot taken with iptables reused for nftables")
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	got := subtract(Ruleset{"a", "b", "a", "c", "a"}, Ruleset{"a", "c", "d"})
+	if want := (Ruleset{"b", "a", "a"}); !slices.Equal(got, want) {
+		t.Errorf("subtract = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Discrepancy is one way the installed redirects differ from the desired
+// mapping.
+type Discrepancy struct {
+	// Kind is "missing", "extra" or "reordered".
+	Kind string
+	Rule string
+}
+
+func (d Discrepancy) String() string {
+	return d.Kind + ": " + d.Rule
+}
+
+// Report is the outcome of Verify.
+type Report struct {
+	Backend       string
+	Discrepancies []Discrepancy
+}
+
+// Verify compares the redirects installed on the host with the desired
+// mapping, using the backend recorded in the snapshot under stateDir or,
+// without one, the backend Detect picks.
+func Verify(stateDir string) (*Report, error) {
+	var b Backend
+	snap, err := loadSnapshot(Dir(stateDir))
+	switch {
+	case err == nil:
+		b, err = backendNamed(snap.backend, Exec)
+	case errors.Is(err, os.ErrNotExist):
+		b, err = Detect(Exec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ds, err := b.Verify(mappings)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return &Report{Backend: b.Name(), Discrepancies: ds}, nil
+}
+
+// compare lists how installed, the rules in the honeypot's chain in order,
+// differs from mappings. Rules are compared by their PortMapping.String
+// form; anything that is not a redirect is kept as listed and is extra.
+func compare(mappings []PortMapping, installed []string) []Discrepancy {
+	var desired []string
+	for _, m := range mappings {
+		desired = append(desired, m.String())
+	}
+	missing, extra := subtract(desired, installed), subtract(installed, desired)
+	var ds []Discrepancy
+	for _, r := range missing {
+		ds = append(ds, Discrepancy{Kind: "missing", Rule: r})
+	}
+	for _, r := range extra {
+		ds = append(ds, Discrepancy{Kind: "extra", Rule: r})
+	}
+	want, got := subtract(desired, missing), subtract(installed, extra)
+	for i := range want {
+		if want[i] != got[i] {
+			ds = append(ds, Discrepancy{Kind: "reordered", Rule: fmt.Sprintf("%s at position %d, expected %s", got[i], i+1, want[i])})
+		}
+	}
+	return ds
+}
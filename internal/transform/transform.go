@@ -3,17 +3,18 @@ package transform
 import (
 	"fmt"
 	"log"
+	"zecx-deploy/internal/config"
 	"zecx-deploy/internal/transform/decoys"
 	"zecx-deploy/internal/transform/emulators"
 	"zecx-deploy/internal/transform/firewall"
 )
 
 // Apply runs the full system transformation.
-func Apply() error {
+func Apply(cfg *config.Config) error {
 	log.Println("Starting system transformation...")
 
 	// 1. Configure firewall
-	if err := firewall.Configure(); err != nil {
+	if err := firewall.Configure(cfg); err != nil {
 		return fmt.Errorf("failed to configure firewall: %w", err)
 	}
 
@@ -24,7 +25,7 @@ func Apply() error {
 
 	// 3. Launch service emulators
 	// This will start the emulators in the background.
-	if err := emulators.Start(); err != nil {
+	if err := emulators.Start(cfg); err != nil {
 		return fmt.Errorf("failed to start service emulators: %w", err)
 	}
 
@@ -1,16 +1,27 @@
 package uninstall
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"zecx-deploy/internal/config"
+	"zecx-deploy/internal/hostkeys"
+	"zecx-deploy/internal/quarantine"
+	"zecx-deploy/internal/recording"
+	"zecx-deploy/internal/spool"
+	"zecx-deploy/internal/tlscert"
 	"zecx-deploy/internal/transform/decoys"
 	"zecx-deploy/internal/transform/emulators"
 	"zecx-deploy/internal/transform/firewall"
 )
 
 // CleanUp removes all traces of the honeypot from the system.
-// It orchestrates the cleanup of all modules.
-func CleanUp() error {
+// It orchestrates the cleanup of all modules. The evidence it collected
+// (quarantined samples, session recordings, and the host keys and
+// certificates attackers have seen) is kept unless purge is set.
+func CleanUp(purge bool) error {
 	log.Println("Starting uninstallation process...")
 
 	// The order of operations is important:
@@ -28,17 +39,69 @@ func CleanUp() error {
 		log.Println("Successfully cleaned decoy environment.")
 	}
 
-	// 3. Restore the firewall to its original state.
-	if err := firewall.Restore(); err != nil {
-		log.Printf("Error restoring firewall: %v. Manual check may be required.", err)
+	// 3. Restore the firewall to its original state from the snapshot kept
+	//    in the state directory.
+	cfg, cfgErr := config.Load()
+	stateDir := config.DefaultStateDir
+	if cfgErr == nil {
+		stateDir = cfg.StateDir
+	}
+	fwErr := firewall.Restore(stateDir)
+	if fwErr != nil {
+		log.Printf("Error restoring firewall: %v. Manual check may be required.", fwErr)
 	} else {
 		log.Println("Successfully restored firewall.")
 	}
 
-	// 4. In a real scenario, we would also remove any other artifacts,
+	// 4. Remove persisted state such as the undelivered event spool.
+	if cfgErr != nil {
+		log.Printf("Error loading configuration: %v. State directory left in place.", cfgErr)
+	} else {
+		removeState(cfg.StateDir, purge, fwErr == nil)
+	}
+
+	// 5. In a real scenario, we would also remove any other artifacts,
 	//    such as hidden persistence mechanisms (e.g., systemd services).
 	log.Println("Uninstallation placeholder: Simulating removal of systemd services.")
 
 	fmt.Println("Uninstallation process complete. The system should be clean.")
 	return nil
 }
+
+// removeState deletes the subdirectories of stateDir that the honeypot
+// created, and never the directory as a whole, which may be shared or
+// hold files of the administrator's. The firewall snapshot is only
+// removed once the firewall has been restored from it, and the evidence
+// only with purge; stateDir itself goes once nothing is left in it.
+func removeState(stateDir string, purge, firewallRestored bool) {
+	if dir := filepath.Clean(stateDir); dir == "/" || dir == "." {
+		log.Printf("Refusing to remove state from suspicious directory %q.", stateDir)
+		return
+	}
+	dirs := []string{spool.Dir(stateDir)}
+	if firewallRestored {
+		dirs = append(dirs, firewall.Dir(stateDir))
+	} else {
+		log.Printf("Firewall snapshot left in place in %s.", firewall.Dir(stateDir))
+	}
+	evidence := []string{quarantine.Dir(stateDir), recording.Dir(stateDir), hostkeys.Dir(stateDir), tlscert.Dir(stateDir)}
+	if purge {
+		dirs = append(dirs, evidence...)
+	} else {
+		for _, dir := range evidence {
+			if _, err := os.Stat(dir); err == nil {
+				log.Printf("Kept %s; uninstall with --purge to delete it.", dir)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Error removing %s: %v", dir, err)
+		}
+	}
+	if err := os.Remove(stateDir); err == nil {
+		log.Printf("Removed state directory: %s", stateDir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("State directory left in place: %v", err)
+	}
+}
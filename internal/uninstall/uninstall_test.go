@@ -0,0 +1,70 @@
+package uninstall
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// stateDir creates a state directory holding every subdirectory the
+// honeypot writes, plus a file of the administrator's.
+func stateDir(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "zecx")
+	for _, sub := range []string{"spool", "firewall", "quarantine", "recordings", "hostkeys", "tls/issued"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, sub, "data"), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func remaining(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestRemoveStateKeepsEvidence(t *testing.T) {
+	dir := stateDir(t)
+	removeState(dir, false, true)
+	if got, want := remaining(t, dir), []string{"hostkeys", "quarantine", "recordings", "tls"}; !slices.Equal(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+}
+
+func TestRemoveStateKeepsUnrestoredSnapshot(t *testing.T) {
+	dir := stateDir(t)
+	removeState(dir, true, false)
+	if got, want := remaining(t, dir), []string{"firewall"}; !slices.Equal(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+}
+
+func TestRemoveStatePurge(t *testing.T) {
+	dir := stateDir(t)
+	removeState(dir, true, true)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("state directory not removed: %q", remaining(t, dir))
+	}
+
+	// Files that are not the honeypot's keep the directory.
+	dir = stateDir(t)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600)
+	removeState(dir, true, true)
+	if got, want := remaining(t, dir), []string{"notes.txt"}; !slices.Equal(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+}